@@ -8,34 +8,60 @@ package main
 
 import (
 	"archive/tar"
+	"bufio"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"path"
 	"path/filepath"
 	"runtime"
+	"strconv"
 	"strings"
+	"syscall"
 
 	"github.com/klauspost/compress/zstd"
 	"github.com/klauspost/pgzip"
 	"github.com/offen/docker-volume-backup/internal/errwrap"
 )
 
-func createArchive(files []string, inputFilePath, outputFilePath string, compression string, compressionConcurrency int) error {
+// createArchive writes the given files to a tar archive at outputFilePath.
+// Symlinks contained in linkTargets are archived using the given target
+// instead of their actual one. Raw images of the given block devices are
+// added to the archive after all files. In case bufferSize is positive,
+// reads and writes are buffered using buffers of the given size. The archive
+// is additionally written to any of the given outputs using their respective
+// compression.
+func createArchive(files []string, inputFilePath, outputFilePath string, compression string, compressionConcurrency int, compressionLevel CompressionLevel, linkTargets map[string]string, devices []string, bufferSize int, additional []archiveOutput) (archiveStats, error) {
+	return createArchiveOutput(files, inputFilePath, archiveOutput{path: outputFilePath, compression: compression}, compressionConcurrency, compressionLevel, linkTargets, devices, bufferSize, additional)
+}
+
+// createArchiveOutput works like createArchive, but writes the archive to
+// the given output, which may be a writer instead of a file.
+func createArchiveOutput(files []string, inputFilePath string, output archiveOutput, compressionConcurrency int, compressionLevel CompressionLevel, linkTargets map[string]string, devices []string, bufferSize int, additional []archiveOutput) (archiveStats, error) {
 	inputFilePath = stripTrailingSlashes(inputFilePath)
-	inputFilePath, outputFilePath, err := makeAbsolute(inputFilePath, outputFilePath)
+	inputFilePath, outputFilePath, err := makeAbsolute(inputFilePath, output.path)
 	if err != nil {
-		return errwrap.Wrap(err, "error transposing given file paths")
+		return archiveStats{}, errwrap.Wrap(err, "error transposing given file paths")
 	}
 	if err := os.MkdirAll(filepath.Dir(outputFilePath), 0755); err != nil {
-		return errwrap.Wrap(err, "error creating output file path")
+		return archiveStats{}, errwrap.Wrap(err, "error creating output file path")
 	}
+	output.path = outputFilePath
 
-	if err := compress(files, outputFilePath, filepath.Dir(inputFilePath), compression, compressionConcurrency); err != nil {
-		return errwrap.Wrap(err, "error creating archive")
+	stats, err := compress(files, output, filepath.Dir(inputFilePath), compressionConcurrency, compressionLevel, linkTargets, devices, bufferSize, additional)
+	if err != nil {
+		return archiveStats{}, errwrap.Wrap(err, "error creating archive")
 	}
 
-	return nil
+	return stats, nil
+}
+
+// archiveStats describes the contents of an archive, i.e. the number of
+// regular files and their total size.
+type archiveStats struct {
+	files uint
+	size  uint64
 }
 
 func stripTrailingSlashes(path string) string {
@@ -55,47 +81,164 @@ func makeAbsolute(inputFilePath, outputFilePath string) (string, string, error)
 	return inputFilePath, outputFilePath, err
 }
 
-func compress(paths []string, outFilePath, subPath string, algo string, concurrency int) error {
-	file, err := os.Create(outFilePath)
-	if err != nil {
-		return errwrap.Wrap(err, "error creating out file")
+// archiveOutput is a file an archive is written to, using the given
+// compression. In case writer is given, the archive is written to it instead
+// of the file, while path is still used for deriving the archive's layout.
+type archiveOutput struct {
+	path        string
+	compression string
+	writer      io.Writer
+}
+
+func compress(paths []string, output archiveOutput, subPath string, concurrency int, level CompressionLevel, linkTargets map[string]string, devices []string, bufferSize int, additional []archiveOutput) (archiveStats, error) {
+	// The tar stream is created once and fanned out to all outputs, so the
+	// sources are read only once, no matter the number of outputs.
+	var outputs []*compressedFile
+	defer func() {
+		// In case archiving fails, all outputs created so far are closed, so
+		// neither files nor workers of the compressors are leaked.
+		for _, out := range outputs {
+			out.Close()
+		}
+	}()
+	var writers []io.Writer
+	for _, o := range append([]archiveOutput{output}, additional...) {
+		out, err := newCompressedFile(o, concurrency, level, bufferSize)
+		if err != nil {
+			return archiveStats{}, errwrap.Wrap(err, fmt.Sprintf("error creating %s", o.path))
+		}
+		outputs = append(outputs, out)
+		writers = append(writers, out.writer)
 	}
 
-	prefix := path.Dir(outFilePath)
-	compressWriter, err := getCompressionWriter(file, algo, concurrency)
-	if err != nil {
-		return errwrap.Wrap(err, "error getting compression writer")
+	prefix := path.Dir(output.path)
+
+	var compressWriter io.Writer = writers[0]
+	if len(writers) > 1 {
+		compressWriter = io.MultiWriter(writers...)
+	}
+
+	var tarOut io.Writer = compressWriter
+	tarBuffer := bufio.NewWriterSize(compressWriter, max(bufferSize, 1))
+	var readBuffer []byte
+	if bufferSize > 0 {
+		tarOut = tarBuffer
+		readBuffer = make([]byte, bufferSize)
 	}
-	tarWriter := tar.NewWriter(compressWriter)
+	tarWriter := tar.NewWriter(tarOut)
 
+	var stats archiveStats
+	hardlinks := map[fileID]string{}
 	for _, p := range paths {
-		if err := writeTarball(p, tarWriter, prefix); err != nil {
-			return errwrap.Wrap(err, fmt.Sprintf("error writing %s to archive", p))
+		header, err := writeTarball(p, tarWriter, prefix, linkTargets[p], readBuffer, hardlinks)
+		if err != nil {
+			return archiveStats{}, errwrap.Wrap(err, fmt.Sprintf("error writing %s to archive", p))
+		}
+		if header != nil && header.Typeflag == tar.TypeReg {
+			stats.files++
+			stats.size += uint64(header.Size)
 		}
 	}
 
-	err = tarWriter.Close()
-	if err != nil {
-		return errwrap.Wrap(err, "error closing tar writer")
+	for _, device := range devices {
+		if err := writeBlockDevice(device, tarWriter); err != nil {
+			return archiveStats{}, errwrap.Wrap(err, fmt.Sprintf("error writing block device %s to archive", device))
+		}
 	}
 
-	err = compressWriter.Close()
+	err := tarWriter.Close()
 	if err != nil {
-		return errwrap.Wrap(err, "error closing compression writer")
+		return archiveStats{}, errwrap.Wrap(err, "error closing tar writer")
 	}
 
-	err = file.Close()
+	if err := tarBuffer.Flush(); err != nil {
+		return archiveStats{}, errwrap.Wrap(err, "error flushing tar buffer")
+	}
+
+	pending := outputs
+	outputs = nil
+	var closeErrors []error
+	for _, out := range pending {
+		if err := out.Close(); err != nil {
+			closeErrors = append(closeErrors, err)
+		}
+	}
+	if len(closeErrors) != 0 {
+		return archiveStats{}, errors.Join(closeErrors...)
+	}
+
+	return stats, nil
+}
+
+// compressedFile is a file that is written to using the given compression.
+// In case the output is a writer, file is nil.
+type compressedFile struct {
+	file   *os.File
+	buffer *bufio.Writer
+	writer io.WriteCloser
+}
+
+func newCompressedFile(o archiveOutput, concurrency int, level CompressionLevel, bufferSize int) (*compressedFile, error) {
+	c := &compressedFile{}
+	out := o.writer
+	if out == nil {
+		file, err := os.Create(o.path)
+		if err != nil {
+			return nil, errwrap.Wrap(err, "error creating out file")
+		}
+		c.file = file
+		out = file
+	}
+
+	// When archiving many small files, the tar writer issues lots of small
+	// writes for headers and padding, which are batched by buffering both
+	// the input to the compressor and its output.
+	if bufferSize > 0 {
+		c.buffer = bufio.NewWriterSize(out, bufferSize)
+		out = c.buffer
+	}
+
+	var err error
+	c.writer, err = getCompressionWriter(out, o.compression, concurrency, level)
 	if err != nil {
-		return errwrap.Wrap(err, "error closing file")
+		if c.file != nil {
+			c.file.Close()
+		}
+		return nil, errwrap.Wrap(err, "error getting compression writer")
 	}
+	return c, nil
+}
 
-	return nil
+// Close closes the compression writer and flushes all buffered data to
+// the underlying file before closing it. The file is closed even if closing
+// the compression writer or flushing fails.
+func (c *compressedFile) Close() error {
+	var err error
+	if closeErr := c.writer.Close(); closeErr != nil {
+		err = errwrap.Wrap(closeErr, "error closing compression writer")
+	} else if c.buffer != nil {
+		if flushErr := c.buffer.Flush(); flushErr != nil {
+			err = errwrap.Wrap(flushErr, "error flushing file buffer")
+		}
+	}
+
+	if c.file == nil {
+		return err
+	}
+	if closeErr := c.file.Close(); closeErr != nil && err == nil {
+		err = errwrap.Wrap(closeErr, "error closing file")
+	}
+	return err
 }
 
-func getCompressionWriter(file *os.File, algo string, concurrency int) (io.WriteCloser, error) {
+func getCompressionWriter(file io.Writer, algo string, concurrency int, level CompressionLevel) (io.WriteCloser, error) {
 	switch algo {
 	case "gz":
-		w, err := pgzip.NewWriterLevel(file, 5)
+		gzipLevel, err := gzipCompressionLevel(level)
+		if err != nil {
+			return nil, err
+		}
+		w, err := pgzip.NewWriterLevel(file, gzipLevel)
 		if err != nil {
 			return nil, errwrap.Wrap(err, "gzip error")
 		}
@@ -110,59 +253,174 @@ func getCompressionWriter(file *os.File, algo string, concurrency int) (io.Write
 
 		return w, nil
 	case "zst":
-		compressWriter, err := zstd.NewWriter(file)
+		zstdLevel, err := zstdCompressionLevel(level)
+		if err != nil {
+			return nil, err
+		}
+		opts := []zstd.EOption{zstd.WithEncoderLevel(zstdLevel)}
+		if concurrency > 0 {
+			opts = append(opts, zstd.WithEncoderConcurrency(concurrency))
+		}
+		compressWriter, err := zstd.NewWriter(file, opts...)
 		if err != nil {
 			return nil, errwrap.Wrap(err, "zstd error")
 		}
 		return compressWriter, nil
+	case "xz":
+		compressWriter, err := newXZWriter(file, concurrency, level)
+		if err != nil {
+			return nil, errwrap.Wrap(err, "xz error")
+		}
+		return compressWriter, nil
+	case "none":
+		return &noopWriteCloser{file}, nil
 	default:
 		return nil, errwrap.Wrap(nil, fmt.Sprintf("unsupported compression algorithm: %s", algo))
 	}
 }
 
-func writeTarball(path string, tarWriter *tar.Writer, prefix string) error {
+// checkCompressionLevel returns an error in case the given level is not
+// supported by the given compression algorithm.
+func checkCompressionLevel(algo string, level CompressionLevel) error {
+	var err error
+	switch algo {
+	case "gz":
+		_, err = gzipCompressionLevel(level)
+	case "zst":
+		_, err = zstdCompressionLevel(level)
+	case "xz":
+		_, err = xzCompressionPreset(level)
+	}
+	return err
+}
+
+// gzipCompressionLevel maps the given level to a gzip compression level.
+// Numeric levels need to be between 1 and 9.
+func gzipCompressionLevel(level CompressionLevel) (int, error) {
+	switch level {
+	case "", "default":
+		return 5, nil
+	case "fastest":
+		return pgzip.BestSpeed, nil
+	case "better":
+		return 7, nil
+	case "best":
+		return pgzip.BestCompression, nil
+	}
+	l, err := strconv.Atoi(level.String())
+	if err != nil || l < pgzip.BestSpeed || l > pgzip.BestCompression {
+		return 0, errwrap.Wrap(nil, fmt.Sprintf("invalid gzip compression level %s, expected a number between 1 and 9", level))
+	}
+	return l, nil
+}
+
+// zstdCompressionLevel maps the given level to a zstd encoder level. Numeric
+// levels between 1 and 22 are mapped to the closest encoder level.
+func zstdCompressionLevel(level CompressionLevel) (zstd.EncoderLevel, error) {
+	switch level {
+	case "", "default":
+		return zstd.SpeedDefault, nil
+	case "fastest":
+		return zstd.SpeedFastest, nil
+	case "better":
+		return zstd.SpeedBetterCompression, nil
+	case "best":
+		return zstd.SpeedBestCompression, nil
+	}
+	l, err := strconv.Atoi(level.String())
+	if err != nil || l < 1 || l > 22 {
+		return 0, errwrap.Wrap(nil, fmt.Sprintf("invalid zstd compression level %s, expected a number between 1 and 22", level))
+	}
+	return zstd.EncoderLevelFromZstd(l), nil
+}
+
+// writeTarball writes the file at the given path to the given tar writer,
+// returning the header that has been written, if any. Regular files with
+// multiple links that have already been written to the archive as recorded in
+// hardlinks are stored as hard links to their first occurrence.
+func writeTarball(path string, tarWriter *tar.Writer, prefix string, linkTarget string, buf []byte, hardlinks map[fileID]string) (*tar.Header, error) {
 	fileInfo, err := os.Lstat(path)
 	if err != nil {
-		return errwrap.Wrap(err, fmt.Sprintf("error getting file info for %s", path))
+		return nil, errwrap.Wrap(err, fmt.Sprintf("error getting file info for %s", path))
 	}
 
 	if fileInfo.Mode()&os.ModeSocket == os.ModeSocket {
-		return nil
+		return nil, nil
 	}
 
-	var link string
-	if fileInfo.Mode()&os.ModeSymlink == os.ModeSymlink {
+	link := linkTarget
+	if fileInfo.Mode()&os.ModeSymlink == os.ModeSymlink && link == "" {
 		var err error
 		if link, err = os.Readlink(path); err != nil {
-			return errwrap.Wrap(err, fmt.Sprintf("error resolving symlink %s", path))
+			return nil, errwrap.Wrap(err, fmt.Sprintf("error resolving symlink %s", path))
 		}
 	}
 
 	header, err := tar.FileInfoHeader(fileInfo, link)
 	if err != nil {
-		return errwrap.Wrap(err, "error getting file info header")
+		return nil, errwrap.Wrap(err, "error getting file info header")
 	}
 	header.Name = strings.TrimPrefix(path, prefix)
 
+	if id, ok := hardlinkID(fileInfo); ok && hardlinks != nil {
+		if first, seen := hardlinks[id]; seen {
+			header.Typeflag = tar.TypeLink
+			header.Linkname = first
+			header.Size = 0
+			if err := tarWriter.WriteHeader(header); err != nil {
+				return nil, errwrap.Wrap(err, "error writing hard link header")
+			}
+			return header, nil
+		}
+		hardlinks[id] = header.Name
+	}
+
 	err = tarWriter.WriteHeader(header)
 	if err != nil {
-		return errwrap.Wrap(err, "error writing file info header")
+		return nil, errwrap.Wrap(err, "error writing file info header")
 	}
 
 	if !fileInfo.Mode().IsRegular() {
-		return nil
+		return header, nil
 	}
 
 	file, err := os.Open(path)
 	if err != nil {
-		return errwrap.Wrap(err, fmt.Sprintf("error opening %s", path))
+		return nil, errwrap.Wrap(err, fmt.Sprintf("error opening %s", path))
 	}
 	defer file.Close()
 
-	_, err = io.Copy(tarWriter, file)
+	// *os.File implements io.WriterTo, which would make io.CopyBuffer ignore
+	// the given buffer, so the file is wrapped to only expose Read.
+	_, err = io.CopyBuffer(tarWriter, struct{ io.Reader }{file}, buf)
 	if err != nil {
-		return errwrap.Wrap(err, fmt.Sprintf("error copying %s to tar writer", path))
+		return nil, errwrap.Wrap(err, fmt.Sprintf("error copying %s to tar writer", path))
 	}
 
-	return nil
+	return header, nil
+}
+
+// fileID identifies a file by its device and inode number.
+type fileID struct {
+	dev uint64
+	ino uint64
+}
+
+// hardlinkID returns the identity of the given file in case it is a regular
+// file that has more than one link.
+func hardlinkID(fi os.FileInfo) (fileID, bool) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok || !fi.Mode().IsRegular() || st.Nlink < 2 {
+		return fileID{}, false
+	}
+	return fileID{dev: uint64(st.Dev), ino: uint64(st.Ino)}, true
+}
+
+// deviceID returns the id of the device the given file resides on.
+func deviceID(fi os.FileInfo) (uint64, bool) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, false
+	}
+	return uint64(st.Dev), true
 }
@@ -0,0 +1,337 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCreateArchiveEmptyDirectories(t *testing.T) {
+	root := t.TempDir()
+	source := filepath.Join(root, "backup")
+	for _, dir := range []string{"data", "spool", "nested/empty"} {
+		if err := os.MkdirAll(filepath.Join(source, dir), 0755); err != nil {
+			t.Fatalf("Unexpected error creating directory: %v", err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(source, "data", "file.txt"), []byte("content"), 0644); err != nil {
+		t.Fatalf("Unexpected error writing file: %v", err)
+	}
+
+	var files []string
+	if err := filepath.WalkDir(source, func(path string, di fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		files = append(files, path)
+		return nil
+	}); err != nil {
+		t.Fatalf("Unexpected error walking source: %v", err)
+	}
+
+	archive := filepath.Join(root, "archive", "backup.tar.gz")
+	contents, err := createArchive(files, source, archive, "gz", 1, "", nil, nil, 0, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error creating archive: %v", err)
+	}
+	if contents.files != 1 || contents.size != uint64(len("content")) {
+		t.Errorf("Expected archive to contain 1 file of 7 bytes, got %d files of %d bytes", contents.files, contents.size)
+	}
+
+	restored := t.TempDir()
+	extractArchive(t, archive, restored)
+
+	for _, dir := range []string{"spool", "nested/empty"} {
+		fi, err := os.Stat(filepath.Join(restored, source, dir))
+		if err != nil {
+			t.Errorf("Expected directory %s to be restored, got error %v", dir, err)
+			continue
+		}
+		if !fi.IsDir() {
+			t.Errorf("Expected %s to be a directory", dir)
+		}
+	}
+	content, err := os.ReadFile(filepath.Join(restored, source, "data", "file.txt"))
+	if err != nil {
+		t.Fatalf("Expected file to be restored, got error %v", err)
+	}
+	if string(content) != "content" {
+		t.Errorf("Unexpected file content %s", content)
+	}
+}
+
+func TestCreateArchiveAdditionalOutputs(t *testing.T) {
+	root := t.TempDir()
+	source := filepath.Join(root, "backup")
+	if err := os.MkdirAll(source, 0755); err != nil {
+		t.Fatalf("Unexpected error creating directory: %v", err)
+	}
+	file := filepath.Join(source, "file.txt")
+	if err := os.WriteFile(file, []byte("content"), 0644); err != nil {
+		t.Fatalf("Unexpected error writing file: %v", err)
+	}
+
+	compressed := filepath.Join(root, "archive", "backup.tar.gz")
+	raw := filepath.Join(root, "archive", "backup.tar")
+	if _, err := createArchive([]string{source, file}, source, compressed, "gz", 1, "", nil, nil, 0, []archiveOutput{{path: raw, compression: "none"}}); err != nil {
+		t.Fatalf("Unexpected error creating archive: %v", err)
+	}
+
+	for archive, compression := range map[string]string{compressed: "gz", raw: "none"} {
+		f, err := os.Open(archive)
+		if err != nil {
+			t.Fatalf("Unexpected error opening archive: %v", err)
+		}
+		restored := t.TempDir()
+		if err := restoreArchive(f, compression, restored); err != nil {
+			t.Fatalf("Unexpected error restoring %s: %v", archive, err)
+		}
+		f.Close()
+		content, err := os.ReadFile(filepath.Join(restored, file))
+		if err != nil {
+			t.Fatalf("Expected file to be restored from %s, got error %v", archive, err)
+		}
+		if string(content) != "content" {
+			t.Errorf("Unexpected file content %s", content)
+		}
+	}
+}
+
+func TestCreateArchiveClosesOutputsOnError(t *testing.T) {
+	if _, err := os.Stat("/proc/self/fd"); err != nil {
+		t.Skip("Counting open files is not supported")
+	}
+	openFiles := func() int {
+		entries, err := os.ReadDir("/proc/self/fd")
+		if err != nil {
+			t.Fatalf("Unexpected error reading open files: %v", err)
+		}
+		return len(entries)
+	}
+
+	root := t.TempDir()
+	source := filepath.Join(root, "backup")
+	if err := os.MkdirAll(source, 0755); err != nil {
+		t.Fatalf("Unexpected error creating directory: %v", err)
+	}
+
+	tests := []struct {
+		name       string
+		files      []string
+		additional []archiveOutput
+	}{
+		{
+			"creating later output fails",
+			[]string{source},
+			[]archiveOutput{
+				{path: filepath.Join(root, "archive", "backup.tar"), compression: "none"},
+				{path: filepath.Join(root, "archive", "backup.tar.bogus"), compression: "bogus"},
+			},
+		},
+		{
+			"writing tarball fails",
+			[]string{source, filepath.Join(source, "missing.txt")},
+			[]archiveOutput{{path: filepath.Join(root, "archive", "backup.tar"), compression: "none"}},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			before := openFiles()
+			_, err := createArchive(test.files, source, filepath.Join(root, "archive", "backup.tar.gz"), "gz", 1, "", nil, nil, 0, test.additional)
+			if err == nil {
+				t.Fatal("Expected an error")
+			}
+			if after := openFiles(); after != before {
+				t.Errorf("Expected %d open files, got %d", before, after)
+			}
+		})
+	}
+}
+
+func TestCreateArchiveHardlinks(t *testing.T) {
+	root := t.TempDir()
+	source := filepath.Join(root, "backup")
+	if err := os.MkdirAll(source, 0755); err != nil {
+		t.Fatalf("Unexpected error creating directory: %v", err)
+	}
+	original := filepath.Join(source, "original.txt")
+	if err := os.WriteFile(original, []byte("content"), 0644); err != nil {
+		t.Fatalf("Unexpected error writing file: %v", err)
+	}
+	link := filepath.Join(source, "link.txt")
+	if err := os.Link(original, link); err != nil {
+		t.Fatalf("Unexpected error creating hard link: %v", err)
+	}
+
+	archive := filepath.Join(root, "archive", "backup.tar")
+	if _, err := createArchive([]string{source, original, link}, source, archive, "none", 1, "", nil, nil, 0, nil); err != nil {
+		t.Fatalf("Unexpected error creating archive: %v", err)
+	}
+
+	f, err := os.Open(archive)
+	if err != nil {
+		t.Fatalf("Unexpected error opening archive: %v", err)
+	}
+	defer f.Close()
+	restored := t.TempDir()
+	if err := restoreArchive(f, "none", restored); err != nil {
+		t.Fatalf("Unexpected error restoring archive: %v", err)
+	}
+
+	a, err := os.Stat(filepath.Join(restored, original))
+	if err != nil {
+		t.Fatalf("Expected original to be restored, got error %v", err)
+	}
+	b, err := os.Stat(filepath.Join(restored, link))
+	if err != nil {
+		t.Fatalf("Expected link to be restored, got error %v", err)
+	}
+	if !os.SameFile(a, b) {
+		t.Error("Expected restored files to be hard linked")
+	}
+}
+
+func extractArchive(t *testing.T, archive, target string) {
+	t.Helper()
+	f, err := os.Open(archive)
+	if err != nil {
+		t.Fatalf("Unexpected error opening archive: %v", err)
+	}
+	defer f.Close()
+
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatalf("Unexpected error reading gzip: %v", err)
+	}
+	tr := tar.NewReader(gz)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			t.Fatalf("Unexpected error reading tar: %v", err)
+		}
+		location := filepath.Join(target, header.Name)
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(location, 0755); err != nil {
+				t.Fatalf("Unexpected error creating directory: %v", err)
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(location), 0755); err != nil {
+				t.Fatalf("Unexpected error creating directory: %v", err)
+			}
+			out, err := os.Create(location)
+			if err != nil {
+				t.Fatalf("Unexpected error creating file: %v", err)
+			}
+			if _, err := io.Copy(out, tr); err != nil {
+				t.Fatalf("Unexpected error writing file: %v", err)
+			}
+			out.Close()
+		}
+	}
+}
+
+func BenchmarkCreateArchiveSmallFiles(b *testing.B) {
+	source := filepath.Join(b.TempDir(), "backup")
+	if err := os.MkdirAll(source, 0755); err != nil {
+		b.Fatalf("Unexpected error creating directory: %v", err)
+	}
+	files := []string{source}
+	for i := 0; i < 2000; i++ {
+		p := filepath.Join(source, fmt.Sprintf("file-%d.txt", i))
+		if err := os.WriteFile(p, []byte("content"), 0644); err != nil {
+			b.Fatalf("Unexpected error writing file: %v", err)
+		}
+		files = append(files, p)
+	}
+
+	for _, bufferSize := range []int{0, 1 << 20} {
+		b.Run(fmt.Sprintf("buffer=%d", bufferSize), func(b *testing.B) {
+			archive := filepath.Join(b.TempDir(), "backup.tar")
+			for i := 0; i < b.N; i++ {
+				if _, err := createArchive(files, source, archive, "none", 1, "", nil, nil, bufferSize, nil); err != nil {
+					b.Fatalf("Unexpected error creating archive: %v", err)
+				}
+			}
+		})
+	}
+}
+
+func TestCompressionLevel(t *testing.T) {
+	tests := []struct {
+		level       string
+		expectError map[string]bool
+	}{
+		{"", nil},
+		{"Fastest", nil},
+		{"best", nil},
+		{"9", nil},
+		{"19", map[string]bool{"gz": true, "xz": true}},
+		{"0", map[string]bool{"decode": true}},
+		{"23", map[string]bool{"decode": true}},
+		{"max", map[string]bool{"decode": true}},
+	}
+	for _, test := range tests {
+		t.Run(test.level, func(t *testing.T) {
+			var level CompressionLevel
+			err := level.Decode(test.level)
+			if (err != nil) != test.expectError["decode"] {
+				t.Fatalf("Unexpected error value decoding %s: %v", test.level, err)
+			}
+			if err != nil {
+				return
+			}
+			for _, algo := range []string{"gz", "zst"} {
+				w, err := getCompressionWriter(io.Discard, algo, 1, level)
+				if (err != nil) != test.expectError[algo] {
+					t.Errorf("Unexpected error value for %s: %v", algo, err)
+				}
+				if w != nil {
+					w.Close()
+				}
+			}
+			if _, err := xzCompressionPreset(level); (err != nil) != test.expectError["xz"] {
+				t.Errorf("Unexpected error value for xz: %v", err)
+			}
+			for _, algo := range []string{"gz", "zst", "xz", "none"} {
+				if err := checkCompressionLevel(algo, level); (err != nil) != test.expectError[algo] {
+					t.Errorf("Unexpected error value checking %s: %v", algo, err)
+				}
+			}
+		})
+	}
+}
+
+// writeSizeRecorder records the size of the largest write it receives.
+type writeSizeRecorder struct {
+	max int
+}
+
+func (w *writeSizeRecorder) Write(p []byte) (int, error) {
+	w.max = max(w.max, len(p))
+	return len(p), nil
+}
+
+func TestWriteTarballBufferSize(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "file.txt")
+	if err := os.WriteFile(file, make([]byte, 1<<16), 0644); err != nil {
+		t.Fatalf("Unexpected error writing file: %v", err)
+	}
+
+	recorder := &writeSizeRecorder{}
+	tarWriter := tar.NewWriter(recorder)
+	if _, err := writeTarball(file, tarWriter, "", "", make([]byte, 512), map[fileID]string{}); err != nil {
+		t.Fatalf("Unexpected error writing tarball: %v", err)
+	}
+	if recorder.max > 512 {
+		t.Errorf("Expected file to be copied using the given buffer, got a write of %d bytes", recorder.max)
+	}
+}
@@ -0,0 +1,186 @@
+// Copyright 2024 - offen.software <hioffen@posteo.de>
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/offen/docker-volume-backup/internal/errwrap"
+)
+
+// BackendState contains the outcome of the most recent uploads to a storage
+// backend, persisted across runs.
+type BackendState struct {
+	LastSuccess time.Time `json:"lastSuccess"`
+	LastFailure time.Time `json:"lastFailure"`
+	LastError   string    `json:"lastError,omitempty"`
+}
+
+// RunState contains the outcome of the most recent backup run, persisted
+// across runs.
+type RunState struct {
+	Time     time.Time     `json:"time"`
+	Outcome  string        `json:"outcome"`
+	Size     uint64        `json:"size"`
+	Duration time.Duration `json:"duration"`
+	// Streak is the number of consecutive runs with the same outcome,
+	// including this one.
+	Streak int `json:"streak"`
+}
+
+const (
+	runOutcomeSuccess = "success"
+	runOutcomeFailure = "failure"
+)
+
+// persistedState is the content of the state file.
+type persistedState struct {
+	Backends map[string]BackendState `json:"backends"`
+	LastRun  *RunState               `json:"lastRun,omitempty"`
+}
+
+// initBackendState loads the persisted state of all storage backends and
+// the previous run and registers a hook that persists the state including
+// the outcome of the current run. In case no state file is configured, it
+// does nothing.
+func (s *script) initBackendState() error {
+	location := s.c.BackupStateFile
+	if location == "" {
+		return nil
+	}
+
+	state, err := readBackendState(location)
+	if err != nil {
+		return errwrap.Wrap(err, "error reading backend state")
+	}
+	s.stats.Backends = state.Backends
+	s.stats.PreviousRun = state.LastRun
+	if s.validating {
+		return nil
+	}
+
+	s.registerHook(hookLevelPlumbing, func(err error) error {
+		s.stats.Lock()
+		defer s.stats.Unlock()
+		state := persistedState{
+			Backends: s.stats.Backends,
+			LastRun:  s.stats.PreviousRun,
+		}
+		// Skipped runs, attempts that are retried and maintenance tasks do not
+		// change the outcome of the previous run.
+		if !s.task && !s.skipped && !s.retryPending(err) {
+			state.LastRun = nextRunState(s.stats.PreviousRun, err, s.stats)
+		}
+		if err := writeBackendState(location, state); err != nil {
+			return errwrap.Wrap(err, "error persisting backend state")
+		}
+		return nil
+	})
+	return nil
+}
+
+// nextRunState returns the state of the current run, continuing the streak
+// of the previous run if the outcome is the same.
+func nextRunState(previous *RunState, runErr error, stats *Stats) *RunState {
+	next := &RunState{
+		Time:     stats.StartTime,
+		Outcome:  runOutcomeSuccess,
+		Size:     stats.BackupFile.Size,
+		Duration: stats.TookTime,
+		Streak:   1,
+	}
+	if runErr != nil {
+		next.Outcome = runOutcomeFailure
+	}
+	if previous != nil && previous.Outcome == next.Outcome {
+		next.Streak = previous.Streak + 1
+	}
+	return next
+}
+
+// recordUpload adds the outcome and duration of an upload to the stats of the
+// given backend, and updates its persisted state in case BACKUP_STATE_FILE is
+// set.
+func (s *script) recordUpload(backend string, took time.Duration, uploadErr error) {
+	s.stats.Lock()
+	defer s.stats.Unlock()
+	stats := s.stats.Storages[backend]
+	stats.Uploaded = uploadErr == nil
+	stats.UploadDuration = took
+	if uploadErr != nil {
+		stats.UploadError = uploadErr.Error()
+	}
+	s.stats.Storages[backend] = stats
+
+	if s.c.BackupStateFile == "" {
+		return
+	}
+	state := s.stats.Backends[backend]
+	if uploadErr == nil {
+		state.LastSuccess = time.Now()
+	} else {
+		state.LastFailure = time.Now()
+		state.LastError = uploadErr.Error()
+	}
+	s.stats.Backends[backend] = state
+}
+
+func readBackendState(location string) (*persistedState, error) {
+	state := &persistedState{}
+	b, err := os.ReadFile(location)
+	if err != nil {
+		if os.IsNotExist(err) {
+			state.Backends = map[string]BackendState{}
+			return state, nil
+		}
+		return nil, errwrap.Wrap(err, fmt.Sprintf("error reading %s", location))
+	}
+	if err := json.Unmarshal(b, state); err != nil {
+		return nil, errwrap.Wrap(err, fmt.Sprintf("error parsing %s", location))
+	}
+	if state.Backends == nil && state.LastRun == nil {
+		// Files written by earlier versions contain the state of the
+		// backends only.
+		if err := json.Unmarshal(b, &state.Backends); err != nil {
+			return nil, errwrap.Wrap(err, fmt.Sprintf("error parsing %s", location))
+		}
+	}
+	if state.Backends == nil {
+		state.Backends = map[string]BackendState{}
+	}
+	return state, nil
+}
+
+func writeBackendState(location string, state persistedState) error {
+	b, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return errwrap.Wrap(err, "error marshaling state")
+	}
+	return writeFileAtomic(location, b)
+}
+
+// writeFileAtomic writes the given content to a temporary file first, so
+// the file at location is never left in an incomplete state.
+func writeFileAtomic(location string, b []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(location), ".tmp-*")
+	if err != nil {
+		return errwrap.Wrap(err, "error creating temporary file")
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return errwrap.Wrap(err, "error writing temporary file")
+	}
+	if err := tmp.Close(); err != nil {
+		return errwrap.Wrap(err, "error closing temporary file")
+	}
+	if err := os.Rename(tmp.Name(), location); err != nil {
+		return errwrap.Wrap(err, fmt.Sprintf("error moving temporary file to %s", location))
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBackendState(t *testing.T) {
+	location := filepath.Join(t.TempDir(), "state.json")
+
+	s := newScript(&Config{BackupStateFile: location})
+	if err := s.initBackendState(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	s.recordUpload("S3", time.Second, nil)
+	s.recordUpload("WebDAV", time.Second, errors.New("connection refused"))
+	if err := s.runHooks(nil); err != nil {
+		t.Fatalf("Unexpected error running hooks: %v", err)
+	}
+
+	s = newScript(&Config{BackupStateFile: location})
+	if err := s.initBackendState(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	s.recordUpload("WebDAV", time.Second, nil)
+
+	s3, webdav := s.stats.Backends["S3"], s.stats.Backends["WebDAV"]
+	if s3.LastSuccess.IsZero() || !s3.LastFailure.IsZero() {
+		t.Errorf("Unexpected state for S3: %v", s3)
+	}
+	if webdav.LastSuccess.IsZero() || webdav.LastFailure.IsZero() || webdav.LastError != "connection refused" {
+		t.Errorf("Unexpected state for WebDAV: %v", webdav)
+	}
+}
+
+func TestRunState(t *testing.T) {
+	location := filepath.Join(t.TempDir(), "state.json")
+	if err := os.WriteFile(location, []byte(`{"S3":{"lastSuccess":"2024-01-01T00:00:00Z"}}`), 0644); err != nil {
+		t.Fatalf("Unexpected error writing file: %v", err)
+	}
+
+	run := func(runErr error, size uint64) *script {
+		s := newScript(&Config{BackupStateFile: location})
+		if err := s.initBackendState(); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		s.stats.BackupFile.Size = size
+		if err := s.runHooks(runErr); err != nil {
+			t.Fatalf("Unexpected error running hooks: %v", err)
+		}
+		return s
+	}
+
+	s := run(errors.New("boom"), 0)
+	if s.stats.PreviousRun != nil {
+		t.Errorf("Expected no previous run, got %v", s.stats.PreviousRun)
+	}
+	if s.stats.Backends["S3"].LastSuccess.IsZero() {
+		t.Error("Expected legacy backend state to be read")
+	}
+	run(errors.New("boom"), 0)
+	s = run(nil, 100)
+	if p := s.stats.PreviousRun; p == nil || p.Outcome != runOutcomeFailure || p.Streak != 2 {
+		t.Errorf("Unexpected previous run %v", p)
+	}
+	s = run(nil, 120)
+	if p := s.stats.PreviousRun; p == nil || p.Outcome != runOutcomeSuccess || p.Streak != 1 || p.Size != 100 {
+		t.Errorf("Unexpected previous run %v", p)
+	}
+
+	s = newScript(&Config{BackupStateFile: location})
+	if err := s.initBackendState(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if p := s.stats.PreviousRun; p.Streak != 2 || p.Size != 120 {
+		t.Errorf("Unexpected previous run %v", p)
+	}
+	if s.stats.Backends["S3"].LastSuccess.IsZero() {
+		t.Error("Expected backend state to be kept")
+	}
+}
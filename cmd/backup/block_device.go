@@ -0,0 +1,249 @@
+// Copyright 2024 - offen.software <hioffen@posteo.de>
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/offen/docker-volume-backup/internal/errwrap"
+)
+
+// blockDeviceBufferSize is the size of the blocks that are read from and
+// written to block devices. When restoring sparsely, blocks of this size
+// containing zeros only are skipped.
+const blockDeviceBufferSize = 1 << 20
+
+// BlockDeviceMetadata is stored next to the raw image of a block device in
+// the archive and is used for checking the target device when restoring.
+type BlockDeviceMetadata struct {
+	Device string `json:"device"`
+	Size   int64  `json:"size"`
+}
+
+// blockDeviceImageName returns the name of the raw image of the given device
+// within the archive.
+func blockDeviceImageName(device string) string {
+	return path.Join("devices", strings.TrimPrefix(filepath.ToSlash(device), "/")+".img")
+}
+
+// checkBlockDevice returns an error in case the given location is not a
+// block device.
+func checkBlockDevice(location string) error {
+	fi, err := os.Stat(location)
+	if err != nil {
+		return errwrap.Wrap(err, fmt.Sprintf("error getting file info for %s", location))
+	}
+	if fi.Mode()&os.ModeDevice == 0 || fi.Mode()&os.ModeCharDevice != 0 {
+		return errwrap.Wrap(nil, fmt.Sprintf("%s is not a block device", location))
+	}
+	return nil
+}
+
+// writeBlockDevice adds a raw image of the given device to the archive,
+// followed by a metadata file describing the device.
+func writeBlockDevice(device string, tarWriter *tar.Writer) error {
+	f, err := os.Open(device)
+	if err != nil {
+		return errwrap.Wrap(err, fmt.Sprintf("error opening %s", device))
+	}
+	defer f.Close()
+
+	// Block devices report a size of zero when calling stat, so the size
+	// is determined by seeking to the end instead.
+	size, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return errwrap.Wrap(err, fmt.Sprintf("error determining size of %s", device))
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return errwrap.Wrap(err, fmt.Sprintf("error seeking %s", device))
+	}
+
+	name := blockDeviceImageName(device)
+	now := time.Now()
+	if err := tarWriter.WriteHeader(&tar.Header{
+		Name:     name,
+		Mode:     0600,
+		Size:     size,
+		ModTime:  now,
+		Typeflag: tar.TypeReg,
+	}); err != nil {
+		return errwrap.Wrap(err, "error writing image header")
+	}
+	if _, err := io.CopyBuffer(tarWriter, io.LimitReader(f, size), make([]byte, blockDeviceBufferSize)); err != nil {
+		return errwrap.Wrap(err, fmt.Sprintf("error copying %s to tar writer", device))
+	}
+
+	metadata, err := json.MarshalIndent(BlockDeviceMetadata{Device: device, Size: size}, "", "  ")
+	if err != nil {
+		return errwrap.Wrap(err, "error marshaling block device metadata")
+	}
+	if err := tarWriter.WriteHeader(&tar.Header{
+		Name:     name + ".json",
+		Mode:     0644,
+		Size:     int64(len(metadata)),
+		ModTime:  now,
+		Typeflag: tar.TypeReg,
+	}); err != nil {
+		return errwrap.Wrap(err, "error writing metadata header")
+	}
+	if _, err := tarWriter.Write(metadata); err != nil {
+		return errwrap.Wrap(err, "error writing block device metadata")
+	}
+	return nil
+}
+
+// restoreBlockDevice writes the given raw image extracted from an archive
+// to the target device. The target must be a block device that is not
+// mounted, is large enough to hold the image and matches the device the
+// image was taken from, unless force is given. In case sparse is given,
+// blocks containing zeros only are skipped, which requires the target to be
+// zeroed already.
+func restoreBlockDevice(image, target string, sparse, force bool) error {
+	if target == "" {
+		return errwrap.Wrap(nil, "a target device is required for restoring a block device")
+	}
+
+	src, err := os.Open(image)
+	if err != nil {
+		return errwrap.Wrap(err, fmt.Sprintf("error opening image %s", image))
+	}
+	defer src.Close()
+	fi, err := src.Stat()
+	if err != nil {
+		return errwrap.Wrap(err, fmt.Sprintf("error getting file info for %s", image))
+	}
+
+	if !force {
+		if err := checkBlockDevice(target); err != nil {
+			return errwrap.Wrap(err, "refusing to restore")
+		}
+		var metadata BlockDeviceMetadata
+		b, err := os.ReadFile(image + ".json")
+		if err != nil {
+			return errwrap.Wrap(err, "refusing to restore without the metadata stored next to the image")
+		}
+		if err := json.Unmarshal(b, &metadata); err != nil {
+			return errwrap.Wrap(err, "error parsing block device metadata")
+		}
+		if metadata.Device != target {
+			return errwrap.Wrap(nil, fmt.Sprintf("refusing to restore image of %s to %s, use -restore-force to do so anyways", metadata.Device, target))
+		}
+	}
+
+	mounted, err := isMounted(target)
+	if err != nil {
+		return errwrap.Wrap(err, "error checking whether target is mounted")
+	}
+	if mounted {
+		return errwrap.Wrap(nil, fmt.Sprintf("refusing to restore to %s as it is mounted", target))
+	}
+
+	dst, err := os.OpenFile(target, os.O_WRONLY, 0)
+	if err != nil {
+		return errwrap.Wrap(err, fmt.Sprintf("error opening target %s", target))
+	}
+	defer dst.Close()
+
+	if size, err := dst.Seek(0, io.SeekEnd); err != nil {
+		return errwrap.Wrap(err, fmt.Sprintf("error determining size of %s", target))
+	} else if size < fi.Size() && !force {
+		return errwrap.Wrap(nil, fmt.Sprintf("target %s of %d bytes is too small for image of %d bytes", target, size, fi.Size()))
+	}
+	if _, err := dst.Seek(0, io.SeekStart); err != nil {
+		return errwrap.Wrap(err, fmt.Sprintf("error seeking %s", target))
+	}
+
+	if err := copyBlocks(dst, src, sparse); err != nil {
+		return errwrap.Wrap(err, fmt.Sprintf("error writing image to %s", target))
+	}
+	if err := dst.Sync(); err != nil {
+		return errwrap.Wrap(err, fmt.Sprintf("error syncing %s", target))
+	}
+	return nil
+}
+
+// copyBlocks copies src to dst block by block. When sparse is given, blocks
+// containing zeros only are skipped by seeking instead of writing.
+func copyBlocks(dst *os.File, src io.Reader, sparse bool) error {
+	buf := make([]byte, blockDeviceBufferSize)
+	zeros := make([]byte, blockDeviceBufferSize)
+	var skipped int64
+	for {
+		n, err := io.ReadFull(src, buf)
+		if n > 0 {
+			if sparse && bytes.Equal(buf[:n], zeros[:n]) {
+				if _, err := dst.Seek(int64(n), io.SeekCurrent); err != nil {
+					return err
+				}
+				skipped += int64(n)
+			} else {
+				if _, err := dst.Write(buf[:n]); err != nil {
+					return err
+				}
+				skipped = 0
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	// In case the image ends with skipped blocks, regular files need to be
+	// extended to their full size.
+	if skipped > 0 {
+		if fi, err := dst.Stat(); err == nil && fi.Mode().IsRegular() {
+			offset, err := dst.Seek(0, io.SeekCurrent)
+			if err != nil {
+				return err
+			}
+			return dst.Truncate(offset)
+		}
+	}
+	return nil
+}
+
+// isMounted returns true if the given device is listed as the source of a
+// mount in /proc/mounts.
+func isMounted(device string) (bool, error) {
+	resolved, err := filepath.EvalSymlinks(device)
+	if err != nil {
+		return false, errwrap.Wrap(err, fmt.Sprintf("error resolving %s", device))
+	}
+	f, err := os.Open("/proc/mounts")
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, errwrap.Wrap(err, "error opening /proc/mounts")
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		source := fields[0]
+		if source == device || source == resolved {
+			return true, nil
+		}
+		if r, err := filepath.EvalSymlinks(source); err == nil && r == resolved {
+			return true, nil
+		}
+	}
+	return false, scanner.Err()
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteBlockDevice(t *testing.T) {
+	device := filepath.Join(t.TempDir(), "device")
+	content := bytes.Repeat([]byte("data"), 1<<10)
+	if err := os.WriteFile(device, content, 0644); err != nil {
+		t.Fatalf("Unexpected error writing device: %v", err)
+	}
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	if err := writeBlockDevice(device, tw); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("Unexpected error closing writer: %v", err)
+	}
+
+	tr := tar.NewReader(&buf)
+	header, err := tr.Next()
+	if err != nil {
+		t.Fatalf("Unexpected error reading image: %v", err)
+	}
+	if header.Name != blockDeviceImageName(device) {
+		t.Errorf("Unexpected image name %s", header.Name)
+	}
+	image, _ := io.ReadAll(tr)
+	if !bytes.Equal(image, content) {
+		t.Error("Image does not match device content")
+	}
+
+	if _, err := tr.Next(); err != nil {
+		t.Fatalf("Unexpected error reading metadata: %v", err)
+	}
+	var metadata BlockDeviceMetadata
+	if err := json.NewDecoder(tr).Decode(&metadata); err != nil {
+		t.Fatalf("Unexpected error decoding metadata: %v", err)
+	}
+	if metadata.Device != device || metadata.Size != int64(len(content)) {
+		t.Errorf("Unexpected metadata %v", metadata)
+	}
+}
+
+func TestRestoreBlockDevice(t *testing.T) {
+	dir := t.TempDir()
+	image := filepath.Join(dir, "device.img")
+	content := append(bytes.Repeat([]byte("data"), blockDeviceBufferSize/4), make([]byte, 2*blockDeviceBufferSize)...)
+	if err := os.WriteFile(image, content, 0644); err != nil {
+		t.Fatalf("Unexpected error writing image: %v", err)
+	}
+
+	target := filepath.Join(dir, "target")
+	if err := os.WriteFile(target, nil, 0644); err != nil {
+		t.Fatalf("Unexpected error creating target: %v", err)
+	}
+
+	if err := restoreBlockDevice(image, target, false, false); err == nil {
+		t.Error("Expected an error restoring to a regular file without force")
+	}
+
+	if err := restoreBlockDevice(image, target, true, true); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	restored, err := os.ReadFile(target)
+	if err != nil {
+		t.Fatalf("Unexpected error reading target: %v", err)
+	}
+	if !bytes.Equal(restored, content) {
+		t.Errorf("Restored content does not match, got %d bytes, expected %d", len(restored), len(content))
+	}
+}
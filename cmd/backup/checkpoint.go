@@ -0,0 +1,247 @@
+// Copyright 2024 - offen.software <hioffen@posteo.de>
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/offen/docker-volume-backup/internal/errwrap"
+	"github.com/otiai10/copy"
+)
+
+const checkpointFile = "checkpoint.json"
+
+// Checkpoint records which storage backends a backup file has already been
+// uploaded to, so a subsequent run can complete the upload to the remaining
+// backends instead of creating a new backup.
+type Checkpoint struct {
+	File        string            `json:"file"`
+	Checksum    string            `json:"checksum"`
+	RemoteNames map[string]string `json:"remoteNames"`
+	Completed   []string          `json:"completed"`
+	// Created is the time the backup file has been created, Resumes the
+	// number of runs that have tried to complete the uploads since.
+	Created time.Time `json:"created"`
+	Resumes int       `json:"resumes"`
+
+	mu sync.Mutex
+}
+
+// complete marks the upload to the given backend as done.
+func (c *Checkpoint) complete(backend string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !slices.Contains(c.Completed, backend) {
+		c.Completed = append(c.Completed, backend)
+	}
+}
+
+// completed returns whether the upload to the given backend is done.
+func (c *Checkpoint) completed(backend string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return slices.Contains(c.Completed, backend)
+}
+
+// resumeCheckpoint looks for a checkpoint left by a previous run in
+// BACKUP_CHECKPOINT_DIR. In case one is found, the checksum of the
+// backup file still matches and the checkpoint has not expired, the file is
+// used as the backup file of the current run and true is returned.
+func (s *script) resumeCheckpoint() (bool, error) {
+	dir := s.c.BackupCheckpointDir
+	if dir == "" {
+		return false, nil
+	}
+
+	b, err := os.ReadFile(filepath.Join(dir, checkpointFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, errwrap.Wrap(err, "error reading checkpoint")
+	}
+	cp := &Checkpoint{}
+	if err := json.Unmarshal(b, cp); err != nil {
+		return false, errwrap.Wrap(err, "error parsing checkpoint")
+	}
+
+	file := filepath.Join(dir, filepath.Base(cp.File))
+	checksum, err := fileChecksum(file)
+	if err != nil || checksum != cp.Checksum {
+		s.logger.Warn(
+			fmt.Sprintf("Discarding checkpoint for `%s` as the backup file is missing or its checksum does not match.", cp.File),
+		)
+		if err := s.clearCheckpoint(); err != nil {
+			return false, errwrap.Wrap(err, "error clearing checkpoint")
+		}
+		return false, nil
+	}
+	if reason := s.checkpointExpired(cp); reason != "" {
+		s.logger.Warn(
+			fmt.Sprintf("Discarding checkpoint for `%s` as %s, creating a new backup instead.", cp.File, reason),
+		)
+		if err := s.clearCheckpoint(); err != nil {
+			return false, errwrap.Wrap(err, "error clearing checkpoint")
+		}
+		return false, nil
+	}
+
+	cp.Resumes++
+	s.file = file
+	s.checkpoint = cp
+	s.logger.Info(
+		fmt.Sprintf(
+			"Resuming upload of `%s` from a previous run, already uploaded to %d backend(s).",
+			cp.File,
+			len(cp.Completed),
+		),
+	)
+	return true, nil
+}
+
+// checkpointExpired returns the reason why the given checkpoint must not be
+// resumed anymore, or an empty string in case it can be resumed. Checkpoints
+// expire after BACKUP_CHECKPOINT_MAX_RESUMES runs have tried to resume them,
+// or once they are older than BACKUP_CHECKPOINT_MAX_AGE, which defaults to
+// the interval of BACKUP_CRON_EXPRESSION. Otherwise, a backend that keeps
+// failing would prevent new backups from ever being created.
+func (s *script) checkpointExpired(cp *Checkpoint) string {
+	if max := s.c.BackupCheckpointMaxResumes.Int(); max > 0 && cp.Resumes >= max {
+		return fmt.Sprintf("it has already been resumed %d time(s)", cp.Resumes)
+	}
+	if cp.Created.IsZero() {
+		return "its age is unknown"
+	}
+	if deadline, ok := s.checkpointDeadline(cp.Created); ok && !time.Now().Before(deadline) {
+		return fmt.Sprintf("it has been created at %s and is outdated", cp.Created.Format(time.RFC3339))
+	}
+	return ""
+}
+
+// checkpointDeadline returns the point in time a checkpoint created at the
+// given time expires. Without BACKUP_CHECKPOINT_MAX_AGE, a checkpoint can be
+// resumed until the second scheduled run after its creation, which is
+// expected to create a new backup. It returns false in case no deadline
+// can be determined.
+func (s *script) checkpointDeadline(created time.Time) (time.Time, bool) {
+	if s.c.BackupCheckpointMaxAge > 0 {
+		return created.Add(s.c.BackupCheckpointMaxAge), true
+	}
+	schedule, err := cronParser.Parse(s.c.BackupCronExpression)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return schedule.Next(schedule.Next(created)), true
+}
+
+// initCheckpoint creates a checkpoint for the current backup file in case
+// BACKUP_CHECKPOINT_DIR is set and the run is not resumed from a previous
+// checkpoint.
+func (s *script) initCheckpoint(remoteNames map[string]string) error {
+	if s.c.BackupCheckpointDir == "" || s.checkpoint != nil {
+		return nil
+	}
+	if len(s.variants) > 0 {
+		s.logger.Warn(
+			"Not creating a checkpoint as BACKUP_COMPRESSION_OVERRIDES is used, failed uploads will not be resumed.",
+		)
+		return nil
+	}
+	if s.envelope != "" {
+		s.logger.Warn(
+			"Not creating a checkpoint as GPG_KMS_PROVIDER is used, failed uploads will not be resumed.",
+		)
+		return nil
+	}
+	checksum, err := fileChecksum(s.file)
+	if err != nil {
+		return errwrap.Wrap(err, "error calculating checksum of backup file")
+	}
+	s.checkpoint = &Checkpoint{
+		File:        filepath.Base(s.file),
+		Checksum:    checksum,
+		RemoteNames: remoteNames,
+		Created:     time.Now(),
+	}
+	return nil
+}
+
+// saveCheckpoint persists the checkpoint of the current run, moving the
+// backup file to BACKUP_CHECKPOINT_DIR so it is available to the next run.
+func (s *script) saveCheckpoint() error {
+	dir := s.c.BackupCheckpointDir
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return errwrap.Wrap(err, "error creating checkpoint directory")
+	}
+
+	target := filepath.Join(dir, s.checkpoint.File)
+	if s.file != target {
+		if err := os.Rename(s.file, target); err != nil {
+			if err := copy.Copy(s.file, target); err != nil {
+				return errwrap.Wrap(err, "error copying backup file to checkpoint directory")
+			}
+		}
+	}
+
+	b, err := json.MarshalIndent(s.checkpoint, "", "  ")
+	if err != nil {
+		return errwrap.Wrap(err, "error marshaling checkpoint")
+	}
+	if err := writeFileAtomic(filepath.Join(dir, checkpointFile), b); err != nil {
+		return errwrap.Wrap(err, "error writing checkpoint")
+	}
+	s.logger.Info(
+		fmt.Sprintf(
+			"Saved checkpoint for `%s`, uploads to %d backend(s) will be resumed by the next run.",
+			s.checkpoint.File,
+			len(s.storages)-len(s.checkpoint.Completed),
+		),
+	)
+	return nil
+}
+
+// clearCheckpoint removes any checkpoint and backup file from
+// BACKUP_CHECKPOINT_DIR.
+func (s *script) clearCheckpoint() error {
+	dir := s.c.BackupCheckpointDir
+	b, err := os.ReadFile(filepath.Join(dir, checkpointFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return errwrap.Wrap(err, "error reading checkpoint")
+	}
+	cp := &Checkpoint{}
+	if err := json.Unmarshal(b, cp); err == nil && cp.File != "" {
+		if err := remove(filepath.Join(dir, filepath.Base(cp.File))); err != nil {
+			return errwrap.Wrap(err, "error removing checkpointed backup file")
+		}
+	}
+	if err := remove(filepath.Join(dir, checkpointFile)); err != nil {
+		return errwrap.Wrap(err, "error removing checkpoint")
+	}
+	return nil
+}
+
+func fileChecksum(location string) (string, error) {
+	f, err := os.Open(location)
+	if err != nil {
+		return "", errwrap.Wrap(err, fmt.Sprintf("error opening %s", location))
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", errwrap.Wrap(err, fmt.Sprintf("error reading %s", location))
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
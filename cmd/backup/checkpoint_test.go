@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/offen/docker-volume-backup/internal/storage"
+)
+
+type mockBackend struct {
+	name    string
+	fail    bool
+	hang    bool
+	mu      sync.Mutex
+	uploads map[string]int
+}
+
+func (m *mockBackend) Copy(ctx context.Context, file, name string) error {
+	if m.hang {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	if m.fail {
+		return errors.New("upload failed")
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.uploads[name]++
+	return nil
+}
+
+func (m *mockBackend) Prune(context.Context, time.Time, string, bool) (*storage.PruneStats, error) {
+	return &storage.PruneStats{}, nil
+}
+
+func (m *mockBackend) Stat(name string) (*storage.ObjectInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.uploads[name] == 0 {
+		return nil, errors.New("not found")
+	}
+	return &storage.ObjectInfo{Name: name}, nil
+}
+
+func (m *mockBackend) List(string) ([]storage.ObjectInfo, error) { return nil, nil }
+
+func (m *mockBackend) Open(string, int64) (io.ReadCloser, error) { return nil, nil }
+
+func (m *mockBackend) Remove(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.uploads, name)
+	return nil
+}
+
+func (m *mockBackend) Name() string { return m.name }
+
+func (m *mockBackend) Preflight(ctx context.Context) error {
+	if m.fail {
+		return errors.New("preflight failed")
+	}
+	return nil
+}
+
+func TestCheckpointResume(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "checkpoint")
+	file := filepath.Join(t.TempDir(), "backup.tar.gz")
+	if err := os.WriteFile(file, []byte("backup"), 0644); err != nil {
+		t.Fatalf("Unexpected error writing file: %v", err)
+	}
+
+	s3 := &mockBackend{name: "S3", uploads: map[string]int{}}
+	ssh := &mockBackend{name: "SSH", fail: true, uploads: map[string]int{}}
+
+	s := newScript(&Config{BackupCheckpointDir: dir})
+	s.file = file
+	s.storages = []storage.Backend{s3, ssh}
+	if err := s.copyArchive(); err == nil {
+		t.Fatal("Expected error copying archive")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "backup.tar.gz")); err != nil {
+		t.Fatalf("Expected backup file to be kept, got error %v", err)
+	}
+
+	ssh.fail = false
+	s = newScript(&Config{BackupCheckpointDir: dir})
+	s.storages = []storage.Backend{s3, ssh}
+	resumed, err := s.resumeCheckpoint()
+	if err != nil {
+		t.Fatalf("Unexpected error resuming checkpoint: %v", err)
+	}
+	if !resumed {
+		t.Fatal("Expected run to be resumed")
+	}
+	if err := s.copyArchive(); err != nil {
+		t.Fatalf("Unexpected error copying archive: %v", err)
+	}
+
+	if s3.uploads["backup.tar.gz"] != 1 {
+		t.Errorf("Expected a single upload to S3, got %d", s3.uploads["backup.tar.gz"])
+	}
+	if ssh.uploads["backup.tar.gz"] != 1 {
+		t.Errorf("Expected a single upload to SSH, got %d", ssh.uploads["backup.tar.gz"])
+	}
+	if _, err := os.Stat(filepath.Join(dir, checkpointFile)); !os.IsNotExist(err) {
+		t.Errorf("Expected checkpoint to be cleared, got %v", err)
+	}
+}
+
+func TestCheckpointExpired(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name     string
+		config   *Config
+		cp       *Checkpoint
+		expected bool
+	}{
+		{"fresh", &Config{BackupCronExpression: "@daily"}, &Checkpoint{Created: now}, false},
+		{"next scheduled run", &Config{BackupCronExpression: "@hourly"}, &Checkpoint{Created: now.Add(-30 * time.Minute)}, false},
+		{"second scheduled run", &Config{BackupCronExpression: "@hourly"}, &Checkpoint{Created: now.Add(-2 * time.Hour)}, true},
+		{"max age", &Config{BackupCronExpression: "@daily", BackupCheckpointMaxAge: time.Hour}, &Checkpoint{Created: now.Add(-2 * time.Hour)}, true},
+		{"within max age", &Config{BackupCronExpression: "@hourly", BackupCheckpointMaxAge: 24 * time.Hour}, &Checkpoint{Created: now.Add(-2 * time.Hour)}, false},
+		{"max resumes", &Config{BackupCheckpointMaxResumes: 3}, &Checkpoint{Created: now, Resumes: 3}, true},
+		{"unlimited resumes", &Config{}, &Checkpoint{Created: now, Resumes: 10}, false},
+		{"unknown age", &Config{}, &Checkpoint{}, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := newScript(test.config)
+			if reason := s.checkpointExpired(test.cp); (reason != "") != test.expected {
+				t.Errorf("Expected expired to be %v, got %q", test.expected, reason)
+			}
+		})
+	}
+}
+
+func TestCheckpointMaxResumes(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "checkpoint")
+	file := filepath.Join(t.TempDir(), "backup.tar.gz")
+	if err := os.WriteFile(file, []byte("backup"), 0644); err != nil {
+		t.Fatalf("Unexpected error writing file: %v", err)
+	}
+
+	s3 := &mockBackend{name: "S3", uploads: map[string]int{}}
+	ssh := &mockBackend{name: "SSH", fail: true, uploads: map[string]int{}}
+	config := &Config{BackupCheckpointDir: dir, BackupCheckpointMaxResumes: 2}
+	s := newScript(config)
+	s.file = file
+	s.storages = []storage.Backend{s3, ssh}
+	if err := s.copyArchive(); err == nil {
+		t.Fatal("Expected error copying archive")
+	}
+
+	for i := 0; i < 2; i++ {
+		s = newScript(config)
+		s.storages = []storage.Backend{s3, ssh}
+		resumed, err := s.resumeCheckpoint()
+		if err != nil || !resumed {
+			t.Fatalf("Expected run %d to be resumed, got %v, %v", i+1, resumed, err)
+		}
+		if err := s.copyArchive(); err == nil {
+			t.Fatal("Expected error copying archive")
+		}
+	}
+
+	s = newScript(config)
+	s.storages = []storage.Backend{s3, ssh}
+	resumed, err := s.resumeCheckpoint()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if resumed {
+		t.Error("Expected checkpoint to be discarded after reaching the maximum number of resumes")
+	}
+	if _, err := os.Stat(filepath.Join(dir, checkpointFile)); !os.IsNotExist(err) {
+		t.Errorf("Expected checkpoint to be cleared, got %v", err)
+	}
+}
@@ -0,0 +1,87 @@
+// Copyright 2024 - offen.software <hioffen@posteo.de>
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/offen/docker-volume-backup/internal/errwrap"
+	"github.com/offen/docker-volume-backup/internal/storage"
+)
+
+// checksumSuffixes contains the suffixes of all checksum files, which are
+// named after the algorithm in use.
+var checksumSuffixes = []string{".sha256", ".sha512", ".blake2b"}
+
+// backupChecksum returns the checksum of the given backup file using
+// BACKUP_CHECKSUM_ALGORITHM. Each file is read once only, so subsequent calls
+// return the existing checksum.
+func (s *script) backupChecksum(file string) (string, error) {
+	if checksum, ok := s.checksums[file]; ok {
+		return checksum, nil
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		return "", errwrap.Wrap(err, fmt.Sprintf("error opening %s", file))
+	}
+	defer f.Close()
+	h, err := s.c.BackupChecksumAlgorithm.New()
+	if err != nil {
+		return "", err
+	}
+	if _, err := io.Copy(h, f); err != nil {
+		return "", errwrap.Wrap(err, fmt.Sprintf("error reading %s", file))
+	}
+	checksum := hex.EncodeToString(h.Sum(nil))
+	s.checksums[file] = checksum
+	return checksum, nil
+}
+
+// copyChecksum uploads a file containing the checksum of the given backup
+// file next to the backup with the given name. The file uses the format
+// understood by tools like `sha256sum -c`. In case no checksum algorithm is
+// configured, it does nothing.
+func (s *script) copyChecksum(b storage.Backend, file, name string) error {
+	if s.c.BackupChecksumAlgorithm == "" {
+		return nil
+	}
+	checksum, err := s.backupChecksum(file)
+	if err != nil {
+		return errwrap.Wrap(err, "error calculating checksum")
+	}
+
+	dir, err := s.tempDir("checksum-*")
+	if err != nil {
+		return errwrap.Wrap(err, "error creating directory for checksum")
+	}
+	checksumFile := filepath.Join(dir, "checksum")
+	if err := os.WriteFile(checksumFile, []byte(fmt.Sprintf("%s  %s\n", checksum, path.Base(name))), 0644); err != nil {
+		return errwrap.Wrap(err, "error writing checksum")
+	}
+	if err := s.withTimeout(b.Name(), func(ctx context.Context) error {
+		return b.Copy(ctx, checksumFile, name+s.c.BackupChecksumAlgorithm.Suffix())
+	}); err != nil {
+		return errwrap.Wrap(err, "error uploading checksum")
+	}
+	return nil
+}
+
+// isChecksumFile returns whether the file with the given name contains the
+// checksum of a backup.
+func isChecksumFile(name string) bool {
+	for _, suffix := range checksumSuffixes {
+		if strings.HasSuffix(name, suffix) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"text/template"
+
+	"github.com/offen/docker-volume-backup/internal/storage"
+	"github.com/offen/docker-volume-backup/internal/storage/local"
+)
+
+func TestCopyChecksum(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "backup.tar.gz")
+	if err := os.WriteFile(file, []byte("content"), 0644); err != nil {
+		t.Fatalf("Unexpected error writing file: %v", err)
+	}
+
+	tests := map[string]string{
+		"sha256":  "ed7002b439e9ac845f22357d822bac1444730fbdb6016d3ec9432297b9ec9f73",
+		"sha512":  "b2d1d285b5199c85f988d03649c37e44fd3dde01e5d69c50fef90651962f48110e9340b60d49a479c4c0b53f5f07d690686dd87d2481937a512e8b85ee7c617f",
+		"blake2b": "c3f4db476d1b1504092b4b3756e9b5ef1d658f609e55361e77de6b74d9d77a28be46411fd3ce158048c77714925207e47960f3dc0f399f1b8dcbb7e70333dc66",
+	}
+	for algorithm, expected := range tests {
+		t.Run(algorithm, func(t *testing.T) {
+			var a ChecksumAlgorithm
+			if err := a.Decode(algorithm); err != nil {
+				t.Fatalf("Unexpected error decoding algorithm: %v", err)
+			}
+			s := newScript(&Config{BackupChecksumAlgorithm: a})
+			archive := t.TempDir()
+			b := local.NewStorageBackend(local.Config{ArchivePath: archive}, func(storage.LogLevel, string, string, ...any) {})
+			if err := s.copyChecksum(b, file, "backup-1.tar.gz"); err != nil {
+				t.Fatalf("Unexpected error copying checksum: %v", err)
+			}
+			content, err := os.ReadFile(filepath.Join(archive, "backup-1.tar.gz."+algorithm))
+			if err != nil {
+				t.Fatalf("Expected checksum file to exist, got %v", err)
+			}
+			checksum, _ := s.backupChecksum(file)
+			if checksum != expected {
+				t.Errorf("Unexpected checksum %s", checksum)
+			}
+			if string(content) != checksum+"  backup-1.tar.gz\n" {
+				t.Errorf("Unexpected checksum file content %s", content)
+			}
+			if name := backupSetName("backup-1.tar.gz." + algorithm); name != "backup-1.tar.gz" {
+				t.Errorf("Expected checksum file to belong to the backup, got %s", name)
+			}
+		})
+	}
+
+	if err := (new(ChecksumAlgorithm)).Decode("md5"); err == nil {
+		t.Error("Expected error decoding unsupported algorithm")
+	}
+}
+
+func TestDefaultNotificationsChecksum(t *testing.T) {
+	tmpl, err := template.New("").Funcs(templateHelpers).Parse(defaultNotifications)
+	if err != nil {
+		t.Fatalf("Unexpected error parsing templates: %v", err)
+	}
+	stats := &Stats{LogOutput: &bytes.Buffer{}}
+	stats.BackupFile.Checksum = "abc"
+	buf := &bytes.Buffer{}
+	if err := tmpl.ExecuteTemplate(buf, "body_success", NotificationData{Stats: stats, Config: &Config{BackupChecksumAlgorithm: "sha256"}}); err != nil {
+		t.Fatalf("Unexpected error executing template: %v", err)
+	}
+	if !strings.Contains(buf.String(), "The checksum of the backup is sha256:abc.") {
+		t.Errorf("Expected checksum in notification, got %s", buf.String())
+	}
+}
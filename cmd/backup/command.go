@@ -4,46 +4,75 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log/slog"
+	"math/rand/v2"
 	"os"
 	"os/signal"
+	"sync"
 	"syscall"
+	"time"
 
 	"github.com/offen/docker-volume-backup/internal/errwrap"
 	"github.com/robfig/cron/v3"
 )
 
 type command struct {
-	logger    *slog.Logger
-	schedules []cron.EntryID
-	cr        *cron.Cron
-	reload    chan struct{}
+	logger              *slog.Logger
+	schedules           map[cron.EntryID]string
+	cr                  *cron.Cron
+	reload              chan struct{}
+	configFile          string
+	ctx                 context.Context
+	shutdownGracePeriod time.Duration
+	controlSocket       string
+
+	// mu guards the configurations and the limiter that have been scheduled
+	// most recently, which are also used for runs triggered using the
+	// control socket.
+	mu             sync.Mutex
+	configurations []*Config
+	limiter        *runLimiter
 }
 
 func newCommand() *command {
 	return &command{
 		logger: slog.New(slog.NewTextHandler(os.Stdout, nil)),
+		ctx:    context.Background(),
 	}
 }
 
 // runAsCommand executes a backup run for each configuration that is available
-// and then returns
+// and then returns. A failing run does not prevent runs for other
+// configurations.
 func (c *command) runAsCommand() error {
-	configurations, err := sourceConfiguration(configStrategyEnv)
+	ctx, stop := signal.NotifyContext(c.ctx, syscall.SIGTERM, syscall.SIGINT)
+	defer stop()
+	c.ctx = ctx
+
+	configurations, err := sourceConfiguration(configStrategyEnv, c.configFile)
 	if err != nil {
 		return errwrap.Wrap(err, "error loading env vars")
 	}
 
+	var errs []error
 	for _, config := range configurations {
-		if err := runScript(config); err != nil {
-			return errwrap.Wrap(err, "error running script")
+		if err := runScript(c.ctx, config); err != nil {
+			errs = append(errs, errwrap.Wrap(err, fmt.Sprintf("error running script for %s", config.source)))
 		}
 	}
 
-	return nil
+	return errors.Join(errs...)
 }
 
+// cronParser parses the cron expressions used for scheduling backups and
+// tasks when running in the foreground.
+var cronParser = cron.NewParser(
+	cron.SecondOptional | cron.Minute | cron.Hour | cron.Dom | cron.Month | cron.Dow | cron.Descriptor,
+)
+
 type foregroundOpts struct {
 	profileCronExpression string
 }
@@ -51,13 +80,11 @@ type foregroundOpts struct {
 // runInForeground starts the program as a long running process, scheduling
 // a job for each configuration that is available.
 func (c *command) runInForeground(opts foregroundOpts) error {
-	c.cr = cron.New(
-		cron.WithParser(
-			cron.NewParser(
-				cron.SecondOptional | cron.Minute | cron.Hour | cron.Dom | cron.Month | cron.Dow | cron.Descriptor,
-			),
-		),
-	)
+	c.cr = cron.New(cron.WithParser(cronParser))
+
+	ctx, cancel := context.WithCancel(c.ctx)
+	defer cancel()
+	c.ctx = ctx
 
 	if err := c.schedule(configStrategyConfd); err != nil {
 		return errwrap.Wrap(err, "error scheduling")
@@ -69,40 +96,126 @@ func (c *command) runInForeground(opts foregroundOpts) error {
 		}
 	}
 
+	if c.controlSocket != "" {
+		if err := c.serveControl(c.controlSocket); err != nil {
+			return errwrap.Wrap(err, "error starting control socket")
+		}
+	}
+
 	var quit = make(chan os.Signal, 1)
 	c.reload = make(chan struct{}, 1)
 	signal.Notify(quit, syscall.SIGTERM, syscall.SIGINT)
+
+	var hup = make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			// A reload that is already pending covers this signal too.
+			select {
+			case c.reload <- struct{}{}:
+			default:
+			}
+		}
+	}()
 	c.cr.Start()
 
 	for {
 		select {
 		case <-quit:
-			ctx := c.cr.Stop()
-			<-ctx.Done()
-			return nil
+			// Running jobs are cancelled so they can release their resources
+			// (e.g. restarting stopped containers) before the process exits.
+			c.logger.Info(
+				fmt.Sprintf("Received signal, cancelling running jobs and waiting up to %s for them to finish.", c.shutdownGracePeriod),
+			)
+			cancel()
+			return waitForJobs(c.cr.Stop(), c.shutdownGracePeriod)
 		case <-c.reload:
+			c.logger.Info("Reloading configuration.")
 			if err := c.schedule(configStrategyConfd); err != nil {
-				return errwrap.Wrap(err, "error reloading configuration")
+				c.logger.Error(
+					fmt.Sprintf("Unexpected error reloading configuration: %v", errwrap.Unwrap(err)),
+					"error",
+					err,
+				)
 			}
 		}
 	}
 }
 
-// schedule wipes all existing schedules and enqueues all schedules available
-// using the given configuration strategy
-func (c *command) schedule(strategy configStrategy) error {
-	for _, id := range c.schedules {
-		c.cr.Remove(id)
+// waitForJobs waits for the given context of the stopped cron scheduler to
+// be done, which signals all running jobs have finished. In case this takes
+// longer than the given grace period, an error is returned.
+func waitForJobs(stopped context.Context, gracePeriod time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), gracePeriod)
+	defer cancel()
+	select {
+	case <-stopped.Done():
+		return nil
+	case <-ctx.Done():
+		return errwrap.Wrap(ctx.Err(), fmt.Sprintf("running jobs did not finish within the shutdown grace period of %s", gracePeriod))
 	}
+}
 
-	configurations, err := sourceConfiguration(strategy)
+// schedule replaces all existing schedules with all schedules available
+// using the given configuration strategy. The new schedules are added before
+// the existing ones are removed, so in case any of them cannot be added, the
+// existing schedules are kept.
+func (c *command) schedule(strategy configStrategy) (err error) {
+	configurations, err := sourceConfiguration(strategy, c.configFile)
 	if err != nil {
 		return errwrap.Wrap(err, "error sourcing configuration")
 	}
 
+	var maxConcurrentRuns int
+	for _, config := range configurations {
+		if n := config.MaxConcurrentRuns.Int(); n > 0 && (maxConcurrentRuns == 0 || n < maxConcurrentRuns) {
+			maxConcurrentRuns = n
+		}
+	}
+	// The limiter is kept across reloads so runs that are in flight keep
+	// counting towards the limit, even if the limit itself changes.
+	limiter := c.limiter
+	if limiter == nil {
+		limiter = newRunLimiter(maxConcurrentRuns)
+	}
+
+	schedules := map[cron.EntryID]string{}
+	defer func() {
+		if err != nil {
+			for id := range schedules {
+				c.cr.Remove(id)
+			}
+			return
+		}
+		// Removing entries does not affect jobs that are currently running.
+		previous := c.schedules
+		for id := range previous {
+			c.cr.Remove(id)
+		}
+		c.schedules = schedules
+		if previous != nil {
+			c.logScheduleChanges(previous)
+		}
+
+		c.shutdownGracePeriod = 0
+		for _, config := range configurations {
+			c.shutdownGracePeriod = max(c.shutdownGracePeriod, config.BackupShutdownGracePeriod)
+			if c.controlSocket == "" {
+				c.controlSocket = config.ControlSocket
+			}
+		}
+		limiter.setLimit(maxConcurrentRuns)
+		c.mu.Lock()
+		c.configurations = configurations
+		c.limiter = limiter
+		c.mu.Unlock()
+	}()
+
+	var scheduled int
 	for _, cfg := range configurations {
 		config := cfg
-		id, err := c.cr.AddFunc(config.BackupCronExpression, func() {
+		var id cron.EntryID
+		id, err := c.cr.AddFunc(config.cronSpec(config.BackupCronExpression), func() {
 			c.logger.Info(
 				fmt.Sprintf(
 					"Now running script on schedule %s",
@@ -110,7 +223,16 @@ func (c *command) schedule(strategy configStrategy) error {
 				),
 			)
 
-			if err := runScript(config); err != nil {
+			if err := c.waitJitter(config); err != nil {
+				c.logger.Info(
+					fmt.Sprintf("Cancelled schedule %s while delaying the run: %v", config.BackupCronExpression, errwrap.Unwrap(err)),
+				)
+				return
+			}
+
+			// Queued runs must not overlap with the next run of the same
+			// schedule, which would otherwise start right after.
+			if err := c.runLimited(limiter, config, c.cr.Entry(id).Next); err != nil {
 				c.logger.Error(
 					fmt.Sprintf(
 						"Unexpected error running schedule %s: %v",
@@ -126,16 +248,247 @@ func (c *command) schedule(strategy configStrategy) error {
 		if err != nil {
 			return errwrap.Wrap(err, fmt.Sprintf("error adding schedule %s", config.BackupCronExpression))
 		}
-		c.logger.Info(fmt.Sprintf("Successfully scheduled backup %s with expression %s", config.source, config.BackupCronExpression))
-		if ok := checkCronSchedule(config.BackupCronExpression); !ok {
+		schedules[id] = fmt.Sprintf("backup %s with expression %s", config.source, config.cronSpec(config.BackupCronExpression))
+		c.logger.Info(fmt.Sprintf("Successfully scheduled backup %s with expression %s", config.source, config.cronSpec(config.BackupCronExpression)))
+		if _, err := renderBackupFilename(config.BackupFilename, config.BackupCompression); err != nil {
+			c.logger.Warn(
+				fmt.Sprintf("Backup %s will fail to run as its BACKUP_FILENAME is invalid: %v", config.source, errwrap.Unwrap(err)),
+			)
+		}
+		for backend, filename := range config.BackupFilenameOverrides {
+			if _, err := renderBackupFilename(filename, config.BackupCompression); err != nil {
+				c.logger.Warn(
+					fmt.Sprintf("Backup %s will fail to run as its filename override for %s is invalid: %v", config.source, backend, errwrap.Unwrap(err)),
+				)
+			}
+		}
+		if config.BackupPrunePreviewCronExpression != "" {
+			if err := c.scheduleTask(schedules, "prune preview", config.BackupPrunePreviewCronExpression, config, (*script).previewPrune); err != nil {
+				return errwrap.Wrap(err, "error scheduling prune preview")
+			}
+		}
+		if config.GpgVerifyCronExpression != "" {
+			if err := c.scheduleTask(schedules, "decryption check", config.GpgVerifyCronExpression, config, (*script).verifyDecryption); err != nil {
+				return errwrap.Wrap(err, "error scheduling decryption check")
+			}
+		}
+		if config.BackupVerifyCronExpression != "" {
+			if err := c.scheduleTask(schedules, "restore verification", config.BackupVerifyCronExpression, config, (*script).verifyRestore); err != nil {
+				return errwrap.Wrap(err, "error scheduling restore verification")
+			}
+		}
+		if ok := checkCronSchedule(config.cronSpec(config.BackupCronExpression)); !ok {
 			c.logger.Warn(
 				fmt.Sprintf("Scheduled cron expression %s will never run, is this intentional?", config.BackupCronExpression),
 			)
+		} else {
+			scheduled++
+		}
+	}
 
-			if err != nil {
-				return errwrap.Wrap(err, "error scheduling")
-			}
-			c.schedules = append(c.schedules, id)
+	if scheduled == 0 {
+		if err := c.warnEmptySchedule(configurations); err != nil {
+			return errwrap.Wrap(err, "error handling empty schedule")
+		}
+	}
+
+	return nil
+}
+
+// logScheduleChanges logs the schedules that have been added and removed
+// compared to the given previous schedules.
+func (c *command) logScheduleChanges(previous map[cron.EntryID]string) {
+	before := map[string]bool{}
+	for _, description := range previous {
+		before[description] = true
+	}
+	after := map[string]bool{}
+	for _, description := range c.schedules {
+		after[description] = true
+	}
+
+	var added, removed int
+	for description := range after {
+		if !before[description] {
+			c.logger.Info(fmt.Sprintf("Added schedule for %s.", description))
+			added++
+		}
+	}
+	for description := range before {
+		if !after[description] {
+			c.logger.Info(fmt.Sprintf("Removed schedule for %s.", description))
+			removed++
+		}
+	}
+	c.logger.Info(
+		fmt.Sprintf("Reloaded configuration, added %d and removed %d schedule(s), %d remain unchanged.", added, removed, len(after)-added),
+	)
+}
+
+// runLimited runs a backup using the given configuration once permitted by
+// the given limiter. In case a non-zero deadline is given and the run is
+// still queued when it passes, the run is skipped.
+func (c *command) runLimited(limiter *runLimiter, config *Config, deadline time.Time) error {
+	ctx := c.ctx
+	if !deadline.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(c.ctx, deadline)
+		defer cancel()
+	}
+	release, err := limiter.acquire(ctx, c.logger, config)
+	if err != nil {
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) && c.ctx.Err() == nil {
+			c.logger.Warn(
+				fmt.Sprintf("Skipping backup %s as it was still queued when its next run was due.", config.source),
+			)
+			return nil
+		}
+		return err
+	}
+	defer release()
+	return runScript(c.ctx, config)
+}
+
+// waitJitter delays a scheduled run by a random duration of up to
+// BACKUP_CRON_JITTER, so that hosts sharing the same schedule do not run
+// their backups at the exact same time. The delay is chosen for each run
+// and does not affect when the next run is scheduled.
+func (c *command) waitJitter(config *Config) error {
+	if config.BackupCronJitter <= 0 {
+		return nil
+	}
+	delay := rand.N(config.BackupCronJitter)
+	c.logger.Info(
+		fmt.Sprintf("Delaying backup %s by %s as BACKUP_CRON_JITTER is set.", config.source, delay.Round(time.Second)),
+	)
+	select {
+	case <-c.ctx.Done():
+		return c.ctx.Err()
+	case <-time.After(delay):
+		return nil
+	}
+}
+
+// runLimiter limits the number of backups that are run concurrently when
+// running in the foreground. A limit of zero does not limit runs. The limit
+// can be changed while runs are in flight, which keep counting towards it.
+type runLimiter struct {
+	mu      sync.Mutex
+	limit   int
+	running int
+	// released is closed and replaced whenever a run finishes or the limit
+	// changes, waking up queued runs.
+	released chan struct{}
+}
+
+func newRunLimiter(limit int) *runLimiter {
+	return &runLimiter{limit: max(limit, 0), released: make(chan struct{})}
+}
+
+// setLimit changes the limit of the limiter, waking up queued runs in case
+// they are now permitted to run.
+func (r *runLimiter) setLimit(limit int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.limit = max(limit, 0)
+	r.notify()
+}
+
+// notify wakes up all queued runs. Callers must hold r.mu.
+func (r *runLimiter) notify() {
+	close(r.released)
+	r.released = make(chan struct{})
+}
+
+// tryAcquire reserves a run in case the limit permits it. Otherwise, it
+// returns a channel that is closed once the caller should try again.
+func (r *runLimiter) tryAcquire() (bool, <-chan struct{}) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.limit == 0 || r.running < r.limit {
+		r.running++
+		return true, nil
+	}
+	return false, r.released
+}
+
+func (r *runLimiter) release() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.running--
+	r.notify()
+}
+
+// acquire blocks until the given configuration is permitted to run as per
+// MAX_CONCURRENT_RUNS. Callers are expected to invoke the returned func once
+// the run has finished.
+func (r *runLimiter) acquire(ctx context.Context, logger *slog.Logger, config *Config) (func(), error) {
+	ok, wait := r.tryAcquire()
+	if !ok {
+		r.mu.Lock()
+		limit := r.limit
+		r.mu.Unlock()
+		logger.Info(
+			fmt.Sprintf("Maximum of %d concurrent runs reached, queuing backup %s until another run has finished.", limit, config.source),
+		)
+	}
+	for !ok {
+		select {
+		case <-ctx.Done():
+			return nil, errwrap.Wrap(ctx.Err(), "cancelled while waiting for other runs to finish")
+		case <-wait:
+		}
+		ok, wait = r.tryAcquire()
+	}
+	var once sync.Once
+	return func() { once.Do(r.release) }, nil
+}
+
+// scheduleTask adds a job that runs the given task using the given
+// configuration on the given schedule.
+func (c *command) scheduleTask(schedules map[cron.EntryID]string, name, expression string, config *Config, task func(s *script) error) error {
+	id, err := c.cr.AddFunc(config.cronSpec(expression), func() {
+		c.logger.Info(
+			fmt.Sprintf("Now running %s on schedule %s", name, expression),
+		)
+		if err := runTask(c.ctx, config, task); err != nil {
+			c.logger.Error(
+				fmt.Sprintf(
+					"Unexpected error running %s on schedule %s: %v",
+					name,
+					expression,
+					errwrap.Unwrap(err),
+				),
+				"error",
+				err,
+			)
+		}
+	})
+	if err != nil {
+		return errwrap.Wrap(err, fmt.Sprintf("error adding %s schedule %s", name, expression))
+	}
+	schedules[id] = fmt.Sprintf("%s %s with expression %s", name, config.source, config.cronSpec(expression))
+	c.logger.Info(
+		fmt.Sprintf("Successfully scheduled %s %s with expression %s", name, config.source, expression),
+	)
+	return nil
+}
+
+// runTaskAsCommand runs the given task for each configuration that is
+// available using the given strategy and then returns
+func (c *command) runTaskAsCommand(strategy configStrategy, task func(s *script) error) error {
+	ctx, stop := signal.NotifyContext(c.ctx, syscall.SIGTERM, syscall.SIGINT)
+	defer stop()
+	c.ctx = ctx
+
+	configurations, err := sourceConfiguration(strategy, c.configFile)
+	if err != nil {
+		return errwrap.Wrap(err, "error loading env vars")
+	}
+
+	for _, config := range configurations {
+		if err := runTask(c.ctx, config, task); err != nil {
+			return errwrap.Wrap(err, "error running task")
 		}
 	}
 
@@ -151,6 +504,33 @@ func (c *command) must(err error) {
 			"error",
 			err,
 		)
-		os.Exit(1)
+		os.Exit(exitCode(err))
+	}
+}
+
+// exitCode returns the code the program exits with for the given error.
+// Runs that uploaded the backup to some of the storage backends only exit
+// with a distinct code, unless any other error occurred.
+func exitCode(err error) int {
+	if partialFailure(err) {
+		return 2
+	}
+	return 1
+}
+
+func partialFailure(err error) bool {
+	switch e := err.(type) {
+	case *partialFailureError:
+		return true
+	case interface{ Unwrap() []error }:
+		for _, err := range e.Unwrap() {
+			if !partialFailure(err) {
+				return false
+			}
+		}
+		return true
+	case interface{ Unwrap() error }:
+		return partialFailure(e.Unwrap())
 	}
+	return false
 }
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"maps"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/offen/docker-volume-backup/internal/errwrap"
+	"github.com/robfig/cron/v3"
+)
+
+func TestRunLimiter(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	limiter := newRunLimiter(1)
+
+	release, err := limiter.acquire(context.Background(), logger, &Config{})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := limiter.acquire(ctx, logger, &Config{}); err == nil {
+		t.Error("Expected error when limit is reached and context is cancelled")
+	}
+
+	release()
+	if _, err := limiter.acquire(ctx, logger, &Config{}); err != nil {
+		t.Errorf("Expected run to be permitted after release, got %v", err)
+	}
+
+	unlimited := newRunLimiter(0)
+	for i := 0; i < 3; i++ {
+		if _, err := unlimited.acquire(ctx, logger, &Config{}); err != nil {
+			t.Errorf("Unexpected error: %v", err)
+		}
+	}
+}
+
+func TestRunLimiterContention(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	limiter := newRunLimiter(2)
+
+	var mu sync.Mutex
+	var running, peak int
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			release, err := limiter.acquire(context.Background(), logger, &Config{})
+			if err != nil {
+				t.Errorf("Unexpected error: %v", err)
+				return
+			}
+			defer release()
+			mu.Lock()
+			running++
+			peak = max(peak, running)
+			mu.Unlock()
+			time.Sleep(5 * time.Millisecond)
+			mu.Lock()
+			running--
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	if peak != 2 {
+		t.Errorf("Expected at most 2 concurrent runs, got %d", peak)
+	}
+}
+
+func TestRunLimiterSetLimit(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	limiter := newRunLimiter(2)
+	first, _ := limiter.acquire(context.Background(), logger, &Config{})
+	second, _ := limiter.acquire(context.Background(), logger, &Config{})
+
+	// Lowering the limit while runs are in flight keeps counting them.
+	limiter.setLimit(1)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := limiter.acquire(ctx, logger, &Config{}); err == nil {
+		t.Error("Expected run to be queued after lowering the limit")
+	}
+	first()
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := limiter.acquire(ctx, logger, &Config{}); err == nil {
+		t.Error("Expected run to be queued while the lowered limit is reached")
+	}
+
+	// Raising the limit wakes up queued runs.
+	done := make(chan error)
+	go func() {
+		_, err := limiter.acquire(context.Background(), logger, &Config{})
+		done <- err
+	}()
+	time.Sleep(5 * time.Millisecond)
+	limiter.setLimit(2)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Unexpected error: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Error("Expected queued run to be permitted after raising the limit")
+	}
+	second()
+}
+
+func TestRunLimitedDeadline(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	limiter := newRunLimiter(1)
+	release, err := limiter.acquire(context.Background(), logger, &Config{})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer release()
+
+	c := &command{ctx: context.Background(), logger: logger}
+	if err := c.runLimited(limiter, &Config{}, time.Now().Add(10*time.Millisecond)); err != nil {
+		t.Errorf("Expected queued run to be skipped once its deadline passed, got %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	c.ctx = ctx
+	if err := c.runLimited(limiter, &Config{}, time.Now().Add(time.Hour)); err == nil {
+		t.Error("Expected error when cancelled while queued")
+	}
+}
+
+func TestWaitForJobs(t *testing.T) {
+	stopped, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := waitForJobs(stopped, time.Hour); err != nil {
+		t.Errorf("Expected no error for finished jobs, got %v", err)
+	}
+
+	running, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	err := waitForJobs(running, 10*time.Millisecond)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected deadline to be exceeded, got %v", err)
+	}
+}
+
+func TestCronSpec(t *testing.T) {
+	var tz TimeZone
+	if err := tz.Decode("Mars/Olympus_Mons"); err == nil {
+		t.Error("Expected error decoding unknown time zone")
+	}
+	if err := tz.Decode("Europe/Berlin"); err != nil {
+		t.Fatalf("Unexpected error decoding time zone: %v", err)
+	}
+
+	c := &Config{BackupCronTimezone: tz}
+	tests := map[string]string{
+		"0 2 * * *":                    "CRON_TZ=Europe/Berlin 0 2 * * *",
+		"@daily":                       "CRON_TZ=Europe/Berlin @daily",
+		"CRON_TZ=Asia/Tokyo 0 2 * * *": "CRON_TZ=Asia/Tokyo 0 2 * * *",
+	}
+	for expression, expected := range tests {
+		spec := c.cronSpec(expression)
+		if spec != expected {
+			t.Errorf("Expected %s, got %s", expected, spec)
+		}
+		if !checkCronSchedule(spec) {
+			t.Errorf("Expected %s to be scheduled", spec)
+		}
+	}
+	if checkCronSchedule(c.cronSpec("0 0 5 31 2 ?")) {
+		t.Error("Expected expression to never run")
+	}
+
+	sched, err := cron.ParseStandard(c.cronSpec("0 2 * * *"))
+	if err != nil {
+		t.Fatalf("Unexpected error parsing spec: %v", err)
+	}
+	next := sched.Next(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	if expected := time.Date(2024, 1, 1, 1, 0, 0, 0, time.UTC); !next.Equal(expected) {
+		t.Errorf("Expected next run at %v, got %v", expected, next)
+	}
+
+	if spec := (&Config{}).cronSpec("@daily"); spec != "@daily" {
+		t.Errorf("Expected expression to be unchanged without time zone, got %s", spec)
+	}
+}
+
+func TestWaitJitter(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	c := &command{ctx: ctx, logger: slog.New(slog.NewTextHandler(io.Discard, nil))}
+
+	if err := c.waitJitter(&Config{}); err != nil {
+		t.Errorf("Unexpected error without jitter: %v", err)
+	}
+
+	start := time.Now()
+	if err := c.waitJitter(&Config{BackupCronJitter: 20 * time.Millisecond}); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected delay of at most the jitter, took %s", elapsed)
+	}
+
+	cancel()
+	if err := c.waitJitter(&Config{BackupCronJitter: time.Hour}); err == nil {
+		t.Error("Expected error when cancelled")
+	}
+}
+
+func TestScheduleReload(t *testing.T) {
+	c := &command{
+		ctx:    context.Background(),
+		cr:     cron.New(),
+		logger: slog.New(slog.NewTextHandler(io.Discard, nil)),
+	}
+
+	t.Setenv("BACKUP_CRON_EXPRESSION", "0 2 * * *")
+	for i := 0; i < 2; i++ {
+		if err := c.schedule(configStrategyEnv); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if n := len(c.cr.Entries()); n != 1 {
+			t.Errorf("Expected a single cron entry after scheduling %d time(s), got %d", i+1, n)
+		}
+	}
+
+	previous := c.schedules
+	limiter := c.limiter
+	t.Setenv("BACKUP_CRON_EXPRESSION", "0 3 * * *")
+	t.Setenv("BACKUP_PRUNE_PREVIEW_CRON_EXPRESSION", "0 4 * * *")
+	t.Setenv("MAX_CONCURRENT_RUNS", "3")
+	if err := c.schedule(configStrategyEnv); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if c.limiter != limiter {
+		t.Error("Expected limiter to be kept across reloads")
+	}
+	if c.limiter.limit != 3 {
+		t.Errorf("Expected limit to be updated to 3, got %d", c.limiter.limit)
+	}
+	for id := range previous {
+		if entry := c.cr.Entry(id); entry.Valid() {
+			t.Errorf("Expected previous cron entry %d to be removed", id)
+		}
+		if _, ok := c.schedules[id]; ok {
+			t.Errorf("Expected previous cron entry %d to not be tracked anymore", id)
+		}
+	}
+	if n := len(c.cr.Entries()); n != 2 {
+		t.Errorf("Expected two cron entries after reloading, got %d", n)
+	}
+	if len(c.schedules) != 2 {
+		t.Errorf("Expected two schedules after reloading, got %v", c.schedules)
+	}
+	for _, entry := range c.cr.Entries() {
+		if _, ok := c.schedules[entry.ID]; !ok {
+			t.Errorf("Expected cron entry %d to be tracked", entry.ID)
+		}
+	}
+
+	// The backup itself can be scheduled, but the task cannot, in which case
+	// the existing schedules are kept.
+	previous = c.schedules
+	t.Setenv("BACKUP_CRON_EXPRESSION", "0 5 * * *")
+	t.Setenv("BACKUP_VERIFY_CRON_EXPRESSION", "0 25 * * *")
+	if err := c.schedule(configStrategyEnv); err == nil || !strings.Contains(err.Error(), "error adding restore verification schedule") {
+		t.Fatalf("Expected error for invalid cron expression, got %v", err)
+	}
+	if !maps.Equal(c.schedules, previous) {
+		t.Errorf("Expected schedules to be kept, got %v", c.schedules)
+	}
+	if n := len(c.cr.Entries()); n != 2 {
+		t.Errorf("Expected previous cron entries to be kept, got %d", n)
+	}
+	for id := range previous {
+		if entry := c.cr.Entry(id); !entry.Valid() {
+			t.Errorf("Expected previous cron entry %d to be kept", id)
+		}
+	}
+	if c.limiter.limit != 3 {
+		t.Errorf("Expected limit to be kept, got %d", c.limiter.limit)
+	}
+}
+
+func TestExitCode(t *testing.T) {
+	partial := errwrap.Wrap(&partialFailureError{err: errors.New("upload failed")}, "error running script")
+	tests := []struct {
+		name     string
+		err      error
+		expected int
+	}{
+		{"failure", errors.New("error"), 1},
+		{"partial failure", partial, 2},
+		{"partial failures", errors.Join(partial, partial), 2},
+		{"partial failure followed by hook error", errwrap.Wrap(partial, "error calling the registered hooks"), 2},
+		{"mixed failures", errors.Join(partial, errors.New("error")), 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if code := exitCode(test.err); code != test.expected {
+				t.Errorf("Expected exit code %d, got %d", test.expected, code)
+			}
+		})
+	}
+}
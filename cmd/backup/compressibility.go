@@ -0,0 +1,114 @@
+// Copyright 2024 - offen.software <hioffen@posteo.de>
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// compressibilitySampleSize is the number of bytes read from the
+	// beginning of a file for estimating how well its contents compress.
+	compressibilitySampleSize = 64 << 10
+	// compressibilitySampleBudget is the total number of bytes sampled per
+	// archive. Files without a known extension that are encountered after the
+	// budget is exhausted are considered to be compressible.
+	compressibilitySampleBudget = 64 << 20
+	// incompressibleRatio is the compression ratio above which a sample is
+	// considered to be incompressible.
+	incompressibleRatio = 0.9
+	// incompressibleShare is the share of incompressible bytes above which
+	// compressing the archive is considered to be a waste.
+	incompressibleShare = 0.9
+)
+
+// compressedExtensions contains the extensions of file formats that are
+// compressed already.
+var compressedExtensions = map[string]bool{
+	".gz": true, ".tgz": true, ".zst": true, ".xz": true, ".bz2": true,
+	".lz4": true, ".br": true, ".zip": true, ".7z": true, ".rar": true,
+	".gpg": true, ".age": true, ".jpg": true, ".jpeg": true, ".png": true,
+	".gif": true, ".webp": true, ".avif": true, ".heic": true, ".mp3": true,
+	".ogg": true, ".flac": true, ".aac": true, ".mp4": true, ".mkv": true,
+	".mov": true, ".webm": true, ".docx": true, ".xlsx": true, ".pptx": true,
+}
+
+// compressibilityEstimator estimates whether the files added to an archive
+// are mostly incompressible, judging from their extensions and from
+// compressing samples of their contents.
+type compressibilityEstimator struct {
+	totalBytes          int64
+	incompressibleBytes int64
+	sampledBytes        int64
+}
+
+// add accounts for the regular file at the given location.
+func (e *compressibilityEstimator) add(path string, di fs.DirEntry) error {
+	info, err := di.Info()
+	if err != nil {
+		return err
+	}
+	size := info.Size()
+	e.totalBytes += size
+
+	if compressedExtensions[strings.ToLower(filepath.Ext(path))] {
+		e.incompressibleBytes += size
+		return nil
+	}
+	if size == 0 || e.sampledBytes >= compressibilitySampleBudget {
+		return nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	sample, err := io.ReadAll(io.LimitReader(f, compressibilitySampleSize))
+	if err != nil {
+		return err
+	}
+	e.sampledBytes += int64(len(sample))
+
+	incompressible, err := isIncompressible(sample)
+	if err != nil {
+		return err
+	}
+	if incompressible {
+		e.incompressibleBytes += size
+	}
+	return nil
+}
+
+// mostlyIncompressible returns true if the share of incompressible bytes
+// exceeds incompressibleShare.
+func (e *compressibilityEstimator) mostlyIncompressible() bool {
+	if e.totalBytes == 0 {
+		return false
+	}
+	return float64(e.incompressibleBytes)/float64(e.totalBytes) >= incompressibleShare
+}
+
+// isIncompressible compresses the given sample and checks whether the
+// compressed size exceeds incompressibleRatio of the original size.
+func isIncompressible(sample []byte) (bool, error) {
+	var buf bytes.Buffer
+	w, err := flate.NewWriter(&buf, flate.BestSpeed)
+	if err != nil {
+		return false, err
+	}
+	if _, err := w.Write(sample); err != nil {
+		return false, err
+	}
+	if err := w.Close(); err != nil {
+		return false, err
+	}
+	return float64(buf.Len())/float64(len(sample)) >= incompressibleRatio, nil
+}
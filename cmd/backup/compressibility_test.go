@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCompressibilityEstimator(t *testing.T) {
+	random := make([]byte, 128<<10)
+	if _, err := rand.Read(random); err != nil {
+		t.Fatalf("Unexpected error generating random data: %v", err)
+	}
+	text := bytes.Repeat([]byte("lorem ipsum dolor sit amet "), 1<<12)
+
+	tests := []struct {
+		name     string
+		files    map[string][]byte
+		expected bool
+	}{
+		{"empty", map[string][]byte{}, false},
+		{"text", map[string][]byte{"a.txt": text, "b.log": text}, false},
+		{"random contents", map[string][]byte{"a.bin": random, "b.txt": []byte("x")}, true},
+		{"compressed extension", map[string][]byte{"a.jpg": text}, true},
+		{"mixed", map[string][]byte{"a.bin": random, "b.txt": text}, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			for name, content := range test.files {
+				if err := os.WriteFile(filepath.Join(dir, name), content, 0644); err != nil {
+					t.Fatalf("Unexpected error writing file: %v", err)
+				}
+			}
+
+			e := &compressibilityEstimator{}
+			if err := filepath.WalkDir(dir, func(path string, di fs.DirEntry, err error) error {
+				if err != nil || !di.Type().IsRegular() {
+					return err
+				}
+				return e.add(path, di)
+			}); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			if result := e.mostlyIncompressible(); result != test.expected {
+				t.Errorf("Expected %v, got %v", test.expected, result)
+			}
+		})
+	}
+}
@@ -4,94 +4,235 @@
 package main
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/sha512"
 	"crypto/x509"
 	"encoding/pem"
 	"fmt"
+	"hash"
 	"os"
 	"regexp"
 	"strconv"
+	"strings"
 	"time"
 
+	openpgp "github.com/ProtonMail/go-crypto/openpgp/v2"
+	"github.com/docker/go-units"
 	"github.com/offen/docker-volume-backup/internal/errwrap"
+	"golang.org/x/crypto/blake2b"
 )
 
 // Config holds all configuration values that are expected to be set
 // by users.
 type Config struct {
-	AwsS3BucketName               string          `split_words:"true"`
-	AwsS3Path                     string          `split_words:"true"`
-	AwsEndpoint                   string          `split_words:"true" default:"s3.amazonaws.com"`
-	AwsEndpointProto              string          `split_words:"true" default:"https"`
-	AwsEndpointInsecure           bool            `split_words:"true"`
-	AwsEndpointCACert             CertDecoder     `envconfig:"AWS_ENDPOINT_CA_CERT"`
-	AwsStorageClass               string          `split_words:"true"`
-	AwsAccessKeyID                string          `envconfig:"AWS_ACCESS_KEY_ID"`
-	AwsSecretAccessKey            string          `split_words:"true"`
-	AwsIamRoleEndpoint            string          `split_words:"true"`
-	AwsPartSize                   int64           `split_words:"true"`
-	BackupCompression             CompressionType `split_words:"true" default:"gz"`
-	GzipParallelism               WholeNumber     `split_words:"true" default:"1"`
-	BackupSources                 string          `split_words:"true" default:"/backup"`
-	BackupFilename                string          `split_words:"true" default:"backup-%Y-%m-%dT%H-%M-%S.{{ .Extension }}"`
-	BackupFilenameExpand          bool            `split_words:"true"`
-	BackupLatestSymlink           string          `split_words:"true"`
-	BackupArchive                 string          `split_words:"true" default:"/archive"`
-	BackupCronExpression          string          `split_words:"true" default:"@daily"`
-	BackupRetentionDays           int32           `split_words:"true" default:"-1"`
-	BackupPruningLeeway           time.Duration   `split_words:"true" default:"1m"`
-	BackupPruningPrefix           string          `split_words:"true"`
-	BackupStopContainerLabel      string          `split_words:"true"`
-	BackupStopDuringBackupLabel   string          `split_words:"true" default:"true"`
-	BackupStopServiceTimeout      time.Duration   `split_words:"true" default:"5m"`
-	BackupFromSnapshot            bool            `split_words:"true"`
-	BackupExcludeRegexp           RegexpDecoder   `split_words:"true"`
-	BackupSkipBackendsFromPrune   []string        `split_words:"true"`
-	GpgPassphrase                 string          `split_words:"true"`
-	NotificationURLs              []string        `envconfig:"NOTIFICATION_URLS"`
-	NotificationLevel             string          `split_words:"true" default:"error"`
-	EmailNotificationRecipient    string          `split_words:"true"`
-	EmailNotificationSender       string          `split_words:"true" default:"noreply@nohost"`
-	EmailSMTPHost                 string          `envconfig:"EMAIL_SMTP_HOST"`
-	EmailSMTPPort                 int             `envconfig:"EMAIL_SMTP_PORT" default:"587"`
-	EmailSMTPUsername             string          `envconfig:"EMAIL_SMTP_USERNAME"`
-	EmailSMTPPassword             string          `envconfig:"EMAIL_SMTP_PASSWORD"`
-	WebdavUrl                     string          `split_words:"true"`
-	WebdavUrlInsecure             bool            `split_words:"true"`
-	WebdavPath                    string          `split_words:"true" default:"/"`
-	WebdavUsername                string          `split_words:"true"`
-	WebdavPassword                string          `split_words:"true"`
-	SSHHostName                   string          `split_words:"true"`
-	SSHPort                       string          `split_words:"true" default:"22"`
-	SSHUser                       string          `split_words:"true"`
-	SSHPassword                   string          `split_words:"true"`
-	SSHIdentityFile               string          `split_words:"true" default:"/root/.ssh/id_rsa"`
-	SSHIdentityPassphrase         string          `split_words:"true"`
-	SSHRemotePath                 string          `split_words:"true"`
-	ExecLabel                     string          `split_words:"true"`
-	ExecForwardOutput             bool            `split_words:"true"`
-	LockTimeout                   time.Duration   `split_words:"true" default:"60m"`
-	AzureStorageAccountName       string          `split_words:"true"`
-	AzureStoragePrimaryAccountKey string          `split_words:"true"`
-	AzureStorageConnectionString  string          `split_words:"true"`
-	AzureStorageContainerName     string          `split_words:"true"`
-	AzureStoragePath              string          `split_words:"true"`
-	AzureStorageEndpoint          string          `split_words:"true" default:"https://{{ .AccountName }}.blob.core.windows.net/"`
-	DropboxEndpoint               string          `split_words:"true" default:"https://api.dropbox.com/"`
-	DropboxOAuth2Endpoint         string          `envconfig:"DROPBOX_OAUTH2_ENDPOINT" default:"https://api.dropbox.com/"`
-	DropboxRefreshToken           string          `split_words:"true"`
-	DropboxAppKey                 string          `split_words:"true"`
-	DropboxAppSecret              string          `split_words:"true"`
-	DropboxRemotePath             string          `split_words:"true"`
-	DropboxConcurrencyLevel       NaturalNumber   `split_words:"true" default:"6"`
-	source                        string
-	additionalEnvVars             map[string]string
+	AwsS3BucketName                     string            `split_words:"true"`
+	AwsS3Path                           string            `split_words:"true"`
+	AwsEndpoint                         string            `split_words:"true" default:"s3.amazonaws.com"`
+	AwsEndpointProto                    string            `split_words:"true" default:"https"`
+	AwsEndpointInsecure                 bool              `split_words:"true"`
+	AwsEndpointCACert                   CertDecoder       `envconfig:"AWS_ENDPOINT_CA_CERT"`
+	AwsStorageClass                     StorageClass      `split_words:"true"`
+	AwsAccessKeyID                      string            `envconfig:"AWS_ACCESS_KEY_ID"`
+	AwsSecretAccessKey                  string            `split_words:"true"`
+	AwsIamRoleEndpoint                  string            `split_words:"true"`
+	AwsPartSize                         int64             `split_words:"true"`
+	AwsUploadConcurrency                WholeNumber       `split_words:"true" default:"4"`
+	AwsSse                              string            `envconfig:"AWS_SSE"`
+	AwsSseKmsKeyID                      string            `envconfig:"AWS_SSE_KMS_KEY_ID"`
+	AwsListRetries                      WholeNumber       `split_words:"true" default:"3"`
+	AwsListRetryDelay                   time.Duration     `split_words:"true" default:"5s"`
+	BackupCompression                   CompressionType   `split_words:"true" default:"gz"`
+	BackupCompressionOverrides          map[string]string `split_words:"true"`
+	BackupSplitSize                     ByteSize          `split_words:"true"`
+	BackupStream                        bool              `split_words:"true"`
+	BackupChecksumAlgorithm             ChecksumAlgorithm `split_words:"true"`
+	BackupCompressionLevel              CompressionLevel  `split_words:"true"`
+	GzipParallelism                     WholeNumber       `split_words:"true" default:"1"`
+	BackupCompressionMemoryLimit        ByteSize          `split_words:"true"`
+	BackupAutoCompression               bool              `split_words:"true"`
+	BackupOneFileSystem                 bool              `split_words:"true"`
+	BackupConsistencyCheck              string            `split_words:"true"`
+	BackupConsistencyCheckSample        WholeNumber       `split_words:"true" default:"0"`
+	BackupArchiveBufferSize             ByteSize          `split_words:"true" default:"1M"`
+	BackupSources                       string            `split_words:"true" default:"/backup"`
+	BackupSplitByTopLevelDir            bool              `split_words:"true"`
+	BackupSplitConcurrency              NaturalNumber     `split_words:"true" default:"1"`
+	BackupFilename                      string            `split_words:"true" default:"backup-%Y-%m-%dT%H-%M-%S.{{ .Extension }}"`
+	BackupFilenameExpand                bool              `split_words:"true"`
+	ConfigExpandEnv                     bool              `split_words:"true"`
+	ConfigStrict                        bool              `split_words:"true"`
+	BackupFilenameOverrides             map[string]string `split_words:"true"`
+	BackupLatestSymlink                 string            `split_words:"true"`
+	BackupLatestCopyBackends            []string          `split_words:"true"`
+	BackupLatestPointerBackends         []string          `split_words:"true"`
+	BackupArchive                       string            `split_words:"true" default:"/archive"`
+	BackupCronExpression                string            `split_words:"true" default:"@daily"`
+	BackupCronTimezone                  TimeZone          `split_words:"true"`
+	BackupCronJitter                    time.Duration     `split_words:"true"`
+	BackupRunRetries                    WholeNumber       `split_words:"true" default:"0"`
+	BackupRunRetryDelay                 time.Duration     `split_words:"true" default:"1m"`
+	BackupUploadRetries                 WholeNumber       `split_words:"true" default:"0"`
+	BackupUploadRetryDelay              time.Duration     `split_words:"true" default:"5s"`
+	BackupParallelUploads               WholeNumber       `split_words:"true" default:"0"`
+	BackupUploadFailFast                bool              `split_words:"true"`
+	BackupContinueOnError               bool              `split_words:"true"`
+	BackupStorageTimeout                time.Duration     `split_words:"true"`
+	BackupStorageTimeoutOverrides       map[string]string `split_words:"true"`
+	BackupShutdownGracePeriod           time.Duration     `split_words:"true" default:"5m"`
+	BackupRetentionDays                 int32             `split_words:"true" default:"-1"`
+	BackupRetentionDaysOverrides        map[string]int    `split_words:"true"`
+	BackupRetentionGfsDaily             WholeNumber       `split_words:"true"`
+	BackupRetentionGfsWeekly            WholeNumber       `split_words:"true"`
+	BackupRetentionGfsMonthly           WholeNumber       `split_words:"true"`
+	BackupRetentionGfsYearly            WholeNumber       `split_words:"true"`
+	BackupPruningLeeway                 time.Duration     `split_words:"true" default:"1m"`
+	BackupPruningPrefix                 string            `split_words:"true"`
+	BackupPruningPrefixOverrides        map[string]string `split_words:"true"`
+	BackupKeyLowercase                  bool              `split_words:"true"`
+	BackupKeySeparator                  string            `split_words:"true"`
+	BackupPrunePreviewCronExpression    string            `split_words:"true"`
+	BackupPruneDryRun                   bool              `split_words:"true"`
+	BackupPruneMaxPercent               WholeNumber       `split_words:"true" default:"50"`
+	BackupImmutableFor                  time.Duration     `split_words:"true"`
+	BackupPreconditionCommand           string            `split_words:"true"`
+	BackupPreflight                     bool              `split_words:"true"`
+	BackupPreScript                     string            `split_words:"true"`
+	BackupPostScript                    string            `split_words:"true"`
+	BackupStopContainerLabel            string            `split_words:"true"`
+	BackupStopDuringBackupLabel         string            `split_words:"true" default:"true"`
+	BackupStopServiceTimeout            time.Duration     `split_words:"true" default:"5m"`
+	BackupStopComposeProject            string            `split_words:"true"`
+	BackupStopAction                    StopAction        `split_words:"true" default:"stop"`
+	BackupStopPriorityLabel             string            `split_words:"true" default:"docker-volume-backup.stop-priority"`
+	BackupFromSnapshot                  bool              `split_words:"true"`
+	BackupExcludeRegexp                 RegexpDecoder     `split_words:"true"`
+	BackupExclude                       PatternList       `split_words:"true"`
+	BackupExcludeMode                   string            `split_words:"true" default:"regexp"`
+	BackupSelfExclusions                []string          `split_words:"true"`
+	BackupBlockDevices                  []string          `split_words:"true"`
+	BackupChangedSinceMarker            string            `split_words:"true"`
+	BackupFullBackupInterval            time.Duration     `split_words:"true"`
+	BackupExcludeLargerThan             ByteSize          `split_words:"true"`
+	BackupExcludeSmallerThan            ByteSize          `split_words:"true"`
+	BackupExternalSymlinks              string            `split_words:"true" default:"keep"`
+	BackupVolumeMetadata                bool              `split_words:"true"`
+	BackupSkipBackendsFromPrune         []string          `split_words:"true"`
+	BackupMirrorBackends                []string          `split_words:"true"`
+	BackupConfirmUpload                 bool              `split_words:"true"`
+	BackupVerifyUpload                  bool              `split_words:"true"`
+	BackupStateFile                     string            `split_words:"true"`
+	BackupCheckpointDir                 string            `split_words:"true"`
+	BackupCheckpointMaxAge              time.Duration     `split_words:"true"`
+	BackupCheckpointMaxResumes          WholeNumber       `split_words:"true" default:"3"`
+	BackupVerifyCommand                 string            `split_words:"true"`
+	BackupVerifyCronExpression          string            `split_words:"true"`
+	GpgPassphrase                       string            `split_words:"true"`
+	GpgPublicKeyRing                    KeyRingDecoder    `split_words:"true"`
+	GpgKmsProvider                      string            `split_words:"true"`
+	GpgKmsKeyID                         string            `envconfig:"GPG_KMS_KEY_ID"`
+	GpgKmsRegion                        string            `split_words:"true"`
+	GpgKmsEndpoint                      string            `split_words:"true"`
+	GpgVerifyCronExpression             string            `split_words:"true"`
+	NotificationURLs                    []string          `envconfig:"NOTIFICATION_URLS"`
+	NotificationConfigFile              string            `split_words:"true"`
+	NotificationLevel                   string            `split_words:"true" default:"error"`
+	NotificationNotifyStart             bool              `split_words:"true"`
+	NotificationLogTailLines            WholeNumber       `split_words:"true" default:"0"`
+	NotificationHeartbeatCronExpression string            `split_words:"true"`
+	NotificationHealthcheckURL          string            `envconfig:"NOTIFICATION_HEALTHCHECK_URL"`
+	EmailNotificationRecipient          string            `split_words:"true"`
+	EmailNotificationSender             string            `split_words:"true" default:"noreply@nohost"`
+	EmailSMTPHost                       string            `envconfig:"EMAIL_SMTP_HOST"`
+	EmailSMTPPort                       int               `envconfig:"EMAIL_SMTP_PORT" default:"587"`
+	EmailSMTPUsername                   string            `envconfig:"EMAIL_SMTP_USERNAME"`
+	EmailSMTPPassword                   string            `envconfig:"EMAIL_SMTP_PASSWORD"`
+	WebdavUrl                           string            `split_words:"true"`
+	WebdavUrlInsecure                   bool              `split_words:"true"`
+	WebdavPath                          string            `split_words:"true" default:"/"`
+	WebdavUsername                      string            `split_words:"true"`
+	WebdavPassword                      string            `split_words:"true"`
+	WebdavChunked                       bool              `split_words:"true"`
+	WebdavChunkSize                     ByteSize          `split_words:"true" default:"100M"`
+	SSHHostName                         string            `split_words:"true"`
+	SSHPort                             string            `split_words:"true" default:"22"`
+	SSHUser                             string            `split_words:"true"`
+	SSHPassword                         string            `split_words:"true"`
+	SSHIdentityFile                     string            `split_words:"true" default:"/root/.ssh/id_rsa"`
+	SSHIdentityPassphrase               string            `split_words:"true"`
+	SSHAuthSock                         string            `envconfig:"SSH_AUTH_SOCK"`
+	SSHKnownHosts                       string            `split_words:"true"`
+	SSHRemotePath                       string            `split_words:"true"`
+	RsyncHostName                       string            `split_words:"true"`
+	RsyncPort                           string            `split_words:"true" default:"22"`
+	RsyncUser                           string            `split_words:"true"`
+	RsyncIdentityFile                   string            `split_words:"true" default:"/root/.ssh/id_rsa"`
+	RsyncRemotePath                     string            `split_words:"true"`
+	RsyncKnownHosts                     string            `split_words:"true"`
+	RsyncSkipHostKeyCheck               bool              `split_words:"true"`
+	ResticRepository                    string            `split_words:"true"`
+	ResticPassword                      string            `split_words:"true"`
+	SmbHostName                         string            `split_words:"true"`
+	SmbPort                             string            `split_words:"true" default:"445"`
+	SmbShare                            string            `split_words:"true"`
+	SmbUsername                         string            `split_words:"true"`
+	SmbPassword                         string            `split_words:"true"`
+	SmbDomain                           string            `split_words:"true"`
+	SmbRemotePath                       string            `split_words:"true"`
+	ExecLabel                           string            `split_words:"true"`
+	ExecForwardOutput                   bool              `split_words:"true"`
+	LockTimeout                         time.Duration     `split_words:"true" default:"60m"`
+	MaxConcurrentRuns                   WholeNumber       `split_words:"true" default:"1"`
+	AzureStorageAccountName             string            `split_words:"true"`
+	AzureStoragePrimaryAccountKey       string            `split_words:"true"`
+	AzureStorageConnectionString        string            `split_words:"true"`
+	AzureStorageContainerName           string            `split_words:"true"`
+	AzureStoragePath                    string            `split_words:"true"`
+	AzureStorageEndpoint                string            `split_words:"true" default:"https://{{ .AccountName }}.blob.core.windows.net/"`
+	DropboxEndpoint                     string            `split_words:"true" default:"https://api.dropbox.com/"`
+	DropboxOAuth2Endpoint               string            `envconfig:"DROPBOX_OAUTH2_ENDPOINT" default:"https://api.dropbox.com/"`
+	DropboxRefreshToken                 string            `split_words:"true"`
+	DropboxAppKey                       string            `split_words:"true"`
+	DropboxAppSecret                    string            `split_words:"true"`
+	DropboxRemotePath                   string            `split_words:"true"`
+	DropboxConcurrencyLevel             NaturalNumber     `split_words:"true" default:"6"`
+	DropboxRateLimitRetries             WholeNumber       `split_words:"true" default:"5"`
+	GcsBucketName                       string            `envconfig:"GCS_BUCKET_NAME"`
+	GcsPath                             string            `envconfig:"GCS_PATH"`
+	GcsCredentials                      string            `envconfig:"GCS_CREDENTIALS"`
+	GcsImpersonateServiceAccount        string            `envconfig:"GCS_IMPERSONATE_SERVICE_ACCOUNT"`
+	GcsKmsKeyName                       string            `envconfig:"GCS_KMS_KEY_NAME"`
+	GcsEndpoint                         string            `envconfig:"GCS_ENDPOINT" default:"https://storage.googleapis.com/"`
+	B2ApplicationKeyID                  string            `envconfig:"B2_APPLICATION_KEY_ID"`
+	B2ApplicationKey                    string            `envconfig:"B2_APPLICATION_KEY"`
+	B2BucketName                        string            `envconfig:"B2_BUCKET_NAME"`
+	B2Path                              string            `envconfig:"B2_PATH"`
+	B2Endpoint                          string            `envconfig:"B2_ENDPOINT" default:"https://api.backblazeb2.com/"`
+	B2LargeFileThreshold                ByteSize          `envconfig:"B2_LARGE_FILE_THRESHOLD" default:"200M"`
+	B2PartSize                          ByteSize          `envconfig:"B2_PART_SIZE" default:"100M"`
+	StorageUserAgent                    string            `split_words:"true"`
+	OtelExporterOtlpEndpoint            string            `split_words:"true"`
+	OtelServiceName                     string            `split_words:"true" default:"docker-volume-backup"`
+	MetricsPushgatewayURL               string            `envconfig:"METRICS_PUSHGATEWAY_URL"`
+	MetricsPushgatewayJob               string            `split_words:"true" default:"docker-volume-backup"`
+	MetricsPushgatewayGrouping          map[string]string `split_words:"true"`
+	ControlSocket                       string            `split_words:"true"`
+	source                              string
+	additionalEnvVars                   map[string]string
+	// containersStopped is set for configurations derived using
+	// BACKUP_SPLIT_BY_TOP_LEVEL_DIR, whose containers are stopped once for
+	// all derived configurations.
+	containersStopped bool
+	// skipTopLevelDirs restricts the archive to the files located directly
+	// in the backup sources.
+	skipTopLevelDirs bool
 }
 
 type CompressionType string
 
 func (c *CompressionType) Decode(v string) error {
 	switch v {
-	case "gz", "zst":
+	case "gz", "zst", "xz", "none":
 		*c = CompressionType(v)
 		return nil
 	default:
@@ -103,6 +244,113 @@ func (c *CompressionType) String() string {
 	return string(*c)
 }
 
+// Extension returns the file extension used for archives using
+// the compression type.
+func (c *CompressionType) Extension() string {
+	if *c == "none" {
+		return "tar"
+	}
+	return fmt.Sprintf("tar.%s", *c)
+}
+
+// ChecksumAlgorithm is a type that can be used to decode the algorithm used
+// for calculating the checksum of backups. An empty value disables checksums.
+type ChecksumAlgorithm string
+
+func (c *ChecksumAlgorithm) Decode(v string) error {
+	switch v {
+	case "", "sha256", "sha512", "blake2b":
+		*c = ChecksumAlgorithm(v)
+		return nil
+	default:
+		return errwrap.Wrap(nil, fmt.Sprintf("error decoding checksum algorithm %s, expected one of sha256, sha512 or blake2b", v))
+	}
+}
+
+// New returns a new hash using the algorithm.
+func (c ChecksumAlgorithm) New() (hash.Hash, error) {
+	switch c {
+	case "sha256":
+		return sha256.New(), nil
+	case "sha512":
+		return sha512.New(), nil
+	case "blake2b":
+		return blake2b.New512(nil)
+	default:
+		return nil, errwrap.Wrap(nil, fmt.Sprintf("unknown checksum algorithm %s", c))
+	}
+}
+
+// Suffix returns the suffix of files containing checksums calculated using
+// the algorithm.
+func (c ChecksumAlgorithm) Suffix() string {
+	return "." + string(c)
+}
+
+// StopAction is a type that can be used to decode how containers are
+// prevented from writing to volumes during backup.
+type StopAction string
+
+func (a *StopAction) Decode(v string) error {
+	switch v {
+	case "stop", "pause":
+		*a = StopAction(v)
+		return nil
+	default:
+		return errwrap.Wrap(nil, fmt.Sprintf("error decoding stop action %s, expected one of stop or pause", v))
+	}
+}
+
+// StorageClass is a type that can be used to decode the storage class
+// objects are uploaded to S3 with.
+type StorageClass string
+
+func (c *StorageClass) Decode(v string) error {
+	switch v {
+	case "", "STANDARD", "REDUCED_REDUNDANCY", "STANDARD_IA", "ONEZONE_IA", "INTELLIGENT_TIERING",
+		"GLACIER", "GLACIER_IR", "DEEP_ARCHIVE", "OUTPOSTS", "EXPRESS_ONEZONE":
+		*c = StorageClass(v)
+		return nil
+	default:
+		return errwrap.Wrap(nil, fmt.Sprintf("error decoding storage class %s, expected one of STANDARD, REDUCED_REDUNDANCY, STANDARD_IA, ONEZONE_IA, INTELLIGENT_TIERING, GLACIER, GLACIER_IR, DEEP_ARCHIVE, OUTPOSTS or EXPRESS_ONEZONE", v))
+	}
+}
+
+// Archived returns whether objects stored using the storage class need to
+// be restored before they can be read.
+func (c StorageClass) Archived() bool {
+	return c == "GLACIER" || c == "DEEP_ARCHIVE"
+}
+
+// CompressionLevel is a type that can be used to decode the level used for
+// compressing archives. It is either one of the named presets `fastest`,
+// `default`, `better` and `best` or a numeric level. Numeric levels are
+// interpreted by the compressor in use, so their valid range depends on the
+// compression type.
+type CompressionLevel string
+
+func (c *CompressionLevel) Decode(v string) error {
+	v = strings.ToLower(strings.TrimSpace(v))
+	switch v {
+	case "", "fastest", "default", "better", "best":
+		*c = CompressionLevel(v)
+		return nil
+	}
+	level, err := strconv.Atoi(v)
+	if err != nil || level < 1 || level > 22 {
+		return errwrap.Wrap(
+			nil,
+			fmt.Sprintf("error decoding compression level %s, expected one of fastest, default, better, best or a number between 1 and 22", v),
+		)
+	}
+	*c = CompressionLevel(v)
+	return nil
+}
+
+func (c *CompressionLevel) String() string {
+	return string(*c)
+}
+
 type CertDecoder struct {
 	Cert *x509.Certificate
 }
@@ -124,6 +372,58 @@ func (c *CertDecoder) Decode(v string) error {
 	return nil
 }
 
+// TimeZone is a type that can be used to decode the name of a time zone in
+// the IANA time zone database, e.g. `Europe/Berlin`.
+type TimeZone string
+
+func (t *TimeZone) Decode(v string) error {
+	if _, err := time.LoadLocation(v); err != nil {
+		return errwrap.Wrap(err, fmt.Sprintf("unknown time zone %s, expected a name like Europe/Berlin", v))
+	}
+	*t = TimeZone(v)
+	return nil
+}
+
+// cronSpec returns the given cron expression so that it is interpreted in the
+// configured time zone. Expressions that define a time zone on their own are
+// returned as is.
+func (c *Config) cronSpec(expression string) string {
+	if c.BackupCronTimezone == "" || strings.HasPrefix(expression, "TZ=") || strings.HasPrefix(expression, "CRON_TZ=") {
+		return expression
+	}
+	return fmt.Sprintf("CRON_TZ=%s %s", c.BackupCronTimezone, expression)
+}
+
+// KeyRingDecoder is a type that can be used to decode a PGP public key ring,
+// given either as the path of a file or as the armored key itself.
+type KeyRingDecoder struct {
+	Entities openpgp.EntityList
+}
+
+func (k *KeyRingDecoder) Decode(v string) error {
+	if v == "" {
+		return nil
+	}
+	content, err := os.ReadFile(v)
+	if err != nil {
+		content = []byte(v)
+	}
+	entities, err := openpgp.ReadArmoredKeyRing(bytes.NewReader(content))
+	if err != nil {
+		entities, err = openpgp.ReadKeyRing(bytes.NewReader(content))
+	}
+	if err != nil {
+		return errwrap.Wrap(err, "error parsing public key ring, expected an armored or binary PGP key or the path of a file containing it")
+	}
+	for _, entity := range entities {
+		if _, ok := entity.EncryptionKey(time.Now(), nil); !ok {
+			return errwrap.Wrap(nil, fmt.Sprintf("public key %X cannot be used for encryption, make sure it is not expired or revoked", entity.PrimaryKey.Fingerprint))
+		}
+	}
+	*k = KeyRingDecoder{Entities: entities}
+	return nil
+}
+
 type RegexpDecoder struct {
 	Re *regexp.Regexp
 }
@@ -140,6 +440,22 @@ func (r *RegexpDecoder) Decode(v string) error {
 	return nil
 }
 
+// PatternList is a type that can be used to decode a list of patterns
+// separated by newlines. Commas are not considered separators as they are
+// commonly used in regular expressions. Empty entries are ignored.
+type PatternList []string
+
+func (p *PatternList) Decode(v string) error {
+	var patterns PatternList
+	for _, pattern := range strings.Split(v, "\n") {
+		if pattern = strings.TrimSpace(pattern); pattern != "" {
+			patterns = append(patterns, pattern)
+		}
+	}
+	*p = patterns
+	return nil
+}
+
 // NaturalNumber is a type that can be used to decode a positive, non-zero natural number
 type NaturalNumber int
 
@@ -178,6 +494,26 @@ func (n *WholeNumber) Int() int {
 	return int(*n)
 }
 
+// ByteSize is a type that can be used to decode a human readable amount of
+// bytes like `512k`, `100M` or `5G`. Units are interpreted as binary multiples.
+type ByteSize int64
+
+func (b *ByteSize) Decode(v string) error {
+	size, err := units.RAMInBytes(v)
+	if err != nil {
+		return errwrap.Wrap(err, fmt.Sprintf("error decoding byte size %s", v))
+	}
+	if size < 0 {
+		return errwrap.Wrap(nil, fmt.Sprintf("expected a positive byte size, got %s", v))
+	}
+	*b = ByteSize(size)
+	return nil
+}
+
+func (b *ByteSize) Int64() int64 {
+	return int64(*b)
+}
+
 type envVarLookup struct {
 	ok    bool
 	key   string
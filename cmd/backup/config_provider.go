@@ -5,14 +5,21 @@ package main
 
 import (
 	"bufio"
+	"encoding"
 	"fmt"
 	"os"
 	"path/filepath"
+	"reflect"
+	"regexp"
+	"slices"
+	"strconv"
 	"strings"
 
+	"github.com/BurntSushi/toml"
 	"github.com/joho/godotenv"
 	"github.com/offen/docker-volume-backup/internal/errwrap"
 	"github.com/offen/envconfig"
+	"gopkg.in/yaml.v3"
 	shell "mvdan.cc/sh/v3/shell"
 )
 
@@ -24,39 +31,263 @@ const (
 )
 
 // sourceConfiguration returns a list of config objects using the given
-// strategy. It should be the single entrypoint for retrieving configuration
-// for all consumers.
-func sourceConfiguration(strategy configStrategy) ([]*Config, error) {
+// strategy. In case a config file is given, its values are used for all
+// keys that are not set in the environment. It should be the single
+// entrypoint for retrieving configuration for all consumers.
+func sourceConfiguration(strategy configStrategy, configFile string) ([]*Config, error) {
+	lookup := envProxy(os.LookupEnv)
+	var sources map[string]map[string]string
+	var fileValues map[string]string
+	if configFile != "" {
+		values, fileSources, err := loadConfigFile(configFile)
+		if err != nil {
+			return nil, errwrap.Wrap(err, fmt.Sprintf("error loading config file %s", configFile))
+		}
+		lookup = func(key string) (string, bool) {
+			if value, ok := os.LookupEnv(key); ok {
+				return value, ok
+			}
+			value, ok := values[key]
+			return value, ok
+		}
+		sources = fileSources
+		fileValues = values
+	}
+
+	var cs []*Config
+
 	switch strategy {
 	case configStrategyEnv:
-		c, err := loadConfigFromEnvVars()
-		return []*Config{c}, err
+		jobCs, err := loadConfigsFromEnvJobs(lookup)
+		if err != nil {
+			return nil, errwrap.Wrap(err, "error loading jobs from environment")
+		}
+		fileCs, err := loadNamedConfigs(withoutEnv(sources), lookup, "source")
+		if err != nil {
+			return nil, errwrap.Wrap(err, fmt.Sprintf("error loading sources from config file %s", configFile))
+		}
+		cs = append(jobCs, fileCs...)
+		if len(cs) == 0 {
+			c, err := loadConfigFromEnvVars(lookup)
+			if err != nil {
+				return nil, err
+			}
+			cs = []*Config{c}
+		}
 	case configStrategyConfd:
-		cs, err := loadConfigsFromEnvFiles("/etc/dockervolumebackup/conf.d")
+		var err error
+		cs, err = loadConfigsFromEnvFiles("/etc/dockervolumebackup/conf.d", lookup)
 		if err != nil {
 			if os.IsNotExist(err) {
-				return sourceConfiguration(configStrategyEnv)
+				return sourceConfiguration(configStrategyEnv, configFile)
 			}
 			return nil, errwrap.Wrap(err, "error loading config files")
 		}
-		return cs, nil
 	default:
 		return nil, errwrap.Wrap(nil, fmt.Sprintf("received unknown config strategy: %v", strategy))
 	}
+
+	for _, c := range cs {
+		if !c.ConfigStrict {
+			continue
+		}
+		if err := checkUnknownKeys(c, fileValues); err != nil {
+			return nil, errwrap.Wrap(err, fmt.Sprintf("error checking config %s", c.source))
+		}
+	}
+	return cs, nil
+}
+
+// withoutEnv returns the given named sets of values without the keys that are
+// set in the environment, as values set in the environment take precedence
+// over the ones given in a config file.
+func withoutEnv(named map[string]map[string]string) map[string]map[string]string {
+	if named == nil {
+		return nil
+	}
+	result := map[string]map[string]string{}
+	for name, values := range named {
+		result[name] = map[string]string{}
+		for key, value := range values {
+			if _, ok := os.LookupEnv(key); !ok {
+				result[name][key] = value
+			}
+		}
+	}
+	return result
+}
+
+// strictConfigPrefixes are the prefixes of variables that are checked for
+// being known when CONFIG_STRICT is set. Prefixes that are shared with
+// other tools, e.g. AWS_ or SSH_, are not checked, as their variables might
+// be set for other reasons.
+var strictConfigPrefixes = []string{
+	"B2_", "BACKUP_", "CONFIG_", "DROPBOX_", "EMAIL_", "EXEC_", "GCS_",
+	"GPG_", "METRICS_", "NOTIFICATION_", "RSYNC_", "SMB_", "WEBDAV_",
+}
+
+// knownConfigKeys returns the names of all variables that are read when
+// loading a config.
+func knownConfigKeys() map[string]bool {
+	known := map[string]bool{"CONFIG_FILE": true}
+	for _, key := range configKeys(reflect.TypeOf(Config{}), "") {
+		known[key] = true
+	}
+	return known
+}
+
+// gatherRegexp and acronymRegexp are used by envconfig for splitting field
+// names into words.
+var (
+	gatherRegexp  = regexp.MustCompile("([^A-Z]+|[A-Z]+[^A-Z]+|[A-Z]+)")
+	acronymRegexp = regexp.MustCompile("([A-Z]+)([A-Z][^A-Z]+)")
+)
+
+// configKeys derives the names of the variables envconfig reads for the
+// fields of the given struct type, using the same rules as envconfig does.
+// Fields of nested structs that cannot be decoded as a whole are read
+// using the name of the field as a prefix, unless they are embedded.
+func configKeys(t reflect.Type, prefix string) []string {
+	var keys []string
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() || isTrue(field.Tag.Get("ignored")) {
+			continue
+		}
+
+		key := field.Name
+		if isTrue(field.Tag.Get("split_words")) {
+			var words []string
+			for _, word := range gatherRegexp.FindAllString(field.Name, -1) {
+				if m := acronymRegexp.FindStringSubmatch(word); len(m) == 3 {
+					words = append(words, m[1], m[2])
+				} else {
+					words = append(words, word)
+				}
+			}
+			key = strings.Join(words, "_")
+		}
+		if alt := field.Tag.Get("envconfig"); alt != "" {
+			key = alt
+		}
+		if prefix != "" {
+			key = prefix + "_" + key
+		}
+		key = strings.ToUpper(key)
+
+		fieldType := field.Type
+		for fieldType.Kind() == reflect.Pointer {
+			fieldType = fieldType.Elem()
+		}
+		if fieldType.Kind() == reflect.Struct && !decodable(fieldType) {
+			innerPrefix := prefix
+			if !field.Anonymous {
+				innerPrefix = key
+			}
+			keys = append(keys, configKeys(fieldType, innerPrefix)...)
+			continue
+		}
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// decodable returns whether envconfig decodes values of the given type as a
+// whole instead of reading its fields.
+func decodable(t reflect.Type) bool {
+	ptr := reflect.PointerTo(t)
+	return ptr.Implements(reflect.TypeFor[envconfig.Decoder]()) ||
+		ptr.Implements(reflect.TypeFor[envconfig.Setter]()) ||
+		ptr.Implements(reflect.TypeFor[encoding.TextUnmarshaler]()) ||
+		ptr.Implements(reflect.TypeFor[encoding.BinaryUnmarshaler]())
+}
+
+func isTrue(s string) bool {
+	b, _ := strconv.ParseBool(s)
+	return b
+}
+
+// checkUnknownKeys returns an error listing all variables in the environment,
+// the given config file values or the values specific to the given config
+// that use one of the checked prefixes, but are not known, which is most
+// likely caused by a typo.
+func checkUnknownKeys(c *Config, fileValues map[string]string) error {
+	keys := map[string]bool{}
+	for _, kv := range os.Environ() {
+		key, _, _ := strings.Cut(kv, "=")
+		// Values of jobs are checked using the config of the job.
+		if !strings.HasPrefix(key, envJobPrefix) {
+			keys[key] = true
+		}
+	}
+	for key := range fileValues {
+		keys[key] = true
+	}
+	for key := range c.additionalEnvVars {
+		keys[key] = true
+	}
+
+	known := knownConfigKeys()
+	var unknown []string
+	for key := range keys {
+		if known[key] || known[strings.TrimSuffix(key, "_FILE")] {
+			continue
+		}
+		for _, prefix := range strictConfigPrefixes {
+			if strings.HasPrefix(key, prefix) {
+				unknown = append(unknown, key)
+				break
+			}
+		}
+	}
+	if len(unknown) != 0 {
+		slices.Sort(unknown)
+		return errwrap.Wrap(nil, fmt.Sprintf("unknown configuration key(s) %s", strings.Join(unknown, ", ")))
+	}
+	return nil
 }
 
 // envProxy is a function that mimics os.LookupEnv but can read values from any other source
 type envProxy func(string) (string, bool)
 
+// secretsDir is the directory Docker mounts secrets into. Any file in there
+// that is named like a configuration key is used as its value.
+var secretsDir = "/run/secrets"
+
+// secretFile returns the location of the secret matching the given
+// configuration key, if any. Names of secrets are matched either exactly or
+// in lower case.
+func secretFile(key string) (string, bool) {
+	for _, name := range []string{key, strings.ToLower(key)} {
+		location := filepath.Join(secretsDir, name)
+		if info, err := os.Stat(location); err == nil && info.Mode().IsRegular() {
+			return location, true
+		}
+	}
+	return "", false
+}
+
 // loadConfig creates a config object using the given lookup function
 func loadConfig(lookup envProxy) (*Config, error) {
+	expand := newConfigExpander(lookup)
+	var conflicts []string
 	envconfig.Lookup = func(key string) (string, bool) {
 		value, okValue := lookup(key)
 		location, okFile := lookup(key + "_FILE")
 
+		if secret, okSecret := secretFile(key); okSecret {
+			switch {
+			case okValue || okFile && filepath.Clean(location) != secret:
+				conflicts = append(conflicts, key)
+				return "", false
+			case !okFile:
+				location, okFile = secret, true
+			}
+		}
+
 		switch {
 		case okValue && !okFile: // only value
-			return value, true
+			return expand.value(value), true
 		case !okValue && okFile: // only file
 			contents, err := os.ReadFile(location)
 			if err != nil {
@@ -74,12 +305,63 @@ func loadConfig(lookup envProxy) (*Config, error) {
 	if err := envconfig.Process("", c); err != nil {
 		return nil, errwrap.Wrap(err, "failed to process configuration values")
 	}
+	if len(conflicts) != 0 {
+		return nil, errwrap.Wrap(
+			nil,
+			fmt.Sprintf("value(s) for %s are set in the environment and as a secret in %s", strings.Join(conflicts, ", "), secretsDir),
+		)
+	}
+	if err := expand.err(); err != nil {
+		return nil, errwrap.Wrap(err, "failed to expand configuration values")
+	}
 
 	return c, nil
 }
 
-func loadConfigFromEnvVars() (*Config, error) {
-	c, err := loadConfig(os.LookupEnv)
+// configExpander expands references to variables like `$VAR` or `${VAR}`
+// in configuration values in case CONFIG_EXPAND_ENV is set. `$$` results in
+// a literal `$`. Values read from files are never expanded, so secrets can
+// contain any character.
+type configExpander struct {
+	enabled bool
+	lookup  envProxy
+	missing []string
+}
+
+func newConfigExpander(lookup envProxy) *configExpander {
+	value, _ := lookup("CONFIG_EXPAND_ENV")
+	enabled, _ := strconv.ParseBool(value)
+	return &configExpander{enabled: enabled, lookup: lookup}
+}
+
+func (e *configExpander) value(value string) string {
+	if !e.enabled {
+		return value
+	}
+	return os.Expand(value, func(name string) string {
+		if name == "$" {
+			return "$"
+		}
+		v, ok := e.lookup(name)
+		if !ok {
+			e.missing = append(e.missing, name)
+		}
+		return v
+	})
+}
+
+// err returns an error in case any of the expanded values referenced a
+// variable that is not set.
+func (e *configExpander) err() error {
+	if len(e.missing) == 0 {
+		return nil
+	}
+	slices.Sort(e.missing)
+	return errwrap.Wrap(nil, fmt.Sprintf("referenced variable(s) %s are not set", strings.Join(slices.Compact(e.missing), ", ")))
+}
+
+func loadConfigFromEnvVars(lookup envProxy) (*Config, error) {
+	c, err := loadConfig(lookup)
 	if err != nil {
 		return nil, errwrap.Wrap(err, "error loading config from environment")
 	}
@@ -87,7 +369,74 @@ func loadConfigFromEnvVars() (*Config, error) {
 	return c, nil
 }
 
-func loadConfigsFromEnvFiles(directory string) ([]*Config, error) {
+// envJobPrefix is the prefix used for env vars that define the configuration
+// of a named job. The name of the job is separated from the key using
+// envJobSeparator, e.g. BACKUP_JOB_DB_1__BACKUP_CRON_EXPRESSION sets
+// BACKUP_CRON_EXPRESSION for the job named `db_1`.
+const (
+	envJobPrefix    = "BACKUP_JOB_"
+	envJobSeparator = "__"
+)
+
+// loadConfigsFromEnvJobs creates a config object for each job defined
+// in the environment. Values that are not set for a job fall back to the
+// given lookup function. In case no jobs are defined, it returns nil.
+func loadConfigsFromEnvJobs(fallback envProxy) ([]*Config, error) {
+	jobs := map[string]map[string]string{}
+	for _, kv := range os.Environ() {
+		key, value, _ := strings.Cut(kv, "=")
+		if !strings.HasPrefix(key, envJobPrefix) {
+			continue
+		}
+		name, jobKey, ok := strings.Cut(strings.TrimPrefix(key, envJobPrefix), envJobSeparator)
+		if !ok || name == "" || jobKey == "" {
+			return nil, errwrap.Wrap(
+				nil,
+				fmt.Sprintf("invalid job variable %s, expected %s<name>%s<key>", key, envJobPrefix, envJobSeparator),
+			)
+		}
+		name = strings.ToLower(name)
+		if _, ok := jobs[name]; !ok {
+			jobs[name] = map[string]string{}
+		}
+		jobs[name][jobKey] = value
+	}
+
+	return loadNamedConfigs(jobs, fallback, "job")
+}
+
+// loadNamedConfigs creates a config object for each of the given named sets
+// of values, sorted by name. Values that are not set fall back to the given
+// lookup function. The kind is used for describing the source of each config.
+func loadNamedConfigs(named map[string]map[string]string, fallback envProxy, kind string) ([]*Config, error) {
+	names := make([]string, 0, len(named))
+	for name := range named {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	configs := []*Config{}
+	for _, name := range names {
+		values := named[name]
+		lookup := func(key string) (string, bool) {
+			val, ok := values[key]
+			if ok {
+				return val, ok
+			}
+			return fallback(key)
+		}
+		c, err := loadConfig(lookup)
+		if err != nil {
+			return nil, errwrap.Wrap(err, fmt.Sprintf("error loading config for %s %s", kind, name))
+		}
+		c.source = fmt.Sprintf("%s %s", kind, name)
+		c.additionalEnvVars = values
+		configs = append(configs, c)
+	}
+	return configs, nil
+}
+
+func loadConfigsFromEnvFiles(directory string, fallback envProxy) ([]*Config, error) {
 	items, err := os.ReadDir(directory)
 	if err != nil {
 		if os.IsNotExist(err) {
@@ -111,7 +460,7 @@ func loadConfigsFromEnvFiles(directory string) ([]*Config, error) {
 			if ok {
 				return val, ok
 			}
-			return os.LookupEnv(key)
+			return fallback(key)
 		}
 		c, err := loadConfig(lookup)
 		if err != nil {
@@ -164,3 +513,112 @@ func source(path string) (map[string]string, error) {
 	}
 	return result, nil
 }
+
+// configFileSourcesKey is the key in a config file that holds the values of
+// named sources, each of which is backed up using its own configuration.
+const configFileSourcesKey = "sources"
+
+// loadConfigFile reads the YAML or TOML file at the given location and
+// returns its values keyed by the name of the respective environment variable.
+// Files ending in `.toml` are decoded as TOML, all others as YAML. Keys of
+// nested mappings are joined using underscores, so both
+// `backup_cron_expression` and `backup: {cron_expression: ...}` refer to
+// BACKUP_CRON_EXPRESSION. Lists are joined using commas. The values of the
+// named sources defined under the `sources` key are returned separately.
+func loadConfigFile(location string) (map[string]string, map[string]map[string]string, error) {
+	values, err := decodeConfigFile(location)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var sources map[string]map[string]string
+	if rawSources, ok := values[configFileSourcesKey]; ok {
+		delete(values, configFileSourcesKey)
+		named, ok := rawSources.(map[string]interface{})
+		if !ok {
+			return nil, nil, errwrap.Wrap(nil, fmt.Sprintf("expected %s in %s to be a mapping of names to values", configFileSourcesKey, location))
+		}
+		sources = map[string]map[string]string{}
+		for name, rawValues := range named {
+			sourceValues, ok := rawValues.(map[string]interface{})
+			if !ok && rawValues != nil {
+				return nil, nil, errwrap.Wrap(nil, fmt.Sprintf("expected source %s in %s to be a mapping", name, location))
+			}
+			if sources[name], err = configValues(sourceValues); err != nil {
+				return nil, nil, errwrap.Wrap(err, fmt.Sprintf("error reading values of source %s from %s", name, location))
+			}
+		}
+	}
+
+	result, err := configValues(values)
+	if err != nil {
+		return nil, nil, errwrap.Wrap(err, fmt.Sprintf("error reading values from %s", location))
+	}
+	return result, sources, nil
+}
+
+// decodeConfigFile decodes the YAML or TOML file at the given location.
+func decodeConfigFile(location string) (map[string]interface{}, error) {
+	b, err := os.ReadFile(location)
+	if err != nil {
+		return nil, errwrap.Wrap(err, fmt.Sprintf("error reading %s", location))
+	}
+
+	var values map[string]interface{}
+	if strings.EqualFold(filepath.Ext(location), ".toml") {
+		if err := toml.Unmarshal(b, &values); err != nil {
+			return nil, errwrap.Wrap(err, fmt.Sprintf("error unmarshaling %s", location))
+		}
+		return values, nil
+	}
+	if err := yaml.Unmarshal(b, &values); err != nil {
+		return nil, errwrap.Wrap(err, fmt.Sprintf("error unmarshaling %s", location))
+	}
+	return values, nil
+}
+
+// configValues flattens the given decoded values of a config file, keying
+// them by the name of the respective environment variable. Keys having a null
+// value are omitted, so they do not override defaults or values set
+// elsewhere using an empty value.
+func configValues(values map[string]interface{}) (map[string]string, error) {
+	result := map[string]string{}
+	if err := flattenConfigValues("", values, result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func flattenConfigValues(prefix string, values map[string]interface{}, result map[string]string) error {
+	for key, value := range values {
+		key = strings.ToUpper(key)
+		if prefix != "" {
+			key = prefix + "_" + key
+		}
+		switch v := value.(type) {
+		case map[string]interface{}:
+			if err := flattenConfigValues(key, v, result); err != nil {
+				return err
+			}
+		case []interface{}:
+			items := []string{}
+			for _, item := range v {
+				switch item.(type) {
+				case map[string]interface{}, []interface{}:
+					return errwrap.Wrap(nil, fmt.Sprintf("unsupported nested value in list %s", key))
+				}
+				if item != nil {
+					items = append(items, fmt.Sprint(item))
+				}
+			}
+			result[key] = strings.Join(items, ",")
+		case []map[string]interface{}:
+			return errwrap.Wrap(nil, fmt.Sprintf("unsupported nested value in list %s", key))
+		case nil:
+			continue
+		default:
+			result[key] = fmt.Sprint(v)
+		}
+	}
+	return nil
+}
@@ -2,8 +2,11 @@ package main
 
 import (
 	"os"
+	"path/filepath"
 	"reflect"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestSource(t *testing.T) {
@@ -75,3 +78,432 @@ func TestSource(t *testing.T) {
 		})
 	}
 }
+
+func TestLoadConfigFile(t *testing.T) {
+	tests := []struct {
+		name            string
+		input           string
+		expectError     bool
+		expectedOutput  map[string]string
+		expectedSources map[string]map[string]string
+	}{
+		{
+			"default",
+			"testdata/config.yml",
+			false,
+			map[string]string{
+				"BACKUP_CRON_EXPRESSION":          "@daily",
+				"BACKUP_RETENTION_DAYS":           "7",
+				"BACKUP_SKIP_BACKENDS_FROM_PRUNE": "s3,webdav",
+				"AWS_S3_BUCKET_NAME":              "backups",
+			},
+			nil,
+		},
+		{
+			"sources",
+			"testdata/sources.yml",
+			false,
+			map[string]string{"BACKUP_RETENTION_DAYS": "7"},
+			map[string]map[string]string{
+				"db":    {"BACKUP_SOURCES": "/backup/db", "BACKUP_CRON_EXPRESSION": "@hourly"},
+				"files": {"BACKUP_CRON_EXPRESSION": "@weekly"},
+			},
+		},
+		{
+			"toml",
+			"testdata/config.toml",
+			false,
+			map[string]string{
+				"BACKUP_CRON_EXPRESSION":          "@daily",
+				"BACKUP_RETENTION_DAYS":           "7",
+				"BACKUP_SKIP_BACKENDS_FROM_PRUNE": "s3,webdav",
+				"AWS_S3_BUCKET_NAME":              "backups",
+			},
+			nil,
+		},
+		{
+			"toml sources",
+			"testdata/sources.toml",
+			false,
+			map[string]string{"BACKUP_RETENTION_DAYS": "7"},
+			map[string]map[string]string{
+				"db":    {"BACKUP_SOURCES": "/backup/db", "BACKUP_CRON_EXPRESSION": "@hourly"},
+				"files": {"BACKUP_CRON_EXPRESSION": "@weekly"},
+			},
+		},
+		{
+			"nulls",
+			"testdata/nulls.yml",
+			false,
+			map[string]string{
+				"BACKUP_CRON_EXPRESSION":          "@weekly",
+				"BACKUP_SKIP_BACKENDS_FROM_PRUNE": "s3",
+			},
+			map[string]map[string]string{
+				"db":    {"BACKUP_SOURCES": "/backup/db"},
+				"files": {},
+			},
+		},
+		{
+			"not found",
+			"testdata/nope.yml",
+			true,
+			nil,
+			nil,
+		},
+		{
+			"invalid",
+			"testdata/default.env",
+			true,
+			nil,
+			nil,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			result, sources, err := loadConfigFile(test.input)
+			if (err != nil) != test.expectError {
+				t.Errorf("Unexpected error value %v", err)
+			}
+			if !reflect.DeepEqual(test.expectedOutput, result) {
+				t.Errorf("Expected %v, got %v", test.expectedOutput, result)
+			}
+			if !reflect.DeepEqual(test.expectedSources, sources) {
+				t.Errorf("Expected sources %v, got %v", test.expectedSources, sources)
+			}
+		})
+	}
+}
+
+func TestLoadConfigsFromEnvJobs(t *testing.T) {
+	t.Setenv("BACKUP_RETENTION_DAYS", "7")
+	// Variables of other tools must not be mistaken for jobs.
+	t.Setenv("JOB_ID", "42")
+	t.Setenv("BACKUP_JOB_DB__BACKUP_CRON_EXPRESSION", "@hourly")
+	t.Setenv("BACKUP_JOB_DB__BACKUP_SOURCES", "/backup/db")
+	t.Setenv("BACKUP_JOB_NIGHTLY_FILES__BACKUP_CRON_EXPRESSION", "@weekly")
+
+	configs, err := loadConfigsFromEnvJobs(os.LookupEnv)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if len(configs) != 2 {
+		t.Fatalf("Expected 2 configs, got %d", len(configs))
+	}
+
+	expected := []struct {
+		source         string
+		cronExpression string
+		sources        string
+	}{
+		{"job db", "@hourly", "/backup/db"},
+		{"job nightly_files", "@weekly", "/backup"},
+	}
+	for i, e := range expected {
+		c := configs[i]
+		if c.source != e.source {
+			t.Errorf("Expected source %s, got %s", e.source, c.source)
+		}
+		if c.BackupCronExpression != e.cronExpression {
+			t.Errorf("Expected cron expression %s, got %s", e.cronExpression, c.BackupCronExpression)
+		}
+		if c.BackupSources != e.sources {
+			t.Errorf("Expected sources %s, got %s", e.sources, c.BackupSources)
+		}
+		if c.BackupRetentionDays != 7 {
+			t.Errorf("Expected retention days to fall back to 7, got %d", c.BackupRetentionDays)
+		}
+	}
+
+	t.Setenv("BACKUP_JOB_DB_BACKUP_SOURCES", "/backup/db")
+	if _, err := loadConfigsFromEnvJobs(os.LookupEnv); err == nil || !strings.Contains(err.Error(), "BACKUP_JOB_DB_BACKUP_SOURCES") {
+		t.Errorf("Expected error for job variable without separator, got %v", err)
+	}
+}
+
+func TestSourceConfigurationFileSources(t *testing.T) {
+	t.Setenv("BACKUP_RETENTION_DAYS", "14")
+
+	configs, err := sourceConfiguration(configStrategyEnv, "testdata/sources.yml")
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if len(configs) != 2 {
+		t.Fatalf("Expected 2 configs, got %d", len(configs))
+	}
+
+	expected := []struct {
+		source         string
+		cronExpression string
+		sources        string
+	}{
+		{"source db", "@hourly", "/backup/db"},
+		{"source files", "@weekly", "/backup"},
+	}
+	for i, e := range expected {
+		c := configs[i]
+		if c.source != e.source {
+			t.Errorf("Expected source %s, got %s", e.source, c.source)
+		}
+		if c.BackupCronExpression != e.cronExpression {
+			t.Errorf("Expected cron expression %s, got %s", e.cronExpression, c.BackupCronExpression)
+		}
+		if c.BackupSources != e.sources {
+			t.Errorf("Expected sources %s, got %s", e.sources, c.BackupSources)
+		}
+		if c.BackupRetentionDays != 14 {
+			t.Errorf("Expected environment to take precedence over the file, got %d", c.BackupRetentionDays)
+		}
+	}
+
+	t.Setenv("BACKUP_SOURCES", "/backup/env")
+	configs, err = sourceConfiguration(configStrategyEnv, "testdata/sources.yml")
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	for _, c := range configs {
+		if c.BackupSources != "/backup/env" {
+			t.Errorf("Expected environment to take precedence over the values of %s, got %s", c.source, c.BackupSources)
+		}
+		if _, ok := c.additionalEnvVars["BACKUP_SOURCES"]; ok {
+			t.Errorf("Expected value set in the environment not to be applied for %s", c.source)
+		}
+	}
+}
+
+func TestSourceConfigurationNullValues(t *testing.T) {
+	configs, err := sourceConfiguration(configStrategyEnv, "testdata/nulls.yml")
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if len(configs) != 2 {
+		t.Fatalf("Expected 2 configs, got %d", len(configs))
+	}
+	for _, c := range configs {
+		if c.BackupCompression != "gz" {
+			t.Errorf("Expected default compression for %s, got %s", c.source, c.BackupCompression)
+		}
+		if c.BackupFilename != "backup-%Y-%m-%dT%H-%M-%S.{{ .Extension }}" {
+			t.Errorf("Expected default filename for %s, got %s", c.source, c.BackupFilename)
+		}
+		if c.BackupCronExpression != "@weekly" {
+			t.Errorf("Expected cron expression of the file to be used for %s, got %s", c.source, c.BackupCronExpression)
+		}
+	}
+}
+
+func TestLoadConfigExpandEnv(t *testing.T) {
+	secret := filepath.Join(t.TempDir(), "secret")
+	if err := os.WriteFile(secret, []byte("pa$$word"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name          string
+		env           map[string]string
+		expectedError bool
+		check         func(t *testing.T, c *Config)
+	}{
+		{
+			"disabled",
+			map[string]string{
+				"HOSTNAME":        "example",
+				"BACKUP_FILENAME": "backup-$HOSTNAME.tar.gz",
+			},
+			false,
+			func(t *testing.T, c *Config) {
+				if c.BackupFilename != "backup-$HOSTNAME.tar.gz" {
+					t.Errorf("Expected filename not to be expanded, got %s", c.BackupFilename)
+				}
+			},
+		},
+		{
+			"enabled",
+			map[string]string{
+				"CONFIG_EXPAND_ENV":           "true",
+				"HOSTNAME":                    "example",
+				"BUCKET":                      "backups",
+				"BACKUP_FILENAME":             "backup-${HOSTNAME}-%Y.tar.gz",
+				"AWS_S3_BUCKET_NAME":          "$BUCKET",
+				"BACKUP_LATEST_COPY_BACKENDS": "$BUCKET,local",
+				"NOTIFICATION_URLS":           "generic://$$HOSTNAME",
+				"AWS_SECRET_ACCESS_KEY_FILE":  secret,
+				"BACKUP_STORAGE_TIMEOUT":      "$TIMEOUT",
+				"TIMEOUT":                     "2m",
+				"BACKUP_PRUNING_PREFIX":       "backup-$HOSTNAME-",
+				"BACKUP_FILENAME_OVERRIDES":   "s3:$HOSTNAME/backup.tar.gz",
+			},
+			false,
+			func(t *testing.T, c *Config) {
+				if c.BackupFilename != "backup-example-%Y.tar.gz" {
+					t.Errorf("Unexpected filename %s", c.BackupFilename)
+				}
+				if c.AwsS3BucketName != "backups" {
+					t.Errorf("Unexpected bucket name %s", c.AwsS3BucketName)
+				}
+				if !reflect.DeepEqual(c.BackupLatestCopyBackends, []string{"backups", "local"}) {
+					t.Errorf("Unexpected backends %v", c.BackupLatestCopyBackends)
+				}
+				if !reflect.DeepEqual(c.NotificationURLs, []string{"generic://$HOSTNAME"}) {
+					t.Errorf("Expected escaped variable to be kept, got %s", c.NotificationURLs)
+				}
+				if c.AwsSecretAccessKey != "pa$$word" {
+					t.Errorf("Expected value read from file not to be expanded, got %s", c.AwsSecretAccessKey)
+				}
+				if c.BackupStorageTimeout != 2*time.Minute {
+					t.Errorf("Unexpected timeout %v", c.BackupStorageTimeout)
+				}
+				if c.BackupFilenameOverrides["s3"] != "example/backup.tar.gz" {
+					t.Errorf("Unexpected overrides %v", c.BackupFilenameOverrides)
+				}
+			},
+		},
+		{
+			"undefined variable",
+			map[string]string{
+				"CONFIG_EXPAND_ENV": "true",
+				"BACKUP_FILENAME":   "backup-$UNDEFINED.tar.gz",
+			},
+			true,
+			nil,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c, err := loadConfig(func(key string) (string, bool) {
+				v, ok := test.env[key]
+				return v, ok
+			})
+			if (err != nil) != test.expectedError {
+				t.Fatalf("Unexpected error value %v", err)
+			}
+			if test.check != nil {
+				test.check(t, c)
+			}
+		})
+	}
+}
+
+func TestLoadConfigSecrets(t *testing.T) {
+	dir := t.TempDir()
+	defer func(d string) { secretsDir = d }(secretsDir)
+	secretsDir = dir
+	for name, value := range map[string]string{
+		"aws_secret_access_key": "secret",
+		"AWS_ACCESS_KEY_ID":     "access",
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(value), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name          string
+		env           map[string]string
+		expectedError bool
+	}{
+		{"secrets only", map[string]string{}, false},
+		{"file pointing to secret", map[string]string{"AWS_ACCESS_KEY_ID_FILE": filepath.Join(dir, "AWS_ACCESS_KEY_ID")}, false},
+		{"value set", map[string]string{"AWS_SECRET_ACCESS_KEY": "other"}, true},
+		{"other file set", map[string]string{"AWS_ACCESS_KEY_ID_FILE": "/run/other"}, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c, err := loadConfig(func(key string) (string, bool) {
+				v, ok := test.env[key]
+				return v, ok
+			})
+			if (err != nil) != test.expectedError {
+				t.Fatalf("Unexpected error value %v", err)
+			}
+			if test.expectedError {
+				return
+			}
+			if c.AwsSecretAccessKey != "secret" || c.AwsAccessKeyID != "access" {
+				t.Errorf("Expected values to be read from secrets, got %s and %s", c.AwsSecretAccessKey, c.AwsAccessKeyID)
+			}
+		})
+	}
+}
+
+func TestSourceConfigurationStrict(t *testing.T) {
+	t.Setenv("BACKUP_RETENTIONDYAS", "7")
+	t.Setenv("NOTIFICATION_URL", "generic://example.com")
+	t.Setenv("BACKUP_CRON_EXPRESSION", "@daily")
+	t.Setenv("GPG_PASSPHRASE_FILE", "/run/secrets/passphrase")
+	t.Setenv("AWS_REGION", "eu-central-1")
+
+	if _, err := sourceConfiguration(configStrategyEnv, ""); err != nil {
+		t.Fatalf("Unexpected error without strict mode: %v", err)
+	}
+
+	t.Setenv("CONFIG_STRICT", "true")
+	_, err := sourceConfiguration(configStrategyEnv, "")
+	if err == nil {
+		t.Fatal("Expected error in strict mode")
+	}
+	if !strings.Contains(err.Error(), "unknown configuration key(s) BACKUP_RETENTIONDYAS, NOTIFICATION_URL") {
+		t.Errorf("Expected all unknown keys to be listed, got %v", err)
+	}
+
+	t.Setenv("BACKUP_JOB_DB__BACKUP_SORCES", "/backup/db")
+	_, err = sourceConfiguration(configStrategyEnv, "")
+	if err == nil || !strings.Contains(err.Error(), "job db") || !strings.Contains(err.Error(), "BACKUP_SORCES") {
+		t.Errorf("Expected unknown key of job to be reported, got %v", err)
+	}
+}
+
+func TestConfigKeys(t *testing.T) {
+	type nested struct {
+		InnerValue string `split_words:"true"`
+	}
+	type Embedded struct {
+		EmbeddedValue string `split_words:"true"`
+	}
+	type spec struct {
+		Embedded
+		PlainValue   string
+		SplitValue   string         `split_words:"true"`
+		AWSAccessKey string         `split_words:"true"`
+		Renamed      string         `split_words:"true" envconfig:"CUSTOM_NAME"`
+		Ignored      string         `ignored:"true"`
+		Nested       nested         `split_words:"true"`
+		NestedPtr    *nested        `split_words:"true"`
+		Decodable    RegexpDecoder  `split_words:"true"`
+		Whole        WholeNumber    `split_words:"true"`
+		Overrides    map[string]int `split_words:"true"`
+		unexported   string
+	}
+
+	expected := []string{
+		"EMBEDDED_VALUE",
+		"PLAINVALUE",
+		"SPLIT_VALUE",
+		"AWS_ACCESS_KEY",
+		"CUSTOM_NAME",
+		"NESTED_INNER_VALUE",
+		"NESTED_PTR_INNER_VALUE",
+		"DECODABLE",
+		"WHOLE",
+		"OVERRIDES",
+	}
+	if keys := configKeys(reflect.TypeOf(spec{}), ""); !reflect.DeepEqual(keys, expected) {
+		t.Errorf("Expected keys %v, got %v", expected, keys)
+	}
+
+	known := knownConfigKeys()
+	for _, key := range []string{
+		"CONFIG_FILE",
+		"AWS_S3_BUCKET_NAME",
+		"AWS_ENDPOINT_CA_CERT",
+		"AWS_IAM_ROLE_ENDPOINT",
+		"BACKUP_CRON_EXPRESSION",
+		"GPG_KMS_KEY_ID",
+		"WEBDAV_URL",
+	} {
+		if !known[key] {
+			t.Errorf("Expected %s to be a known key", key)
+		}
+	}
+}
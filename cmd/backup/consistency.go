@@ -0,0 +1,127 @@
+// Copyright 2024 - offen.software <hioffen@posteo.de>
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/offen/docker-volume-backup/internal/errwrap"
+)
+
+// sourceChecksums maps the paths of files in the backup sources to a
+// checksum of their size, modification time and contents.
+type sourceChecksums map[string]string
+
+// checksumSources calculates checksums for the regular files among the given
+// paths. In case sample is positive, only an evenly distributed sample of the
+// given size is considered.
+func checksumSources(paths []string, sample int) (sourceChecksums, error) {
+	var files []string
+	for _, p := range paths {
+		fi, err := os.Lstat(p)
+		if err != nil {
+			return nil, errwrap.Wrap(err, fmt.Sprintf("error getting file info for %s", p))
+		}
+		if fi.Mode().IsRegular() {
+			files = append(files, p)
+		}
+	}
+
+	if sample > 0 && sample < len(files) {
+		step := float64(len(files)) / float64(sample)
+		sampled := make([]string, 0, sample)
+		for i := 0; i < sample; i++ {
+			sampled = append(sampled, files[int(float64(i)*step)])
+		}
+		files = sampled
+	}
+
+	checksums := sourceChecksums{}
+	for _, file := range files {
+		checksum, err := checksumSource(file)
+		if err != nil {
+			return nil, errwrap.Wrap(err, fmt.Sprintf("error calculating checksum of %s", file))
+		}
+		checksums[file] = checksum
+	}
+	return checksums, nil
+}
+
+func checksumSource(location string) (string, error) {
+	f, err := os.Open(location)
+	if err != nil {
+		// A file that has been removed in the meantime is considered changed.
+		if os.IsNotExist(err) {
+			return "", nil
+		}
+		return "", err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	fmt.Fprintf(h, "%d:%d:", fi.Size(), fi.ModTime().UnixNano())
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+// changed returns the sorted paths of files whose checksum differs in the
+// given checksums.
+func (c sourceChecksums) changed(other sourceChecksums) []string {
+	var result []string
+	for file, checksum := range c {
+		if other[file] != checksum {
+			result = append(result, file)
+		}
+	}
+	sort.Strings(result)
+	return result
+}
+
+// checkConsistency compares the given checksums taken before archiving
+// with the current state of the files and handles any changes as per
+// BACKUP_CONSISTENCY_CHECK.
+func (s *script) checkConsistency(before sourceChecksums) error {
+	after := sourceChecksums{}
+	for file := range before {
+		checksum, err := checksumSource(file)
+		if err != nil {
+			return errwrap.Wrap(err, fmt.Sprintf("error calculating checksum of %s after archiving", file))
+		}
+		after[file] = checksum
+	}
+
+	changed := before.changed(after)
+	if len(changed) == 0 {
+		s.logger.Info(
+			fmt.Sprintf("Verified %d file(s) in the backup sources did not change while archiving.", len(before)),
+		)
+		return nil
+	}
+
+	listed := changed
+	if len(listed) > 10 {
+		listed = append(listed[:10:10], "...")
+	}
+	message := fmt.Sprintf(
+		"%d file(s) in the backup sources changed while archiving, which indicates a process is still writing to them: %s",
+		len(changed),
+		strings.Join(listed, ", "),
+	)
+	if s.c.BackupConsistencyCheck == "fail" {
+		return errwrap.Wrap(nil, message)
+	}
+	s.logger.Warn(message)
+	return nil
+}
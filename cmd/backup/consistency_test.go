@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestChecksumSources(t *testing.T) {
+	dir := t.TempDir()
+	paths := []string{dir}
+	for i := 0; i < 10; i++ {
+		p := filepath.Join(dir, fmt.Sprintf("file-%d.txt", i))
+		if err := os.WriteFile(p, []byte("content"), 0644); err != nil {
+			t.Fatalf("Unexpected error writing file: %v", err)
+		}
+		paths = append(paths, p)
+	}
+
+	before, err := checksumSources(paths, 0)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(before) != 10 {
+		t.Errorf("Expected checksums for 10 files, got %d", len(before))
+	}
+
+	sampled, err := checksumSources(paths, 3)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(sampled) != 3 {
+		t.Errorf("Expected checksums for 3 files, got %d", len(sampled))
+	}
+
+	if err := os.WriteFile(paths[2], []byte("changed"), 0644); err != nil {
+		t.Fatalf("Unexpected error writing file: %v", err)
+	}
+	if err := os.Remove(paths[5]); err != nil {
+		t.Fatalf("Unexpected error removing file: %v", err)
+	}
+
+	after := sourceChecksums{}
+	for file := range before {
+		checksum, err := checksumSource(file)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		after[file] = checksum
+	}
+
+	changed := before.changed(after)
+	expected := []string{paths[2], paths[5]}
+	if !reflect.DeepEqual(changed, expected) {
+		t.Errorf("Expected %v, got %v", expected, changed)
+	}
+}
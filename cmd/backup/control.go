@@ -0,0 +1,192 @@
+// Copyright 2024 - offen.software <hioffen@posteo.de>
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/offen/docker-volume-backup/internal/errwrap"
+)
+
+// runStatus describes the most recent backup run of a configuration.
+type runStatus struct {
+	Source     string                  `json:"source"`
+	Running    bool                    `json:"running"`
+	StartTime  time.Time               `json:"startTime"`
+	EndTime    time.Time               `json:"endTime,omitempty"`
+	TookTime   time.Duration           `json:"tookTime,omitempty"`
+	Error      string                  `json:"error,omitempty"`
+	BackupFile BackupFileStats         `json:"backupFile"`
+	Storages   map[string]StorageStats `json:"storages,omitempty"`
+}
+
+// runRegistry records the status of the most recent backup run per
+// configuration, so it can be queried using the control socket.
+type runRegistry struct {
+	mu   sync.Mutex
+	runs map[string]runStatus
+}
+
+var lastRuns = &runRegistry{runs: map[string]runStatus{}}
+
+func (r *runRegistry) start(source string, stats *Stats) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.runs[source] = runStatus{Source: source, Running: true, StartTime: stats.StartTime}
+}
+
+func (r *runRegistry) finish(source string, stats *Stats, err error) {
+	stats.Lock()
+	status := runStatus{
+		Source:     source,
+		StartTime:  stats.StartTime,
+		EndTime:    stats.EndTime,
+		TookTime:   stats.TookTime,
+		BackupFile: stats.BackupFile,
+		Storages:   stats.Storages,
+	}
+	stats.Unlock()
+	if err != nil {
+		status.Error = errwrap.Unwrap(err).Error()
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.runs[source] = status
+}
+
+func (r *runRegistry) all() []runStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	result := []runStatus{}
+	for _, status := range r.runs {
+		result = append(result, status)
+	}
+	slices.SortFunc(result, func(a, b runStatus) int {
+		return strings.Compare(a.Source, b.Source)
+	})
+	return result
+}
+
+// serveControl listens for commands on the unix socket at the given location
+// until the command's context is cancelled. Each connection sends a single
+// line containing either `run <source>`, which runs a backup using the
+// configuration of the given source, or `status`, which returns the status
+// of the most recent run of each configuration as JSON.
+func (c *command) serveControl(socket string) error {
+	if err := os.Remove(socket); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return errwrap.Wrap(err, "error removing stale control socket")
+	}
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		return errwrap.Wrap(err, fmt.Sprintf("error listening on %s", socket))
+	}
+	go func() {
+		<-c.ctx.Done()
+		listener.Close()
+	}()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				if c.ctx.Err() == nil {
+					c.logger.Error(fmt.Sprintf("Unexpected error accepting control connection: %v", err))
+				}
+				return
+			}
+			go c.handleControl(conn)
+		}
+	}()
+	c.logger.Info(fmt.Sprintf("Listening for commands on control socket %s", socket))
+	return nil
+}
+
+func (c *command) handleControl(conn net.Conn) {
+	defer conn.Close()
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil && !errors.Is(err, io.EOF) {
+		return
+	}
+	command, arg, _ := strings.Cut(strings.TrimSpace(line), " ")
+	switch command {
+	case "run":
+		config := c.lookupSource(arg)
+		if config == nil {
+			fmt.Fprintf(conn, "error: unknown source %s\n", arg)
+			return
+		}
+		c.logger.Info(fmt.Sprintf("Now running backup %s as requested using the control socket", config.source))
+		c.mu.Lock()
+		limiter := c.limiter
+		c.mu.Unlock()
+		if err := c.runLimited(limiter, config, time.Time{}); err != nil {
+			c.logger.Error(
+				fmt.Sprintf("Unexpected error running backup %s: %v", config.source, errwrap.Unwrap(err)),
+				"error",
+				err,
+			)
+			fmt.Fprintf(conn, "error: %v\n", errwrap.Unwrap(err))
+			return
+		}
+		fmt.Fprintln(conn, "ok")
+	case "status":
+		enc := json.NewEncoder(conn)
+		enc.SetIndent("", "  ")
+		enc.Encode(lastRuns.all())
+	default:
+		fmt.Fprintf(conn, "error: unknown command %s, expected run or status\n", command)
+	}
+}
+
+// lookupSource returns the scheduled configuration of the given source. The
+// extension of configuration files can be omitted.
+func (c *command) lookupSource(source string) *Config {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, config := range c.configurations {
+		if config.source == source || strings.TrimSuffix(config.source, path.Ext(config.source)) == source {
+			return config
+		}
+	}
+	return nil
+}
+
+// sendControl sends the given command to the control socket of a process
+// running in the foreground and prints the response.
+func (c *command) sendControl(command string) error {
+	configurations, err := sourceConfiguration(configStrategyEnv, c.configFile)
+	if err != nil {
+		return errwrap.Wrap(err, "error loading env vars")
+	}
+	if len(configurations) == 0 || configurations[0].ControlSocket == "" {
+		return errwrap.Wrap(nil, "CONTROL_SOCKET is not set")
+	}
+	conn, err := net.Dial("unix", configurations[0].ControlSocket)
+	if err != nil {
+		return errwrap.Wrap(err, "error connecting to control socket")
+	}
+	defer conn.Close()
+	if _, err := fmt.Fprintln(conn, command); err != nil {
+		return errwrap.Wrap(err, "error sending command")
+	}
+	response, err := io.ReadAll(conn)
+	if err != nil {
+		return errwrap.Wrap(err, "error reading response")
+	}
+	fmt.Print(string(response))
+	if strings.HasPrefix(string(response), "error: ") {
+		return errwrap.Wrap(nil, strings.TrimSpace(strings.TrimPrefix(string(response), "error: ")))
+	}
+	return nil
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestControlSocket(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c := newCommand()
+	c.ctx = ctx
+	c.configurations = []*Config{{source: "01daily.conf"}}
+	c.limiter = newRunLimiter(0)
+
+	socket := filepath.Join(t.TempDir(), "control.sock")
+	if err := c.serveControl(socket); err != nil {
+		t.Fatalf("Unexpected error serving control socket: %v", err)
+	}
+
+	send := func(command string) string {
+		conn, err := net.Dial("unix", socket)
+		if err != nil {
+			t.Fatalf("Unexpected error connecting: %v", err)
+		}
+		defer conn.Close()
+		fmt.Fprintln(conn, command)
+		var lines []string
+		scanner := bufio.NewScanner(conn)
+		for scanner.Scan() {
+			lines = append(lines, scanner.Text())
+		}
+		return strings.Join(lines, "\n")
+	}
+
+	if response := send("run weekly"); response != "error: unknown source weekly" {
+		t.Errorf("Unexpected response %q", response)
+	}
+	if response := send("backup"); !strings.HasPrefix(response, "error: unknown command") {
+		t.Errorf("Unexpected response %q", response)
+	}
+	if config := c.lookupSource("01daily"); config == nil {
+		t.Error("Expected source to be found without extension")
+	}
+
+	lastRuns.finish("01daily.conf", &Stats{}, errors.New("upload failed"))
+	var statuses []runStatus
+	if err := json.Unmarshal([]byte(send("status")), &statuses); err != nil {
+		t.Fatalf("Unexpected error decoding status: %v", err)
+	}
+	idx := slices.IndexFunc(statuses, func(s runStatus) bool { return s.Source == "01daily.conf" })
+	if idx == -1 || statuses[idx].Error != "upload failed" {
+		t.Errorf("Unexpected status %v", statuses)
+	}
+}
@@ -4,38 +4,409 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"os"
 	"path"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
 
 	"github.com/offen/docker-volume-backup/internal/errwrap"
+	"github.com/offen/docker-volume-backup/internal/storage"
+	"go.opentelemetry.io/otel/attribute"
 	"golang.org/x/sync/errgroup"
 )
 
 // copyArchive makes sure the backup file is copied to both local and remote locations
 // as per the given configuration.
 func (s *script) copyArchive() error {
+	// When streaming, the archive has been uploaded while creating it.
+	if s.stream {
+		return nil
+	}
 	_, name := path.Split(s.file)
 	if stat, err := os.Stat(s.file); err != nil {
 		return errwrap.Wrap(err, "unable to stat backup file")
 	} else {
 		size := stat.Size()
-		s.stats.BackupFile = BackupFileStats{
-			Size:     uint64(size),
-			Name:     name,
-			FullPath: s.file,
+		s.stats.BackupFile.Size = uint64(size)
+		s.stats.BackupFile.Name = name
+		s.stats.BackupFile.FullPath = s.file
+	}
+
+	if s.c.BackupChecksumAlgorithm != "" {
+		checksum, err := s.backupChecksum(s.file)
+		if err != nil {
+			return errwrap.Wrap(err, "error calculating checksum")
+		}
+		s.stats.BackupFile.Checksum = checksum
+	}
+
+	remoteNames := map[string]string{}
+	latestPointers := map[string]string{}
+	for _, b := range s.storages {
+		remoteName, err := s.remoteName(b.Name())
+		if err != nil {
+			return errwrap.Wrap(err, fmt.Sprintf("error determining name of backup in backend `%s`", b.Name()))
+		}
+		// When resuming from a checkpoint, the backup keeps the names it has
+		// been given by the run that created it.
+		if s.checkpoint != nil {
+			if name, ok := s.checkpoint.RemoteNames[b.Name()]; ok {
+				remoteName = name
+			} else {
+				s.checkpoint.RemoteNames[b.Name()] = remoteName
+			}
+		}
+		remoteNames[b.Name()] = remoteName
+		if s.c.BackupLatestSymlink != "" && containsBackend(s.c.BackupLatestPointerBackends, b.Name()) {
+			pointer, err := s.prepareLatestPointer(s.uploadedName(remoteName))
+			if err != nil {
+				return errwrap.Wrap(err, "error preparing latest backup")
+			}
+			latestPointers[b.Name()] = pointer
+		}
+	}
+
+	if err := s.initCheckpoint(remoteNames); err != nil {
+		return errwrap.Wrap(err, "error creating checkpoint")
+	}
+
+	if s.c.BackupSplitSize > 0 {
+		// Files are split before uploading in parallel, so backends sharing
+		// the same file use the same parts.
+		for _, b := range s.storages {
+			if _, err := s.split(s.backendFile(b.Name())); err != nil {
+				return errwrap.Wrap(err, "error splitting backup file")
+			}
 		}
 	}
 
-	eg := errgroup.Group{}
-	for _, backend := range s.storages {
-		b := backend
-		eg.Go(func() error {
-			return b.Copy(s.file)
+	// Uploads to the different backends do not affect each other, unless
+	// BACKUP_UPLOAD_FAIL_FAST is set, in which case pending uploads are
+	// skipped after the first failure.
+	eg, ctx := &errgroup.Group{}, context.Background()
+	if s.c.BackupUploadFailFast {
+		eg, ctx = errgroup.WithContext(ctx)
+	}
+	if limit := s.c.BackupParallelUploads.Int(); limit > 0 {
+		eg.SetLimit(limit)
+	}
+	errs := make([]error, len(s.storages))
+	for i, backend := range s.storages {
+		i, b := i, backend
+		remoteName := remoteNames[b.Name()]
+		file := s.backendFile(b.Name())
+		eg.Go(func() (err error) {
+			if ctx.Err() != nil {
+				s.logger.Info(
+					fmt.Sprintf("Skipping upload to backend `%s` as an upload to another backend has failed.", b.Name()),
+				)
+				return nil
+			}
+			span := s.startSpan("upload", attribute.String("backend", b.Name()))
+			defer func() {
+				endSpan(span, err)
+				if err != nil {
+					errs[i] = errwrap.Wrap(err, fmt.Sprintf("error uploading backup to backend `%s`", b.Name()))
+				}
+			}()
+			if s.checkpoint != nil && s.checkpoint.completed(b.Name()) {
+				if _, err := b.Stat(s.uploadedName(remoteName)); err == nil {
+					s.logger.Info(
+						fmt.Sprintf("Skipping upload of `%s` to backend `%s` as it has been uploaded by a previous run.", remoteName, b.Name()),
+					)
+					return nil
+				}
+			}
+			start := time.Now()
+			// The envelope is uploaded first so an encrypted backup never
+			// exists without the key required for decrypting it.
+			err = s.copyEnvelope(b, remoteName)
+			if err == nil && s.c.BackupSplitSize > 0 {
+				err = s.copySplitArchive(b, file, remoteName)
+			} else if err == nil {
+				err = s.copyWithRetries(b, file, remoteName)
+				if err == nil && (s.c.BackupConfirmUpload || s.c.BackupVerifyUpload) {
+					err = s.confirmUpload(b, file, remoteName)
+				}
+			}
+			if err == nil {
+				err = s.copyChecksum(b, file, remoteName)
+			}
+			s.recordUpload(b.Name(), time.Since(start), err)
+			if err != nil {
+				return err
+			}
+			if s.checkpoint != nil {
+				s.checkpoint.complete(b.Name())
+			}
+			// The latest backup is uploaded after the actual backup, so it is
+			// always the newest file in the backend and will never become
+			// subject to pruning on its own.
+			switch {
+			case b.Name() == "Local" && s.c.BackupLatestSymlink != "":
+				// Local storage uses a symlink instead, which still requires
+				// the envelope to be stored next to it.
+				return s.copyEnvelope(b, s.c.BackupLatestSymlink)
+			case b.Name() == "Local":
+			case s.c.BackupLatestSymlink != "" && containsBackend(s.c.BackupLatestCopyBackends, b.Name()) && s.c.BackupSplitSize > 0:
+				// Copying split archives would defeat the purpose of splitting.
+				s.logger.Warn(
+					fmt.Sprintf("Skipping copy of latest backup to backend `%s` as BACKUP_SPLIT_SIZE is set.", b.Name()),
+				)
+			case s.c.BackupLatestSymlink != "" && containsBackend(s.c.BackupLatestCopyBackends, b.Name()):
+				if err := s.copyEnvelope(b, s.c.BackupLatestSymlink); err != nil {
+					return err
+				}
+				return s.withTimeout(b.Name(), func(ctx context.Context) error {
+					return b.Copy(ctx, file, s.c.BackupLatestSymlink)
+				})
+			case latestPointers[b.Name()] != "":
+				return s.withTimeout(b.Name(), func(ctx context.Context) error {
+					return b.Copy(ctx, latestPointers[b.Name()], s.c.BackupLatestSymlink)
+				})
+			}
+			return nil
 		})
 	}
-	if err := eg.Wait(); err != nil {
-		return errwrap.Wrap(err, "error copying archive")
+	// All errors are reported, as each of them is caused by a different
+	// backend.
+	eg.Wait()
+	if err := errors.Join(errs...); err != nil {
+		err = errwrap.Wrap(err, "error copying archive")
+		if s.checkpoint != nil && len(s.checkpoint.Completed) > 0 {
+			if cerr := s.saveCheckpoint(); cerr != nil {
+				err = errors.Join(err, errwrap.Wrap(cerr, "error saving checkpoint"))
+			}
+		} else if s.checkpoint != nil {
+			if cerr := s.clearCheckpoint(); cerr != nil {
+				err = errors.Join(err, errwrap.Wrap(cerr, "error clearing checkpoint"))
+			}
+		}
+		if !s.c.BackupContinueOnError || !slices.Contains(errs, nil) {
+			return err
+		}
+		partial := &partialFailureError{err: err}
+		for i, b := range s.storages {
+			if errs[i] == nil {
+				partial.succeeded = append(partial.succeeded, b.Name())
+			} else {
+				partial.failed = append(partial.failed, b.Name())
+			}
+		}
+		s.uploadErr = partial
+		s.logger.Warn(
+			fmt.Sprintf(
+				"Uploading the backup failed for storage backend(s) %s, continuing as BACKUP_CONTINUE_ON_ERROR is set.",
+				strings.Join(partial.failed, ", "),
+			),
+		)
+		s.recordUploadStats()
+		return nil
+	}
+
+	if s.checkpoint != nil {
+		if err := s.clearCheckpoint(); err != nil {
+			return errwrap.Wrap(err, "error clearing checkpoint")
+		}
+	}
+
+	s.recordUploadStats()
+	return nil
+}
+
+// partialFailureError is returned for runs that uploaded the backup to some
+// of the storage backends only, as per BACKUP_CONTINUE_ON_ERROR.
+type partialFailureError struct {
+	succeeded []string
+	failed    []string
+	err       error
+}
+
+func (p *partialFailureError) Error() string {
+	return fmt.Sprintf(
+		"backup was uploaded to %s, but failed for %s: %v",
+		strings.Join(p.succeeded, ", "), strings.Join(p.failed, ", "), p.err,
+	)
+}
+
+func (p *partialFailureError) Unwrap() error {
+	return p.err
+}
+
+// recordUploadStats adds the upload stats reported by storage backends to
+// the stats of the run.
+func (s *script) recordUploadStats() {
+	s.stats.Lock()
+	defer s.stats.Unlock()
+	for _, b := range s.storages {
+		reporter, ok := b.(storage.UploadReporter)
+		if !ok {
+			continue
+		}
+		upload := reporter.UploadStats()
+		stats := s.stats.Storages[b.Name()]
+		stats.UploadedBytes = uint64(upload.Bytes)
+		stats.UploadParts = uint(upload.Parts)
+		if upload.Duration > 0 {
+			stats.UploadThroughput = uint64(float64(upload.Bytes) / upload.Duration.Seconds())
+		}
+		s.stats.Storages[b.Name()] = stats
+	}
+}
+
+// copyWithRetries copies the given file to the given backend, retrying in
+// case of transient errors. The number of attempts is added to the stats of
+// the backend.
+func (s *script) copyWithRetries(b storage.Backend, file, name string) error {
+	attempts, err := s.withRetries(b.Name(), fmt.Sprintf("upload `%s`", name), func(ctx context.Context) error {
+		return b.Copy(ctx, file, name)
+	})
+	s.recordUploadAttempts(b.Name(), attempts)
+	return err
+}
+
+// recordUploadAttempts records the number of attempts an upload to the
+// backend with the given name took, keeping the maximum of all uploads.
+func (s *script) recordUploadAttempts(backend string, attempts uint) {
+	s.stats.Lock()
+	defer s.stats.Unlock()
+	stats := s.stats.Storages[backend]
+	stats.UploadAttempts = max(stats.UploadAttempts, attempts)
+	s.stats.Storages[backend] = stats
+}
+
+// remoteName returns the name the backup file is stored as in the backend
+// with the given name. Unless BACKUP_FILENAME_OVERRIDES contains a template
+// for the backend, this is the name of the local backup file. The name is
+// normalized as per BACKUP_KEY_LOWERCASE and BACKUP_KEY_SEPARATOR.
+func (s *script) remoteName(backend string) (string, error) {
+	override, ok := lookupBackend(s.c.BackupFilenameOverrides, backend)
+	if !ok {
+		_, name := path.Split(s.backendFile(backend))
+		return s.normalizeKey(name), nil
+	}
+	compression, err := s.backendCompression(backend)
+	if err != nil {
+		return "", err
+	}
+	name, err := s.renderFilename(override, compression)
+	if err != nil {
+		return "", errwrap.Wrap(err, "error rendering filename override")
+	}
+	if s.encrypted() {
+		name = fmt.Sprintf("%s.gpg", name)
+	}
+	return s.normalizeKey(name), nil
+}
+
+// pruningPrefix returns the pruning prefix to be used for the backend with
+// the given name, preferring BACKUP_PRUNING_PREFIX_OVERRIDES. The prefix is
+// normalized the same way remote names are, so it matches uploaded backups.
+func (s *script) pruningPrefix(backend string) string {
+	override, ok := lookupBackend(s.c.BackupPruningPrefixOverrides, backend)
+	if !ok {
+		return s.normalizeKey(s.c.BackupPruningPrefix)
+	}
+	if s.c.BackupFilenameExpand {
+		override = os.ExpandEnv(override)
+	}
+	return s.normalizeKey(override)
+}
+
+// unsafeKeyChars matches runs of characters that are replaced when
+// BACKUP_KEY_SEPARATOR is set.
+var unsafeKeyChars = regexp.MustCompile(`[^a-zA-Z0-9._/-]+`)
+
+// normalizeKey applies BACKUP_KEY_LOWERCASE and BACKUP_KEY_SEPARATOR to
+// the given object key. Path separators are kept as is.
+func (s *script) normalizeKey(key string) string {
+	if s.c.BackupKeyLowercase {
+		key = strings.ToLower(key)
+	}
+	if s.c.BackupKeySeparator != "" {
+		key = unsafeKeyChars.ReplaceAllString(key, s.c.BackupKeySeparator)
+	}
+	return key
+}
+
+// lookupBackend returns the value for the given backend name, ignoring case
+// on both sides.
+func lookupBackend[T any](values map[string]T, name string) (T, bool) {
+	for key, value := range values {
+		if strings.EqualFold(key, name) {
+			return value, true
+		}
+	}
+	var zero T
+	return zero, false
+}
+
+// prepareLatestPointer creates a local file named after BACKUP_LATEST_SYMLINK
+// that contains the given name of the latest backup.
+func (s *script) prepareLatestPointer(name string) (string, error) {
+	dir, err := s.tempDir("latest-pointer-*")
+	if err != nil {
+		return "", errwrap.Wrap(err, "error creating directory for latest pointer")
+	}
+	latestPointer := path.Join(dir, s.c.BackupLatestSymlink)
+	if err := os.WriteFile(latestPointer, []byte(name+"\n"), 0644); err != nil {
+		return "", errwrap.Wrap(err, "error writing latest pointer")
+	}
+	return latestPointer, nil
+}
+
+// tempDir creates a temporary directory which is removed after the
+// script has finished running.
+func (s *script) tempDir(pattern string) (string, error) {
+	dir, err := os.MkdirTemp("", pattern)
+	if err != nil {
+		return "", errwrap.Wrap(err, "error creating temporary directory")
 	}
+	s.registerHook(hookLevelPlumbing, func(error) error {
+		if err := remove(dir); err != nil {
+			return errwrap.Wrap(err, fmt.Sprintf("error removing temporary directory `%s`", dir))
+		}
+		return nil
+	})
+	return dir, nil
+}
 
+// confirmUpload looks up the file with the given name in the given backend
+// and returns an error in case it does not exist or its size does not match
+// the size of the given local backup file. In case BACKUP_VERIFY_UPLOAD is
+// set, the checksum of the uploaded file is compared as well.
+func (s *script) confirmUpload(b storage.Backend, file, name string) error {
+	stat, err := os.Stat(file)
+	if err != nil {
+		return errwrap.Wrap(err, "unable to stat backup file")
+	}
+	info, err := b.Stat(name)
+	if err != nil {
+		return errwrap.Wrap(err, fmt.Sprintf("error confirming upload to backend `%s`", b.Name()))
+	}
+	if info.Size != stat.Size() {
+		return errwrap.Wrap(
+			nil,
+			fmt.Sprintf(
+				"size of uploaded file in backend `%s` does not match, expected %d bytes, got %d",
+				b.Name(),
+				stat.Size(),
+				info.Size,
+			),
+		)
+	}
+	if s.c.BackupVerifyUpload {
+		if err := s.verifyUpload(b, file, name); err != nil {
+			return err
+		}
+	}
+	s.logger.Info(
+		fmt.Sprintf("Confirmed upload of `%s` to backend `%s`.", name, b.Name()),
+	)
 	return nil
 }
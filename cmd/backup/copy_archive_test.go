@@ -0,0 +1,278 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/offen/docker-volume-backup/internal/kms"
+	"github.com/offen/docker-volume-backup/internal/storage"
+	"github.com/offen/docker-volume-backup/internal/storage/local"
+)
+
+func TestRemoteName(t *testing.T) {
+	s := newScript(&Config{
+		BackupFilenameOverrides: map[string]string{"s3": "%Y/%m/backup.{{ .Extension }}"},
+		GpgPassphrase:           "secret",
+	})
+	s.stats.StartTime = time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	s.compression = "zst"
+	s.file = "/tmp/backup-2024-03-01.tar.zst.gpg"
+
+	tests := map[string]string{
+		"S3":    "2024/03/backup.tar.zst.gpg",
+		"Local": "backup-2024-03-01.tar.zst.gpg",
+	}
+	for backend, expected := range tests {
+		name, err := s.remoteName(backend)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if name != expected {
+			t.Errorf("Expected %s for backend %s, got %s", expected, backend, name)
+		}
+	}
+}
+
+func TestRemoteNameNormalized(t *testing.T) {
+	s := newScript(&Config{
+		BackupKeyLowercase:           true,
+		BackupKeySeparator:           "_",
+		BackupPruningPrefix:          "My Backup ",
+		BackupPruningPrefixOverrides: map[string]string{"s3": "Daily/My Backup "},
+		BackupFilenameOverrides:      map[string]string{"s3": "Daily/My Backup (%Y).tar"},
+	})
+	s.stats.StartTime = time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	s.file = "/tmp/My Backup (2024).tar"
+
+	tests := map[string][2]string{
+		"S3":    {"daily/my_backup_2024_.tar", "daily/my_backup_"},
+		"Local": {"my_backup_2024_.tar", "my_backup_"},
+	}
+	for backend, expected := range tests {
+		name, err := s.remoteName(backend)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if name != expected[0] {
+			t.Errorf("Expected name %s for backend %s, got %s", expected[0], backend, name)
+		}
+		if prefix := s.pruningPrefix(backend); prefix != expected[1] {
+			t.Errorf("Expected prefix %s for backend %s, got %s", expected[1], backend, prefix)
+		}
+	}
+}
+
+func TestRemoteNameCompressionOverrides(t *testing.T) {
+	s := newScript(&Config{
+		BackupFilename:             "backup.{{ .Extension }}",
+		BackupCompressionOverrides: map[string]string{"local": "none"},
+		BackupFilenameOverrides:    map[string]string{"s3": "daily/backup.{{ .Extension }}"},
+	})
+	s.compression = "gz"
+	s.file = "/tmp/backup.tar.gz"
+	s.variants = map[CompressionType]string{"none": "/tmp/backup.tar"}
+
+	tests := map[string][2]string{
+		"Local": {"/tmp/backup.tar", "backup.tar"},
+		"S3":    {"/tmp/backup.tar.gz", "daily/backup.tar.gz"},
+	}
+	for backend, expected := range tests {
+		if file := s.backendFile(backend); file != expected[0] {
+			t.Errorf("Expected file %s for backend %s, got %s", expected[0], backend, file)
+		}
+		name, err := s.remoteName(backend)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if name != expected[1] {
+			t.Errorf("Expected name %s for backend %s, got %s", expected[1], backend, name)
+		}
+	}
+}
+
+func TestStorageClass(t *testing.T) {
+	var class StorageClass
+	if err := class.Decode("GLACIER"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !class.Archived() {
+		t.Error("expected GLACIER to be archived")
+	}
+	if err := class.Decode("STANDARD_IA"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if class.Archived() {
+		t.Error("expected STANDARD_IA not to be archived")
+	}
+	if err := class.Decode("glacier"); err == nil {
+		t.Error("expected error decoding lowercase storage class")
+	}
+}
+
+func TestCopyArchiveParallel(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "backup.tar.gz")
+	if err := os.WriteFile(file, []byte("backup"), 0644); err != nil {
+		t.Fatalf("Unexpected error writing file: %v", err)
+	}
+
+	tests := []struct {
+		name             string
+		failFast         bool
+		expectedUploaded []string
+	}{
+		{"failures are isolated", false, []string{"S3", "WebDAV"}},
+		{"fail fast", true, []string{"S3"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			backends := []*mockBackend{
+				{name: "S3", uploads: map[string]int{}},
+				{name: "SSH", fail: true, uploads: map[string]int{}},
+				{name: "WebDAV", uploads: map[string]int{}},
+			}
+			// Using a single worker, uploads happen in the order of backends.
+			s := newScript(&Config{BackupParallelUploads: 1, BackupUploadFailFast: test.failFast})
+			s.file = file
+			for _, b := range backends {
+				s.storages = append(s.storages, b)
+			}
+
+			err := s.copyArchive()
+			if err == nil || !strings.Contains(err.Error(), "backend `SSH`") {
+				t.Errorf("Expected error to be attributed to SSH, got %v", err)
+			}
+			var uploaded []string
+			for _, b := range backends {
+				if b.uploads["backup.tar.gz"] == 1 {
+					uploaded = append(uploaded, b.name)
+				}
+				if stats := s.stats.Storages[b.name]; stats.Uploaded != slices.Contains(test.expectedUploaded, b.name) {
+					t.Errorf("Expected stats of %s to match uploads, got %v", b.name, stats.Uploaded)
+				}
+			}
+			if !slices.Equal(uploaded, test.expectedUploaded) {
+				t.Errorf("Expected uploads to %v, got %v", test.expectedUploaded, uploaded)
+			}
+			if stats := s.stats.Storages["SSH"]; stats.UploadError == "" {
+				t.Error("Expected upload error to be recorded for SSH")
+			}
+		})
+	}
+}
+
+func TestCopyArchiveContinueOnError(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "backup.tar.gz")
+	if err := os.WriteFile(file, []byte("backup"), 0644); err != nil {
+		t.Fatalf("Unexpected error writing file: %v", err)
+	}
+
+	s3 := &mockBackend{name: "S3", uploads: map[string]int{}}
+	ssh := &mockBackend{name: "SSH", fail: true, uploads: map[string]int{}}
+	s := newScript(&Config{BackupContinueOnError: true})
+	s.file = file
+	s.storages = []storage.Backend{s3, ssh}
+	if err := s.copyArchive(); err != nil {
+		t.Fatalf("Expected partial failure not to fail copying, got %v", err)
+	}
+	partial, ok := s.uploadErr.(*partialFailureError)
+	if !ok {
+		t.Fatalf("Expected partial failure to be recorded, got %v", s.uploadErr)
+	}
+	if !slices.Equal(partial.succeeded, []string{"S3"}) || !slices.Equal(partial.failed, []string{"SSH"}) {
+		t.Errorf("Unexpected outcome %v, %v", partial.succeeded, partial.failed)
+	}
+
+	s3.fail = true
+	s = newScript(&Config{BackupContinueOnError: true})
+	s.file = file
+	s.storages = []storage.Backend{s3, ssh}
+	if err := s.copyArchive(); err == nil {
+		t.Error("Expected error when all uploads fail")
+	}
+}
+
+func TestCopyArchiveLatestEnvelope(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "backup.tar.gz.gpg")
+	if err := os.WriteFile(file, []byte("backup"), 0644); err != nil {
+		t.Fatalf("Unexpected error writing file: %v", err)
+	}
+	envelope := filepath.Join(t.TempDir(), "envelope.json")
+	if err := os.WriteFile(envelope, []byte("{}"), 0644); err != nil {
+		t.Fatalf("Unexpected error writing envelope: %v", err)
+	}
+
+	archive := t.TempDir()
+	s3 := &mockBackend{name: "S3", uploads: map[string]int{}}
+	s := newScript(&Config{BackupLatestSymlink: "backup-latest.tar.gz.gpg", BackupLatestCopyBackends: []string{"S3"}})
+	s.file = file
+	s.envelope = envelope
+	s.storages = []storage.Backend{
+		s3,
+		local.NewStorageBackend(local.Config{ArchivePath: archive, LatestSymlink: s.c.BackupLatestSymlink}, func(storage.LogLevel, string, string, ...any) {}),
+	}
+	if err := s.copyArchive(); err != nil {
+		t.Fatalf("Unexpected error copying archive: %v", err)
+	}
+
+	for _, name := range []string{"backup.tar.gz.gpg", "backup-latest.tar.gz.gpg"} {
+		if s3.uploads[name+kms.EnvelopeSuffix] != 1 {
+			t.Errorf("Expected envelope of %s to be uploaded to S3, got %v", name, s3.uploads)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(archive, "backup-latest.tar.gz.gpg"+kms.EnvelopeSuffix)); err != nil {
+		t.Errorf("Expected envelope of latest backup to be stored locally, got %v", err)
+	}
+	target, err := os.Readlink(filepath.Join(archive, "backup-latest.tar.gz.gpg"))
+	if err != nil || target != "backup.tar.gz.gpg" {
+		t.Errorf("Expected latest symlink to point to the backup, got %s, %v", target, err)
+	}
+}
+
+func TestConfirmUpload(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "backup.tar.gz")
+	if err := os.WriteFile(file, []byte("content"), 0644); err != nil {
+		t.Fatalf("Unexpected error writing file: %v", err)
+	}
+	archive := t.TempDir()
+	b := local.NewStorageBackend(local.Config{ArchivePath: archive}, func(storage.LogLevel, string, string, ...any) {})
+
+	tests := []struct {
+		name     string
+		remote   []byte
+		expected string
+	}{
+		{"missing", nil, "error confirming upload to backend `Local`"},
+		{"size mismatch", []byte("cont"), "expected 7 bytes, got 4"},
+		{"matching", []byte("content"), ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			remote := filepath.Join(archive, "backup.tar.gz")
+			os.Remove(remote)
+			if test.remote != nil {
+				if err := os.WriteFile(remote, test.remote, 0644); err != nil {
+					t.Fatalf("Unexpected error writing file: %v", err)
+				}
+			}
+
+			s := newScript(&Config{})
+			err := s.confirmUpload(b, file, "backup.tar.gz")
+			if test.expected == "" {
+				if err != nil {
+					t.Errorf("Unexpected error: %v", err)
+				}
+				if !strings.Contains(s.stats.LogOutput.String(), "Confirmed upload of `backup.tar.gz` to backend `Local`.") {
+					t.Errorf("Expected confirmation to be logged, got %s", s.stats.LogOutput.String())
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), test.expected) {
+				t.Errorf("Expected error containing %q, got %v", test.expected, err)
+			}
+		})
+	}
+}
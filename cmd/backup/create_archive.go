@@ -5,8 +5,15 @@ package main
 
 import (
 	"fmt"
+	"io"
 	"io/fs"
+	"os"
+	"path"
 	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"time"
 
 	"github.com/offen/docker-volume-backup/internal/errwrap"
 	"github.com/otiai10/copy"
@@ -46,43 +53,615 @@ func (s *script) createArchive() error {
 		)
 	}
 
-	tarFile := s.file
-	s.registerHook(hookLevelPlumbing, func(error) error {
-		if err := remove(tarFile); err != nil {
-			return errwrap.Wrap(err, "error removing tar file")
-		}
-		s.logger.Info(
-			fmt.Sprintf("Removed tar file `%s`.", tarFile),
-		)
-		return nil
-	})
-
 	backupPath, err := filepath.Abs(stripTrailingSlashes(backupSources))
 	if err != nil {
 		return errwrap.Wrap(err, "error getting absolute path")
 	}
 
+	concurrency := s.compressionConcurrency()
+
+	changedSince, err := s.readChangedSinceMarker()
+	if err != nil {
+		return errwrap.Wrap(err, "error reading changed since marker")
+	}
+
+	largerThan, smallerThan := s.c.BackupExcludeLargerThan.Int64(), s.c.BackupExcludeSmallerThan.Int64()
+	var excludedBySize int
+	var excludedBytes uint64
+
+	var externalSymlinks int
+	rewrittenLinks := map[string]string{}
+
+	var estimator *compressibilityEstimator
+	if s.c.BackupAutoCompression && s.compression != "none" {
+		estimator = &compressibilityEstimator{}
+	}
+
+	exclusions, err := s.selfExclusions(backupPath)
+	if err != nil {
+		return errwrap.Wrap(err, "error determining self exclusions")
+	}
+
+	var rootDevice uint64
+	if s.c.BackupOneFileSystem {
+		info, err := os.Stat(backupPath)
+		if err != nil {
+			return errwrap.Wrap(err, "error getting file info for backup sources")
+		}
+		rootDevice, _ = deviceID(info)
+	}
+
 	var filesEligibleForBackup []string
 	if err := filepath.WalkDir(backupPath, func(path string, di fs.DirEntry, err error) error {
 		if err != nil {
 			return err
 		}
+		if err := s.checkCancelled(); err != nil {
+			return err
+		}
 
-		if s.c.BackupExcludeRegexp.Re != nil && s.c.BackupExcludeRegexp.Re.MatchString(path) {
+		if slices.Contains(exclusions, path) {
+			s.logger.Info(
+				fmt.Sprintf("Excluding `%s` from the archive as it is used by docker-volume-backup itself.", path),
+			)
+			if di.IsDir() {
+				return filepath.SkipDir
+			}
 			return nil
 		}
+
+		if s.c.skipTopLevelDirs && di.IsDir() && filepath.Dir(path) == backupPath {
+			return filepath.SkipDir
+		}
+
+		if excluded, skipContents := s.exclude.excluded(backupPath, path, di.IsDir()); excluded {
+			if skipContents {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if s.c.BackupOneFileSystem && di.IsDir() && path != backupPath {
+			info, err := di.Info()
+			if err != nil {
+				return errwrap.Wrap(err, fmt.Sprintf("error getting file info for %s", path))
+			}
+			if device, ok := deviceID(info); ok && device != rootDevice {
+				s.logger.Info(
+					fmt.Sprintf("Not descending into `%s` as it is located on a different filesystem.", path),
+				)
+				filesEligibleForBackup = append(filesEligibleForBackup, path)
+				return filepath.SkipDir
+			}
+		}
+
+		if di.Type()&fs.ModeSymlink == fs.ModeSymlink {
+			target, external, err := externalSymlinkTarget(path, backupPath)
+			if err != nil {
+				return errwrap.Wrap(err, fmt.Sprintf("error resolving symlink %s", path))
+			}
+			if external {
+				externalSymlinks++
+				switch s.c.BackupExternalSymlinks {
+				case "drop":
+					s.logger.Warn(
+						fmt.Sprintf("Dropping symlink `%s` from the archive as it points to `%s` outside of the backup sources.", path, target),
+					)
+					return nil
+				case "rewrite":
+					if filepath.IsAbs(target) {
+						rel, ok, err := rewriteSymlinkTarget(path, target, filepath.Dir(s.file))
+						if err != nil {
+							return errwrap.Wrap(err, fmt.Sprintf("error rewriting symlink %s", path))
+						}
+						if !ok {
+							s.logger.Warn(
+								fmt.Sprintf("Dropping symlink `%s` from the archive as its target `%s` cannot be expressed relative to the archive root.", path, target),
+							)
+							return nil
+						}
+						rewrittenLinks[path] = rel
+					}
+				}
+			}
+		}
+
+		if di.Type().IsRegular() && (!changedSince.IsZero() || largerThan > 0 || smallerThan > 0) {
+			info, err := di.Info()
+			if err != nil {
+				return errwrap.Wrap(err, fmt.Sprintf("error getting file info for %s", path))
+			}
+			if !changedSince.IsZero() && !info.ModTime().After(changedSince) {
+				return nil
+			}
+			if (largerThan > 0 && info.Size() > largerThan) || (smallerThan > 0 && info.Size() < smallerThan) {
+				excludedBySize++
+				excludedBytes += uint64(info.Size())
+				return nil
+			}
+		}
+		if estimator != nil && di.Type().IsRegular() {
+			if err := estimator.add(path, di); err != nil {
+				return errwrap.Wrap(err, fmt.Sprintf("error estimating compressibility of %s", path))
+			}
+		}
 		filesEligibleForBackup = append(filesEligibleForBackup, path)
 		return nil
 	}); err != nil {
 		return errwrap.Wrap(err, "error walking filesystem tree")
 	}
 
-	if err := createArchive(filesEligibleForBackup, backupSources, tarFile, s.c.BackupCompression.String(), s.c.GzipParallelism.Int()); err != nil {
+	metadataFile, err := s.writeVolumeMetadata(backupPath)
+	if err != nil {
+		return errwrap.Wrap(err, "error writing volume metadata")
+	}
+	if metadataFile != "" {
+		filesEligibleForBackup = append(filesEligibleForBackup, metadataFile)
+	}
+
+	manifestFile, err := s.writeIncrementalManifest()
+	if err != nil {
+		return errwrap.Wrap(err, "error writing incremental manifest")
+	}
+	if manifestFile != "" {
+		filesEligibleForBackup = append(filesEligibleForBackup, manifestFile)
+	}
+
+	if excludedBySize > 0 {
+		s.logger.Info(
+			fmt.Sprintf(
+				"Excluded %d file(s) totalling %s from the archive as their size was outside of the configured limits.",
+				excludedBySize,
+				formatBytes(excludedBytes, false),
+			),
+		)
+	}
+
+	if externalSymlinks > 0 {
+		switch s.c.BackupExternalSymlinks {
+		case "", "keep":
+			s.logger.Warn(
+				fmt.Sprintf(
+					"Archived %d symlink(s) pointing outside of the backup sources, these will not resolve when restoring to a different location. Set BACKUP_EXTERNAL_SYMLINKS to configure this behavior.",
+					externalSymlinks,
+				),
+			)
+		case "rewrite":
+			s.logger.Info(
+				fmt.Sprintf("Rewrote %d absolute symlink(s) pointing outside of the backup sources to be relative.", len(rewrittenLinks)),
+			)
+		}
+	}
+
+	if estimator != nil && estimator.mostlyIncompressible() {
+		s.logger.Info(
+			fmt.Sprintf(
+				"Contents of `%s` are mostly incompressible, skipping %s compression for this archive.",
+				backupSources,
+				s.compression,
+			),
+		)
+		s.compression = "none"
+		if err := s.resolveFile(); err != nil {
+			return errwrap.Wrap(err, "error resolving backup file")
+		}
+	}
+
+	tarFile := s.file
+	if !s.stream {
+		s.registerHook(hookLevelPlumbing, func(error) error {
+			if err := remove(tarFile); err != nil {
+				return errwrap.Wrap(err, "error removing tar file")
+			}
+			s.logger.Info(
+				fmt.Sprintf("Removed tar file `%s`.", tarFile),
+			)
+			return nil
+		})
+	}
+
+	for _, device := range s.c.BackupBlockDevices {
+		if err := checkBlockDevice(device); err != nil {
+			return errwrap.Wrap(err, "error checking block devices")
+		}
+	}
+
+	variants, err := s.compressionVariants()
+	if err != nil {
+		return errwrap.Wrap(err, "error determining compression overrides")
+	}
+	var additional []archiveOutput
+	for compression, file := range variants {
+		additional = append(additional, archiveOutput{path: file, compression: compression.String()})
+		s.registerHook(hookLevelPlumbing, func(error) error {
+			if err := remove(file); err != nil {
+				return errwrap.Wrap(err, "error removing tar file")
+			}
+			s.logger.Info(
+				fmt.Sprintf("Removed tar file `%s`.", file),
+			)
+			return nil
+		})
+	}
+	s.variants = variants
+
+	var checksums sourceChecksums
+	if s.c.BackupConsistencyCheck != "" {
+		checksums, err = checksumSources(filesEligibleForBackup, s.c.BackupConsistencyCheckSample.Int())
+		if err != nil {
+			return errwrap.Wrap(err, "error calculating checksums of backup sources")
+		}
+	}
+
+	var contents archiveStats
+	if s.stream {
+		if err := s.streamArchive(func(w io.Writer) (err error) {
+			output := archiveOutput{path: tarFile, compression: s.compression.String(), writer: w}
+			contents, err = createArchiveOutput(filesEligibleForBackup, backupSources, output, concurrency, s.c.BackupCompressionLevel, rewrittenLinks, s.c.BackupBlockDevices, int(s.c.BackupArchiveBufferSize.Int64()), nil)
+			return err
+		}); err != nil {
+			return errwrap.Wrap(err, "error streaming backup folder")
+		}
+	} else if contents, err = createArchive(filesEligibleForBackup, backupSources, tarFile, s.compression.String(), concurrency, s.c.BackupCompressionLevel, rewrittenLinks, s.c.BackupBlockDevices, int(s.c.BackupArchiveBufferSize.Int64()), additional); err != nil {
 		return errwrap.Wrap(err, "error compressing backup folder")
 	}
+	s.stats.BackupFile.Files = contents.files
+	s.stats.BackupFile.UncompressedSize = contents.size
+
+	if checksums != nil {
+		if err := s.checkConsistency(checksums); err != nil {
+			return errwrap.Wrap(err, "error checking consistency of backup sources")
+		}
+	}
 
+	if s.stream {
+		return nil
+	}
 	s.logger.Info(
 		fmt.Sprintf("Created backup of `%s` at `%s`.", backupSources, tarFile),
 	)
+	for _, file := range variants {
+		s.logger.Info(
+			fmt.Sprintf("Created additional backup of `%s` at `%s`.", backupSources, file),
+		)
+	}
 	return nil
 }
+
+// compressionVariants returns the location of an additional backup file for
+// each compression other than the default one that is configured for a
+// storage backend in BACKUP_COMPRESSION_OVERRIDES.
+func (s *script) compressionVariants() (map[CompressionType]string, error) {
+	variants := map[CompressionType]string{}
+	for _, b := range s.storages {
+		compression, err := s.backendCompression(b.Name())
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := variants[compression]; ok || compression == s.compression {
+			continue
+		}
+		filename, err := s.renderFilename(s.c.BackupFilename, compression)
+		if err != nil {
+			return nil, errwrap.Wrap(err, "error rendering backup filename")
+		}
+		file := filepath.Join("/tmp", filename)
+		if file == s.file {
+			return nil, errwrap.Wrap(nil, "BACKUP_FILENAME needs to contain `{{ .Extension }}` when using BACKUP_COMPRESSION_OVERRIDES or restic")
+		}
+		variants[compression] = file
+	}
+	return variants, nil
+}
+
+// backendCompression returns the compression used for the backup uploaded
+// to the backend with the given name, preferring BACKUP_COMPRESSION_OVERRIDES.
+// Backups stored in restic are not compressed by default, as restic would not
+// be able to deduplicate them otherwise.
+func (s *script) backendCompression(backend string) (CompressionType, error) {
+	override, ok := lookupBackend(s.c.BackupCompressionOverrides, backend)
+	if !ok {
+		if backend == "Restic" && !s.c.BackupStream {
+			return "none", nil
+		}
+		return s.compression, nil
+	}
+	var compression CompressionType
+	if err := compression.Decode(override); err != nil {
+		return "", errwrap.Wrap(err, fmt.Sprintf("invalid compression override for backend `%s`", backend))
+	}
+	return compression, nil
+}
+
+// backendFile returns the location of the backup file to be uploaded to the
+// backend with the given name.
+func (s *script) backendFile(backend string) string {
+	compression, err := s.backendCompression(backend)
+	if err != nil {
+		return s.file
+	}
+	if file, ok := s.variants[compression]; ok {
+		return file
+	}
+	return s.file
+}
+
+// selfExclusions returns the absolute locations within backupPath that are
+// used by the tool itself, i.e. the local archive, the directory backups are
+// staged in, the backup file itself and any additionally configured
+// locations. Locations containing backupPath are never excluded, so e.g.
+// backups from a snapshot in the staging directory keep working.
+func (s *script) selfExclusions(backupPath string) ([]string, error) {
+	candidates := append([]string{s.c.BackupArchive, os.TempDir(), s.file}, s.c.BackupSelfExclusions...)
+
+	var exclusions []string
+	for _, candidate := range candidates {
+		if candidate == "" {
+			continue
+		}
+		location, err := filepath.Abs(stripTrailingSlashes(candidate))
+		if err != nil {
+			return nil, errwrap.Wrap(err, fmt.Sprintf("error getting absolute path of %s", candidate))
+		}
+		if location == backupPath || isWithin(backupPath, location) {
+			continue
+		}
+		if isWithin(location, backupPath) {
+			exclusions = append(exclusions, location)
+		}
+	}
+	return exclusions, nil
+}
+
+// isWithin returns true if location is a descendant of dir.
+func isWithin(location, dir string) bool {
+	rel, err := filepath.Rel(dir, location)
+	if err != nil {
+		return false
+	}
+	return rel != "." && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+const (
+	// gzipMemoryPerBlock is the estimated memory used for compressing a single
+	// block of 1MiB using gzip, consisting of input and output buffers as well
+	// as the state of the compressor.
+	gzipMemoryPerBlock = 3 << 20
+	// zstdMemoryPerEncoder is the estimated memory used by a single zstd
+	// encoder using the default window size of 8MiB.
+	zstdMemoryPerEncoder = 16 << 20
+	// xzMemoryPerThread is the estimated memory used by a single xz thread
+	// using the default preset.
+	xzMemoryPerThread = 96 << 20
+)
+
+// archiveCompressions returns all distinct compressions the archive is
+// written with, i.e. the default one and the ones configured in
+// BACKUP_COMPRESSION_OVERRIDES. All of them are run at the same time.
+func (s *script) archiveCompressions() []CompressionType {
+	compressions := []CompressionType{s.compression}
+	for _, b := range s.storages {
+		// Overrides are validated when initializing the script.
+		compression, err := s.backendCompression(b.Name())
+		if err != nil || slices.Contains(compressions, compression) {
+			continue
+		}
+		compressions = append(compressions, compression)
+	}
+	return compressions
+}
+
+// compressionMemory returns the concurrency configured for the compression
+// of the archive and the estimated memory used by each of its workers. As
+// each compression runs the given number of workers, the memory is summed up
+// over all compressions the archive is written with. A memory of 0 means no
+// compression uses workers.
+func (s *script) compressionMemory() (int, int64) {
+	var concurrency int
+	if s.compression == "gz" {
+		concurrency = s.c.GzipParallelism.Int()
+	}
+	var perWorker int64
+	for _, compression := range s.archiveCompressions() {
+		switch compression {
+		case "gz":
+			perWorker += gzipMemoryPerBlock
+		case "zst":
+			perWorker += zstdMemoryPerEncoder
+		case "xz":
+			perWorker += xzMemoryPerThread
+		}
+	}
+	return concurrency, perWorker
+}
+
+// checkCompressionSettings returns an error in case the configured
+// compression settings contradict each other. Archives are always compressed
+// before being encrypted, so when compression is disabled, settings tuning
+// it would silently have no effect.
+func (s *script) checkCompressionSettings(compressions []CompressionType) error {
+	if s.compression == "none" && s.c.BackupAutoCompression {
+		return errwrap.Wrap(nil, "BACKUP_AUTO_COMPRESSION cannot be used when BACKUP_COMPRESSION is set to none")
+	}
+	if s.c.BackupCompressionLevel == "" {
+		return nil
+	}
+	for _, compression := range compressions {
+		if compression != "none" {
+			return nil
+		}
+	}
+	return errwrap.Wrap(nil, "BACKUP_COMPRESSION_LEVEL cannot be used when no backup is compressed")
+}
+
+// checkCompressionMemoryLimit returns an error in case the configured memory
+// limit does not fit a single worker of each compression.
+func (s *script) checkCompressionMemoryLimit() error {
+	_, perWorker := s.compressionMemory()
+	limit := s.c.BackupCompressionMemoryLimit.Int64()
+	if perWorker == 0 || limit <= 0 || limit >= perWorker {
+		return nil
+	}
+	return errwrap.Wrap(
+		nil,
+		fmt.Sprintf(
+			"BACKUP_COMPRESSION_MEMORY_LIMIT of %s is too low for %s compression, at least %s are required",
+			formatBytes(uint64(limit), false),
+			compressionNames(s.archiveCompressions()),
+			formatBytes(uint64(perWorker), false),
+		),
+	)
+}
+
+// compressionNames returns the given compressions as a human readable list.
+func compressionNames(compressions []CompressionType) string {
+	var names []string
+	for _, compression := range compressions {
+		if compression != "none" {
+			names = append(names, compression.String())
+		}
+	}
+	return strings.Join(names, " and ")
+}
+
+// compressionConcurrency returns the concurrency to be used when compressing
+// the archive. In case a memory limit is configured, the concurrency is
+// reduced so that the estimated memory usage of the compression buffers fits
+// the limit. A concurrency of 0 means the default of the compressor is used.
+// The limit is expected to have been checked when initializing the script.
+func (s *script) compressionConcurrency() int {
+	concurrency, perWorker := s.compressionMemory()
+	limit := s.c.BackupCompressionMemoryLimit.Int64()
+	if perWorker == 0 || limit <= 0 {
+		return concurrency
+	}
+
+	maxConcurrency := max(int(limit/perWorker), 1)
+	if concurrency == 0 {
+		concurrency = runtime.GOMAXPROCS(0)
+	}
+	if concurrency > maxConcurrency {
+		s.logger.Info(
+			fmt.Sprintf(
+				"Reducing compression parallelism from %d to %d to fit BACKUP_COMPRESSION_MEMORY_LIMIT of %s.",
+				concurrency,
+				maxConcurrency,
+				formatBytes(uint64(limit), false),
+			),
+		)
+		concurrency = maxConcurrency
+	}
+	return concurrency
+}
+
+// readChangedSinceMarker returns the modification time of the configured
+// marker file. Only files modified after this point in time are expected to
+// be archived. In case no marker is configured or it does not exist yet, the
+// zero time is returned, resulting in a full backup. On success, the marker
+// is updated to the start time of the current run and the name of the backup
+// is stored in it, so subsequent backups can refer to their base. In case a
+// full backup interval is configured, the marker is only updated by full
+// backups, which are forced once the marker is older than the interval.
+func (s *script) readChangedSinceMarker() (time.Time, error) {
+	marker := s.c.BackupChangedSinceMarker
+	if marker == "" {
+		return time.Time{}, nil
+	}
+
+	interval := s.c.BackupFullBackupInterval
+	var changedSince time.Time
+	fi, err := os.Stat(marker)
+	switch {
+	case err == nil && interval > 0 && s.stats.StartTime.Sub(fi.ModTime()) >= interval:
+		s.logger.Info(
+			fmt.Sprintf("Last full backup at %s as per marker `%s` is older than %s, all files will be archived.", fi.ModTime().Format(time.RFC3339), marker, interval),
+		)
+	case err == nil:
+		changedSince = fi.ModTime()
+		s.logger.Info(
+			fmt.Sprintf("Only files modified after %s will be archived as per marker `%s`.", changedSince.Format(time.RFC3339), marker),
+		)
+	case os.IsNotExist(err):
+		s.logger.Info(
+			fmt.Sprintf("Marker `%s` does not exist yet, all files will be archived.", marker),
+		)
+	default:
+		return time.Time{}, errwrap.Wrap(err, fmt.Sprintf("error checking for existence of marker `%s`", marker))
+	}
+
+	manifest := &IncrementalManifest{Type: backupTypeFull}
+	if !changedSince.IsZero() {
+		base, err := os.ReadFile(marker)
+		if err != nil {
+			return time.Time{}, errwrap.Wrap(err, fmt.Sprintf("error reading marker `%s`", marker))
+		}
+		manifest.Type = backupTypeIncremental
+		if interval > 0 {
+			manifest.Type = backupTypeDifferential
+		}
+		manifest.ChangedSince = &changedSince
+		manifest.Base = strings.TrimSpace(string(base))
+	}
+	s.stats.BackupFile.Incremental = manifest
+
+	// In case a full backup interval is configured, the marker keeps the time
+	// of the last full backup so subsequent runs are differential.
+	if interval > 0 && !changedSince.IsZero() {
+		return changedSince, nil
+	}
+
+	startTime := s.stats.StartTime
+	s.registerHook(hookLevelPlumbing, func(err error) error {
+		if err != nil {
+			return nil
+		}
+		if err := os.WriteFile(marker, []byte(path.Base(s.file)+"\n"), 0644); err != nil {
+			return errwrap.Wrap(err, "error writing changed since marker")
+		}
+		if err := touch(marker, startTime); err != nil {
+			return errwrap.Wrap(err, "error updating changed since marker")
+		}
+		s.logger.Info(
+			fmt.Sprintf("Updated marker `%s` to %s.", marker, startTime.Format(time.RFC3339)),
+		)
+		return nil
+	})
+
+	return changedSince, nil
+}
+
+// rewriteSymlinkTarget returns the target of the symlink at the given
+// location relative to the link. As archive entries are named after their
+// location with the given prefix trimmed, the relative target might point
+// outside of the directory the archive is extracted to, in which case false
+// is returned.
+func rewriteSymlinkTarget(location, target, prefix string) (string, bool, error) {
+	rel, err := filepath.Rel(filepath.Dir(location), target)
+	if err != nil {
+		return "", false, err
+	}
+	name := strings.TrimPrefix(strings.TrimPrefix(location, prefix), "/")
+	resolved := filepath.Clean(filepath.Join(filepath.Dir(name), rel))
+	if resolved == ".." || strings.HasPrefix(resolved, "../") {
+		return "", false, nil
+	}
+	return rel, true, nil
+}
+
+// externalSymlinkTarget reads the target of the symlink at the given location
+// and reports whether it points outside of the given root directory.
+func externalSymlinkTarget(location, root string) (string, bool, error) {
+	target, err := os.Readlink(location)
+	if err != nil {
+		return "", false, err
+	}
+	resolved := target
+	if !filepath.IsAbs(resolved) {
+		resolved = filepath.Join(filepath.Dir(location), resolved)
+	}
+	rel, err := filepath.Rel(root, filepath.Clean(resolved))
+	if err != nil {
+		return "", false, err
+	}
+	return target, rel == ".." || strings.HasPrefix(rel, "../"), nil
+}
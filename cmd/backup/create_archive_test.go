@@ -0,0 +1,232 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/offen/docker-volume-backup/internal/storage"
+)
+
+func TestCompressionConcurrency(t *testing.T) {
+	tests := []struct {
+		name                string
+		compression         string
+		overrides           map[string]string
+		parallelism         int
+		limit               int64
+		expectedConcurrency int
+		expectError         bool
+	}{
+		{"gz without limit", "gz", nil, 4, 0, 4, false},
+		{"gz within limit", "gz", nil, 2, 16 << 20, 2, false},
+		{"gz reduced", "gz", nil, 8, 10 << 20, 3, false},
+		{"gz too low", "gz", nil, 1, 1 << 20, 0, true},
+		{"zst without limit", "zst", nil, 1, 0, 0, false},
+		{"zst too low", "zst", nil, 1, 8 << 20, 0, true},
+		{"none", "none", nil, 1, 1, 0, false},
+		{"gz with zst override within limit", "gz", map[string]string{"s3": "zst"}, 2, 64 << 20, 2, false},
+		{"gz with zst override reduced", "gz", map[string]string{"s3": "zst"}, 8, 40 << 20, 2, false},
+		{"gz with xz override too low", "gz", map[string]string{"s3": "xz"}, 1, 64 << 20, 0, true},
+		{"gz with duplicate override", "gz", map[string]string{"s3": "gz", "local": "gz"}, 8, 10 << 20, 3, false},
+		{"none with zst override too low", "none", map[string]string{"s3": "zst"}, 1, 8 << 20, 0, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := newScript(&Config{
+				BackupCompression:            CompressionType(test.compression),
+				GzipParallelism:              WholeNumber(test.parallelism),
+				BackupCompressionMemoryLimit: ByteSize(test.limit),
+				BackupCompressionOverrides:   test.overrides,
+			})
+			s.storages = []storage.Backend{&mockBackend{name: "S3"}, &mockBackend{name: "Local"}}
+			if err := s.checkCompressionMemoryLimit(); (err != nil) != test.expectError {
+				t.Errorf("Unexpected error value %v", err)
+			}
+			if test.expectError {
+				return
+			}
+			if concurrency := s.compressionConcurrency(); concurrency != test.expectedConcurrency {
+				t.Errorf("Expected concurrency %d, got %d", test.expectedConcurrency, concurrency)
+			}
+		})
+	}
+}
+
+func TestReadChangedSinceMarkerFullBackupInterval(t *testing.T) {
+	tests := []struct {
+		name          string
+		markerAge     time.Duration
+		expectFull    bool
+		expectUpdated bool
+	}{
+		{"cold start", -1, true, true},
+		{"within interval", time.Hour, false, false},
+		{"interval elapsed", 48 * time.Hour, true, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			marker := filepath.Join(t.TempDir(), "marker")
+			var markerTime time.Time
+			if test.markerAge >= 0 {
+				markerTime = time.Now().Add(-test.markerAge).Truncate(time.Second)
+				if err := touch(marker, markerTime); err != nil {
+					t.Fatalf("Unexpected error creating marker: %v", err)
+				}
+			}
+
+			s := newScript(&Config{
+				BackupChangedSinceMarker: marker,
+				BackupFullBackupInterval: 24 * time.Hour,
+			})
+			changedSince, err := s.readChangedSinceMarker()
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if changedSince.IsZero() != test.expectFull {
+				t.Errorf("Expected full backup to be %v, got changed since %v", test.expectFull, changedSince)
+			}
+
+			if err := s.runHooks(nil); err != nil {
+				t.Fatalf("Unexpected error running hooks: %v", err)
+			}
+			fi, err := os.Stat(marker)
+			if err != nil {
+				t.Fatalf("Unexpected error reading marker: %v", err)
+			}
+			if updated := !fi.ModTime().Equal(markerTime); updated != test.expectUpdated {
+				t.Errorf("Expected marker update to be %v, got %v", test.expectUpdated, updated)
+			}
+		})
+	}
+}
+
+func TestSelfExclusions(t *testing.T) {
+	tests := []struct {
+		name       string
+		backupPath string
+		config     Config
+		expected   []string
+	}{
+		{
+			"sources unrelated",
+			"/backup",
+			Config{BackupArchive: "/archive"},
+			nil,
+		},
+		{
+			"broad sources",
+			"/",
+			Config{BackupArchive: "/archive/", BackupSelfExclusions: []string{"/data/cache"}},
+			[]string{"/archive", os.TempDir(), "/tmp/backup.tar.gz", "/data/cache"},
+		},
+		{
+			"sources in staging directory",
+			filepath.Join(os.TempDir(), "backup"),
+			Config{BackupArchive: filepath.Join(os.TempDir(), "backup", "archive")},
+			[]string{filepath.Join(os.TempDir(), "backup", "archive")},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := newScript(&test.config)
+			s.file = "/tmp/backup.tar.gz"
+			result, err := s.selfExclusions(test.backupPath)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if !slices.Equal(result, test.expected) {
+				t.Errorf("Expected %v, got %v", test.expected, result)
+			}
+		})
+	}
+}
+
+func TestIncrementalManifest(t *testing.T) {
+	dir := t.TempDir()
+	marker := filepath.Join(dir, "marker")
+
+	first := newScript(&Config{BackupChangedSinceMarker: marker})
+	first.file = filepath.Join(dir, "backup-1.tar.gz")
+	first.stats.StartTime = time.Now().Add(-time.Hour)
+	if _, err := first.readChangedSinceMarker(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if manifest := first.stats.BackupFile.Incremental; manifest.Type != backupTypeFull || manifest.Base != "" || manifest.ChangedSince != nil {
+		t.Errorf("Expected full backup, got %#v", manifest)
+	}
+	if err := first.runHooks(nil); err != nil {
+		t.Fatalf("Unexpected error running hooks: %v", err)
+	}
+
+	for _, interval := range []time.Duration{0, 24 * time.Hour} {
+		s := newScript(&Config{BackupChangedSinceMarker: marker, BackupFullBackupInterval: interval})
+		s.file = filepath.Join(dir, "backup-2.tar.gz")
+		if _, err := s.readChangedSinceMarker(); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		manifest := s.stats.BackupFile.Incremental
+		expectedType := backupTypeIncremental
+		if interval > 0 {
+			expectedType = backupTypeDifferential
+		}
+		if manifest.Type != expectedType {
+			t.Errorf("Expected type %s, got %s", expectedType, manifest.Type)
+		}
+		if manifest.Base != "backup-1.tar.gz" {
+			t.Errorf("Expected base backup-1.tar.gz, got %s", manifest.Base)
+		}
+		if manifest.ChangedSince == nil {
+			t.Error("Expected point in time of changes to be set")
+		}
+
+		location, err := s.writeIncrementalManifest()
+		if err != nil {
+			t.Fatalf("Unexpected error writing manifest: %v", err)
+		}
+		if location != filepath.Join(dir, incrementalManifestFile) {
+			t.Errorf("Unexpected location %s", location)
+		}
+		if _, err := os.Stat(location); err != nil {
+			t.Errorf("Expected manifest to be written: %v", err)
+		}
+		if err := s.runHooks(errors.New("failed")); err != nil {
+			t.Fatalf("Unexpected error running hooks: %v", err)
+		}
+		if _, err := os.Stat(location); !os.IsNotExist(err) {
+			t.Errorf("Expected manifest to be removed, got %v", err)
+		}
+	}
+}
+
+func TestRewriteSymlinkTarget(t *testing.T) {
+	tests := []struct {
+		name     string
+		location string
+		target   string
+		prefix   string
+		expected string
+		ok       bool
+	}{
+		{"absolute entry names", "/backup/app/link", "/etc/config", "/tmp", "../../etc/config", true},
+		{"target next to sources", "/archive/backup/app/link", "/archive/shared/config", "/archive", "../../shared/config", true},
+		{"target outside of archive root", "/archive/backup/app/link", "/etc/config", "/archive", "", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			result, ok, err := rewriteSymlinkTarget(test.location, test.target, test.prefix)
+			if err != nil {
+				t.Fatalf("Unexpected error %v", err)
+			}
+			if ok != test.ok || result != test.expected {
+				t.Errorf("Expected %q, %v, got %q, %v", test.expected, test.ok, result, ok)
+			}
+		})
+	}
+}
@@ -0,0 +1,69 @@
+// Copyright 2024 - offen.software <hioffen@posteo.de>
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"fmt"
+	"path"
+
+	"github.com/offen/docker-volume-backup/internal/errwrap"
+)
+
+// simulate runs through a backup run without stopping containers, creating an
+// archive, uploading or deleting any files, logging the actions that would
+// have been performed instead. The stats reflect the simulated run. In case
+// notifications are configured, a notification summarizing the run is sent.
+func (s *script) simulate() error {
+	s.dryRun = true
+	s.pruneDryRun = true
+
+	restart, err := s.stopContainersAndServices()
+	if err != nil {
+		return errwrap.Wrap(err, "error selecting containers to stop")
+	}
+	if err := restart(); err != nil {
+		return err
+	}
+
+	if s.encrypted() {
+		s.file = fmt.Sprintf("%s.gpg", s.file)
+	}
+	_, name := path.Split(s.file)
+	s.stats.BackupFile.Name = name
+	s.stats.BackupFile.FullPath = s.file
+	s.logger.Info(
+		fmt.Sprintf("Backup filename `%s` resolves to `%s`.", s.c.BackupFilename, name),
+	)
+	s.logger.Info(
+		fmt.Sprintf("Would create backup `%s` of `%s`.", s.file, s.c.BackupSources),
+	)
+
+	for _, b := range s.storages {
+		remoteName, err := s.remoteName(b.Name())
+		if err != nil {
+			return errwrap.Wrap(err, fmt.Sprintf("error determining name of backup in backend `%s`", b.Name()))
+		}
+		s.logger.Info(
+			fmt.Sprintf("Would upload `%s` to backend `%s` as `%s`.", name, b.Name(), remoteName),
+		)
+	}
+
+	if err := s.pruneBackups(); err != nil {
+		return err
+	}
+
+	s.logger.Info(
+		fmt.Sprintf(
+			"Dry run finished: %d container(s) would be stopped, %d backend(s) would receive the backup.",
+			s.stats.Containers.ToStop,
+			len(s.storages),
+		),
+	)
+	if len(s.senders) != 0 {
+		if err := s.notifyDryRun(); err != nil {
+			return errwrap.Wrap(err, "error sending dry run notification")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/offen/docker-volume-backup/internal/storage"
+	"github.com/offen/docker-volume-backup/internal/storage/local"
+)
+
+func TestSimulate(t *testing.T) {
+	archive := t.TempDir()
+	writeBackups(t, archive, 0, 48*time.Hour, 72*time.Hour)
+
+	s := newScript(&Config{BackupRetentionDays: 1, BackupSources: "/backup", BackupPruningPrefix: "backup-", BackupFilename: "backup-%Y-%m-%d.tar.gz"})
+	s.stats.StartTime = time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	if err := s.resolveFile(); err != nil {
+		t.Fatalf("Unexpected error resolving filename: %v", err)
+	}
+	s.storages = append(s.storages, local.NewStorageBackend(local.Config{ArchivePath: archive}, func(storage.LogLevel, string, string, ...any) {}))
+
+	if err := s.simulate(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	entries, err := os.ReadDir(archive)
+	if err != nil {
+		t.Fatalf("Unexpected error reading directory: %v", err)
+	}
+	if len(entries) != 3 {
+		t.Errorf("Expected no files to be deleted, got %d remaining", len(entries))
+	}
+	if pruned := s.stats.Storages["Local"].Pruned; pruned != 2 {
+		t.Errorf("Expected 2 simulated prunes, got %d", pruned)
+	}
+	if s.stats.BackupFile.Name != "backup-2024-03-01.tar.gz" {
+		t.Errorf("Unexpected backup file %s", s.stats.BackupFile.Name)
+	}
+	if !strings.Contains(s.stats.LogOutput.String(), "Backup filename `backup-%Y-%m-%d.tar.gz` resolves to `backup-2024-03-01.tar.gz`.") {
+		t.Errorf("Expected filename to be logged, got %s", s.stats.LogOutput.String())
+	}
+	if !strings.Contains(s.stats.LogOutput.String(), "Would upload `backup-2024-03-01.tar.gz` to backend `Local`") {
+		t.Errorf("Expected upload to be logged, got %s", s.stats.LogOutput.String())
+	}
+}
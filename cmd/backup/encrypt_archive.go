@@ -4,24 +4,156 @@
 package main
 
 import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"io"
 	"os"
 	"path"
+	"path/filepath"
 
 	openpgp "github.com/ProtonMail/go-crypto/openpgp/v2"
 	"github.com/offen/docker-volume-backup/internal/errwrap"
+	"github.com/offen/docker-volume-backup/internal/kms"
+	"github.com/offen/docker-volume-backup/internal/storage"
 )
 
-// encryptArchive encrypts the backup file using PGP and the configured passphrase.
-// In case no passphrase is given it returns early, leaving the backup file
-// untouched.
+// encryptArchive encrypts the backup file and any of its variants using PGP
+// and the configured public key ring, passphrase or a data key wrapped by the
+// configured key management service. In case none is given it returns early,
+// leaving the backup files untouched.
 func (s *script) encryptArchive() error {
-	if s.c.GpgPassphrase == "" {
+	// When streaming, the archive has been encrypted while uploading it.
+	if !s.encrypted() || s.stream {
 		return nil
 	}
 
-	gpgFile := fmt.Sprintf("%s.gpg", s.file)
+	passphrase := []byte(s.c.GpgPassphrase)
+	if s.keyWrapper != nil {
+		var err error
+		passphrase, err = s.newDataKey()
+		if err != nil {
+			return errwrap.Wrap(err, "error creating data key")
+		}
+	}
+
+	gpgFile, err := s.encryptFile(s.file, passphrase)
+	if err != nil {
+		return err
+	}
+	s.file = gpgFile
+
+	for compression, file := range s.variants {
+		gpgFile, err := s.encryptFile(file, passphrase)
+		if err != nil {
+			return err
+		}
+		s.variants[compression] = gpgFile
+	}
+	return nil
+}
+
+// encrypted returns whether backups are encrypted.
+func (s *script) encrypted() bool {
+	return s.c.GpgPassphrase != "" || s.keyWrapper != nil || s.publicKeyEncrypted()
+}
+
+// publicKeyEncrypted returns whether backups are encrypted to the recipients
+// of the configured public key ring. It takes precedence over a passphrase.
+func (s *script) publicKeyEncrypted() bool {
+	return len(s.c.GpgPublicKeyRing.Entities) > 0
+}
+
+// newDataKey generates a random data key and wraps it using the configured
+// key management service, writing the resulting envelope to a temporary
+// file. It returns the passphrase derived from the plaintext key, which is
+// never persisted.
+func (s *script) newDataKey() ([]byte, error) {
+	key, err := kms.NewDataKey()
+	if err != nil {
+		return nil, err
+	}
+	envelope, err := s.keyWrapper.Wrap(s.ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	b, err := json.MarshalIndent(envelope, "", "  ")
+	if err != nil {
+		return nil, errwrap.Wrap(err, "error marshaling envelope")
+	}
+	dir, err := s.tempDir("envelope-*")
+	if err != nil {
+		return nil, errwrap.Wrap(err, "error creating directory for envelope")
+	}
+	s.envelope = filepath.Join(dir, "envelope.json")
+	if err := os.WriteFile(s.envelope, b, 0600); err != nil {
+		return nil, errwrap.Wrap(err, "error writing envelope")
+	}
+	s.logger.Info(
+		fmt.Sprintf("Wrapped data key using key `%s`.", envelope.KeyID),
+	)
+	return dataKeyPassphrase(key), nil
+}
+
+// copyEnvelope uploads the envelope containing the wrapped data key next to
+// the backup with the given name. In case no key management service is used,
+// it does nothing.
+func (s *script) copyEnvelope(b storage.Backend, name string) error {
+	if s.envelope == "" {
+		return nil
+	}
+	if err := s.withTimeout(b.Name(), func(ctx context.Context) error {
+		return b.Copy(ctx, s.envelope, name+kms.EnvelopeSuffix)
+	}); err != nil {
+		return errwrap.Wrap(err, "error uploading envelope")
+	}
+	return nil
+}
+
+// decryptionPassphrase returns the passphrase for decrypting the backup with
+// the given name stored in the given backend. When using a key management
+// service, the envelope stored next to the backup is downloaded and the data
+// key is unwrapped.
+func (s *script) decryptionPassphrase(b storage.Backend, name string) ([]byte, error) {
+	if s.publicKeyEncrypted() {
+		return nil, errwrap.Wrap(nil, "backups encrypted using GPG_PUBLIC_KEY_RING can only be decrypted using the private key, which is not available")
+	}
+	if s.keyWrapper == nil {
+		if s.c.GpgPassphrase == "" {
+			return nil, errwrap.Wrap(nil, "GPG_PASSPHRASE or GPG_KMS_PROVIDER is required for decrypting backups")
+		}
+		return []byte(s.c.GpgPassphrase), nil
+	}
+
+	rc, err := b.Open(name+kms.EnvelopeSuffix, 0)
+	if err != nil {
+		return nil, errwrap.Wrap(err, "error opening envelope")
+	}
+	defer rc.Close()
+	var envelope kms.Envelope
+	if err := json.NewDecoder(rc).Decode(&envelope); err != nil {
+		return nil, errwrap.Wrap(err, "error decoding envelope")
+	}
+	key, err := s.keyWrapper.Unwrap(s.ctx, &envelope)
+	if err != nil {
+		return nil, err
+	}
+	return dataKeyPassphrase(key), nil
+}
+
+// dataKeyPassphrase returns the passphrase used for encrypting backups with
+// the given data key. The key is hex encoded so it can also be passed to gpg
+// when decrypting backups manually.
+func dataKeyPassphrase(key []byte) []byte {
+	return []byte(hex.EncodeToString(key))
+}
+
+// encryptFile encrypts the given file using the given passphrase, returning
+// the location of the encrypted file. In case a public key ring is configured,
+// the file is encrypted to its recipients instead.
+func (s *script) encryptFile(file string, passphrase []byte) (string, error) {
+	gpgFile := fmt.Sprintf("%s.gpg", file)
 	s.registerHook(hookLevelPlumbing, func(error) error {
 		if err := remove(gpgFile); err != nil {
 			return errwrap.Wrap(err, "error removing gpg file")
@@ -34,31 +166,51 @@ func (s *script) encryptArchive() error {
 
 	outFile, err := os.Create(gpgFile)
 	if err != nil {
-		return errwrap.Wrap(err, "error opening out file")
+		return "", errwrap.Wrap(err, "error opening out file")
 	}
 	defer outFile.Close()
 
-	_, name := path.Split(s.file)
-	dst, err := openpgp.SymmetricallyEncrypt(outFile, []byte(s.c.GpgPassphrase), &openpgp.FileHints{
-		FileName: name,
-	}, nil)
+	src, err := os.Open(file)
 	if err != nil {
-		return errwrap.Wrap(err, "error encrypting backup file")
+		return "", errwrap.Wrap(err, fmt.Sprintf("error opening backup file `%s`", file))
 	}
-	defer dst.Close()
+	defer src.Close()
 
-	src, err := os.Open(s.file)
+	_, name := path.Split(file)
+	dst, err := s.encryptWriter(outFile, name, passphrase)
 	if err != nil {
-		return errwrap.Wrap(err, fmt.Sprintf("error opening backup file `%s`", s.file))
+		return "", errwrap.Wrap(err, "error encrypting backup file")
 	}
 
 	if _, err := io.Copy(dst, src); err != nil {
-		return errwrap.Wrap(err, "error writing ciphertext to file")
+		dst.Close()
+		return "", errwrap.Wrap(err, "error writing ciphertext to file")
+	}
+	// Closing the writer writes the remaining packets of the OpenPGP message,
+	// so errors need to be checked for not to end up with a truncated file.
+	if err := dst.Close(); err != nil {
+		return "", errwrap.Wrap(err, "error finalizing ciphertext")
+	}
+	if err := outFile.Close(); err != nil {
+		return "", errwrap.Wrap(err, "error closing out file")
 	}
 
-	s.file = gpgFile
 	s.logger.Info(
-		fmt.Sprintf("Encrypted backup using given passphrase, saving as `%s`.", s.file),
+		fmt.Sprintf("Encrypted backup, saving as `%s`.", gpgFile),
 	)
-	return nil
+	return gpgFile, nil
+}
+
+// encryptWriter returns a writer encrypting all data written to it to the
+// given writer using the given passphrase. In case a public key ring is
+// configured, data is encrypted to its recipients instead. Callers need to
+// close the returned writer once all data has been written.
+func (s *script) encryptWriter(w io.Writer, name string, passphrase []byte) (io.WriteCloser, error) {
+	hints := &openpgp.FileHints{
+		FileName: name,
+	}
+	if s.publicKeyEncrypted() {
+		return openpgp.Encrypt(w, s.c.GpgPublicKeyRing.Entities, nil, nil, hints, nil)
+	}
+	return openpgp.SymmetricallyEncrypt(w, passphrase, hints, nil)
 }
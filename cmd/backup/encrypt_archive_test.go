@@ -0,0 +1,248 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	openpgp "github.com/ProtonMail/go-crypto/openpgp/v2"
+	"github.com/offen/docker-volume-backup/internal/kms"
+	"github.com/offen/docker-volume-backup/internal/storage"
+	"github.com/offen/docker-volume-backup/internal/storage/local"
+)
+
+// xorKeyWrapper stands in for a key management service.
+type xorKeyWrapper struct{}
+
+func (xorKeyWrapper) Wrap(_ context.Context, key []byte) (*kms.Envelope, error) {
+	wrapped := make([]byte, len(key))
+	for i := range key {
+		wrapped[i] = key[i] ^ 0xff
+	}
+	return &kms.Envelope{Provider: "test", KeyID: "key", WrappedKey: wrapped}, nil
+}
+
+func (w xorKeyWrapper) Unwrap(ctx context.Context, envelope *kms.Envelope) ([]byte, error) {
+	e, err := w.Wrap(ctx, envelope.WrappedKey)
+	return e.WrappedKey, err
+}
+
+func TestEncryptArchiveKMS(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "backup.tar.gz")
+	if err := os.WriteFile(file, []byte("content"), 0644); err != nil {
+		t.Fatalf("Unexpected error writing file: %v", err)
+	}
+
+	s := newScript(&Config{})
+	s.keyWrapper = xorKeyWrapper{}
+	s.file = file
+	if err := s.encryptArchive(); err != nil {
+		t.Fatalf("Unexpected error encrypting archive: %v", err)
+	}
+	if s.file != file+".gpg" || s.envelope == "" {
+		t.Fatalf("Expected encrypted file and envelope, got %s and %s", s.file, s.envelope)
+	}
+
+	b := local.NewStorageBackend(local.Config{ArchivePath: t.TempDir()}, func(storage.LogLevel, string, string, ...any) {})
+	name, err := s.remoteName(b.Name())
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := s.copyEnvelope(b, name); err != nil {
+		t.Fatalf("Unexpected error copying envelope: %v", err)
+	}
+	if err := b.Copy(context.Background(), s.file, name); err != nil {
+		t.Fatalf("Unexpected error copying backup: %v", err)
+	}
+
+	passphrase, err := s.decryptionPassphrase(b, name)
+	if err != nil {
+		t.Fatalf("Unexpected error retrieving passphrase: %v", err)
+	}
+	rc, err := b.Open(name, 0)
+	if err != nil {
+		t.Fatalf("Unexpected error opening backup: %v", err)
+	}
+	defer rc.Close()
+	r, err := decryptMessage(rc, passphrase)
+	if err != nil {
+		t.Fatalf("Unexpected error decrypting backup: %v", err)
+	}
+	plaintext, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("Unexpected error reading plaintext: %v", err)
+	}
+	if !bytes.Equal(plaintext, []byte("content")) {
+		t.Errorf("Unexpected plaintext %s", plaintext)
+	}
+
+	if _, err := s.decryptionPassphrase(b, "missing.tar.gz.gpg"); err == nil {
+		t.Error("Expected error for backup without envelope")
+	}
+}
+
+func TestEncryptArchivePublicKey(t *testing.T) {
+	entity, err := openpgp.NewEntity("backup", "", "backup@example.com", nil)
+	if err != nil {
+		t.Fatalf("Unexpected error generating key: %v", err)
+	}
+	var armored bytes.Buffer
+	w, err := armor.Encode(&armored, "PGP PUBLIC KEY BLOCK", nil)
+	if err != nil {
+		t.Fatalf("Unexpected error creating armor: %v", err)
+	}
+	if err := entity.Serialize(w); err != nil {
+		t.Fatalf("Unexpected error serializing key: %v", err)
+	}
+	w.Close()
+
+	var keyRing KeyRingDecoder
+	if err := keyRing.Decode(armored.String()); err != nil {
+		t.Fatalf("Unexpected error decoding key ring: %v", err)
+	}
+	if err := (&KeyRingDecoder{}).Decode("not a key"); err == nil {
+		t.Error("Expected error decoding invalid key ring")
+	}
+
+	file := filepath.Join(t.TempDir(), "backup.tar.gz")
+	if err := os.WriteFile(file, []byte("content"), 0644); err != nil {
+		t.Fatalf("Unexpected error writing file: %v", err)
+	}
+
+	s := newScript(&Config{GpgPassphrase: "ignored", GpgPublicKeyRing: keyRing})
+	s.file = file
+	if err := s.encryptArchive(); err != nil {
+		t.Fatalf("Unexpected error encrypting archive: %v", err)
+	}
+	if s.file != file+".gpg" {
+		t.Fatalf("Expected encrypted file, got %s", s.file)
+	}
+
+	f, err := os.Open(s.file)
+	if err != nil {
+		t.Fatalf("Unexpected error opening backup: %v", err)
+	}
+	defer f.Close()
+	md, err := openpgp.ReadMessage(f, openpgp.EntityList{entity}, nil, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error decrypting backup: %v", err)
+	}
+	plaintext, err := io.ReadAll(md.UnverifiedBody)
+	if err != nil {
+		t.Fatalf("Unexpected error reading plaintext: %v", err)
+	}
+	if !bytes.Equal(plaintext, []byte("content")) {
+		t.Errorf("Unexpected plaintext %s", plaintext)
+	}
+
+	if _, err := s.decryptionPassphrase(nil, "backup.tar.gz.gpg"); err == nil {
+		t.Error("Expected error retrieving passphrase for public key encryption")
+	}
+}
+
+func TestEncryptArchiveCompressesFirst(t *testing.T) {
+	root := t.TempDir()
+	source := filepath.Join(root, "backup")
+	if err := os.MkdirAll(source, 0755); err != nil {
+		t.Fatalf("Unexpected error creating directory: %v", err)
+	}
+	file := filepath.Join(source, "file.txt")
+	if err := os.WriteFile(file, []byte("content"), 0644); err != nil {
+		t.Fatalf("Unexpected error writing file: %v", err)
+	}
+
+	compressed := filepath.Join(root, "backup.tar.gz")
+	raw := filepath.Join(root, "backup.tar")
+	if _, err := createArchive([]string{source, file}, source, compressed, "gz", 1, "", nil, nil, 0, []archiveOutput{{path: raw, compression: "none"}}); err != nil {
+		t.Fatalf("Unexpected error creating archive: %v", err)
+	}
+
+	s := newScript(&Config{GpgPassphrase: "secret"})
+	s.file = compressed
+	s.variants = map[CompressionType]string{"none": raw}
+	if err := s.encryptArchive(); err != nil {
+		t.Fatalf("Unexpected error encrypting archive: %v", err)
+	}
+
+	for _, test := range []struct {
+		file       string
+		compressed bool
+	}{
+		{s.file, true},
+		{s.variants["none"], false},
+	} {
+		f, err := os.Open(test.file)
+		if err != nil {
+			t.Fatalf("Unexpected error opening backup: %v", err)
+		}
+		defer f.Close()
+		r, err := decryptMessage(f, []byte("secret"))
+		if err != nil {
+			t.Fatalf("Unexpected error decrypting %s: %v", test.file, err)
+		}
+		if test.compressed {
+			if r, err = gzip.NewReader(r); err != nil {
+				t.Fatalf("Expected %s to contain a gzip stream, got %v", test.file, err)
+			}
+		}
+		hdr, err := tar.NewReader(r).Next()
+		if err != nil {
+			t.Fatalf("Expected %s to contain a tar archive, got %v", test.file, err)
+		}
+		if hdr.Name != "/backup" {
+			t.Errorf("Unexpected first entry %s in %s", hdr.Name, test.file)
+		}
+	}
+}
+
+func TestEncryptFile(t *testing.T) {
+	if _, err := os.Stat("/proc/self/fd"); err != nil {
+		t.Skip("Counting open files is not supported")
+	}
+	openFiles := func() int {
+		entries, err := os.ReadDir("/proc/self/fd")
+		if err != nil {
+			t.Fatalf("Unexpected error reading open files: %v", err)
+		}
+		return len(entries)
+	}
+
+	file := filepath.Join(t.TempDir(), "backup.tar.gz")
+	content := bytes.Repeat([]byte("content"), 1<<16)
+	if err := os.WriteFile(file, content, 0644); err != nil {
+		t.Fatalf("Unexpected error writing file: %v", err)
+	}
+
+	s := newScript(&Config{GpgPassphrase: "secret"})
+	before := openFiles()
+	gpgFile, err := s.encryptFile(file, []byte("secret"))
+	if err != nil {
+		t.Fatalf("Unexpected error encrypting file: %v", err)
+	}
+	if after := openFiles(); after != before {
+		t.Errorf("Expected %d open files, got %d", before, after)
+	}
+
+	f, err := os.Open(gpgFile)
+	if err != nil {
+		t.Fatalf("Unexpected error opening encrypted file: %v", err)
+	}
+	defer f.Close()
+	r, err := decryptMessage(f, []byte("secret"))
+	if err != nil {
+		t.Fatalf("Unexpected error decrypting file: %v", err)
+	}
+	decrypted, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("Unexpected error reading decrypted file: %v", err)
+	}
+	if !bytes.Equal(decrypted, content) {
+		t.Errorf("Expected %d bytes to be decrypted, got %d", len(content), len(decrypted))
+	}
+}
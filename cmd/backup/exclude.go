@@ -0,0 +1,177 @@
+// Copyright 2024 - offen.software <hioffen@posteo.de>
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/offen/docker-volume-backup/internal/errwrap"
+)
+
+// excludeMatcher decides which files in the backup sources are excluded from
+// the archive, using BACKUP_EXCLUDE and BACKUP_EXCLUDE_REGEXP.
+type excludeMatcher struct {
+	// regexps are matched against the full path of a file.
+	regexps []*regexp.Regexp
+	// globs are matched against the path relative to the backup sources, the
+	// last matching one deciding whether a file is excluded.
+	globs []globPattern
+}
+
+// globPattern is a gitignore-style pattern compiled to a regular expression.
+type globPattern struct {
+	re      *regexp.Regexp
+	negate  bool
+	dirOnly bool
+}
+
+// newExcludeMatcher compiles the exclusions configured in the given config.
+// It returns nil in case nothing is excluded.
+func newExcludeMatcher(c *Config) (*excludeMatcher, error) {
+	m := &excludeMatcher{}
+	if c.BackupExcludeRegexp.Re != nil {
+		m.regexps = append(m.regexps, c.BackupExcludeRegexp.Re)
+	}
+
+	switch c.BackupExcludeMode {
+	case "", "regexp":
+		for _, pattern := range c.BackupExclude {
+			re, err := regexp.Compile(pattern)
+			if err != nil {
+				return nil, errwrap.Wrap(err, fmt.Sprintf("error compiling exclude pattern `%s`", pattern))
+			}
+			m.regexps = append(m.regexps, re)
+		}
+	case "glob":
+		for _, pattern := range globPatterns(c.BackupExclude) {
+			glob, err := compileGlob(pattern)
+			if err != nil {
+				return nil, errwrap.Wrap(err, fmt.Sprintf("error compiling exclude pattern `%s`", pattern))
+			}
+			m.globs = append(m.globs, glob)
+		}
+	default:
+		return nil, errwrap.Wrap(nil, fmt.Sprintf("unknown value for BACKUP_EXCLUDE_MODE: %s", c.BackupExcludeMode))
+	}
+
+	if len(m.regexps) == 0 && len(m.globs) == 0 {
+		return nil, nil
+	}
+	return m, nil
+}
+
+// excluded returns whether the file at the given path within the given root
+// is excluded from the archive. Directories excluded by a glob are excluded
+// including all of their contents, which is signaled by the second return
+// value, so, like in gitignore, files within them cannot be included again.
+// Regexps only exclude the paths they match.
+func (m *excludeMatcher) excluded(root, path string, isDir bool) (bool, bool) {
+	if m == nil {
+		return false, false
+	}
+	for _, re := range m.regexps {
+		if re.MatchString(path) {
+			return true, false
+		}
+	}
+
+	rel, err := filepath.Rel(root, path)
+	if err != nil || rel == "." {
+		return false, false
+	}
+	rel = filepath.ToSlash(rel)
+	var excluded bool
+	for _, glob := range m.globs {
+		if glob.dirOnly && !isDir {
+			continue
+		}
+		if glob.re.MatchString(rel) {
+			excluded = !glob.negate
+		}
+	}
+	return excluded, excluded && isDir
+}
+
+// globPatterns splits the given lines of glob patterns on commas in addition,
+// which, unlike in regular expressions, are not used in glob patterns.
+func globPatterns(lines []string) []string {
+	var patterns []string
+	for _, line := range lines {
+		for _, pattern := range strings.Split(line, ",") {
+			if pattern = strings.TrimSpace(pattern); pattern != "" {
+				patterns = append(patterns, pattern)
+			}
+		}
+	}
+	return patterns
+}
+
+// compileGlob translates a gitignore-style pattern into a regular expression
+// matching paths relative to the backup sources. A leading `!` negates the
+// pattern, a trailing `/` matches directories only and patterns without a
+// slash match at any depth. `*` and `?` do not match slashes, `**` matches any
+// number of directories.
+func compileGlob(pattern string) (globPattern, error) {
+	var glob globPattern
+	if strings.HasPrefix(pattern, "!") {
+		glob.negate = true
+		pattern = pattern[1:]
+	}
+	if strings.HasSuffix(pattern, "/") {
+		glob.dirOnly = true
+		pattern = strings.TrimRight(pattern, "/")
+	}
+	if pattern == "" {
+		return glob, errwrap.Wrap(nil, "pattern is empty")
+	}
+
+	expr := &strings.Builder{}
+	expr.WriteString("^")
+	if !strings.Contains(pattern, "/") {
+		expr.WriteString("(?:.*/)?")
+	}
+	pattern = strings.TrimPrefix(pattern, "/")
+
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; {
+		case strings.HasPrefix(pattern[i:], "**/"):
+			expr.WriteString("(?:.*/)?")
+			i += 2
+		case strings.HasPrefix(pattern[i:], "**") && i+2 == len(pattern):
+			expr.WriteString(".*")
+			i++
+		case c == '*':
+			expr.WriteString("[^/]*")
+		case c == '?':
+			expr.WriteString("[^/]")
+		case c == '[':
+			end := strings.IndexByte(pattern[i+1:], ']')
+			if end < 0 {
+				return glob, errwrap.Wrap(nil, "unterminated character class")
+			}
+			class := pattern[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			expr.WriteString("[" + class + "]")
+			i += end + 1
+		case c == '\\' && i+1 < len(pattern):
+			i++
+			expr.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+		default:
+			expr.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+		}
+	}
+	expr.WriteString("$")
+
+	re, err := regexp.Compile(expr.String())
+	if err != nil {
+		return glob, errwrap.Wrap(err, "error compiling pattern")
+	}
+	glob.re = re
+	return glob, nil
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"reflect"
+	"regexp"
+	"testing"
+)
+
+func TestPatternListDecode(t *testing.T) {
+	var p PatternList
+	if err := p.Decode("\\.log$\n ^/backup/cache\n\n^/backup/[0-9]{2,3}/\n"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	expected := PatternList{`\.log$`, "^/backup/cache", "^/backup/[0-9]{2,3}/"}
+	if !reflect.DeepEqual(p, expected) {
+		t.Errorf("Expected %v, got %v", expected, p)
+	}
+}
+
+func TestExcludeMatcher(t *testing.T) {
+	type check struct {
+		path         string
+		isDir        bool
+		excluded     bool
+		skipContents bool
+	}
+	tests := []struct {
+		name        string
+		config      *Config
+		checks      []check
+		expectError bool
+	}{
+		{
+			"nothing excluded",
+			&Config{},
+			[]check{{"/backup/app.log", false, false, false}},
+			false,
+		},
+		{
+			"regexps",
+			&Config{
+				BackupExcludeRegexp: RegexpDecoder{Re: regexp.MustCompile(`\.tmp$`)},
+				BackupExclude:       PatternList{`\.log$`, `^/backup/cache`, `^/backup/[0-9]{2,3}/`},
+			},
+			[]check{
+				{"/backup/app.log", false, true, false},
+				{"/backup/data.tmp", false, true, false},
+				{"/backup/cache", true, true, false},
+				{"/backup/123/data", false, true, false},
+				{"/backup/1/data", false, false, false},
+				{"/backup/data/db.sqlite", false, false, false},
+			},
+			false,
+		},
+		{
+			"globs",
+			&Config{
+				BackupExcludeRegexp: RegexpDecoder{Re: regexp.MustCompile(`\.tmp$`)},
+				BackupExclude:       PatternList{"*.log, !important.log", "/cache/", "node_modules/", "data/**/*.bak,build/**"},
+				BackupExcludeMode:   "glob",
+			},
+			[]check{
+				{"/backup/app.log", false, true, false},
+				{"/backup/nested/dir/app.log", false, true, false},
+				{"/backup/nested/important.log", false, false, false},
+				{"/backup/data.tmp", false, true, false},
+				{"/backup/cache", true, true, true},
+				{"/backup/nested/cache", true, false, false},
+				{"/backup/cache", false, false, false},
+				{"/backup/app/node_modules", true, true, true},
+				{"/backup/data/db.bak", false, true, false},
+				{"/backup/data/a/b/db.bak", false, true, false},
+				{"/backup/other/db.bak", false, false, false},
+				{"/backup/build", true, false, false},
+				{"/backup/build/out/bin", false, true, false},
+				{"/backup/data/db.sqlite", false, false, false},
+			},
+			false,
+		},
+		{
+			"invalid regexp",
+			&Config{BackupExclude: PatternList{"(unclosed"}},
+			nil,
+			true,
+		},
+		{
+			"invalid glob",
+			&Config{BackupExclude: PatternList{"[unclosed"}, BackupExcludeMode: "glob"},
+			nil,
+			true,
+		},
+		{
+			"unknown mode",
+			&Config{BackupExclude: PatternList{"*.log"}, BackupExcludeMode: "gitignore"},
+			nil,
+			true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m, err := newExcludeMatcher(test.config)
+			if (err != nil) != test.expectError {
+				t.Fatalf("Unexpected error value %v", err)
+			}
+			for _, c := range test.checks {
+				excluded, skipContents := m.excluded("/backup", c.path, c.isDir)
+				if excluded != c.excluded || skipContents != c.skipContents {
+					t.Errorf("%s: expected %v, %v, got %v, %v", c.path, c.excluded, c.skipContents, excluded, skipContents)
+				}
+			}
+		})
+	}
+}
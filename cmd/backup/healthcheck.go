@@ -0,0 +1,84 @@
+// Copyright 2024 - offen.software <hioffen@posteo.de>
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/offen/docker-volume-backup/internal/errwrap"
+)
+
+const (
+	// healthcheckTimeout limits the time spent pinging the healthcheck URL.
+	healthcheckTimeout = 10 * time.Second
+	// healthcheckMaxBody is the maximum size of the log output sent with a
+	// ping. Longer output is truncated from the start.
+	healthcheckMaxBody = 100_000
+)
+
+// initHealthcheck sends a start ping to the configured healthcheck URL and
+// registers a hook that sends a success or failure ping including the log
+// output once the run has finished. Failing pings are logged only. In case
+// no healthcheck URL is configured, it does nothing.
+func (s *script) initHealthcheck() {
+	if s.c.NotificationHealthcheckURL == "" || s.task {
+		return
+	}
+
+	s.pingHealthcheck("/start", nil)
+	// The hook is registered at the error level so that success pings are
+	// sent when NOTIFICATION_LEVEL is set to error too. Otherwise, the
+	// healthcheck would consider the backup to be missing.
+	s.registerHook(hookLevelError, func(err error) error {
+		if s.retryPending(err) {
+			return nil
+		}
+		suffix := ""
+		if err != nil {
+			suffix = "/fail"
+		}
+		output := s.stats.LogOutput.Bytes()
+		if len(output) > healthcheckMaxBody {
+			output = output[len(output)-healthcheckMaxBody:]
+		}
+		s.pingHealthcheck(suffix, output)
+		return nil
+	})
+}
+
+// pingHealthcheck sends the given body to the healthcheck URL using the
+// given suffix. Errors are logged as warnings as a failing ping is not
+// supposed to fail the backup.
+func (s *script) pingHealthcheck(suffix string, body []byte) {
+	if err := pingHealthcheck(s.c.NotificationHealthcheckURL, suffix, body); err != nil {
+		s.logger.Warn(
+			fmt.Sprintf("Failed to ping healthcheck URL: %v", errwrap.Unwrap(err)),
+		)
+	}
+}
+
+func pingHealthcheck(url, suffix string, body []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), healthcheckTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(url, "/")+suffix, bytes.NewReader(body))
+	if err != nil {
+		return errwrap.Wrap(err, "error creating request")
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return errwrap.Wrap(err, "error sending request")
+	}
+	defer res.Body.Close()
+	if res.StatusCode >= 300 {
+		return errwrap.Wrap(nil, fmt.Sprintf("unexpected status code %d", res.StatusCode))
+	}
+	return nil
+}
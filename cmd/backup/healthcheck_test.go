@@ -0,0 +1,55 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestHealthcheck(t *testing.T) {
+	var paths []string
+	var body string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		paths = append(paths, r.URL.Path)
+		body = string(b)
+	}))
+	defer server.Close()
+
+	for _, test := range []struct {
+		name     string
+		err      error
+		expected []string
+	}{
+		{"success", nil, []string{"/ping/start", "/ping"}},
+		{"failure", errors.New("failed"), []string{"/ping/start", "/ping/fail"}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			paths = nil
+			s := newScript(&Config{NotificationHealthcheckURL: server.URL + "/ping/"})
+			s.hookLevel = hookLevelError
+			s.initHealthcheck()
+			s.logger.Info("Created backup.")
+			if err := s.runHooks(test.err); err != nil {
+				t.Fatalf("Unexpected error running hooks: %v", err)
+			}
+			if !slices.Equal(paths, test.expected) {
+				t.Errorf("Expected pings %v, got %v", test.expected, paths)
+			}
+			if !strings.Contains(body, "Created backup.") {
+				t.Errorf("Expected log output to be sent, got %s", body)
+			}
+		})
+	}
+
+	server.Close()
+	s := newScript(&Config{NotificationHealthcheckURL: server.URL})
+	s.initHealthcheck()
+	if err := s.runHooks(nil); err != nil {
+		t.Errorf("Expected failing ping to be logged only, got %v", err)
+	}
+}
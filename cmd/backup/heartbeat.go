@@ -0,0 +1,66 @@
+// Copyright 2024 - offen.software <hioffen@posteo.de>
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/offen/docker-volume-backup/internal/errwrap"
+)
+
+// warnEmptySchedule is expected to be called when none of the given
+// configurations is scheduled to ever run. It logs a warning and sends a
+// notification using the notification settings of each configuration. In case
+// a configuration defines a heartbeat, the notification is repeated on the
+// given schedule.
+func (c *command) warnEmptySchedule(configurations []*Config) error {
+	c.logger.Warn(
+		"None of the available configurations is scheduled to ever run, no backups will be created. Please check your configuration.",
+	)
+
+	for _, cfg := range configurations {
+		config := cfg
+		c.notifyEmptySchedule(config)
+
+		if config.NotificationHeartbeatCronExpression == "" {
+			continue
+		}
+		id, err := c.cr.AddFunc(config.cronSpec(config.NotificationHeartbeatCronExpression), func() {
+			c.notifyEmptySchedule(config)
+		})
+		if err != nil {
+			return errwrap.Wrap(err, fmt.Sprintf("error adding heartbeat schedule %s", config.NotificationHeartbeatCronExpression))
+		}
+		c.schedules[id] = fmt.Sprintf("heartbeat %s with expression %s", config.source, config.cronSpec(config.NotificationHeartbeatCronExpression))
+		c.logger.Info(
+			fmt.Sprintf("Successfully scheduled heartbeat %s with expression %s", config.source, config.NotificationHeartbeatCronExpression),
+		)
+	}
+	return nil
+}
+
+// notifyEmptySchedule sends a notification about no backups being scheduled
+// using the notification settings of the given configuration. Errors are
+// logged only.
+func (c *command) notifyEmptySchedule(config *Config) {
+	s := newScript(config)
+	if err := s.initNotifications(); err != nil {
+		c.logger.Error(
+			fmt.Sprintf("Unexpected error initializing notifications for %s: %v", config.source, errwrap.Unwrap(err)),
+			"error",
+			err,
+		)
+		return
+	}
+	if len(s.senders) == 0 {
+		return
+	}
+	if err := s.notifyEmptySchedule(); err != nil {
+		c.logger.Error(
+			fmt.Sprintf("Unexpected error sending notification for %s: %v", config.source, errwrap.Unwrap(err)),
+			"error",
+			err,
+		)
+	}
+}
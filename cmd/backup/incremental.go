@@ -0,0 +1,78 @@
+// Copyright 2024 - offen.software <hioffen@posteo.de>
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"time"
+
+	"github.com/offen/docker-volume-backup/internal/errwrap"
+)
+
+// incrementalManifestFile is the name of the file describing which backup
+// an archive created using BACKUP_CHANGED_SINCE_MARKER is based on. It is
+// stored at the root of the archive.
+const incrementalManifestFile = "docker-volume-backup.incremental.json"
+
+const (
+	backupTypeFull         = "full"
+	backupTypeIncremental  = "incremental"
+	backupTypeDifferential = "differential"
+)
+
+// IncrementalManifest describes the contents of a backup created using
+// BACKUP_CHANGED_SINCE_MARKER. Restoring a backup that is not of type full
+// requires restoring the backup named in Base first.
+type IncrementalManifest struct {
+	// Type is one of full, incremental or differential.
+	Type string
+	// ChangedSince is the point in time after which files have been modified
+	// to be contained in the backup. It is nil for full backups.
+	ChangedSince *time.Time `json:",omitempty"`
+	// Base is the name of the backup the contained changes are relative to.
+	// It is empty for full backups and in case the name is not known, e.g.
+	// when the marker has been created by a previous version.
+	Base string `json:",omitempty"`
+}
+
+// writeIncrementalManifest writes the manifest collected when reading the
+// changed since marker to a file which is expected to be added to the
+// archive. It returns the location of the file, or an empty string in case
+// no marker is configured.
+func (s *script) writeIncrementalManifest() (string, error) {
+	manifest := s.stats.BackupFile.Incremental
+	if manifest == nil {
+		return "", nil
+	}
+
+	b, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return "", errwrap.Wrap(err, "error marshaling incremental manifest")
+	}
+
+	// Files located next to the archive are stored at the root of the archive.
+	location := path.Join(path.Dir(s.file), incrementalManifestFile)
+	if err := os.MkdirAll(path.Dir(location), 0755); err != nil {
+		return "", errwrap.Wrap(err, "error creating directory for incremental manifest")
+	}
+	if err := os.WriteFile(location, b, 0644); err != nil {
+		return "", errwrap.Wrap(err, "error writing incremental manifest")
+	}
+	s.registerHook(hookLevelPlumbing, func(error) error {
+		if err := remove(location); err != nil {
+			return errwrap.Wrap(err, "error removing incremental manifest")
+		}
+		return nil
+	})
+
+	if manifest.Base != "" {
+		s.logger.Info(
+			fmt.Sprintf("Creating %s backup based on `%s`.", manifest.Type, manifest.Base),
+		)
+	}
+	return location, nil
+}
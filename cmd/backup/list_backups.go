@@ -0,0 +1,125 @@
+// Copyright 2024 - offen.software <hioffen@posteo.de>
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/offen/docker-volume-backup/internal/errwrap"
+	"github.com/offen/docker-volume-backup/internal/storage"
+)
+
+// listedBackup describes a backup stored in a backend.
+type listedBackup struct {
+	Configuration string    `json:"configuration"`
+	Backend       string    `json:"backend"`
+	Name          string    `json:"name"`
+	Size          int64     `json:"size"`
+	LastModified  time.Time `json:"lastModified"`
+	Protected     bool      `json:"protected"`
+}
+
+// listAsCommand prints all backups matching the pruning prefix per storage
+// backend for each configuration, either as a table or as JSON. The
+// configurations are resolved the same way as when running in the
+// foreground, so the backups of all schedules are listed.
+func (c *command) listAsCommand(asJSON bool) error {
+	backups := []listedBackup{}
+	if err := c.runTaskAsCommand(configStrategyConfd, func(s *script) error {
+		listed, err := s.listBackups()
+		if err != nil {
+			return err
+		}
+		backups = append(backups, listed...)
+		return nil
+	}); err != nil {
+		return err
+	}
+	return writeBackupList(os.Stdout, backups, asJSON)
+}
+
+// listBackups returns all backups matching the pruning prefix per storage
+// backend. Files belonging to the same backup, e.g. the parts of a split
+// archive or checksum files, are listed as a single backup whose size is the
+// sum of its files.
+func (s *script) listBackups() ([]listedBackup, error) {
+	backups := []listedBackup{}
+	for _, b := range s.storages {
+		candidates, err := b.List(s.pruningPrefix(b.Name()))
+		if err != nil {
+			return nil, errwrap.Wrap(err, fmt.Sprintf("error listing backups in backend `%s`", b.Name()))
+		}
+
+		protected := map[string]bool{}
+		var listed []listedBackup
+		for _, candidate := range candidates {
+			if storage.IsProtectionMarker(candidate.Name) {
+				protected[backupSetName(strings.TrimSuffix(candidate.Name, storage.ProtectionMarkerSuffix))] = true
+				continue
+			}
+			name := backupSetName(candidate.Name)
+			idx := slices.IndexFunc(listed, func(l listedBackup) bool {
+				return l.Name == name
+			})
+			if idx == -1 {
+				listed = append(listed, listedBackup{Configuration: s.c.source, Backend: b.Name(), Name: name})
+				idx = len(listed) - 1
+			}
+			listed[idx].Size += candidate.Size
+			if candidate.LastModified.After(listed[idx].LastModified) {
+				listed[idx].LastModified = candidate.LastModified
+			}
+		}
+		for i := range listed {
+			listed[i].Protected = protected[listed[i].Name]
+		}
+		slices.SortStableFunc(listed, func(a, b listedBackup) int {
+			return a.LastModified.Compare(b.LastModified)
+		})
+		backups = append(backups, listed...)
+	}
+	return backups, nil
+}
+
+// writeBackupList writes the given backups to the given writer, either as a
+// table or as JSON.
+func writeBackupList(w io.Writer, backups []listedBackup, asJSON bool) error {
+	if asJSON {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(backups); err != nil {
+			return errwrap.Wrap(err, "error encoding backups")
+		}
+		return nil
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "CONFIGURATION\tBACKEND\tNAME\tSIZE\tMODIFIED\tPROTECTED")
+	for _, backup := range backups {
+		protected := ""
+		if backup.Protected {
+			protected = "yes"
+		}
+		fmt.Fprintf(
+			tw, "%s\t%s\t%s\t%s\t%s\t%s\n",
+			backup.Configuration,
+			backup.Backend,
+			backup.Name,
+			formatBytes(uint64(backup.Size), false),
+			backup.LastModified.Local().Format(time.RFC3339),
+			protected,
+		)
+	}
+	if err := tw.Flush(); err != nil {
+		return errwrap.Wrap(err, "error writing backups")
+	}
+	return nil
+}
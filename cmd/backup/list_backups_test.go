@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/offen/docker-volume-backup/internal/storage"
+	"github.com/offen/docker-volume-backup/internal/storage/local"
+)
+
+func TestWriteBackupList(t *testing.T) {
+	archive := t.TempDir()
+	for name, content := range map[string]string{
+		"backup-1.tar.gz":           "content",
+		"backup-1.tar.gz.sha256":    "abc",
+		"backup-2.tar.gz":           "content",
+		"backup-2.tar.gz.protected": "",
+		"other.txt":                 "",
+	} {
+		if err := os.WriteFile(filepath.Join(archive, name), []byte(content), 0644); err != nil {
+			t.Fatalf("Unexpected error writing file: %v", err)
+		}
+	}
+
+	s := newScript(&Config{BackupPruningPrefix: "backup-", source: "from environment"})
+	s.storages = append(s.storages, local.NewStorageBackend(local.Config{ArchivePath: archive}, func(storage.LogLevel, string, string, ...any) {}))
+
+	listed, err := s.listBackups()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	buf := &bytes.Buffer{}
+	if err := writeBackupList(buf, listed, true); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	var backups []listedBackup
+	if err := json.Unmarshal(buf.Bytes(), &backups); err != nil {
+		t.Fatalf("Unexpected error decoding output: %v", err)
+	}
+	if len(backups) != 2 {
+		t.Fatalf("Expected 2 backups, got %v", backups)
+	}
+	for _, backup := range backups {
+		if backup.Configuration != "from environment" {
+			t.Errorf("Unexpected configuration %s", backup.Configuration)
+		}
+		switch backup.Name {
+		case "backup-1.tar.gz":
+			if backup.Size != 10 || backup.Protected {
+				t.Errorf("Unexpected backup %v", backup)
+			}
+		case "backup-2.tar.gz":
+			if backup.Size != 7 || !backup.Protected {
+				t.Errorf("Unexpected backup %v", backup)
+			}
+		default:
+			t.Errorf("Unexpected backup %v", backup)
+		}
+	}
+
+	buf.Reset()
+	if err := writeBackupList(buf, listed, false); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if lines := strings.Split(strings.TrimSpace(buf.String()), "\n"); len(lines) != 3 || !strings.HasPrefix(lines[0], "CONFIGURATION") {
+		t.Errorf("Unexpected output %s", buf.String())
+	}
+}
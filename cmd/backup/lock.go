@@ -5,12 +5,35 @@ package main
 
 import (
 	"fmt"
+	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/gofrs/flock"
 	"github.com/offen/docker-volume-backup/internal/errwrap"
 )
 
+// lockDirectory is the directory lockfiles are created in.
+var lockDirectory = "/var/lock"
+
+// lockfileFor returns the location of the lockfile used by runs of the given
+// source. Runs of the same source are mutually exclusive, while runs of
+// different sources do not block each other.
+func lockfileFor(source string) string {
+	if source == "" {
+		return filepath.Join(lockDirectory, "dockervolumebackup.lock")
+	}
+	name := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '.', r == '_', r == '-':
+			return r
+		default:
+			return '-'
+		}
+	}, source)
+	return filepath.Join(lockDirectory, fmt.Sprintf("dockervolumebackup-%s.lock", name))
+}
+
 // lock opens a lockfile at the given location, keeping it locked until the
 // caller invokes the returned release func. In case the lock is currently blocked
 // by another execution, it will repeatedly retry until the lock is available
@@ -34,27 +57,32 @@ func (s *script) lock(lockfile string) (func() error, error) {
 			return noop, errwrap.Wrap(err, "error trying to lock")
 		}
 		if acquired {
-			if s.encounteredLock {
-				s.logger.Info("Acquired exclusive lock on subsequent attempt, ready to continue.")
+			if s.encounteredLock != "" {
+				s.logger.Info(
+					fmt.Sprintf("Acquired exclusive lock %s on subsequent attempt, ready to continue.", lockfile),
+				)
 			}
 			return fileLock.Unlock, nil
 		}
 
-		if !s.encounteredLock {
+		if s.encounteredLock == "" {
 			s.logger.Info(
 				fmt.Sprintf(
-					"Exclusive lock was not available on first attempt. Will retry until it becomes available or the timeout of %s is exceeded.",
+					"Exclusive lock %s was not available on first attempt. Will retry until it becomes available or the timeout of %s is exceeded.",
+					lockfile,
 					s.c.LockTimeout,
 				),
 			)
-			s.encounteredLock = true
+			s.encounteredLock = lockfile
 		}
 
 		select {
 		case <-retry.C:
 			continue
 		case <-deadline.C:
-			return noop, errwrap.Wrap(nil, "timed out waiting for lockfile to become available")
+			return noop, errwrap.Wrap(nil, fmt.Sprintf("timed out waiting for lockfile %s to become available", lockfile))
+		case <-s.ctx.Done():
+			return noop, errwrap.Wrap(s.ctx.Err(), "cancelled while waiting for lockfile to become available")
 		}
 	}
 }
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+)
+
+func TestLock(t *testing.T) {
+	lockDirectory = t.TempDir()
+	defer func() { lockDirectory = "/var/lock" }()
+
+	newLockScript := func() *script {
+		return &script{
+			c:      &Config{LockTimeout: 50 * time.Millisecond},
+			ctx:    context.Background(),
+			logger: slog.New(slog.NewTextHandler(io.Discard, nil)),
+			stats:  &Stats{},
+		}
+	}
+
+	first := newLockScript()
+	unlock, err := first.lock(lockfileFor("01daily.conf"))
+	if err != nil {
+		t.Fatalf("Unexpected error acquiring lock: %v", err)
+	}
+
+	other := newLockScript()
+	unlockOther, err := other.lock(lockfileFor("02weekly.conf"))
+	if err != nil {
+		t.Fatalf("Expected lock of other source to be available, got %v", err)
+	}
+	if other.encounteredLock != "" {
+		t.Errorf("Expected no contended lock, got %s", other.encounteredLock)
+	}
+	if err := unlockOther(); err != nil {
+		t.Errorf("Unexpected error releasing lock: %v", err)
+	}
+
+	second := newLockScript()
+	start := time.Now()
+	if _, err := second.lock(lockfileFor("01daily.conf")); err == nil {
+		t.Error("Expected overlapping run of the same source to time out")
+	}
+	if elapsed := time.Since(start); elapsed < second.c.LockTimeout {
+		t.Errorf("Expected to wait for LOCK_TIMEOUT, returned after %s", elapsed)
+	}
+	if second.encounteredLock != lockfileFor("01daily.conf") {
+		t.Errorf("Expected contended lock to be recorded, got %q", second.encounteredLock)
+	}
+
+	if err := unlock(); err != nil {
+		t.Errorf("Unexpected error releasing lock: %v", err)
+	}
+	unlock, err = second.lock(lockfileFor("01daily.conf"))
+	if err != nil {
+		t.Fatalf("Expected lock to be available after release, got %v", err)
+	}
+	if err := unlock(); err != nil {
+		t.Errorf("Unexpected error releasing lock: %v", err)
+	}
+}
+
+func TestLockfileFor(t *testing.T) {
+	tests := map[string]string{
+		"":                  "/var/lock/dockervolumebackup.lock",
+		"01daily.conf":      "/var/lock/dockervolumebackup-01daily.conf.lock",
+		"from environment":  "/var/lock/dockervolumebackup-from-environment.lock",
+		"job DB (app/data)": "/var/lock/dockervolumebackup-job-DB--app-data-.lock",
+	}
+	for source, expected := range tests {
+		if lockfile := lockfileFor(source); lockfile != expected {
+			t.Errorf("Expected %s for source %q, got %s", expected, source, lockfile)
+		}
+	}
+}
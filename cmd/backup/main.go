@@ -5,15 +5,67 @@ package main
 
 import (
 	"flag"
+	"os"
+	"time"
+	// The image does not contain the time zone database, which is required
+	// for BACKUP_CRON_TIMEZONE.
+	_ "time/tzdata"
 )
 
+// version is expected to be set at build time using
+// `-ldflags "-X main.version=<version>"`
+var version = "development"
+
 func main() {
 	foreground := flag.Bool("foreground", false, "run the tool in the foreground")
 	profile := flag.String("profile", "", "collect runtime metrics and log them periodically on the given cron expression")
+	configFile := flag.String("config", "", "read configuration from the given YAML or TOML file, values set in the environment take precedence. Defaults to the value of CONFIG_FILE")
+	verifyDecryption := flag.Bool("verify-decryption", false, "check that the most recent backup in each storage backend can be decrypted and exit")
+	verifyRestore := flag.Bool("verify-restore", false, "restore the most recent backup in each storage backend, run BACKUP_VERIFY_COMMAND against it and exit")
+	share := flag.String("share", "", "print a pre-signed download URL for the backup with the given name and exit")
+	shareExpiry := flag.Duration("share-expiry", 24*time.Hour, "the duration a URL printed by -share is valid for")
+	restoreDevice := flag.String("restore-block-device", "", "write the given raw block device image extracted from a backup to the device given in -restore-target and exit")
+	restoreTarget := flag.String("restore-target", "", "the block device to write the image given in -restore-block-device to")
+	restoreSparse := flag.Bool("restore-sparse", false, "skip writing blocks containing zeros only when restoring a block device, the target must be zeroed already")
+	protect := flag.String("protect", "", "protect the backup with the given name from being pruned in all storage backends and exit")
+	unprotect := flag.String("unprotect", "", "remove the protection of the backup with the given name in all storage backends and exit")
+	list := flag.Bool("list", false, "print all backups matching the pruning prefix per storage backend and exit")
+	asJSON := flag.Bool("json", false, "print the output of -list as JSON")
+	listProtected := flag.Bool("list-protected", false, "print the names of all protected backups per storage backend and exit")
+	dryRun := flag.Bool("dry-run", false, "log the actions a backup run would perform, including the backups that would be pruned, without performing them and exit")
+	validate := flag.Bool("validate", false, "check all available configurations for errors without running a backup and exit")
+	control := flag.String("control", "", "send the given command, i.e. run <source> or status, to the control socket of the process running in the foreground and exit")
+	restoreForce := flag.Bool("restore-force", false, "skip checking the target device matches the device the image was taken from when restoring a block device")
 	flag.Parse()
 
 	c := newCommand()
-	if *foreground {
+	c.configFile = *configFile
+	if c.configFile == "" {
+		c.configFile = os.Getenv("CONFIG_FILE")
+	}
+	if *restoreDevice != "" {
+		c.must(restoreBlockDevice(*restoreDevice, *restoreTarget, *restoreSparse, *restoreForce))
+	} else if *protect != "" {
+		c.must(c.runTaskAsCommand(configStrategyEnv, protectBackup(*protect)))
+	} else if *unprotect != "" {
+		c.must(c.runTaskAsCommand(configStrategyEnv, unprotectBackup(*unprotect)))
+	} else if *list {
+		c.must(c.listAsCommand(*asJSON))
+	} else if *listProtected {
+		c.must(c.runTaskAsCommand(configStrategyEnv, (*script).listProtected))
+	} else if *share != "" {
+		c.must(c.runTaskAsCommand(configStrategyEnv, shareBackup(*share, *shareExpiry)))
+	} else if *control != "" {
+		c.must(c.sendControl(*control))
+	} else if *validate {
+		c.must(c.validate())
+	} else if *dryRun {
+		c.must(c.runTaskAsCommand(configStrategyEnv, (*script).simulate))
+	} else if *verifyRestore {
+		c.must(c.runTaskAsCommand(configStrategyEnv, (*script).verifyRestore))
+	} else if *verifyDecryption {
+		c.must(c.runTaskAsCommand(configStrategyEnv, (*script).verifyDecryption))
+	} else if *foreground {
 		opts := foregroundOpts{
 			profileCronExpression: *profile,
 		}
@@ -0,0 +1,171 @@
+// Copyright 2024 - offen.software <hioffen@posteo.de>
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/offen/docker-volume-backup/internal/errwrap"
+)
+
+// metricsPushTimeout limits the time spent pushing metrics, so an unreachable
+// Pushgateway does not delay the end of a backup run.
+const metricsPushTimeout = 30 * time.Second
+
+// initMetrics registers a hook that pushes metrics about the backup run to
+// the configured Prometheus Pushgateway. Failing to push metrics is logged,
+// but does not fail the run. In case no Pushgateway is configured, it does
+// nothing.
+func (s *script) initMetrics() error {
+	if s.c.MetricsPushgatewayURL == "" {
+		return nil
+	}
+	pushURL, err := pushgatewayURL(s.c.MetricsPushgatewayURL, s.c.MetricsPushgatewayJob, s.c.MetricsPushgatewayGrouping)
+	if err != nil {
+		return errwrap.Wrap(err, "error building Pushgateway URL")
+	}
+	if s.validating {
+		return nil
+	}
+
+	s.registerHook(hookLevelPlumbing, func(err error) error {
+		// Skipped runs, attempts that are retried and maintenance tasks are
+		// not reported.
+		if s.task || s.skipped || s.retryPending(err) {
+			return nil
+		}
+		if err := pushMetrics(pushURL, s.metrics(err)); err != nil {
+			s.logger.Warn(
+				fmt.Sprintf("Failed to push metrics to Pushgateway: %v", errwrap.Unwrap(err)),
+			)
+			return nil
+		}
+		s.logger.Info("Pushed metrics to Pushgateway.")
+		return nil
+	})
+	return nil
+}
+
+// metrics renders the stats of the current run using the Prometheus text
+// exposition format.
+func (s *script) metrics(runErr error) []byte {
+	s.stats.Lock()
+	defer s.stats.Unlock()
+
+	var buf bytes.Buffer
+	gauge := func(name, help string) {
+		fmt.Fprintf(&buf, "# HELP docker_volume_backup_%s %s\n", name, help)
+		fmt.Fprintf(&buf, "# TYPE docker_volume_backup_%s gauge\n", name)
+	}
+
+	success := 0
+	if runErr == nil {
+		success = 1
+	}
+	gauge("success", "Whether the last backup run succeeded.")
+	fmt.Fprintf(&buf, "docker_volume_backup_success %d\n", success)
+	gauge("last_run_timestamp_seconds", "Time the last backup run started at.")
+	fmt.Fprintf(&buf, "docker_volume_backup_last_run_timestamp_seconds %d\n", s.stats.StartTime.Unix())
+	gauge("duration_seconds", "Time it took to run the last backup.")
+	fmt.Fprintf(&buf, "docker_volume_backup_duration_seconds %g\n", s.stats.TookTime.Seconds())
+	if runErr == nil {
+		// Metrics are pushed using POST, so these are retained when a
+		// subsequent run fails.
+		gauge("last_success_timestamp_seconds", "Time the last successful backup run started at.")
+		fmt.Fprintf(&buf, "docker_volume_backup_last_success_timestamp_seconds %d\n", s.stats.StartTime.Unix())
+		gauge("size_bytes", "Size of the last successfully created backup.")
+		fmt.Fprintf(&buf, "docker_volume_backup_size_bytes %d\n", s.stats.BackupFile.Size)
+	}
+
+	names := make([]string, 0, len(s.stats.Storages))
+	for name := range s.stats.Storages {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for _, metric := range []struct {
+		name  string
+		help  string
+		value func(StorageStats) uint
+	}{
+		{"storage_backups", "Number of backups in the storage backend.", func(s StorageStats) uint { return s.Total }},
+		{"storage_pruned", "Number of backups pruned from the storage backend in the last run.", func(s StorageStats) uint {
+			if s.PruneDryRun {
+				return 0
+			}
+			return s.Pruned
+		}},
+		{"storage_prune_errors", "Number of backups that could not be pruned from the storage backend in the last run.", func(s StorageStats) uint { return s.PruneErrors }},
+	} {
+		gauge(metric.name, metric.help)
+		for _, name := range names {
+			fmt.Fprintf(&buf, "docker_volume_backup_%s{storage=%q} %d\n", metric.name, name, metric.value(s.stats.Storages[name]))
+		}
+	}
+	return buf.Bytes()
+}
+
+// pushgatewayURL returns the URL for pushing metrics using the given job and
+// grouping labels to the Pushgateway at the given base URL.
+func pushgatewayURL(base, job string, grouping map[string]string) (string, error) {
+	u, err := url.Parse(base)
+	if err != nil {
+		return "", errwrap.Wrap(err, "error parsing URL")
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return "", errwrap.Wrap(nil, fmt.Sprintf("expected an absolute URL, got %s", base))
+	}
+	if job == "" {
+		return "", errwrap.Wrap(nil, "job must not be empty")
+	}
+
+	labels := make([]string, 0, len(grouping))
+	for label := range grouping {
+		labels = append(labels, label)
+	}
+	slices.Sort(labels)
+
+	segments := []string{strings.TrimSuffix(u.String(), "/"), "metrics", pushgatewaySegment("job", job)}
+	for _, label := range labels {
+		segments = append(segments, pushgatewaySegment(label, grouping[label]))
+	}
+	return strings.Join(segments, "/"), nil
+}
+
+// pushgatewaySegment encodes the given label and value as a path segment.
+// Values that cannot be represented in a path are base64 encoded.
+func pushgatewaySegment(label, value string) string {
+	if value == "" || strings.Contains(value, "/") {
+		return fmt.Sprintf("%s@base64/%s", label, base64.RawURLEncoding.EncodeToString([]byte(value)))
+	}
+	return fmt.Sprintf("%s/%s", label, url.PathEscape(value))
+}
+
+// pushMetrics sends the given metrics to the given Pushgateway URL.
+func pushMetrics(pushURL string, metrics []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), metricsPushTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, pushURL, bytes.NewReader(metrics))
+	if err != nil {
+		return errwrap.Wrap(err, "error creating request")
+	}
+	req.Header.Set("Content-Type", "text/plain; version=0.0.4")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return errwrap.Wrap(err, "error sending request")
+	}
+	defer res.Body.Close()
+	if res.StatusCode >= 300 {
+		return errwrap.Wrap(nil, fmt.Sprintf("unexpected status code %d", res.StatusCode))
+	}
+	return nil
+}
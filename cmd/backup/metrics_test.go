@@ -0,0 +1,86 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPushgatewayURL(t *testing.T) {
+	tests := []struct {
+		base        string
+		job         string
+		grouping    map[string]string
+		expected    string
+		expectError bool
+	}{
+		{"http://pushgateway:9091", "backup", nil, "http://pushgateway:9091/metrics/job/backup", false},
+		{"http://pushgateway:9091/", "backup", map[string]string{"instance": "host", "path": "/data"}, "http://pushgateway:9091/metrics/job/backup/instance/host/path@base64/L2RhdGE", false},
+		{"pushgateway:9091", "backup", nil, "", true},
+		{"http://pushgateway:9091", "", nil, "", true},
+	}
+	for _, test := range tests {
+		result, err := pushgatewayURL(test.base, test.job, test.grouping)
+		if (err != nil) != test.expectError {
+			t.Errorf("Unexpected error value for %s: %v", test.base, err)
+		}
+		if result != test.expected {
+			t.Errorf("Expected %s, got %s", test.expected, result)
+		}
+	}
+}
+
+func TestPushMetrics(t *testing.T) {
+	var path, body string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		path, body = r.URL.Path, string(b)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	s := newScript(&Config{
+		MetricsPushgatewayURL: server.URL,
+		MetricsPushgatewayJob: "backup",
+	})
+	s.stats.TookTime = 90 * time.Second
+	s.stats.BackupFile.Size = 1024
+	s.stats.Storages["Local"] = StorageStats{Total: 3, Pruned: 1}
+	if err := s.initMetrics(); err != nil {
+		t.Fatalf("Unexpected error initializing metrics: %v", err)
+	}
+	if err := s.runHooks(nil); err != nil {
+		t.Fatalf("Unexpected error running hooks: %v", err)
+	}
+
+	if path != "/metrics/job/backup" {
+		t.Errorf("Unexpected path %s", path)
+	}
+	for _, expected := range []string{
+		"docker_volume_backup_success 1\n",
+		"docker_volume_backup_duration_seconds 90\n",
+		"docker_volume_backup_size_bytes 1024\n",
+		"docker_volume_backup_storage_backups{storage=\"Local\"} 3\n",
+		"docker_volume_backup_storage_pruned{storage=\"Local\"} 1\n",
+	} {
+		if !strings.Contains(body, expected) {
+			t.Errorf("Expected metrics to contain %q, got %s", expected, body)
+		}
+	}
+
+	if err := s.runHooks(errors.New("failed")); err != nil {
+		t.Fatalf("Unexpected error running hooks: %v", err)
+	}
+	if !strings.Contains(body, "docker_volume_backup_success 0\n") || strings.Contains(body, "size_bytes") {
+		t.Errorf("Unexpected metrics for failed run %s", body)
+	}
+
+	server.Close()
+	if err := s.runHooks(nil); err != nil {
+		t.Errorf("Expected failing push to be logged only, got %v", err)
+	}
+}
@@ -4,15 +4,25 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
 	_ "embed"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"net/url"
 	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
 	"text/template"
+	"text/template/parse"
 	"time"
 
+	"github.com/containrrr/shoutrrr"
+	"github.com/containrrr/shoutrrr/pkg/router"
+	"github.com/containrrr/shoutrrr/pkg/services/slack"
 	sTypes "github.com/containrrr/shoutrrr/pkg/types"
 	"github.com/offen/docker-volume-backup/internal/errwrap"
 )
@@ -27,6 +37,183 @@ type NotificationData struct {
 	Stats  *Stats
 }
 
+// LogOutput returns the log output of the run. In case
+// NOTIFICATION_LOG_TAIL_LINES is set, only the given number of lines from
+// the end of the output are returned.
+func (n NotificationData) LogOutput() string {
+	if n.Stats == nil || n.Stats.LogOutput == nil {
+		return ""
+	}
+	output := n.Stats.LogOutput.String()
+	if n.Config == nil {
+		return output
+	}
+	return tail(n.Config.NotificationLogTailLines.Int(), output)
+}
+
+// initNotifications creates the sender and the templates used for sending
+// notifications. In case no notification URLs are configured, it does nothing.
+func (s *script) initNotifications() error {
+	urls := s.c.NotificationURLs
+	if s.c.NotificationConfigFile != "" {
+		fileURLs, err := readNotificationConfig(s.c.NotificationConfigFile)
+		if err != nil {
+			return errwrap.Wrap(err, "error reading notification config file")
+		}
+		urls = append(slices.Clone(urls), fileURLs...)
+	}
+	if s.c.EmailNotificationRecipient != "" {
+		emailURL := fmt.Sprintf(
+			"smtp://%s:%s@%s:%d/?from=%s&to=%s",
+			s.c.EmailSMTPUsername,
+			s.c.EmailSMTPPassword,
+			s.c.EmailSMTPHost,
+			s.c.EmailSMTPPort,
+			s.c.EmailNotificationSender,
+			s.c.EmailNotificationRecipient,
+		)
+		urls = append(slices.Clone(urls), emailURL)
+		s.logger.Warn(
+			"Using EMAIL_* keys for providing notification configuration has been deprecated and will be removed in the next major version.",
+		)
+		s.logger.Warn(
+			"Please use NOTIFICATION_URLS instead. Refer to the README for an upgrade guide.",
+		)
+	}
+
+	if len(urls) == 0 {
+		return nil
+	}
+
+	senders, err := newNotificationSenders(urls)
+	if err != nil {
+		return err
+	}
+	s.senders = senders
+
+	tmpl, custom, err := parseNotificationTemplates("/etc/dockervolumebackup/notifications.d")
+	if err != nil {
+		return err
+	}
+	s.template = tmpl
+	s.customTemplates = custom
+	return nil
+}
+
+// notificationSender sends notifications to all URLs of a service.
+type notificationSender struct {
+	// service is only set for services that have dedicated templates.
+	service string
+	router  *router.ServiceRouter
+	// richRouter is used for sending messages rendered using the dedicated
+	// templates of the service, in case they require different parameters.
+	richRouter *router.ServiceRouter
+	// slackConfigs are used for posting the Block Kit payloads rendered
+	// using the dedicated Slack templates.
+	slackConfigs []*slack.Config
+}
+
+// richServices are the notification services that come with dedicated
+// templates making use of their formatting capabilities.
+var richServices = []string{"discord", "slack", "telegram"}
+
+// richParams are the URL parameters required for sending messages rendered
+// using dedicated templates, i.e. sending the message as the payload of the
+// request for Discord embeds and parsing messages as HTML for Telegram.
+var richParams = map[string]map[string]string{
+	"discord":  {"json": "yes"},
+	"telegram": {"parsemode": "HTML"},
+}
+
+// newNotificationSenders creates a sender for each service that has
+// dedicated templates, and a single sender for all other URLs.
+func newNotificationSenders(urls []string) ([]notificationSender, error) {
+	groups := map[string][]string{}
+	for _, u := range urls {
+		service := ""
+		if parsed, err := url.Parse(u); err == nil && slices.Contains(richServices, parsed.Scheme) {
+			service = parsed.Scheme
+		}
+		groups[service] = append(groups[service], u)
+	}
+
+	var senders []notificationSender
+	for _, service := range append([]string{""}, richServices...) {
+		urls := groups[service]
+		if len(urls) == 0 {
+			continue
+		}
+		sender := notificationSender{service: service}
+		var err error
+		if sender.router, err = shoutrrr.CreateSender(urls...); err != nil {
+			return nil, errwrap.Wrap(err, "error creating sender")
+		}
+		if params, ok := richParams[service]; ok {
+			richURLs := make([]string, len(urls))
+			for i, u := range urls {
+				parsed, _ := url.Parse(u)
+				query := parsed.Query()
+				for key, value := range params {
+					query.Set(key, value)
+				}
+				parsed.RawQuery = query.Encode()
+				richURLs[i] = parsed.String()
+			}
+			if sender.richRouter, err = shoutrrr.CreateSender(richURLs...); err != nil {
+				return nil, errwrap.Wrap(err, "error creating sender")
+			}
+		}
+		if service == "slack" {
+			if sender.slackConfigs, err = newSlackConfigs(urls); err != nil {
+				return nil, err
+			}
+		}
+		senders = append(senders, sender)
+	}
+	return senders, nil
+}
+
+// parseNotificationTemplates parses the default templates and the user
+// defined templates in the given directory, in case it exists. It also
+// returns the names of all templates defined by the user.
+func parseNotificationTemplates(dir string) (*template.Template, map[string]bool, error) {
+	tmpl, err := template.New("").Funcs(templateHelpers).Parse(defaultNotifications)
+	if err != nil {
+		return nil, nil, errwrap.Wrap(err, "unable to parse default notifications templates")
+	}
+	custom := map[string]bool{}
+	if fi, err := os.Stat(dir); err == nil && fi.IsDir() {
+		defaults := map[string]*parse.Tree{}
+		for _, t := range tmpl.Templates() {
+			defaults[t.Name()] = t.Tree
+		}
+		tmpl, err = tmpl.ParseGlob(filepath.Join(dir, "*.*"))
+		if err != nil {
+			return nil, nil, errwrap.Wrap(err, "unable to parse user defined notifications templates")
+		}
+		for _, t := range tmpl.Templates() {
+			if t.Tree != defaults[t.Name()] {
+				custom[t.Name()] = true
+			}
+		}
+	}
+	return tmpl, custom, nil
+}
+
+// templateFor returns the name of the template to be used for the given
+// service. Templates dedicated to the service are preferred, unless the user
+// has only overridden the generic template.
+func (s *script) templateFor(name, service string) (string, bool) {
+	dedicated := name + "_" + service
+	if service == "" || s.template.Lookup(dedicated) == nil {
+		return name, false
+	}
+	if s.customTemplates[name] && !s.customTemplates[dedicated] {
+		return name, false
+	}
+	return dedicated, true
+}
+
 // notify sends a notification using the given title and body templates.
 // Automatically creates notification data, adding the given error
 func (s *script) notify(titleTemplate string, bodyTemplate string, err error) error {
@@ -36,18 +223,37 @@ func (s *script) notify(titleTemplate string, bodyTemplate string, err error) er
 		Config: s.c,
 	}
 
-	titleBuf := &bytes.Buffer{}
-	if err := s.template.ExecuteTemplate(titleBuf, titleTemplate, params); err != nil {
-		return errwrap.Wrap(err, fmt.Sprintf("error executing %s template", titleTemplate))
-	}
+	var errs []error
+	for _, sender := range s.senders {
+		title, _ := s.templateFor(titleTemplate, sender.service)
+		titleBuf := &bytes.Buffer{}
+		if err := s.template.ExecuteTemplate(titleBuf, title, params); err != nil {
+			errs = append(errs, errwrap.Wrap(err, fmt.Sprintf("error executing %s template", title)))
+			continue
+		}
 
-	bodyBuf := &bytes.Buffer{}
-	if err := s.template.ExecuteTemplate(bodyBuf, bodyTemplate, params); err != nil {
-		return errwrap.Wrap(err, fmt.Sprintf("error executing %s template", bodyTemplate))
-	}
+		body, dedicated := s.templateFor(bodyTemplate, sender.service)
+		bodyBuf := &bytes.Buffer{}
+		if err := s.template.ExecuteTemplate(bodyBuf, body, params); err != nil {
+			errs = append(errs, errwrap.Wrap(err, fmt.Sprintf("error executing %s template", body)))
+			continue
+		}
 
-	if err := s.sendNotification(titleBuf.String(), bodyBuf.String()); err != nil {
-		return errwrap.Wrap(err, "error sending notification")
+		var err error
+		switch {
+		case dedicated && sender.slackConfigs != nil:
+			err = sendSlackPayload(sender.slackConfigs, titleBuf.String(), bodyBuf.String())
+		case dedicated && sender.richRouter != nil:
+			err = sendNotification(sender.richRouter, titleBuf.String(), bodyBuf.String())
+		default:
+			err = sendNotification(sender.router, titleBuf.String(), bodyBuf.String())
+		}
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) != 0 {
+		return errwrap.Wrap(errors.Join(errs...), "error sending notification")
 	}
 	return nil
 }
@@ -57,15 +263,93 @@ func (s *script) notifyFailure(err error) error {
 	return s.notify("title_failure", "body_failure", err)
 }
 
-// notifyFailure sends a notification about a successful backup run
+// notifyPartialSuccess sends a notification about a backup run that uploaded
+// the backup to some of the storage backends only
+func (s *script) notifyPartialSuccess(err error) error {
+	return s.notify("title_partial_success", "body_partial_success", err)
+}
+
+// notifySuccess sends a notification about a successful backup run
 func (s *script) notifySuccess() error {
 	return s.notify("title_success", "body_success", nil)
 }
 
-// sendNotification sends a notification to all configured third party services
-func (s *script) sendNotification(title, body string) error {
+// notifyStart sends a notification about a backup run having started in
+// case NOTIFICATION_NOTIFY_START is set and NOTIFICATION_LEVEL is `info`. It
+// is sent for the first attempt of a run only, and not for runs that have
+// been skipped. Failing to send it does not fail the run.
+func (s *script) notifyStart() {
+	if !s.c.NotificationNotifyStart || len(s.senders) == 0 || s.hookLevel < hookLevelInfo {
+		return
+	}
+	if s.task || s.skipped || s.attempt != 1 {
+		return
+	}
+	if err := s.notify("title_started", "body_started", nil); err != nil {
+		s.logger.Warn(
+			fmt.Sprintf("Failed to send start notification: %v", errwrap.Unwrap(err)),
+		)
+	}
+}
+
+// notifySkipped sends a notification about a backup run that has been
+// skipped as its precondition was not met
+func (s *script) notifySkipped() error {
+	return s.notify("title_skipped", "body_skipped", nil)
+}
+
+// notifyEmptySchedule sends a notification about no backups being scheduled
+func (s *script) notifyEmptySchedule() error {
+	return s.notify("title_empty_schedule", "body_empty_schedule", nil)
+}
+
+// notifyPrunePreview sends a notification about the backups that would be pruned
+func (s *script) notifyPrunePreview() error {
+	return s.notify("title_prune_preview", "body_prune_preview", nil)
+}
+
+// notifyDryRun sends a notification about the actions a backup run would
+// have performed
+func (s *script) notifyDryRun() error {
+	return s.notify("title_dry_run", "body_dry_run", nil)
+}
+
+// appriseTagPrefix matches the optional `tag1,tag2=` prefix used for
+// tagging URLs in Apprise text config files.
+var appriseTagPrefix = regexp.MustCompile(`^[\w\s,-]+=\s*([a-zA-Z0-9+.-]+://.*)$`)
+
+// readNotificationConfig reads notification URLs from a file containing
+// one URL per line. Empty lines and lines starting with `#` or `;` are
+// ignored. Tags as used in Apprise config files are stripped.
+func readNotificationConfig(location string) ([]string, error) {
+	f, err := os.Open(location)
+	if err != nil {
+		return nil, errwrap.Wrap(err, "error opening file")
+	}
+	defer f.Close()
+
+	var urls []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+		if match := appriseTagPrefix.FindStringSubmatch(line); match != nil {
+			line = match[1]
+		}
+		urls = append(urls, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errwrap.Wrap(err, "error scanning file")
+	}
+	return urls, nil
+}
+
+// sendNotification sends a notification to all services of the given router
+func sendNotification(router *router.ServiceRouter, title, body string) error {
 	var errs []error
-	for _, result := range s.sender.Send(body, &sTypes.Params{"title": title}) {
+	for _, result := range router.Send(body, &sTypes.Params{"title": title}) {
 		if result != nil {
 			errs = append(errs, result)
 		}
@@ -86,9 +370,104 @@ var templateHelpers = template.FuncMap{
 	"formatBytesBin": func(bytes uint64) string {
 		return formatBytes(bytes, false)
 	},
-	"env":          os.Getenv,
-	"toJson":       toJson,
-	"toPrettyJson": toPrettyJson,
+	"formatDuration": func(d time.Duration) string {
+		return d.Round(time.Second).String()
+	},
+	"truncate":         truncate,
+	"truncateStart":    truncateStart,
+	"percentChange":    percentChange,
+	"compressionRatio": compressionRatio,
+	"uploads":          uploads,
+	"env":              os.Getenv,
+	"toJson":           toJson,
+	"toPrettyJson":     toPrettyJson,
+}
+
+// UploadOutcome describes the outcome of uploading the backup to a single
+// storage backend.
+type UploadOutcome struct {
+	Storage string
+	// Status is either `success` or `failure`.
+	Status string
+	Error  string
+	// Duration is the time it took to upload the backup, including retries.
+	Duration time.Duration
+}
+
+// uploads returns the outcome of uploading the backup for each of the given
+// storages an upload has been attempted for, sorted by name.
+func uploads(storages map[string]StorageStats) []UploadOutcome {
+	var outcomes []UploadOutcome
+	for name, stats := range storages {
+		switch {
+		case stats.Uploaded:
+			outcomes = append(outcomes, UploadOutcome{Storage: name, Status: runOutcomeSuccess, Duration: stats.UploadDuration})
+		case stats.UploadError != "":
+			outcomes = append(outcomes, UploadOutcome{Storage: name, Status: runOutcomeFailure, Error: stats.UploadError, Duration: stats.UploadDuration})
+		}
+	}
+	slices.SortFunc(outcomes, func(a, b UploadOutcome) int {
+		return strings.Compare(a.Storage, b.Storage)
+	})
+	return outcomes
+}
+
+// truncate shortens the given string to the given number of characters,
+// e.g. for respecting the length limits of a notification service.
+func truncate(length int, s string) string {
+	runes := []rune(s)
+	if len(runes) <= length {
+		return s
+	}
+	return string(runes[:max(length-1, 0)]) + "…"
+}
+
+// truncateStart shortens the given string to the given number of characters
+// by removing characters from its start, e.g. for keeping the end of the log
+// output when respecting the length limits of a notification service.
+func truncateStart(length int, s string) string {
+	runes := []rune(s)
+	if len(runes) <= length {
+		return s
+	}
+	return "…" + string(runes[len(runes)-max(length-1, 0):])
+}
+
+// tail returns the given number of lines from the end of the given string.
+// In case lines is zero, the string is returned as is.
+func tail(lines int, s string) string {
+	if lines <= 0 {
+		return s
+	}
+	trimmed := strings.TrimSuffix(s, "\n")
+	for i := len(trimmed) - 1; i >= 0; i-- {
+		if trimmed[i] != '\n' {
+			continue
+		}
+		if lines--; lines == 0 {
+			return s[i+1:]
+		}
+	}
+	return s
+}
+
+// percentChange returns the change from previous to current in percent. In
+// case previous is zero, it returns zero.
+func percentChange(previous, current uint64) float64 {
+	if previous == 0 {
+		return 0
+	}
+	return (float64(current) - float64(previous)) / float64(previous) * 100
+}
+
+// compressionRatio returns the size of the compressed archive in relation to
+// its uncompressed contents in percent. In case uncompressed is zero, it
+// returns zero.
+func compressionRatio(compressed, uncompressed uint64) float64 {
+	if uncompressed == 0 {
+		return 0
+	}
+	return float64(compressed) / float64(uncompressed) * 100
 }
 
 // formatBytes converts an amount of bytes in a human-readable representation
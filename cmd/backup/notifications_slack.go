@@ -0,0 +1,127 @@
+// Copyright 2024 - offen.software <hioffen@posteo.de>
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/containrrr/shoutrrr/pkg/services/slack"
+	"github.com/offen/docker-volume-backup/internal/errwrap"
+)
+
+// slackWebhookURL and slackAPIURL are the endpoints Block Kit payloads are
+// posted to, depending on whether a Slack URL contains a webhook or a bot
+// token.
+var (
+	slackWebhookURL = "https://hooks.slack.com/services/"
+	slackAPIURL     = "https://slack.com/api/chat.postMessage"
+)
+
+// newSlackConfigs parses the given Slack URLs, so messages rendered using the
+// dedicated Slack templates can be posted as Block Kit payloads, which is not
+// supported by shoutrrr.
+func newSlackConfigs(urls []string) ([]*slack.Config, error) {
+	var configs []*slack.Config
+	for _, u := range urls {
+		parsed, err := url.Parse(u)
+		if err != nil {
+			return nil, errwrap.Wrap(err, "error parsing Slack URL")
+		}
+		config, err := slack.CreateConfigFromURL(parsed)
+		if err != nil {
+			return nil, errwrap.Wrap(err, "error parsing Slack URL")
+		}
+		configs = append(configs, config)
+	}
+	return configs, nil
+}
+
+// sendSlackPayload posts the given Block Kit payload to all of the given
+// Slack configurations. The title is used as the text of the notification in
+// case the payload does not define one.
+func sendSlackPayload(configs []*slack.Config, title, body string) error {
+	payload := map[string]any{}
+	if err := json.Unmarshal([]byte(body), &payload); err != nil {
+		return errwrap.Wrap(err, "error decoding Slack payload")
+	}
+	if _, ok := payload["text"]; !ok {
+		payload["text"] = title
+	}
+
+	var errs []error
+	for _, config := range configs {
+		if err := postSlackPayload(config, maps.Clone(payload)); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) != 0 {
+		return errwrap.Wrap(errors.Join(errs...), "error sending message")
+	}
+	return nil
+}
+
+// postSlackPayload posts the given payload using the webhook or the bot token
+// of the given configuration.
+func postSlackPayload(config *slack.Config, payload map[string]any) error {
+	if config.BotName != "" {
+		payload["username"] = config.BotName
+	}
+	if config.ThreadTS != "" {
+		payload["thread_ts"] = config.ThreadTS
+	}
+
+	location := slackAPIURL
+	if config.Token.IsAPIToken() {
+		payload["channel"] = config.Channel
+	} else {
+		hook, err := url.Parse(config.Token.WebhookURL())
+		if err != nil {
+			return errwrap.Wrap(err, "error parsing webhook URL")
+		}
+		location = slackWebhookURL + strings.TrimPrefix(hook.Path, "/services/")
+	}
+
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return errwrap.Wrap(err, "error encoding Slack payload")
+	}
+	req, err := http.NewRequest(http.MethodPost, location, bytes.NewReader(b))
+	if err != nil {
+		return errwrap.Wrap(err, "error creating request")
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if config.Token.IsAPIToken() {
+		req.Header.Set("Authorization", config.Token.Authorization())
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return errwrap.Wrap(err, "error posting to Slack")
+	}
+	defer res.Body.Close()
+	response, _ := io.ReadAll(io.LimitReader(res.Body, 1<<16))
+	if res.StatusCode != http.StatusOK {
+		return errwrap.Wrap(nil, fmt.Sprintf("unexpected status %d: %s", res.StatusCode, strings.TrimSpace(string(response))))
+	}
+	if !config.Token.IsAPIToken() {
+		return nil
+	}
+
+	var apiResponse slack.APIResponse
+	if err := json.Unmarshal(response, &apiResponse); err != nil {
+		return errwrap.Wrap(err, "error decoding Slack response")
+	}
+	if !apiResponse.Ok {
+		return errwrap.Wrap(nil, fmt.Sprintf("Slack responded with error %s", apiResponse.Error))
+	}
+	return nil
+}
@@ -0,0 +1,48 @@
+// Copyright 2024 - offen.software <hioffen@posteo.de>
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+
+	"github.com/offen/docker-volume-backup/internal/errwrap"
+)
+
+// checkPrecondition runs the configured precondition command. In case the
+// command exits with a non-zero code, the script is marked as skipped, which
+// is not considered to be an error. An error is returned in case the command
+// cannot be run at all.
+func (s *script) checkPrecondition() error {
+	command := s.c.BackupPreconditionCommand
+	if command == "" {
+		return nil
+	}
+
+	output, err := exec.CommandContext(s.ctx, "/bin/sh", "-c", command).CombinedOutput()
+	if out := strings.TrimSpace(string(output)); out != "" {
+		s.logger.Info(out)
+	}
+
+	var exitErr *exec.ExitError
+	switch {
+	case s.ctx.Err() != nil:
+		return s.checkCancelled()
+	case err == nil:
+		s.logger.Info(
+			fmt.Sprintf("Precondition `%s` is met, continuing with backup.", command),
+		)
+		return nil
+	case errors.As(err, &exitErr):
+		s.logger.Info(
+			fmt.Sprintf("Skipped by precondition as `%s` exited with code %d.", command, exitErr.ExitCode()),
+		)
+		s.skipped = true
+		return nil
+	default:
+		return errwrap.Wrap(err, fmt.Sprintf("error running precondition command `%s`", command))
+	}
+}
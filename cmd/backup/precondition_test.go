@@ -0,0 +1,26 @@
+package main
+
+import "testing"
+
+func TestCheckPrecondition(t *testing.T) {
+	tests := []struct {
+		name          string
+		command       string
+		expectSkipped bool
+	}{
+		{"not configured", "", false},
+		{"met", "true", false},
+		{"not met", "exit 3", true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := newScript(&Config{BackupPreconditionCommand: test.command})
+			if err := s.checkPrecondition(); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if s.skipped != test.expectSkipped {
+				t.Errorf("Expected skipped to be %v, got %v", test.expectSkipped, s.skipped)
+			}
+		})
+	}
+}
@@ -0,0 +1,37 @@
+// Copyright 2024 - offen.software <hioffen@posteo.de>
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/offen/docker-volume-backup/internal/errwrap"
+)
+
+// runPreflight checks all storage backends are reachable and writable in
+// case BACKUP_PREFLIGHT is set, so misconfigured backends make the run fail
+// before the archive is created. All backends are checked, even if one of
+// them fails.
+func (s *script) runPreflight() error {
+	if !s.c.BackupPreflight {
+		return nil
+	}
+
+	var errs []error
+	for _, b := range s.storages {
+		err := s.withTimeout(b.Name(), func(ctx context.Context) error {
+			return b.Preflight(ctx)
+		})
+		if err != nil {
+			errs = append(errs, errwrap.Wrap(err, fmt.Sprintf("preflight check failed for backend `%s`", b.Name())))
+			continue
+		}
+		s.logger.Info(
+			fmt.Sprintf("Preflight check succeeded for backend `%s`.", b.Name()),
+		)
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/offen/docker-volume-backup/internal/storage"
+)
+
+func TestRunPreflight(t *testing.T) {
+	s := newScript(&Config{BackupPreflight: true})
+	s.storages = []storage.Backend{
+		&mockBackend{name: "S3", fail: true},
+		&mockBackend{name: "SSH"},
+		&mockBackend{name: "WebDAV", fail: true},
+	}
+	err := s.runPreflight()
+	if err == nil {
+		t.Fatal("Expected error")
+	}
+	for _, backend := range []string{"`S3`", "`WebDAV`"} {
+		if !strings.Contains(err.Error(), backend) {
+			t.Errorf("Expected error %v to mention backend %s", err, backend)
+		}
+	}
+	if !strings.Contains(s.stats.LogOutput.String(), "Preflight check succeeded for backend `SSH`.") {
+		t.Errorf("Expected successful check to be logged, got %s", s.stats.LogOutput.String())
+	}
+
+	s.c.BackupPreflight = false
+	if err := s.runPreflight(); err != nil {
+		t.Errorf("Expected no check when disabled, got %v", err)
+	}
+}
@@ -0,0 +1,130 @@
+// Copyright 2024 - offen.software <hioffen@posteo.de>
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/offen/docker-volume-backup/internal/errwrap"
+	"github.com/offen/docker-volume-backup/internal/kms"
+	"github.com/offen/docker-volume-backup/internal/storage"
+)
+
+// protectBackup returns a task that protects the backup with the given name
+// from being pruned in all storage backends containing it. Protection is
+// recorded in a marker file stored next to the backup. Backends supporting
+// it additionally flag the backup itself.
+func protectBackup(name string) func(s *script) error {
+	return func(s *script) error {
+		dir, err := s.tempDir("protect-*")
+		if err != nil {
+			return errwrap.Wrap(err, "error creating temporary directory")
+		}
+		marker := filepath.Join(dir, "marker")
+		if err := os.WriteFile(marker, []byte(time.Now().Format(time.RFC3339)+"\n"), 0644); err != nil {
+			return errwrap.Wrap(err, "error writing protection marker")
+		}
+
+		var protected int
+		for _, b := range s.storages {
+			// Split archives only exist in the form of their parts, in which
+			// case the manifest is looked up.
+			_, err := b.Stat(name)
+			if err != nil {
+				_, err = b.Stat(name + splitManifestSuffix)
+			}
+			if err != nil {
+				s.logger.Warn(
+					fmt.Sprintf("Backup `%s` could not be found in backend `%s`, skipping: %v", name, b.Name(), errwrap.Unwrap(err)),
+				)
+				continue
+			}
+			if err := b.Copy(context.Background(), marker, name+storage.ProtectionMarkerSuffix); err != nil {
+				return errwrap.Wrap(err, fmt.Sprintf("error protecting backup `%s` in backend `%s`", name, b.Name()))
+			}
+			// The envelope containing the key of an encrypted backup needs to
+			// be retained for as long as the backup itself.
+			if _, err := b.Stat(name + kms.EnvelopeSuffix); err == nil {
+				if err := b.Copy(context.Background(), marker, name+kms.EnvelopeSuffix+storage.ProtectionMarkerSuffix); err != nil {
+					return errwrap.Wrap(err, fmt.Sprintf("error protecting envelope of backup `%s` in backend `%s`", name, b.Name()))
+				}
+			}
+			if protector, ok := b.(storage.Protector); ok {
+				if err := protector.SetProtected(name, true); err != nil {
+					s.logger.Warn(
+						fmt.Sprintf("Backup `%s` is protected in backend `%s`, but could not be flagged natively: %v", name, b.Name(), errwrap.Unwrap(err)),
+					)
+				}
+			}
+			s.logger.Info(
+				fmt.Sprintf("Protected backup `%s` in backend `%s` from being pruned.", name, b.Name()),
+			)
+			protected++
+		}
+		if protected == 0 {
+			return errwrap.Wrap(nil, fmt.Sprintf("backup `%s` could not be found in any storage backend", name))
+		}
+		return nil
+	}
+}
+
+// unprotectBackup returns a task that removes the protection of the backup
+// with the given name in all storage backends, making it subject to pruning
+// again.
+func unprotectBackup(name string) func(s *script) error {
+	return func(s *script) error {
+		var unprotected int
+		for _, b := range s.storages {
+			if _, err := b.Stat(name + storage.ProtectionMarkerSuffix); err != nil {
+				continue
+			}
+			if err := b.Remove(name + storage.ProtectionMarkerSuffix); err != nil {
+				return errwrap.Wrap(err, fmt.Sprintf("error unprotecting backup `%s` in backend `%s`", name, b.Name()))
+			}
+			if _, err := b.Stat(name + kms.EnvelopeSuffix + storage.ProtectionMarkerSuffix); err == nil {
+				if err := b.Remove(name + kms.EnvelopeSuffix + storage.ProtectionMarkerSuffix); err != nil {
+					return errwrap.Wrap(err, fmt.Sprintf("error unprotecting envelope of backup `%s` in backend `%s`", name, b.Name()))
+				}
+			}
+			if protector, ok := b.(storage.Protector); ok {
+				if err := protector.SetProtected(name, false); err != nil {
+					s.logger.Warn(
+						fmt.Sprintf("Backup `%s` is unprotected in backend `%s`, but its native flag could not be removed: %v", name, b.Name(), errwrap.Unwrap(err)),
+					)
+				}
+			}
+			s.logger.Info(
+				fmt.Sprintf("Removed protection of backup `%s` in backend `%s`.", name, b.Name()),
+			)
+			unprotected++
+		}
+		if unprotected == 0 {
+			return errwrap.Wrap(nil, fmt.Sprintf("backup `%s` is not protected in any storage backend", name))
+		}
+		return nil
+	}
+}
+
+// listProtected prints the names of all protected backups per storage
+// backend.
+func (s *script) listProtected() error {
+	for _, b := range s.storages {
+		candidates, err := b.List("")
+		if err != nil {
+			return errwrap.Wrap(err, fmt.Sprintf("error listing backups in backend `%s`", b.Name()))
+		}
+		for _, candidate := range candidates {
+			name := strings.TrimSuffix(candidate.Name, storage.ProtectionMarkerSuffix)
+			if storage.IsProtectionMarker(candidate.Name) && !strings.HasSuffix(name, kms.EnvelopeSuffix) {
+				fmt.Printf("%s\t%s\n", b.Name(), name)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/offen/docker-volume-backup/internal/storage"
+)
+
+func TestProtectBackup(t *testing.T) {
+	backend := &mockBackend{name: "S3", uploads: map[string]int{"backup.tar.gz": 1}}
+	s := newScript(&Config{})
+	s.storages = []storage.Backend{backend}
+
+	if err := protectBackup("missing.tar.gz")(s); err == nil {
+		t.Error("Expected error protecting missing backup")
+	}
+
+	if err := protectBackup("backup.tar.gz")(s); err != nil {
+		t.Fatalf("Unexpected error protecting backup: %v", err)
+	}
+	if backend.uploads["backup.tar.gz.protected"] != 1 {
+		t.Error("Expected protection marker to be uploaded")
+	}
+
+	if err := unprotectBackup("backup.tar.gz")(s); err != nil {
+		t.Fatalf("Unexpected error unprotecting backup: %v", err)
+	}
+	if _, ok := backend.uploads["backup.tar.gz.protected"]; ok {
+		t.Error("Expected protection marker to be removed")
+	}
+	if err := unprotectBackup("backup.tar.gz")(s); err == nil {
+		t.Error("Expected error unprotecting backup that is not protected")
+	}
+}
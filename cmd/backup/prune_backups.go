@@ -4,44 +4,102 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"slices"
 	"strings"
 	"time"
 
 	"github.com/offen/docker-volume-backup/internal/errwrap"
+	"github.com/offen/docker-volume-backup/internal/storage"
+	"go.opentelemetry.io/otel/attribute"
 	"golang.org/x/sync/errgroup"
 )
 
 // pruneBackups rotates away backups from local and remote storages using
 // the given configuration. In case the given configuration would delete all
-// backups, it does nothing instead and logs a warning.
+// backups, it does nothing instead and logs a warning. When a GFS retention
+// policy is configured, it is applied instead, keeping backups younger than
+// the retention days in addition. Split archives are always pruned as a unit.
 func (s *script) pruneBackups() error {
-	if s.c.BackupRetentionDays < 0 {
+	gfs := s.gfsEnabled()
+	if s.c.BackupRetentionDays < 0 && len(s.c.BackupRetentionDaysOverrides) == 0 && !gfs {
 		return nil
 	}
 
-	deadline := time.Now().AddDate(0, 0, -int(s.c.BackupRetentionDays)).Add(s.c.BackupPruningLeeway)
+	s.warnSharedStorage()
 
+	var primaryMirror string
 	eg := errgroup.Group{}
 	for _, backend := range s.storages {
 		b := backend
+		if containsBackend(s.c.BackupMirrorBackends, b.Name()) {
+			if primaryMirror != "" {
+				s.logger.Info(
+					fmt.Sprintf("Skipping pruning for backend `%s` as it mirrors backend `%s`.", b.Name(), primaryMirror),
+				)
+				continue
+			}
+			primaryMirror = b.Name()
+		}
+		// Pruning would remove older backups although the current one is
+		// missing.
+		if partial, ok := s.uploadErr.(*partialFailureError); ok && slices.Contains(partial.failed, b.Name()) {
+			s.logger.Warn(
+				fmt.Sprintf("Skipping pruning for backend `%s` as uploading the backup has failed.", b.Name()),
+			)
+			continue
+		}
 		eg.Go(func() error {
-			if skipPrune(b.Name(), s.c.BackupSkipBackendsFromPrune) {
+			if !s.pruneDryRun && skipPrune(b.Name(), s.c.BackupSkipBackendsFromPrune) {
 				s.logger.Info(
 					fmt.Sprintf("Skipping pruning for backend `%s`.", b.Name()),
 				)
 				return nil
 			}
-			stats, err := b.Prune(deadline, s.c.BackupPruningPrefix)
+			retentionDays := s.retentionDays(b.Name())
+			if retentionDays < 0 && !gfs {
+				s.logger.Info(
+					fmt.Sprintf("Skipping pruning for backend `%s` as no retention is configured.", b.Name()),
+				)
+				return nil
+			}
+			var deadline time.Time
+			if retentionDays >= 0 {
+				deadline = time.Now().AddDate(0, 0, -retentionDays).Add(s.c.BackupPruningLeeway)
+			}
+
+			span := s.startSpan("prune", attribute.String("backend", b.Name()))
+			var stats *storage.PruneStats
+			attempts, err := s.withRetries(b.Name(), "prune backups", func(ctx context.Context) (err error) {
+				// Backends applying the retention policy themselves are only
+				// pruned by the caller when files need to be pruned as a unit.
+				_, native := b.(storage.RetentionPolicy)
+				if (gfs && !native) || s.c.BackupSplitSize > 0 || s.c.BackupChecksumAlgorithm != "" {
+					stats, err = s.pruneBackupSets(ctx, b, deadline)
+				} else {
+					stats, err = b.Prune(ctx, deadline, s.pruningPrefix(b.Name()), s.pruneDryRun)
+				}
+				return err
+			})
+			endSpan(span, err)
 			if err != nil {
 				return err
 			}
-			s.stats.Lock()
-			s.stats.Storages[b.Name()] = StorageStats{
-				Total:  stats.Total,
-				Pruned: stats.Pruned,
+			if s.pruneDryRun && len(stats.Matches) != 0 {
+				s.logger.Info(
+					fmt.Sprintf("Would prune backup(s) %s in backend `%s` (dry run).", strings.Join(stats.Matches, ", "), b.Name()),
+				)
 			}
+			s.stats.Lock()
+			storageStats := s.stats.Storages[b.Name()]
+			storageStats.Total = stats.Total
+			storageStats.Pruned = stats.Pruned
+			storageStats.PruneMatches = stats.Matches
+			storageStats.PruneDryRun = s.pruneDryRun
+			storageStats.RetentionDays = retentionDays
+			storageStats.PruneAttempts = attempts
+			s.stats.Storages[b.Name()] = storageStats
 			s.stats.Unlock()
 			return nil
 		})
@@ -54,11 +112,87 @@ func (s *script) pruneBackups() error {
 	return nil
 }
 
+// retentionDays returns the number of days backups are retained in the
+// backend with the given name, preferring BACKUP_RETENTION_DAYS_OVERRIDES.
+// A negative value means backups are not pruned by age.
+func (s *script) retentionDays(backend string) int {
+	if days, ok := lookupBackend(s.c.BackupRetentionDaysOverrides, backend); ok {
+		return days
+	}
+	return int(s.c.BackupRetentionDays)
+}
+
+// warnSharedStorage logs a warning for each pair of backends that appear to
+// target the same underlying storage, i.e. list the exact same backups with
+// identical sizes and modification times, without being marked as mirrors.
+// Backends that cannot be listed are ignored.
+func (s *script) warnSharedStorage() {
+	if len(s.storages) < 2 {
+		return
+	}
+
+	fingerprints := make([]string, len(s.storages))
+	eg := errgroup.Group{}
+	for i, backend := range s.storages {
+		b := backend
+		idx := i
+		eg.Go(func() error {
+			candidates, err := b.List(s.pruningPrefix(b.Name()))
+			if err != nil {
+				s.logger.Warn(
+					fmt.Sprintf("Unable to list backend `%s` for detecting shared storage: %v", b.Name(), errwrap.Unwrap(err)),
+				)
+				return nil
+			}
+			fingerprints[idx] = storageFingerprint(candidates)
+			return nil
+		})
+	}
+	_ = eg.Wait()
+
+	for i := range s.storages {
+		for j := i + 1; j < len(s.storages); j++ {
+			a, b := s.storages[i].Name(), s.storages[j].Name()
+			if fingerprints[i] == "" || fingerprints[i] != fingerprints[j] {
+				continue
+			}
+			if containsBackend(s.c.BackupMirrorBackends, a) && containsBackend(s.c.BackupMirrorBackends, b) {
+				continue
+			}
+			s.logger.Warn(
+				fmt.Sprintf(
+					"Backends `%s` and `%s` appear to share the same storage, which can result in pruning them twice. Add both to BACKUP_MIRROR_BACKENDS in case this is intentional.",
+					a,
+					b,
+				),
+			)
+		}
+	}
+}
+
+// storageFingerprint returns a string identifying the given set of files by
+// name, size and modification time. Modification times are truncated to
+// seconds as backends report them using different precisions.
+func storageFingerprint(candidates []storage.ObjectInfo) string {
+	entries := make([]string, 0, len(candidates))
+	for _, c := range candidates {
+		entries = append(entries, fmt.Sprintf("%s:%d:%d", c.Name, c.Size, c.LastModified.Unix()))
+	}
+	slices.Sort(entries)
+	return strings.Join(entries, "\n")
+}
+
 // skipPrune returns true if the given backend name is contained in the
 // list of skipped backends.
 func skipPrune(name string, skippedBackends []string) bool {
+	return containsBackend(skippedBackends, name)
+}
+
+// containsBackend returns true if the given backend name is contained in the
+// given list of backend names.
+func containsBackend(backends []string, name string) bool {
 	return slices.ContainsFunc(
-		skippedBackends,
+		backends,
 		func(b string) bool {
 			return strings.EqualFold(b, name) // ignore case on both sides
 		},
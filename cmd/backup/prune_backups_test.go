@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/offen/docker-volume-backup/internal/storage"
+	"github.com/offen/docker-volume-backup/internal/storage/local"
+)
+
+func TestRetentionDays(t *testing.T) {
+	s := newScript(&Config{
+		BackupRetentionDays: 7,
+		BackupRetentionDaysOverrides: map[string]int{
+			"local": 30,
+			"S3":    -1,
+		},
+	})
+	tests := []struct {
+		backend  string
+		expected int
+	}{
+		{"Local", 30},
+		{"S3", -1},
+		{"Azure", 7},
+	}
+	for _, test := range tests {
+		if result := s.retentionDays(test.backend); result != test.expected {
+			t.Errorf("Expected %d for %s, got %d", test.expected, test.backend, result)
+		}
+	}
+
+	// Overrides are parsed when loading the configuration.
+	_, err := loadConfig(func(key string) (string, bool) {
+		if key == "BACKUP_RETENTION_DAYS_OVERRIDES" {
+			return "webdav:seven", true
+		}
+		return "", false
+	})
+	if err == nil {
+		t.Error("Expected error for invalid retention days override")
+	}
+}
+
+func TestPruneBackupsDryRun(t *testing.T) {
+	archive := t.TempDir()
+	writeBackups(t, archive, 0, 48*time.Hour, 72*time.Hour)
+
+	s := newScript(&Config{BackupRetentionDays: 1, BackupPruningPrefix: "backup-", BackupPruneDryRun: true})
+	s.storages = append(s.storages, local.NewStorageBackend(local.Config{ArchivePath: archive}, func(storage.LogLevel, string, string, ...any) {}))
+	if err := s.pruneBackups(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	entries, err := os.ReadDir(archive)
+	if err != nil {
+		t.Fatalf("Unexpected error reading directory: %v", err)
+	}
+	if len(entries) != 3 {
+		t.Errorf("Expected no files to be deleted, got %d remaining", len(entries))
+	}
+	stats := s.stats.Storages["Local"]
+	if !stats.PruneDryRun || stats.Pruned != 2 {
+		t.Errorf("Expected 2 backups to be reported as dry run, got %d, %v", stats.Pruned, stats.PruneDryRun)
+	}
+	expected := "Would prune backup(s) backup-1.tar.gz, backup-2.tar.gz in backend `Local` (dry run)."
+	if !strings.Contains(s.stats.LogOutput.String(), expected) {
+		t.Errorf("Expected %q to be logged, got %s", expected, s.stats.LogOutput.String())
+	}
+}
+
+func TestPruneBackupsMaxPercent(t *testing.T) {
+	archive := t.TempDir()
+	writeBackups(t, archive, 0, 48*time.Hour, 72*time.Hour)
+
+	s := newScript(&Config{BackupRetentionDays: 1, BackupPruningPrefix: "backup-", BackupPruneMaxPercent: 50})
+	b := local.NewStorageBackend(local.Config{ArchivePath: archive}, func(storage.LogLevel, string, string, ...any) {})
+	b.(storage.PruneLimiter).SetPruneMaxPercent(s.c.BackupPruneMaxPercent.Int())
+	s.storages = append(s.storages, b)
+	err := s.pruneBackups()
+	if err == nil || !strings.Contains(err.Error(), "refusing to prune 2 out of 3 backups") {
+		t.Fatalf("Expected pruning to be refused, got %v", err)
+	}
+
+	entries, err := os.ReadDir(archive)
+	if err != nil {
+		t.Fatalf("Unexpected error reading directory: %v", err)
+	}
+	if len(entries) != 3 {
+		t.Errorf("Expected no files to be deleted, got %d remaining", len(entries))
+	}
+}
+
+// writeBackups writes a backup named backup-<index>.tar.gz to the given
+// directory for each of the given ages, setting its modification time
+// accordingly.
+func writeBackups(t *testing.T, dir string, ages ...time.Duration) {
+	t.Helper()
+	for i, age := range ages {
+		file := filepath.Join(dir, fmt.Sprintf("backup-%d.tar.gz", i))
+		if err := os.WriteFile(file, []byte("content"), 0644); err != nil {
+			t.Fatalf("Unexpected error writing file: %v", err)
+		}
+		mtime := time.Now().Add(-age)
+		if err := os.Chtimes(file, mtime, mtime); err != nil {
+			t.Fatalf("Unexpected error setting mtime: %v", err)
+		}
+	}
+}
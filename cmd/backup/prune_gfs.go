@@ -0,0 +1,297 @@
+// Copyright 2024 - offen.software <hioffen@posteo.de>
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/offen/docker-volume-backup/internal/errwrap"
+	"github.com/offen/docker-volume-backup/internal/storage"
+)
+
+// gfsPeriod defines how many of the most recent periods of a given length
+// retain their newest backup.
+type gfsPeriod struct {
+	keep int
+	key  func(time.Time) string
+}
+
+// gfsPeriods returns the periods configured for the grandfather-father-son
+// retention policy.
+func (s *script) gfsPeriods() []gfsPeriod {
+	return []gfsPeriod{
+		{s.c.BackupRetentionGfsDaily.Int(), func(t time.Time) string {
+			return t.Format("2006-01-02")
+		}},
+		{s.c.BackupRetentionGfsWeekly.Int(), func(t time.Time) string {
+			year, week := t.ISOWeek()
+			return fmt.Sprintf("%d-W%02d", year, week)
+		}},
+		{s.c.BackupRetentionGfsMonthly.Int(), func(t time.Time) string {
+			return t.Format("2006-01")
+		}},
+		{s.c.BackupRetentionGfsYearly.Int(), func(t time.Time) string {
+			return t.Format("2006")
+		}},
+	}
+}
+
+// gfsEnabled returns whether a grandfather-father-son retention policy is
+// configured, which takes precedence over pruning by deadline.
+func (s *script) gfsEnabled() bool {
+	for _, p := range s.gfsPeriods() {
+		if p.keep > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// pruneBackupSets prunes the backups in the given backend that are not
+// retained by the grandfather-father-son retention policy or are older than
+// the given deadline, unless it is zero. Contrary to pruning in the backends,
+// files belonging to the same backup, i.e. parts of a split archive, its
+// manifest and the envelope of an encrypted backup, are pruned as a unit.
+func (s *script) pruneBackupSets(ctx context.Context, b storage.Backend, deadline time.Time) (*storage.PruneStats, error) {
+	candidates, err := b.List(s.pruningPrefix(b.Name()))
+	if err != nil {
+		return nil, errwrap.Wrap(err, fmt.Sprintf("error listing backups in backend `%s`", b.Name()))
+	}
+
+	protected := map[string]bool{}
+	members := map[string][]string{}
+	// index maps the name of a set to its position in sets.
+	index := map[string]int{}
+	var sets []storage.ObjectInfo
+	for _, candidate := range candidates {
+		// The latest backup and its envelope might match the pruning prefix,
+		// but must never be pruned.
+		if s.c.BackupLatestSymlink != "" && path.Base(backupSetName(candidate.Name)) == s.c.BackupLatestSymlink {
+			continue
+		}
+		if storage.IsProtectionMarker(candidate.Name) {
+			protected[backupSetName(strings.TrimSuffix(candidate.Name, storage.ProtectionMarkerSuffix))] = true
+			continue
+		}
+		name := backupSetName(candidate.Name)
+		idx, ok := index[name]
+		if !ok {
+			sets = append(sets, storage.ObjectInfo{Name: name})
+			idx = len(sets) - 1
+			index[name] = idx
+		}
+		// A set is considered as old as its newest file.
+		if candidate.LastModified.After(sets[idx].LastModified) {
+			sets[idx].LastModified = candidate.LastModified
+		}
+		members[name] = append(members[name], candidate.Name)
+	}
+
+	var lenProtected int
+	sets = slices.DeleteFunc(sets, func(o storage.ObjectInfo) bool {
+		if protected[o.Name] {
+			lenProtected++
+			return true
+		}
+		return false
+	})
+	if lenProtected > 0 {
+		s.logger.Info(fmt.Sprintf("Skipping %d protected backups.", lenProtected), "storage", b.Name())
+	}
+
+	timestamp := s.backupTimestamp(b.Name())
+	matches := gfsMatches(sets, timestamp, s.gfsPeriods(), deadline)
+	stats := &storage.PruneStats{
+		Total:   uint(len(sets) + lenProtected),
+		Pruned:  uint(len(matches)),
+		Matches: matches,
+	}
+
+	if len(matches) == 0 {
+		s.logger.Info(fmt.Sprintf("None of %d existing backups were pruned.", stats.Total), "storage", b.Name())
+		return stats, nil
+	}
+	if len(matches) == len(sets) {
+		s.logger.Warn(fmt.Sprintf("The current configuration would delete all %d existing backups.", len(matches)), "storage", b.Name())
+		s.logger.Warn("Refusing to do so, please check your configuration.", "storage", b.Name())
+		stats.Pruned = 0
+		stats.Matches = nil
+		return stats, nil
+	}
+	limitErr := storage.CheckPruneLimit(len(matches), int(stats.Total), s.c.BackupPruneMaxPercent.Int())
+	if s.pruneDryRun {
+		s.logger.Info(
+			fmt.Sprintf("Would prune %d out of %d backups as they are not retained by the configured retention.", stats.Pruned, stats.Total),
+			"storage", b.Name(),
+		)
+		if limitErr != nil {
+			s.logger.Warn(fmt.Sprintf("Pruning would fail: %v", errwrap.Unwrap(limitErr)), "storage", b.Name())
+		}
+		return stats, nil
+	}
+	if limitErr != nil {
+		return stats, limitErr
+	}
+
+	// Only sets that have been removed completely are counted, so the stats
+	// are accurate in case removing a file fails.
+	stats.Pruned = 0
+	for _, name := range matches {
+		if err := ctx.Err(); err != nil {
+			return stats, errwrap.Wrap(err, "pruning was cancelled")
+		}
+		files := members[name]
+		// The manifest is removed first, so an incomplete set of parts is
+		// never mistaken for a complete backup.
+		slices.SortStableFunc(files, func(a, b string) int {
+			if strings.HasSuffix(a, splitManifestSuffix) {
+				return -1
+			}
+			if strings.HasSuffix(b, splitManifestSuffix) {
+				return 1
+			}
+			return 0
+		})
+		for _, file := range files {
+			if err := b.Remove(file); err != nil {
+				return stats, errwrap.Wrap(err, fmt.Sprintf("error removing `%s` of backup `%s`", file, name))
+			}
+		}
+		stats.Pruned++
+	}
+	s.logger.Info(
+		fmt.Sprintf("Pruned %d out of %d backups as they were not retained by the configured retention.", stats.Pruned, stats.Total),
+		"storage", b.Name(),
+	)
+	return stats, nil
+}
+
+// gfsMatches returns the names of all backups that are not retained by the
+// given periods. Going from the newest to the oldest backup, a backup is
+// retained in case it is the newest one in a period that has not been seen
+// before, until the number of periods to keep is reached.
+func gfsMatches(backups []storage.ObjectInfo, timestamp func(storage.ObjectInfo) (time.Time, bool), periods []gfsPeriod, deadline time.Time) []string {
+	type timedBackup struct {
+		name string
+		time time.Time
+	}
+	var timed []timedBackup
+	for _, backup := range backups {
+		// Backups without a date in their name, e.g. the latest copy, are
+		// neither retained nor pruned.
+		if t, ok := timestamp(backup); ok {
+			timed = append(timed, timedBackup{backup.Name, t})
+		}
+	}
+	slices.SortStableFunc(timed, func(a, b timedBackup) int {
+		return b.time.Compare(a.time)
+	})
+
+	retained := make([]bool, len(timed))
+	for _, p := range periods {
+		var kept int
+		var last string
+		for i, backup := range timed {
+			if kept >= p.keep {
+				break
+			}
+			if key := p.key(backup.time); key != last {
+				retained[i] = true
+				last = key
+				kept++
+			}
+		}
+	}
+
+	var matches []string
+	for i, backup := range timed {
+		if retained[i] || (!deadline.IsZero() && backup.time.After(deadline)) {
+			continue
+		}
+		matches = append(matches, backup.name)
+	}
+	return matches
+}
+
+// strftimeDirectives maps the strftime directives that are used for
+// determining the time a backup was created at to a matching expression.
+var strftimeDirectives = map[byte]string{
+	'Y': `(\d{4})`,
+	'y': `(\d{2})`,
+	'm': `(\d{2})`,
+	'd': `(\d{2})`,
+	'H': `(\d{2})`,
+	'M': `(\d{2})`,
+	'S': `(\d{2})`,
+}
+
+// backupTimestamp returns a func that determines the time a backup in the
+// given backend was created at by parsing the date and time contained in its
+// name according to the strftime directives in BACKUP_FILENAME. In case
+// BACKUP_FILENAME does not contain a date, the modification time is used
+// instead. Names that do not contain a date although BACKUP_FILENAME does,
+// e.g. a copy of the latest backup, are reported as undated.
+func (s *script) backupTimestamp(backend string) func(storage.ObjectInfo) (time.Time, bool) {
+	modTime := func(o storage.ObjectInfo) (time.Time, bool) {
+		return o.LastModified, true
+	}
+
+	filename, ok := lookupBackend(s.c.BackupFilenameOverrides, backend)
+	if !ok {
+		filename = s.c.BackupFilename
+	}
+	if s.c.BackupFilenameExpand {
+		filename = os.ExpandEnv(filename)
+	}
+
+	// Literal parts might be altered by BACKUP_KEY_SEPARATOR and similar, so
+	// directives are only required to be separated by non-digits.
+	var directives []byte
+	var expressions []string
+	for i := 0; i < len(filename)-1; i++ {
+		if filename[i] != '%' {
+			continue
+		}
+		i++
+		if filename[i] == '%' {
+			// a literal percent sign
+			continue
+		}
+		if expr, ok := strftimeDirectives[filename[i]]; ok {
+			directives = append(directives, filename[i])
+			expressions = append(expressions, expr)
+		}
+	}
+	if !slices.Contains(directives, 'd') {
+		return modTime
+	}
+	re := regexp.MustCompile(strings.Join(expressions, `\D*`))
+
+	return func(o storage.ObjectInfo) (time.Time, bool) {
+		submatches := re.FindStringSubmatch(path.Base(o.Name))
+		if submatches == nil {
+			return time.Time{}, false
+		}
+		values := map[byte]int{'m': 1, 'd': 1}
+		for i, directive := range directives {
+			values[directive], _ = strconv.Atoi(submatches[i+1])
+		}
+		if _, ok := values['Y']; !ok {
+			values['Y'] = 2000 + values['y']
+		}
+		t := time.Date(values['Y'], time.Month(values['m']), values['d'], values['H'], values['M'], values['S'], 0, time.Local)
+		if t.Month() != time.Month(values['m']) || t.Day() != values['d'] {
+			return time.Time{}, false
+		}
+		return t, true
+	}
+}
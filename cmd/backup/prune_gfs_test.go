@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/offen/docker-volume-backup/internal/storage"
+	"github.com/offen/docker-volume-backup/internal/storage/local"
+)
+
+func TestPruneGFS(t *testing.T) {
+	archive := t.TempDir()
+	start := time.Date(2024, 3, 31, 4, 0, 0, 0, time.Local)
+	// one backup per day, going back a little more than three months
+	for i := 0; i < 100; i++ {
+		name := start.AddDate(0, 0, -i).Format("backup-2006-01-02T15-04-05.tar.gz")
+		if err := os.WriteFile(filepath.Join(archive, name), []byte("content"), 0644); err != nil {
+			t.Fatalf("Unexpected error writing file: %v", err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(archive, "backup-2024-01-01T04-00-00.tar.gz.protected"), nil, 0644); err != nil {
+		t.Fatalf("Unexpected error writing marker: %v", err)
+	}
+	// a copy of the latest backup without a date is neither retained nor pruned
+	if err := os.WriteFile(filepath.Join(archive, "backup-latest.tar.gz"), []byte("content"), 0644); err != nil {
+		t.Fatalf("Unexpected error writing file: %v", err)
+	}
+
+	s := newScript(&Config{
+		BackupFilename:            "backup-%Y-%m-%dT%H-%M-%S.tar.gz",
+		BackupPruningPrefix:       "backup-",
+		BackupRetentionDays:       -1,
+		BackupRetentionGfsDaily:   3,
+		BackupRetentionGfsWeekly:  2,
+		BackupRetentionGfsMonthly: 3,
+	})
+	if !s.gfsEnabled() {
+		t.Fatal("Expected GFS retention to be enabled")
+	}
+	b := local.NewStorageBackend(local.Config{ArchivePath: archive}, func(storage.LogLevel, string, string, ...any) {})
+
+	stats, err := s.pruneBackupSets(context.Background(), b, time.Time{})
+	if err != nil {
+		t.Fatalf("Unexpected error pruning: %v", err)
+	}
+	if stats.Total != 101 {
+		t.Errorf("Expected 101 backups in total, got %d", stats.Total)
+	}
+
+	entries, err := os.ReadDir(archive)
+	if err != nil {
+		t.Fatalf("Unexpected error reading directory: %v", err)
+	}
+	var remaining []string
+	for _, e := range entries {
+		remaining = append(remaining, e.Name())
+	}
+	expected := []string{
+		"backup-2024-01-01T04-00-00.tar.gz",
+		"backup-2024-01-01T04-00-00.tar.gz.protected",
+		// months
+		"backup-2024-01-31T04-00-00.tar.gz",
+		"backup-2024-02-29T04-00-00.tar.gz",
+		// weeks, the most recent one also being the current month
+		"backup-2024-03-24T04-00-00.tar.gz",
+		// days
+		"backup-2024-03-29T04-00-00.tar.gz",
+		"backup-2024-03-30T04-00-00.tar.gz",
+		"backup-2024-03-31T04-00-00.tar.gz",
+		"backup-latest.tar.gz",
+	}
+	slices.Sort(expected)
+	if !slices.Equal(remaining, expected) {
+		t.Errorf("Unexpected remaining backups %v", remaining)
+	}
+	if int(stats.Pruned) != 99-6 {
+		t.Errorf("Unexpected number of pruned backups %d", stats.Pruned)
+	}
+}
+
+func TestPruneGFSLatest(t *testing.T) {
+	archive := t.TempDir()
+	now := time.Now()
+	for i, name := range []string{"backup-a.tar.gz", "backup-b.tar.gz", "backup-latest.tar.gz"} {
+		file := filepath.Join(archive, name)
+		if err := os.WriteFile(file, []byte("content"), 0644); err != nil {
+			t.Fatalf("Unexpected error writing file: %v", err)
+		}
+		modified := now.AddDate(0, 0, -10*(i+1))
+		if err := os.Chtimes(file, modified, modified); err != nil {
+			t.Fatalf("Unexpected error setting modification time: %v", err)
+		}
+	}
+
+	s := newScript(&Config{
+		BackupFilename:          "backup.tar.gz",
+		BackupPruningPrefix:     "backup-",
+		BackupLatestSymlink:     "backup-latest.tar.gz",
+		BackupRetentionGfsDaily: 1,
+	})
+	b := local.NewStorageBackend(local.Config{ArchivePath: archive}, func(storage.LogLevel, string, string, ...any) {})
+	if _, err := s.pruneBackupSets(context.Background(), b, time.Time{}); err != nil {
+		t.Fatalf("Unexpected error pruning: %v", err)
+	}
+
+	entries, err := os.ReadDir(archive)
+	if err != nil {
+		t.Fatalf("Unexpected error reading directory: %v", err)
+	}
+	var remaining []string
+	for _, e := range entries {
+		remaining = append(remaining, e.Name())
+	}
+	if expected := []string{"backup-a.tar.gz", "backup-latest.tar.gz"}; !slices.Equal(remaining, expected) {
+		t.Errorf("Expected %v to remain, got %v", expected, remaining)
+	}
+}
+
+func TestBackupTimestamp(t *testing.T) {
+	modified := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		filename string
+		name     string
+		expected time.Time
+		dated    bool
+	}{
+		{"backup-%Y-%m-%dT%H-%M-%S.tar.gz", "backup-2024-05-06T07-08-09.tar.gz.gpg", time.Date(2024, 5, 6, 7, 8, 9, 0, time.Local), true},
+		{"app1-%y%m%d.tar", "dir/app1-240506.tar", time.Date(2024, 5, 6, 0, 0, 0, 0, time.Local), true},
+		{"backup-%Y-%m-%dT%H-%M-%S.tar.gz", "backup_2024_05_06t07_08_09.tar.gz", time.Date(2024, 5, 6, 7, 8, 9, 0, time.Local), true},
+		{"backup-%Y-%m-%dT%H-%M-%S.tar.gz", "backup.latest.tar.gz", time.Time{}, false},
+		{"backup-%Y-%m-%dT%H-%M-%S.tar.gz", "backup-2024-13-06T07-08-09.tar.gz", time.Time{}, false},
+		{"backup.tar.gz", "backup.tar.gz", modified, true},
+		{"backup-%%d-%Y-%m.tar.gz", "backup-%d-2024-05.tar.gz", modified, true},
+		{"backup-%%%d-%Y-%m.tar.gz", "backup-%06-2024-05.tar.gz", time.Date(2024, 5, 6, 0, 0, 0, 0, time.Local), true},
+	}
+	for _, test := range tests {
+		s := newScript(&Config{BackupFilename: test.filename})
+		result, dated := s.backupTimestamp("Local")(storage.ObjectInfo{Name: test.name, LastModified: modified})
+		if dated != test.dated {
+			t.Errorf("Expected %s to be dated: %v, got %v", test.name, test.dated, dated)
+		}
+		if !result.Equal(test.expected) {
+			t.Errorf("Expected %v for %s, got %v", test.expected, test.name, result)
+		}
+	}
+}
+
+// failingRemover fails removing files once the given number of files has
+// been removed.
+type failingRemover struct {
+	storage.Backend
+	remaining int
+}
+
+func (f *failingRemover) Remove(name string) error {
+	if f.remaining == 0 {
+		return errors.New("remove failed")
+	}
+	f.remaining--
+	return f.Backend.Remove(name)
+}
+
+func TestPruneBackupSetsRemoveError(t *testing.T) {
+	archive := t.TempDir()
+	old := time.Now().Add(-72 * time.Hour)
+	for i, modTime := range []time.Time{time.Now(), old, old, old} {
+		location := filepath.Join(archive, fmt.Sprintf("backup-%d.tar.gz", i))
+		if err := os.WriteFile(location, []byte("content"), 0644); err != nil {
+			t.Fatalf("Unexpected error writing file: %v", err)
+		}
+		if err := os.Chtimes(location, modTime, modTime); err != nil {
+			t.Fatalf("Unexpected error setting modification time: %v", err)
+		}
+	}
+
+	s := newScript(&Config{BackupFilename: "backup.tar.gz", BackupPruningPrefix: "backup-"})
+	b := &failingRemover{
+		Backend:   local.NewStorageBackend(local.Config{ArchivePath: archive}, func(storage.LogLevel, string, string, ...any) {}),
+		remaining: 1,
+	}
+	stats, err := s.pruneBackupSets(context.Background(), b, time.Now().Add(-24*time.Hour))
+	if err == nil {
+		t.Fatal("Expected an error when removing fails")
+	}
+	if stats.Pruned != 1 {
+		t.Errorf("Expected 1 pruned backup to be reported, got %d", stats.Pruned)
+	}
+}
+
+func TestPruneCancelled(t *testing.T) {
+	archive := t.TempDir()
+	old := time.Now().Add(-72 * time.Hour)
+	for i, modTime := range []time.Time{time.Now(), old, old} {
+		location := filepath.Join(archive, fmt.Sprintf("backup-%d.tar.gz", i))
+		if err := os.WriteFile(location, []byte("content"), 0644); err != nil {
+			t.Fatalf("Unexpected error writing file: %v", err)
+		}
+		if err := os.Chtimes(location, modTime, modTime); err != nil {
+			t.Fatalf("Unexpected error setting modification time: %v", err)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	s := newScript(&Config{BackupFilename: "backup.tar.gz", BackupPruningPrefix: "backup-"})
+	b := local.NewStorageBackend(local.Config{ArchivePath: archive}, func(storage.LogLevel, string, string, ...any) {})
+	if _, err := s.pruneBackupSets(ctx, b, time.Now().Add(-24*time.Hour)); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected pruning backup sets to be cancelled, got %v", err)
+	}
+	if _, err := b.Prune(ctx, time.Now().Add(-24*time.Hour), "backup-", false); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected pruning to be cancelled, got %v", err)
+	}
+	if entries, _ := os.ReadDir(archive); len(entries) != 3 {
+		t.Errorf("Expected no backups to be pruned, got %d remaining", len(entries))
+	}
+}
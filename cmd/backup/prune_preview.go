@@ -0,0 +1,27 @@
+// Copyright 2024 - offen.software <hioffen@posteo.de>
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"github.com/offen/docker-volume-backup/internal/errwrap"
+)
+
+// previewPrune runs the pruning process for all configured backends without
+// deleting any files and sends a notification listing the backups that would
+// have been pruned.
+func (s *script) previewPrune() error {
+	s.pruneDryRun = true
+	if s.c.BackupRetentionDays < 0 && len(s.c.BackupRetentionDaysOverrides) == 0 && !s.gfsEnabled() {
+		s.logger.Warn("Neither BACKUP_RETENTION_DAYS nor a GFS retention policy is set, no backups would be pruned.")
+	}
+	if err := s.pruneBackups(); err != nil {
+		return err
+	}
+	if len(s.senders) != 0 {
+		if err := s.notifyPrunePreview(); err != nil {
+			return errwrap.Wrap(err, "error sending prune preview")
+		}
+	}
+	return nil
+}
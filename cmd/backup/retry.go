@@ -0,0 +1,136 @@
+// Copyright 2024 - offen.software <hioffen@posteo.de>
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"syscall"
+	"time"
+
+	"github.com/offen/docker-volume-backup/internal/errwrap"
+	"github.com/offen/docker-volume-backup/internal/storage"
+)
+
+// withRetries calls fn until it succeeds or returns an error that is not
+// transient. In between attempts, it waits for BACKUP_UPLOAD_RETRY_DELAY,
+// doubling the delay after each attempt and adding jitter. It returns the
+// number of attempts that have been made. Each attempt is subject to the
+// timeout configured for the backend.
+func (s *script) withRetries(backend, action string, fn func(ctx context.Context) error) (uint, error) {
+	retries := s.c.BackupUploadRetries.Int()
+	for attempt := 1; ; attempt++ {
+		err := s.withTimeout(backend, fn)
+		if err == nil || attempt > retries || !transient(err) {
+			return uint(attempt), err
+		}
+		delay := backoff(s.c.BackupUploadRetryDelay, attempt)
+		s.logger.Warn(
+			fmt.Sprintf(
+				"Attempt %d of %d to %s in backend `%s` failed, retrying in %s: %v",
+				attempt, retries+1, action, backend, delay.Round(time.Millisecond), err,
+			),
+		)
+		select {
+		case <-s.ctx.Done():
+			return uint(attempt), err
+		case <-time.After(delay):
+		}
+	}
+}
+
+// withTimeout calls fn with a context that is cancelled once the timeout
+// configured for the given backend has passed. Uploads in progress are
+// allowed to finish when the script is shut down, which is why the context
+// is not derived from the one of the script.
+func (s *script) withTimeout(backend string, fn func(ctx context.Context) error) error {
+	// Overrides are validated when initializing the script.
+	timeout, _ := s.storageTimeout(backend)
+	if timeout <= 0 {
+		return fn(context.Background())
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	err := fn(ctx)
+	if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return &timeoutError{timeout: timeout, err: err}
+	}
+	return err
+}
+
+// storageTimeout returns the timeout for operations in the backend with the
+// given name, preferring BACKUP_STORAGE_TIMEOUT_OVERRIDES. A value of zero
+// means operations do not time out.
+func (s *script) storageTimeout(backend string) (time.Duration, error) {
+	override, ok := lookupBackend(s.c.BackupStorageTimeoutOverrides, backend)
+	if !ok {
+		return s.c.BackupStorageTimeout, nil
+	}
+	timeout, err := time.ParseDuration(override)
+	if err != nil {
+		return 0, errwrap.Wrap(err, fmt.Sprintf("invalid storage timeout override for backend `%s`", backend))
+	}
+	return timeout, nil
+}
+
+// timeoutError is returned in case a storage backend did not finish an
+// operation within the configured timeout. It matches
+// context.DeadlineExceeded, no matter how the backend reported the
+// cancellation.
+type timeoutError struct {
+	timeout time.Duration
+	err     error
+}
+
+func (t *timeoutError) Error() string {
+	return fmt.Sprintf("storage backend did not finish within %s: %v", t.timeout, t.err)
+}
+
+func (t *timeoutError) Unwrap() error {
+	return t.err
+}
+
+func (t *timeoutError) Is(target error) bool {
+	return target == context.DeadlineExceeded
+}
+
+// backoff returns the delay before the next attempt after the given number
+// of attempts. The delay grows exponentially and is randomized by up to half
+// of its value in both directions, so runs sharing a storage do not retry
+// at the same time.
+func backoff(base time.Duration, attempt int) time.Duration {
+	if base <= 0 {
+		return 0
+	}
+	delay := base << min(attempt-1, 20)
+	return delay/2 + rand.N(delay)
+}
+
+// transient returns whether the given error is likely to go away when
+// retrying, i.e. it is caused by a network failure, a timeout, throttling
+// or an error on the server side. Errors caused by invalid credentials or
+// missing permissions are never considered transient.
+func transient(err error) bool {
+	var statusErr *storage.StatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode == http.StatusRequestTimeout ||
+			statusErr.StatusCode == http.StatusTooManyRequests ||
+			statusErr.StatusCode >= 500
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	var opErr *net.OpError
+	return errors.As(err, &opErr) ||
+		errors.Is(err, context.DeadlineExceeded) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.EPIPE)
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/offen/docker-volume-backup/internal/storage"
+)
+
+func TestTransient(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      error
+		expected bool
+	}{
+		{"server error", &storage.StatusError{StatusCode: 503, Err: errors.New("unavailable")}, true},
+		{"throttled", fmt.Errorf("wrapped: %w", &storage.StatusError{StatusCode: 429, Err: errors.New("slow down")}), true},
+		{"forbidden", &storage.StatusError{StatusCode: 403, Err: errors.New("access denied")}, false},
+		{"unauthorized", &storage.StatusError{StatusCode: 401, Err: errors.New("invalid credentials")}, false},
+		{"connection refused", &net.OpError{Op: "dial", Err: errors.New("connection refused")}, true},
+		{"other error", errors.New("no such file or directory"), false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := transient(test.err); got != test.expected {
+				t.Errorf("expected %v, got %v", test.expected, got)
+			}
+		})
+	}
+}
+
+func TestWithRetries(t *testing.T) {
+	s := newScript(&Config{BackupUploadRetries: 3, BackupUploadRetryDelay: time.Millisecond})
+
+	calls := 0
+	attempts, err := s.withRetries("S3", "upload", func(context.Context) error {
+		calls++
+		if calls < 3 {
+			return &storage.StatusError{StatusCode: 500, Err: errors.New("internal error")}
+		}
+		return nil
+	})
+	if err != nil || attempts != 3 {
+		t.Errorf("expected success after 3 attempts, got %d, %v", attempts, err)
+	}
+
+	calls = 0
+	attempts, err = s.withRetries("S3", "upload", func(context.Context) error {
+		calls++
+		return &storage.StatusError{StatusCode: 403, Err: errors.New("access denied")}
+	})
+	if err == nil || attempts != 1 {
+		t.Errorf("expected permanent error not to be retried, got %d attempts, %v", attempts, err)
+	}
+
+	attempts, err = s.withRetries("S3", "upload", func(context.Context) error {
+		return &storage.StatusError{StatusCode: 502, Err: errors.New("bad gateway")}
+	})
+	if err == nil || attempts != 4 {
+		t.Errorf("expected error after 4 attempts, got %d, %v", attempts, err)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	for attempt := 1; attempt <= 4; attempt++ {
+		expected := time.Second << (attempt - 1)
+		delay := backoff(time.Second, attempt)
+		if delay < expected/2 || delay >= expected*3/2 {
+			t.Errorf("attempt %d: expected delay around %s, got %s", attempt, expected, delay)
+		}
+	}
+	if delay := backoff(0, 3); delay != 0 {
+		t.Errorf("expected no delay, got %s", delay)
+	}
+}
+
+func TestStorageTimeout(t *testing.T) {
+	s := newScript(&Config{
+		BackupUploadRetries:           1,
+		BackupUploadRetryDelay:        time.Millisecond,
+		BackupStorageTimeout:          time.Hour,
+		BackupStorageTimeoutOverrides: map[string]string{"webdav": "20ms"},
+	})
+	s.stats.Storages = map[string]StorageStats{}
+
+	hanging := &mockBackend{name: "WebDAV", hang: true, uploads: map[string]int{}}
+	done := make(chan error)
+	go func() {
+		done <- s.copyWithRetries(hanging, "backup.tar.gz", "backup.tar.gz")
+	}()
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("expected upload to time out, got %v", err)
+		}
+		if attempts := s.stats.Storages["WebDAV"].UploadAttempts; attempts != 2 {
+			t.Errorf("expected timed out upload to be retried, got %d attempts", attempts)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected hanging upload to be cancelled")
+	}
+
+	if timeout, err := s.storageTimeout("S3"); err != nil || timeout != time.Hour {
+		t.Errorf("expected default timeout, got %s, %v", timeout, err)
+	}
+	s.c.BackupStorageTimeoutOverrides = map[string]string{"S3": "soon"}
+	if _, err := s.storageTimeout("S3"); err == nil {
+		t.Error("expected error for invalid override")
+	}
+}
@@ -4,18 +4,244 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"os"
+	"path/filepath"
 	"runtime/debug"
+	"strings"
+	"time"
 
 	"github.com/offen/docker-volume-backup/internal/errwrap"
+	"go.opentelemetry.io/otel/attribute"
+	"golang.org/x/sync/errgroup"
 )
 
-// runScript instantiates a new script object and orchestrates a backup run.
-// To ensure it runs mutually exclusive a global file lock is acquired before
-// it starts running. Any panic within the script will be recovered and returned
-// as an error.
-func runScript(c *Config) (err error) {
+// runScript orchestrates a backup run using the given configuration. In case
+// the run fails and retries are configured, the entire run is attempted again
+// after the configured delay until it either succeeds or no retries are left.
+// Cancelling the given context aborts the run as soon as possible, releasing
+// all resources acquired so far.
+func runScript(ctx context.Context, c *Config) error {
+	if c.BackupSplitByTopLevelDir {
+		return runSplitScript(ctx, c)
+	}
+
+	retries := c.BackupRunRetries.Int()
+	for attempt := 1; ; attempt++ {
+		err := runScriptAttempt(ctx, c, attempt)
+		if err == nil || partialFailure(err) || attempt > retries || ctx.Err() != nil {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(c.BackupRunRetryDelay):
+		}
+	}
+}
+
+// runSplitScript runs a separate backup for each top-level directory in the
+// configured backup sources and one for the files located directly in them.
+// Labeled containers are stopped once for all of these backups. A failing
+// backup does not prevent the remaining directories from being backed up.
+func runSplitScript(ctx context.Context, c *Config) (err error) {
+	configurations, err := splitByTopLevelDir(c)
+	if err != nil {
+		return errwrap.Wrap(err, "error splitting backup sources")
+	}
+
+	s := newScript(c)
+	s.ctx = ctx
+	unlock, lockErr := s.lock(lockfileFor(c.source))
+	if lockErr != nil {
+		return errwrap.Wrap(lockErr, "error acquiring file lock")
+	}
+	defer func() {
+		if derr := unlock(); derr != nil {
+			err = errors.Join(err, errwrap.Wrap(derr, "error releasing file lock"))
+		}
+	}()
+
+	unset, err := s.c.applyEnv()
+	if err != nil {
+		return errwrap.Wrap(err, "error applying env")
+	}
+	defer func() {
+		if derr := unset(); derr != nil {
+			err = errors.Join(err, errwrap.Wrap(derr, "error unsetting environment variables"))
+		}
+	}()
+
+	cli, err := newDockerClient()
+	if err != nil {
+		return errwrap.Wrap(err, "error creating docker client")
+	}
+	if cli != nil {
+		s.cli = cli
+		defer func() {
+			if derr := cli.Close(); derr != nil {
+				err = errors.Join(err, errwrap.Wrap(derr, "failed to close docker client"))
+			}
+		}()
+	}
+
+	restartContainersAndServices, err := s.stopContainersAndServices()
+	defer func() {
+		if derr := restartContainersAndServices(); derr != nil {
+			err = errors.Join(err, errwrap.Wrap(derr, "error restarting containers and services"))
+		}
+	}()
+	if err != nil {
+		return errwrap.Wrap(err, "error stopping containers and services")
+	}
+
+	// Archives are created and uploaded by up to BACKUP_SPLIT_CONCURRENCY
+	// runs at the same time, all of them within the window containers are
+	// stopped in.
+	eg := &errgroup.Group{}
+	eg.SetLimit(c.BackupSplitConcurrency.Int())
+	errs := make([]error, len(configurations))
+	for i, config := range configurations {
+		i, config := i, config
+		eg.Go(func() error {
+			if err := runScript(ctx, config); err != nil {
+				errs[i] = errwrap.Wrap(err, fmt.Sprintf("error backing up %s", config.source))
+			}
+			return nil
+		})
+	}
+	eg.Wait()
+	return errors.Join(errs...)
+}
+
+// splitLabel returns the label that is prepended to the names of archives
+// derived from the top-level directory of the given name. Names are escaped
+// so they never contain the trailing `@`, which ensures the label of one
+// directory is never a prefix of the label of another one. Files located
+// directly in the backup sources use the empty name.
+func splitLabel(name string) string {
+	return strings.NewReplacer("%", "%25", "@", "%40").Replace(name) + "@"
+}
+
+// splitByTopLevelDir derives a configuration for each immediate child
+// directory of the configured backup sources, and one for the files located
+// directly in them. A label derived from the name of the directory is
+// prepended to the filename, the pruning prefix and the latest symlink so
+// that the resulting archives can be told apart and are pruned independently.
+// Derived configurations do not stop containers themselves, as this is done
+// once for all of them.
+func splitByTopLevelDir(c *Config) ([]*Config, error) {
+	entries, err := os.ReadDir(c.BackupSources)
+	if err != nil {
+		return nil, errwrap.Wrap(err, fmt.Sprintf("error reading backup sources %s", c.BackupSources))
+	}
+
+	derive := func(name, sources string) *Config {
+		label := splitLabel(name)
+		config := *c
+		config.BackupSplitByTopLevelDir = false
+		config.containersStopped = true
+		config.BackupSources = sources
+		// the label is used as part of a strftime pattern
+		config.BackupFilename = strings.ReplaceAll(label, "%", "%%") + c.BackupFilename
+		config.BackupPruningPrefix = label + c.BackupPruningPrefix
+		if c.BackupLatestSymlink != "" {
+			config.BackupLatestSymlink = label + c.BackupLatestSymlink
+		}
+		if c.BackupChangedSinceMarker != "" {
+			config.BackupChangedSinceMarker = fmt.Sprintf("%s.%s", c.BackupChangedSinceMarker, label)
+		}
+		if c.BackupCheckpointDir != "" {
+			config.BackupCheckpointDir = filepath.Join(c.BackupCheckpointDir, label)
+		}
+		// The environment is applied once for all of them, so concurrent runs
+		// do not restore each other's values.
+		config.additionalEnvVars = nil
+		return &config
+	}
+
+	var configurations []*Config
+	var hasFiles bool
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			hasFiles = true
+			continue
+		}
+		name := entry.Name()
+		config := derive(name, filepath.Join(c.BackupSources, name))
+		config.source = fmt.Sprintf("%s (%s)", c.source, name)
+		configurations = append(configurations, config)
+	}
+	if hasFiles {
+		config := derive("", c.BackupSources)
+		config.skipTopLevelDirs = true
+		config.source = fmt.Sprintf("%s (files)", c.source)
+		configurations = append(configurations, config)
+	}
+
+	if len(configurations) == 0 {
+		return nil, errwrap.Wrap(nil, fmt.Sprintf("no files found in backup sources %s", c.BackupSources))
+	}
+	return configurations, nil
+}
+
+// runTask instantiates a new script object and runs the given task instead
+// of a backup run, e.g. for maintenance tasks running on their own schedule.
+// The file lock of the configuration's source is acquired before the task
+// starts running. Contrary to a backup run, only failure notifications are
+// sent.
+func runTask(ctx context.Context, c *Config, task func(s *script) error) (err error) {
+	s := newScript(c)
+	s.ctx = ctx
+	s.task = true
+
+	unlock, lockErr := s.lock(lockfileFor(c.source))
+	if lockErr != nil {
+		return errwrap.Wrap(lockErr, "error acquiring file lock")
+	}
+	defer func() {
+		if derr := unlock(); derr != nil {
+			err = errors.Join(err, errwrap.Wrap(derr, "error releasing file lock"))
+		}
+	}()
+
+	unset, err := s.c.applyEnv()
+	if err != nil {
+		return errwrap.Wrap(err, "error applying env")
+	}
+	defer func() {
+		if derr := unset(); derr != nil {
+			err = errors.Join(err, errwrap.Wrap(derr, "error unsetting environment variables"))
+		}
+	}()
+
+	initErr := s.init()
+	s.hookLevel = min(s.hookLevel, hookLevelError)
+	if initErr != nil {
+		err = errwrap.Wrap(initErr, "error instantiating script")
+		if hookErr := s.runHooks(err); hookErr != nil {
+			err = errors.Join(err, errwrap.Wrap(hookErr, "error calling the registered hooks"))
+		}
+		return err
+	}
+
+	taskErr := task(s)
+	if hookErr := s.runHooks(taskErr); hookErr != nil {
+		return errors.Join(taskErr, errwrap.Wrap(hookErr, "error calling the registered hooks"))
+	}
+	if taskErr != nil {
+		return errwrap.Wrap(taskErr, "error running task")
+	}
+	return nil
+}
+
+// runScriptAttempt instantiates a new script object and orchestrates a single
+// attempt of a backup run. To ensure it runs mutually exclusive with other
+// runs of the same source a file lock is acquired before it starts running.
+// Any panic within the script will be recovered and returned as an error.
+func runScriptAttempt(ctx context.Context, c *Config, attempt int) (err error) {
 	defer func() {
 		if derr := recover(); derr != nil {
 			fmt.Printf("%s: %s\n", derr, debug.Stack())
@@ -29,8 +255,32 @@ func runScript(c *Config) (err error) {
 	}()
 
 	s := newScript(c)
+	s.ctx = ctx
+	s.attempt = attempt
+	lastRuns.start(c.source, s.stats)
+	defer func() {
+		lastRuns.finish(c.source, s.stats, err)
+	}()
+	if retries := s.c.BackupRunRetries.Int(); retries > 0 {
+		s.logger.Info(
+			fmt.Sprintf("Starting attempt %d of %d.", attempt, retries+1),
+		)
+		defer func() {
+			if s.retryPending(err) {
+				s.logger.Warn(
+					fmt.Sprintf(
+						"Attempt %d of %d failed, retrying in %s: %v",
+						attempt,
+						retries+1,
+						s.c.BackupRunRetryDelay,
+						errwrap.Unwrap(err),
+					),
+				)
+			}
+		}()
+	}
 
-	unlock, lockErr := s.lock("/var/lock/dockervolumebackup.lock")
+	unlock, lockErr := s.lock(lockfileFor(c.source))
 	if lockErr != nil {
 		err = errwrap.Wrap(lockErr, "error acquiring file lock")
 		return
@@ -53,51 +303,86 @@ func runScript(c *Config) (err error) {
 
 	if initErr := s.init(); initErr != nil {
 		err = errwrap.Wrap(initErr, "error instantiating script")
+		if hookErr := s.runHooks(err); hookErr != nil {
+			err = errors.Join(err, errwrap.Wrap(hookErr, "error calling the registered hooks"))
+		}
 		return
 	}
 
 	return func() (err error) {
-		scriptErr := func() error {
-			if err := s.withLabeledCommands(lifecyclePhaseArchive, func() (err error) {
-				restartContainersAndServices, err := s.stopContainersAndServices()
-				// The mechanism for restarting containers is not using hooks as it
-				// should happen as soon as possible (i.e. before uploading backups or
-				// similar).
-				defer func() {
-					if derr := restartContainersAndServices(); derr != nil {
-						err = errors.Join(err, errwrap.Wrap(derr, "error restarting containers and services"))
+		scriptErr := s.withSpan("backup", func() error {
+			if err := s.checkCancelled(); err != nil {
+				return err
+			}
+			if err := s.checkPrecondition(); err != nil {
+				return err
+			}
+			if s.skipped {
+				return nil
+			}
+			s.notifyStart()
+			if err := s.runPreflight(); err != nil {
+				return err
+			}
+			resumed, err := s.resumeCheckpoint()
+			if err != nil {
+				return errwrap.Wrap(err, "error resuming checkpoint")
+			}
+			if !resumed {
+				if err := s.runPreScript(); err != nil {
+					return err
+				}
+				if err := s.withSpan(string(lifecyclePhaseArchive), s.withLabeledCommands(lifecyclePhaseArchive, func() (err error) {
+					stopSpan := s.startSpan("stop")
+					restartContainersAndServices, err := s.stopContainersAndServices()
+					endSpan(stopSpan, err)
+					// The mechanism for restarting containers is not using hooks as it
+					// should happen as soon as possible (i.e. before uploading backups or
+					// similar).
+					defer func() {
+						restartSpan := s.startSpan("restart")
+						derr := restartContainersAndServices()
+						endSpan(restartSpan, derr)
+						if derr != nil {
+							err = errors.Join(err, errwrap.Wrap(derr, "error restarting containers and services"))
+						}
+					}()
+					if err != nil {
+						return
 					}
-				}()
-				if err != nil {
+					err = s.createArchive()
 					return
+				}))(); err != nil {
+					return err
 				}
-				err = s.createArchive()
-				return
-			})(); err != nil {
-				return err
-			}
 
-			if err := s.withLabeledCommands(lifecyclePhaseProcess, s.encryptArchive)(); err != nil {
+				if err := s.checkCancelled(); err != nil {
+					return err
+				}
+				if err := s.withSpan(string(lifecyclePhaseProcess), s.withLabeledCommands(lifecyclePhaseProcess, s.encryptArchive))(); err != nil {
+					return err
+				}
+				if err := s.checkCancelled(); err != nil {
+					return err
+				}
+			}
+			if err := s.withSpan(string(lifecyclePhaseCopy), s.withLabeledCommands(lifecyclePhaseCopy, s.copyArchive))(); err != nil {
 				return err
 			}
-			if err := s.withLabeledCommands(lifecyclePhaseCopy, s.copyArchive)(); err != nil {
+			if err := s.checkCancelled(); err != nil {
 				return err
 			}
-			if err := s.withLabeledCommands(lifecyclePhasePrune, s.pruneBackups)(); err != nil {
+			if err := s.withSpan(string(lifecyclePhasePrune), s.withLabeledCommands(lifecyclePhasePrune, s.pruneBackups))(); err != nil {
 				return err
 			}
-			return nil
-		}()
+			return s.uploadErr
+		}, attribute.Int("attempt", s.attempt))()
 
 		if hookErr := s.runHooks(scriptErr); hookErr != nil {
 			if scriptErr != nil {
 				return errwrap.Wrap(
-					nil,
-					fmt.Sprintf(
-						"error %v executing the script followed by %v calling the registered hooks",
-						scriptErr,
-						hookErr,
-					),
+					scriptErr,
+					fmt.Sprintf("error calling the registered hooks (%v) after executing the script", hookErr),
 				)
 			}
 			return errwrap.Wrap(
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSplitByTopLevelDir(t *testing.T) {
+	source := t.TempDir()
+	for _, dir := range []string{"app", "app-data", "a@b%c"} {
+		if err := os.Mkdir(filepath.Join(source, dir), 0755); err != nil {
+			t.Fatalf("Unexpected error creating directory: %v", err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(source, "file.txt"), []byte("content"), 0644); err != nil {
+		t.Fatalf("Unexpected error writing file: %v", err)
+	}
+
+	configurations, err := splitByTopLevelDir(&Config{
+		BackupSources:            source,
+		BackupSplitByTopLevelDir: true,
+		BackupFilename:           "backup-%Y.tar.gz",
+		BackupPruningPrefix:      "backup-",
+		BackupLatestSymlink:      "latest",
+		BackupCheckpointDir:      "/checkpoint",
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(configurations) != 4 {
+		t.Fatalf("Expected 4 configurations, got %d", len(configurations))
+	}
+
+	for _, config := range configurations {
+		if config.BackupSplitByTopLevelDir {
+			t.Error("Expected derived configuration to not be split again")
+		}
+		if !config.containersStopped {
+			t.Error("Expected derived configuration to not stop containers itself")
+		}
+		if expected := filepath.Join("/checkpoint", strings.TrimSuffix(config.BackupPruningPrefix, "backup-")); config.BackupCheckpointDir != expected {
+			t.Errorf("Expected checkpoint directory %s, got %s", expected, config.BackupCheckpointDir)
+		}
+		for _, other := range configurations {
+			if other != config && strings.HasPrefix(other.BackupPruningPrefix, config.BackupPruningPrefix) {
+				t.Errorf("Expected pruning prefix %s to not match %s", config.BackupPruningPrefix, other.BackupPruningPrefix)
+			}
+		}
+	}
+
+	expected := []struct {
+		sources, filename, prefix, symlink string
+		skipTopLevelDirs                   bool
+	}{
+		{filepath.Join(source, "a@b%c"), "a%%40b%%25c@backup-%Y.tar.gz", "a%40b%25c@backup-", "a%40b%25c@latest", false},
+		{filepath.Join(source, "app"), "app@backup-%Y.tar.gz", "app@backup-", "app@latest", false},
+		{filepath.Join(source, "app-data"), "app-data@backup-%Y.tar.gz", "app-data@backup-", "app-data@latest", false},
+		{source, "@backup-%Y.tar.gz", "@backup-", "@latest", true},
+	}
+	for i, e := range expected {
+		config := configurations[i]
+		if config.BackupSources != e.sources {
+			t.Errorf("Unexpected backup sources %s", config.BackupSources)
+		}
+		if config.BackupFilename != e.filename {
+			t.Errorf("Unexpected filename %s", config.BackupFilename)
+		}
+		if config.BackupPruningPrefix != e.prefix {
+			t.Errorf("Unexpected pruning prefix %s", config.BackupPruningPrefix)
+		}
+		if config.BackupLatestSymlink != e.symlink {
+			t.Errorf("Unexpected latest symlink %s", config.BackupLatestSymlink)
+		}
+		if config.skipTopLevelDirs != e.skipTopLevelDirs {
+			t.Errorf("Unexpected value %v for skipping top level directories of %s", config.skipTopLevelDirs, config.BackupSources)
+		}
+	}
+
+	if _, err := splitByTopLevelDir(&Config{BackupSources: t.TempDir()}); err == nil {
+		t.Error("Expected error for empty backup sources")
+	}
+}
+
+func TestRunSplitScriptConcurrency(t *testing.T) {
+	lockDirectory = t.TempDir()
+	defer func() { lockDirectory = "/var/lock" }()
+
+	source := t.TempDir()
+	for _, dir := range []string{"app", "db", "media"} {
+		if err := os.Mkdir(filepath.Join(source, dir), 0755); err != nil {
+			t.Fatalf("Unexpected error creating directory: %v", err)
+		}
+		if err := os.WriteFile(filepath.Join(source, dir, "data.txt"), []byte(dir), 0644); err != nil {
+			t.Fatalf("Unexpected error writing file: %v", err)
+		}
+	}
+	archive := t.TempDir()
+
+	values := map[string]string{
+		"BACKUP_SOURCES":                source,
+		"BACKUP_ARCHIVE":                archive,
+		"BACKUP_SPLIT_BY_TOP_LEVEL_DIR": "true",
+		"BACKUP_SPLIT_CONCURRENCY":      "3",
+		"BACKUP_FILENAME":               "backup.tar.gz",
+	}
+	c, err := loadConfig(func(key string) (string, bool) {
+		value, ok := values[key]
+		return value, ok
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error loading config: %v", err)
+	}
+	c.source = "split"
+
+	if err := runScript(context.Background(), c); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	for _, name := range []string{"app@backup.tar.gz", "db@backup.tar.gz", "media@backup.tar.gz"} {
+		if _, err := os.Stat(filepath.Join(archive, name)); err != nil {
+			t.Errorf("Expected archive %s to exist: %v", name, err)
+		}
+	}
+}
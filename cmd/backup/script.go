@@ -5,26 +5,35 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"fmt"
+	"io"
 	"log/slog"
 	"os"
 	"path"
+	"strings"
 	"text/template"
 	"time"
 
 	"github.com/offen/docker-volume-backup/internal/errwrap"
+	"github.com/offen/docker-volume-backup/internal/kms"
 	"github.com/offen/docker-volume-backup/internal/storage"
 	"github.com/offen/docker-volume-backup/internal/storage/azure"
+	"github.com/offen/docker-volume-backup/internal/storage/b2"
 	"github.com/offen/docker-volume-backup/internal/storage/dropbox"
+	"github.com/offen/docker-volume-backup/internal/storage/gcs"
 	"github.com/offen/docker-volume-backup/internal/storage/local"
+	"github.com/offen/docker-volume-backup/internal/storage/restic"
+	"github.com/offen/docker-volume-backup/internal/storage/rsync"
 	"github.com/offen/docker-volume-backup/internal/storage/s3"
+	"github.com/offen/docker-volume-backup/internal/storage/smb"
 	"github.com/offen/docker-volume-backup/internal/storage/ssh"
 	"github.com/offen/docker-volume-backup/internal/storage/webdav"
 
-	"github.com/containrrr/shoutrrr"
-	"github.com/containrrr/shoutrrr/pkg/router"
 	"github.com/docker/docker/client"
 	"github.com/leekchan/timeutil"
+	"go.opentelemetry.io/otel/trace"
+	tracenoop "go.opentelemetry.io/otel/trace/noop"
 )
 
 // script holds all the stateful information required to orchestrate a
@@ -33,15 +42,63 @@ type script struct {
 	cli       *client.Client
 	storages  []storage.Backend
 	logger    *slog.Logger
-	sender    *router.ServiceRouter
+	senders   []notificationSender
 	template  *template.Template
 	hooks     []hook
 	hookLevel hookLevel
 
-	file  string
-	stats *Stats
+	// customTemplates contains the names of all notification templates
+	// defined by the user.
+	customTemplates map[string]bool
 
-	encounteredLock bool
+	file        string
+	compression CompressionType
+	stats       *Stats
+
+	// variants contains additional backup files for backends using a
+	// compression other than the default one.
+	variants map[CompressionType]string
+	// splits contains the parts of each backup file when using
+	// BACKUP_SPLIT_SIZE, keyed by the location of the backup file.
+	splits map[string]*splitArchive
+	// checksums contains the checksum of each backup file when using
+	// BACKUP_CHECKSUM_ALGORITHM, keyed by the location of the backup file.
+	checksums map[string]string
+
+	// encounteredLock is the location of the lockfile in case it was not
+	// available on first attempt.
+	encounteredLock string
+	attempt         int
+	pruneDryRun     bool
+	exclude         *excludeMatcher
+	dryRun          bool
+	stream          bool
+	skipped         bool
+	task            bool
+	checkpoint      *Checkpoint
+
+	// validating is set when the script is initialized for validating its
+	// configuration only. No hooks other than the ones releasing resources
+	// are registered then, so validating does not send notifications or
+	// persist any state.
+	validating bool
+
+	// uploadErr holds the error of uploads that have failed for some
+	// storage backends only when BACKUP_CONTINUE_ON_ERROR is set, failing the
+	// run once all other steps have completed.
+	uploadErr error
+
+	// keyWrapper is used for wrapping the data encryption key when using
+	// GPG_KMS_PROVIDER. envelope is the location of the wrapped key that is
+	// uploaded next to the encrypted backup.
+	keyWrapper kms.KeyWrapper
+	envelope   string
+
+	tracer  trace.Tracer
+	spanCtx context.Context
+
+	// ctx is cancelled when the process is asked to shut down.
+	ctx context.Context
 
 	c *Config
 }
@@ -53,8 +110,16 @@ type script struct {
 func newScript(c *Config) *script {
 	stdOut, logBuffer := buffer(os.Stdout)
 	return &script{
-		c:      c,
-		logger: slog.New(slog.NewTextHandler(stdOut, nil)),
+		c:           c,
+		attempt:     1,
+		compression: c.BackupCompression,
+		pruneDryRun: c.BackupPruneDryRun,
+		logger:      slog.New(slog.NewTextHandler(stdOut, nil)),
+		tracer:      tracenoop.NewTracerProvider().Tracer(""),
+		spanCtx:     context.Background(),
+		ctx:         context.Background(),
+		splits:      map[string]*splitArchive{},
+		checksums:   map[string]string{},
 		stats: &Stats{
 			StartTime: time.Now(),
 			LogOutput: logBuffer,
@@ -62,14 +127,122 @@ func newScript(c *Config) *script {
 				"S3":      {},
 				"WebDAV":  {},
 				"SSH":     {},
+				"Rsync":   {},
+				"Restic":  {},
+				"SMB":     {},
 				"Local":   {},
 				"Azure":   {},
 				"Dropbox": {},
+				"GCS":     {},
+				"B2":      {},
 			},
 		},
 	}
 }
 
+// retryPending returns true in case the run will be attempted again as the
+// current attempt failed using the given error. Runs that uploaded the backup
+// to some of the storage backends only are not retried.
+func (s *script) retryPending(err error) bool {
+	if err == nil || partialFailure(err) {
+		return false
+	}
+	return s.attempt <= s.c.BackupRunRetries.Int() && s.ctx.Err() == nil
+}
+
+// checkCancelled returns an error in case the script has been cancelled,
+// e.g. because the process is shutting down.
+func (s *script) checkCancelled() error {
+	if err := s.ctx.Err(); err != nil {
+		return errwrap.Wrap(err, "backup run was cancelled")
+	}
+	return nil
+}
+
+// renderBackupFilename renders the extension template contained in the
+// given backup filename using the given compression type.
+func renderBackupFilename(filename string, compression CompressionType) (string, error) {
+	tmplFileName, err := template.New("extension").Parse(filename)
+	if err != nil {
+		return "", errwrap.Wrap(err, "unable to parse backup file extension template")
+	}
+
+	var bf bytes.Buffer
+	if err := tmplFileName.Execute(&bf, map[string]string{
+		"Extension": compression.Extension(),
+	}); err != nil {
+		return "", errwrap.Wrap(err, "error executing backup file extension template")
+	}
+	return bf.String(), nil
+}
+
+// resolveFile sets the location of the backup file according to the
+// configured filename and the compression used by the script.
+func (s *script) resolveFile() error {
+	pattern, err := s.expandFilename(s.c.BackupFilename, s.compression)
+	if err != nil {
+		return errwrap.Wrap(err, "error rendering backup filename")
+	}
+	s.stats.BackupFile.Pattern = pattern
+	s.file = path.Join("/tmp", timeutil.Strftime(&s.stats.StartTime, pattern))
+	return nil
+}
+
+// renderFilename renders the given filename template for the given
+// compression, expanding environment variables if configured and
+// interpolating strftime tokens using the start time of the script.
+func (s *script) renderFilename(filename string, compression CompressionType) (string, error) {
+	pattern, err := s.expandFilename(filename, compression)
+	if err != nil {
+		return "", err
+	}
+	return timeutil.Strftime(&s.stats.StartTime, pattern), nil
+}
+
+// expandFilename renders the given filename template for the given
+// compression and expands environment variables if configured. strftime
+// tokens are not interpolated.
+func (s *script) expandFilename(filename string, compression CompressionType) (string, error) {
+	rendered, err := renderBackupFilename(filename, compression)
+	if err != nil {
+		return "", err
+	}
+	if s.c.BackupFilenameExpand {
+		rendered = os.ExpandEnv(rendered)
+	}
+	return rendered, nil
+}
+
+// supportedDirectives are the directives supported when interpolating
+// strftime tokens in filenames.
+const supportedDirectives = "aAwdbBmyYHIpMSfzZjUWcxX%"
+
+// unknownDirectives returns the strftime directives in the given pattern
+// that are not supported. These are silently removed when interpolating
+// the pattern, which is usually caused by a percent sign that is not
+// escaped.
+func unknownDirectives(pattern string) []string {
+	var unknown []string
+	runes := []rune(pattern)
+	for i := 0; i < len(runes); i++ {
+		if runes[i] != '%' {
+			continue
+		}
+		if i == len(runes)-1 {
+			unknown = append(unknown, "%")
+			break
+		}
+		if !strings.ContainsRune(supportedDirectives, runes[i+1]) {
+			unknown = append(unknown, string(runes[i:i+2]))
+		}
+		i++
+	}
+	return unknown
+}
+
+// init initializes all resources required for a backup run. In case it
+// returns an error, callers are expected to run the hooks registered so far
+// so that notifications are sent and resources are released.
 func (s *script) init() error {
 	s.registerHook(hookLevelPlumbing, func(error) error {
 		s.stats.EndTime = time.Now()
@@ -77,35 +250,78 @@ func (s *script) init() error {
 		return nil
 	})
 
-	s.file = path.Join("/tmp", s.c.BackupFilename)
+	// Notifications are initialized first so that any subsequent error
+	// in initializing the script can be reported.
+	hookLevel, ok := hookLevels[s.c.NotificationLevel]
+	if !ok {
+		return errwrap.Wrap(nil, fmt.Sprintf("unknown NOTIFICATION_LEVEL %s", s.c.NotificationLevel))
+	}
+	s.hookLevel = hookLevel
+
+	if err := s.initNotifications(); err != nil {
+		return errwrap.Wrap(err, "error initializing notifications")
+	}
 
-	tmplFileName, tErr := template.New("extension").Parse(s.file)
-	if tErr != nil {
-		return errwrap.Wrap(tErr, "unable to parse backup file extension template")
+	if len(s.senders) != 0 && !s.validating {
+		// To prevent duplicate notifications, ensure the regsistered callbacks
+		// run mutually exclusive.
+		s.registerHook(hookLevelError, func(err error) error {
+			if err == nil || s.retryPending(err) {
+				return nil
+			}
+			if partialFailure(err) {
+				return s.notifyPartialSuccess(err)
+			}
+			return s.notifyFailure(err)
+		})
+		s.registerHook(hookLevelInfo, func(err error) error {
+			if err != nil {
+				return nil
+			}
+			if s.skipped {
+				return s.notifySkipped()
+			}
+			return s.notifySuccess()
+		})
 	}
 
-	var bf bytes.Buffer
-	if tErr := tmplFileName.Execute(&bf, map[string]string{
-		"Extension": fmt.Sprintf("tar.%s", s.c.BackupCompression),
-	}); tErr != nil {
-		return errwrap.Wrap(tErr, "error executing backup file extension template")
+	s.initHealthcheck()
+	s.initPostScript()
+
+	if err := s.initTracing(); err != nil {
+		return errwrap.Wrap(err, "error initializing tracing")
+	}
+
+	if err := s.initBackendState(); err != nil {
+		return errwrap.Wrap(err, "error initializing backend state")
+	}
+
+	if err := s.initMetrics(); err != nil {
+		return errwrap.Wrap(err, "error initializing metrics")
+	}
+
+	if err := s.resolveFile(); err != nil {
+		return errwrap.Wrap(err, "error resolving backup file")
+	}
+	if unknown := unknownDirectives(s.stats.BackupFile.Pattern); len(unknown) != 0 {
+		s.logger.Warn(
+			fmt.Sprintf(
+				"BACKUP_FILENAME contains unsupported strftime directive(s) %s, which are removed from the filename. Use `%%%%` for a literal percent sign.",
+				strings.Join(unknown, ", "),
+			),
+		)
 	}
-	s.file = bf.String()
 
 	if s.c.BackupFilenameExpand {
-		s.file = os.ExpandEnv(s.file)
 		s.c.BackupLatestSymlink = os.ExpandEnv(s.c.BackupLatestSymlink)
 		s.c.BackupPruningPrefix = os.ExpandEnv(s.c.BackupPruningPrefix)
 	}
-	s.file = timeutil.Strftime(&s.stats.StartTime, s.file)
 
-	_, err := os.Stat("/var/run/docker.sock")
-	_, dockerHostSet := os.LookupEnv("DOCKER_HOST")
-	if !os.IsNotExist(err) || dockerHostSet {
-		cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
-		if err != nil {
-			return errwrap.Wrap(err, "failed to create docker client")
-		}
+	cli, err := newDockerClient()
+	if err != nil {
+		return errwrap.Wrap(err, "failed to create docker client")
+	}
+	if cli != nil {
 		s.cli = cli
 		s.registerHook(hookLevelPlumbing, func(err error) error {
 			if err := s.cli.Close(); err != nil {
@@ -124,7 +340,15 @@ func (s *script) init() error {
 		}
 	}
 
+	userAgent := s.c.StorageUserAgent
+	if userAgent == "" {
+		userAgent = fmt.Sprintf("docker-volume-backup/%s", version)
+	}
+
 	if s.c.AwsS3BucketName != "" {
+		if s.c.AwsStorageClass.Archived() && s.c.BackupVerifyUpload {
+			return errwrap.Wrap(nil, fmt.Sprintf("BACKUP_VERIFY_UPLOAD cannot be used with AWS_STORAGE_CLASS %s as archived objects cannot be downloaded", s.c.AwsStorageClass))
+		}
 		s3Config := s3.Config{
 			Endpoint:         s.c.AwsEndpoint,
 			AccessKeyID:      s.c.AwsAccessKeyID,
@@ -134,9 +358,16 @@ func (s *script) init() error {
 			EndpointInsecure: s.c.AwsEndpointInsecure,
 			RemotePath:       s.c.AwsS3Path,
 			BucketName:       s.c.AwsS3BucketName,
-			StorageClass:     s.c.AwsStorageClass,
+			StorageClass:     string(s.c.AwsStorageClass),
 			CACert:           s.c.AwsEndpointCACert.Cert,
 			PartSize:         s.c.AwsPartSize,
+			Concurrency:      s.c.AwsUploadConcurrency.Int(),
+			UserAgent:        userAgent,
+			ImmutableFor:     s.c.BackupImmutableFor,
+			ListRetries:      s.c.AwsListRetries.Int(),
+			ListRetryDelay:   s.c.AwsListRetryDelay,
+			SSE:              s.c.AwsSse,
+			SSEKMSKeyID:      s.c.AwsSseKmsKeyID,
 		}
 		s3Backend, err := s3.NewStorageBackend(s3Config, logFunc)
 		if err != nil {
@@ -152,6 +383,9 @@ func (s *script) init() error {
 			Username:    s.c.WebdavUsername,
 			Password:    s.c.WebdavPassword,
 			RemotePath:  s.c.WebdavPath,
+			UserAgent:   userAgent,
+			Chunked:     s.c.WebdavChunked,
+			ChunkSize:   int64(s.c.WebdavChunkSize),
 		}
 		webdavBackend, err := webdav.NewStorageBackend(webDavConfig, logFunc)
 		if err != nil {
@@ -168,6 +402,8 @@ func (s *script) init() error {
 			Password:           s.c.SSHPassword,
 			IdentityFile:       s.c.SSHIdentityFile,
 			IdentityPassphrase: s.c.SSHIdentityPassphrase,
+			AgentSocket:        s.c.SSHAuthSock,
+			KnownHosts:         s.c.SSHKnownHosts,
 			RemotePath:         s.c.SSHRemotePath,
 		}
 		sshBackend, err := ssh.NewStorageBackend(sshConfig, logFunc)
@@ -177,6 +413,71 @@ func (s *script) init() error {
 		s.storages = append(s.storages, sshBackend)
 	}
 
+	if s.c.RsyncHostName != "" {
+		rsyncConfig := rsync.Config{
+			HostName:         s.c.RsyncHostName,
+			Port:             s.c.RsyncPort,
+			User:             s.c.RsyncUser,
+			IdentityFile:     s.c.RsyncIdentityFile,
+			RemotePath:       s.c.RsyncRemotePath,
+			SkipHostKeyCheck: s.c.RsyncSkipHostKeyCheck,
+		}
+		if s.c.RsyncKnownHosts != "" {
+			if s.c.RsyncSkipHostKeyCheck {
+				return errwrap.Wrap(nil, "RSYNC_KNOWN_HOSTS and RSYNC_SKIP_HOST_KEY_CHECK cannot be used at the same time")
+			}
+			dir, err := s.tempDir("rsync-*")
+			if err != nil {
+				return errwrap.Wrap(err, "error creating directory for known hosts")
+			}
+			rsyncConfig.KnownHostsFile = path.Join(dir, "known_hosts")
+			if err := os.WriteFile(rsyncConfig.KnownHostsFile, []byte(s.c.RsyncKnownHosts+"\n"), 0600); err != nil {
+				return errwrap.Wrap(err, "error writing known hosts")
+			}
+		}
+		rsyncBackend, err := rsync.NewStorageBackend(rsyncConfig, logFunc)
+		if err != nil {
+			return errwrap.Wrap(err, "error creating rsync storage backend")
+		}
+		s.storages = append(s.storages, rsyncBackend)
+	}
+
+	if s.c.ResticRepository != "" {
+		resticConfig := restic.Config{
+			Repository:    s.c.ResticRepository,
+			Password:      s.c.ResticPassword,
+			PruningPrefix: s.pruningPrefix("Restic"),
+		}
+		resticBackend, err := restic.NewStorageBackend(resticConfig, logFunc)
+		if err != nil {
+			return errwrap.Wrap(err, "error creating restic storage backend")
+		}
+		s.storages = append(s.storages, resticBackend)
+	}
+
+	if s.c.SmbHostName != "" {
+		smbConfig := smb.Config{
+			HostName:   s.c.SmbHostName,
+			Port:       s.c.SmbPort,
+			Share:      s.c.SmbShare,
+			Username:   s.c.SmbUsername,
+			Password:   s.c.SmbPassword,
+			Domain:     s.c.SmbDomain,
+			RemotePath: s.c.SmbRemotePath,
+		}
+		smbBackend, err := smb.NewStorageBackend(smbConfig, logFunc)
+		if err != nil {
+			return errwrap.Wrap(err, "error creating smb storage backend")
+		}
+		s.storages = append(s.storages, smbBackend)
+		s.registerHook(hookLevelPlumbing, func(error) error {
+			if err := smbBackend.(io.Closer).Close(); err != nil {
+				return errwrap.Wrap(err, "failed to close smb connection")
+			}
+			return nil
+		})
+	}
+
 	if _, err := os.Stat(s.c.BackupArchive); !os.IsNotExist(err) {
 		localConfig := local.Config{
 			ArchivePath:   s.c.BackupArchive,
@@ -194,6 +495,8 @@ func (s *script) init() error {
 			Endpoint:          s.c.AzureStorageEndpoint,
 			RemotePath:        s.c.AzureStoragePath,
 			ConnectionString:  s.c.AzureStorageConnectionString,
+			UserAgent:         userAgent,
+			ImmutableFor:      s.c.BackupImmutableFor,
 		}
 		azureBackend, err := azure.NewStorageBackend(azureConfig, logFunc)
 		if err != nil {
@@ -211,6 +514,8 @@ func (s *script) init() error {
 			AppSecret:        s.c.DropboxAppSecret,
 			RemotePath:       s.c.DropboxRemotePath,
 			ConcurrencyLevel: s.c.DropboxConcurrencyLevel.Int(),
+			RateLimitRetries: s.c.DropboxRateLimitRetries.Int(),
+			UserAgent:        userAgent,
 		}
 		dropboxBackend, err := dropbox.NewStorageBackend(dropboxConfig, logFunc)
 		if err != nil {
@@ -219,67 +524,171 @@ func (s *script) init() error {
 		s.storages = append(s.storages, dropboxBackend)
 	}
 
-	if s.c.EmailNotificationRecipient != "" {
-		emailURL := fmt.Sprintf(
-			"smtp://%s:%s@%s:%d/?from=%s&to=%s",
-			s.c.EmailSMTPUsername,
-			s.c.EmailSMTPPassword,
-			s.c.EmailSMTPHost,
-			s.c.EmailSMTPPort,
-			s.c.EmailNotificationSender,
-			s.c.EmailNotificationRecipient,
-		)
-		s.c.NotificationURLs = append(s.c.NotificationURLs, emailURL)
-		s.logger.Warn(
-			"Using EMAIL_* keys for providing notification configuration has been deprecated and will be removed in the next major version.",
-		)
-		s.logger.Warn(
-			"Please use NOTIFICATION_URLS instead. Refer to the README for an upgrade guide.",
+	if s.c.GcsBucketName != "" {
+		gcsConfig := gcs.Config{
+			BucketName:                s.c.GcsBucketName,
+			RemotePath:                s.c.GcsPath,
+			Credentials:               s.c.GcsCredentials,
+			ImpersonateServiceAccount: s.c.GcsImpersonateServiceAccount,
+			KMSKeyName:                s.c.GcsKmsKeyName,
+			Endpoint:                  s.c.GcsEndpoint,
+			UserAgent:                 userAgent,
+		}
+		gcsBackend, err := gcs.NewStorageBackend(gcsConfig, logFunc)
+		if err != nil {
+			return errwrap.Wrap(err, "error creating gcs storage backend")
+		}
+		s.storages = append(s.storages, gcsBackend)
+	}
+
+	if s.c.B2BucketName != "" {
+		b2Config := b2.Config{
+			Endpoint:           s.c.B2Endpoint,
+			ApplicationKeyID:   s.c.B2ApplicationKeyID,
+			ApplicationKey:     s.c.B2ApplicationKey,
+			BucketName:         s.c.B2BucketName,
+			RemotePath:         s.c.B2Path,
+			LargeFileThreshold: s.c.B2LargeFileThreshold.Int64(),
+			PartSize:           s.c.B2PartSize.Int64(),
+			UserAgent:          userAgent,
+		}
+		b2Backend, err := b2.NewStorageBackend(b2Config, logFunc)
+		if err != nil {
+			return errwrap.Wrap(err, "error creating b2 storage backend")
+		}
+		s.storages = append(s.storages, b2Backend)
+	}
+
+	if len(s.storages) == 0 {
+		return errwrap.Wrap(
+			nil,
+			fmt.Sprintf(
+				"no storage backend is configured, configure at least one remote storage or mount a volume to `%s`",
+				s.c.BackupArchive,
+			),
 		)
 	}
 
-	hookLevel, ok := hookLevels[s.c.NotificationLevel]
-	if !ok {
-		return errwrap.Wrap(nil, fmt.Sprintf("unknown NOTIFICATION_LEVEL %s", s.c.NotificationLevel))
+	switch s.c.BackupExternalSymlinks {
+	case "", "keep", "rewrite", "drop":
+	default:
+		return errwrap.Wrap(nil, fmt.Sprintf("unknown value for BACKUP_EXTERNAL_SYMLINKS: %s", s.c.BackupExternalSymlinks))
+	}
+
+	switch s.c.BackupConsistencyCheck {
+	case "", "warn", "fail":
+	default:
+		return errwrap.Wrap(nil, fmt.Sprintf("unknown value for BACKUP_CONSISTENCY_CHECK: %s", s.c.BackupConsistencyCheck))
 	}
-	s.hookLevel = hookLevel
 
-	if len(s.c.NotificationURLs) > 0 {
-		sender, senderErr := shoutrrr.CreateSender(s.c.NotificationURLs...)
-		if senderErr != nil {
-			return errwrap.Wrap(senderErr, "error creating sender")
+	exclude, err := newExcludeMatcher(s.c)
+	if err != nil {
+		return errwrap.Wrap(err, "error initializing exclusions")
+	}
+	s.exclude = exclude
+
+	if maxPercent := s.c.BackupPruneMaxPercent.Int(); maxPercent > 100 {
+		return errwrap.Wrap(nil, fmt.Sprintf("BACKUP_PRUNE_MAX_PERCENT must not exceed 100, got %d", maxPercent))
+	}
+	for _, b := range s.storages {
+		if l, ok := b.(storage.PruneLimiter); ok {
+			l.SetPruneMaxPercent(s.c.BackupPruneMaxPercent.Int())
+		}
+		// The latest backup and its envelope might match the pruning prefix,
+		// but must never be pruned.
+		if e, ok := b.(storage.PruneExcluder); ok && s.c.BackupLatestSymlink != "" {
+			e.SetPruneExclusions(s.c.BackupLatestSymlink, s.c.BackupLatestSymlink+kms.EnvelopeSuffix)
+		}
+		if r, ok := b.(storage.RetentionPolicy); ok {
+			r.SetRetention(
+				s.c.BackupRetentionGfsDaily.Int(),
+				s.c.BackupRetentionGfsWeekly.Int(),
+				s.c.BackupRetentionGfsMonthly.Int(),
+				s.c.BackupRetentionGfsYearly.Int(),
+			)
 		}
-		s.sender = sender
+	}
+
+	if s.publicKeyEncrypted() && s.c.GpgPassphrase != "" {
+		s.logger.Warn("Both GPG_PUBLIC_KEY_RING and GPG_PASSPHRASE are set, backups will be encrypted using the public key ring.")
+	}
 
-		tmpl := template.New("")
-		tmpl.Funcs(templateHelpers)
-		tmpl, err = tmpl.Parse(defaultNotifications)
+	if s.c.GpgKmsProvider != "" {
+		if s.c.GpgPassphrase != "" {
+			return errwrap.Wrap(nil, "GPG_PASSPHRASE and GPG_KMS_PROVIDER cannot be used at the same time")
+		}
+		if s.publicKeyEncrypted() {
+			return errwrap.Wrap(nil, "GPG_PUBLIC_KEY_RING and GPG_KMS_PROVIDER cannot be used at the same time")
+		}
+		keyWrapper, err := kms.NewKeyWrapper(kms.Config{
+			Provider:        s.c.GpgKmsProvider,
+			KeyID:           s.c.GpgKmsKeyID,
+			Region:          s.c.GpgKmsRegion,
+			Endpoint:        s.c.GpgKmsEndpoint,
+			AccessKeyID:     s.c.AwsAccessKeyID,
+			SecretAccessKey: s.c.AwsSecretAccessKey,
+			IamRoleEndpoint: s.c.AwsIamRoleEndpoint,
+			UserAgent:       userAgent,
+		})
 		if err != nil {
-			return errwrap.Wrap(err, "unable to parse default notifications templates")
+			return errwrap.Wrap(err, "error creating key wrapper")
 		}
+		s.keyWrapper = keyWrapper
+	}
 
-		if fi, err := os.Stat("/etc/dockervolumebackup/notifications.d"); err == nil && fi.IsDir() {
-			tmpl, err = tmpl.ParseGlob("/etc/dockervolumebackup/notifications.d/*.*")
-			if err != nil {
-				return errwrap.Wrap(err, "unable to parse user defined notifications templates")
-			}
+	compressions := []CompressionType{s.compression}
+	for _, b := range s.storages {
+		compression, err := s.backendCompression(b.Name())
+		if err != nil {
+			return errwrap.Wrap(err, "error validating compression overrides")
 		}
-		s.template = tmpl
+		compressions = append(compressions, compression)
+	}
+	if err := s.checkCompressionSettings(compressions); err != nil {
+		return errwrap.Wrap(err, "error validating compression settings")
+	}
+	for _, compression := range compressions {
+		if err := checkCompressionLevel(compression.String(), s.c.BackupCompressionLevel); err != nil {
+			return errwrap.Wrap(err, "error validating BACKUP_COMPRESSION_LEVEL")
+		}
+	}
 
-		// To prevent duplicate notifications, ensure the regsistered callbacks
-		// run mutually exclusive.
-		s.registerHook(hookLevelError, func(err error) error {
-			if err == nil {
-				return nil
-			}
-			return s.notifyFailure(err)
-		})
-		s.registerHook(hookLevelInfo, func(err error) error {
-			if err != nil {
-				return nil
-			}
-			return s.notifySuccess()
-		})
+	if err := s.checkCompressionMemoryLimit(); err != nil {
+		return errwrap.Wrap(err, "error validating compression memory limit")
+	}
+
+	if s.c.ResticRepository != "" {
+		// restic encrypts and deduplicates data itself, which does not work
+		// for data that is compressed or encrypted already.
+		if s.encrypted() {
+			return errwrap.Wrap(nil, "RESTIC_REPOSITORY cannot be used together with GPG encryption, as restic encrypts backups itself")
+		}
+		compression, err := s.backendCompression("Restic")
+		if err != nil {
+			return errwrap.Wrap(err, "error determining compression for restic")
+		}
+		if s.c.BackupStream {
+			compression = s.compression
+		}
+		if compression != "none" {
+			s.logger.Warn(
+				fmt.Sprintf("Backups stored in restic are compressed using %s, which prevents restic from deduplicating data.", compression),
+			)
+		}
+	}
+
+	if s.c.BackupContinueOnError && s.c.BackupUploadFailFast {
+		return errwrap.Wrap(nil, "BACKUP_CONTINUE_ON_ERROR and BACKUP_UPLOAD_FAIL_FAST cannot be used at the same time")
+	}
+
+	for _, b := range s.storages {
+		if _, err := s.storageTimeout(b.Name()); err != nil {
+			return errwrap.Wrap(err, "error validating storage timeouts")
+		}
+	}
+
+	if err := s.initStream(); err != nil {
+		return errwrap.Wrap(err, "error initializing streaming")
 	}
 
 	return nil
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/offen/docker-volume-backup/internal/errwrap"
+)
+
+func TestResolveFile(t *testing.T) {
+	t.Setenv("BACKUP_HOST", "db")
+	s := newScript(&Config{BackupFilename: "$BACKUP_HOST-%Y-%m-%d.{{ .Extension }}", BackupFilenameExpand: true})
+	s.compression = "gz"
+	s.stats.StartTime = time.Date(2024, 5, 1, 2, 0, 0, 0, time.UTC)
+	if err := s.resolveFile(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if s.stats.BackupFile.Pattern != "db-%Y-%m-%d.tar.gz" {
+		t.Errorf("Unexpected pattern %s", s.stats.BackupFile.Pattern)
+	}
+	if s.file != "/tmp/db-2024-05-01.tar.gz" {
+		t.Errorf("Unexpected file %s", s.file)
+	}
+}
+
+func TestUnknownDirectives(t *testing.T) {
+	tests := []struct {
+		pattern  string
+		expected []string
+	}{
+		{"backup-%Y-%m-%dT%H-%M-%S.tar.gz", nil},
+		{"backup-100%%.tar.gz", nil},
+		{"backup-100%.tar.gz", []string{"%."}},
+		{"backup-%Q-%Y.tar.gz%", []string{"%Q", "%"}},
+	}
+	for _, test := range tests {
+		if got := unknownDirectives(test.pattern); !reflect.DeepEqual(got, test.expected) {
+			t.Errorf("unknownDirectives(%s): expected %v, got %v", test.pattern, test.expected, got)
+		}
+	}
+}
+
+func TestRetryPending(t *testing.T) {
+	partial := errwrap.Wrap(&partialFailureError{err: errors.New("upload failed")}, "error running script")
+	tests := []struct {
+		name     string
+		attempt  int
+		err      error
+		expected bool
+	}{
+		{"success", 1, nil, false},
+		{"failure", 1, errors.New("error"), true},
+		{"last attempt", 3, errors.New("error"), false},
+		{"partial failure", 1, partial, false},
+		{"partial failure followed by hook error", 1, errwrap.Wrap(partial, "error calling the registered hooks"), false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := newScript(&Config{BackupRunRetries: 2})
+			s.attempt = test.attempt
+			if pending := s.retryPending(test.err); pending != test.expected {
+				t.Errorf("Expected %v, got %v", test.expected, pending)
+			}
+		})
+	}
+}
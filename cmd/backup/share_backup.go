@@ -0,0 +1,43 @@
+// Copyright 2024 - offen.software <hioffen@posteo.de>
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/offen/docker-volume-backup/internal/errwrap"
+	"github.com/offen/docker-volume-backup/internal/storage"
+)
+
+// shareBackup returns a task that prints a pre-signed download URL for the
+// backup with the given name for each storage backend supporting it. The
+// URLs stop working once the given expiry has passed.
+func shareBackup(name string, expiry time.Duration) func(s *script) error {
+	return func(s *script) error {
+		var shared int
+		for _, b := range s.storages {
+			presigner, ok := b.(storage.Presigner)
+			if !ok {
+				continue
+			}
+			if _, err := b.Stat(name); err != nil {
+				return errwrap.Wrap(err, fmt.Sprintf("error looking up backup `%s` in backend `%s`", name, b.Name()))
+			}
+			u, err := presigner.PresignedURL(name, expiry)
+			if err != nil {
+				return errwrap.Wrap(err, fmt.Sprintf("error sharing backup using backend `%s`", b.Name()))
+			}
+			s.logger.Info(
+				fmt.Sprintf("Generated download URL for `%s` in backend `%s`, valid until %s.", name, b.Name(), time.Now().Add(expiry).Format(time.RFC3339)),
+			)
+			fmt.Println(u)
+			shared++
+		}
+		if shared == 0 {
+			return errwrap.Wrap(nil, "no storage backend supporting pre-signed URLs is configured, sharing requires S3 or Azure")
+		}
+		return nil
+	}
+}
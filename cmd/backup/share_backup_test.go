@@ -0,0 +1,115 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/offen/docker-volume-backup/internal/storage"
+)
+
+type presignBackend struct {
+	*mockBackend
+}
+
+func (p *presignBackend) PresignedURL(name string, expiry time.Duration) (string, error) {
+	if name == "broken.tar.gz" {
+		return "", errors.New("presigning failed")
+	}
+	return fmt.Sprintf("https://%s.example.com/%s?expires=%s", p.name, name, expiry), nil
+}
+
+func TestShareBackup(t *testing.T) {
+	tests := []struct {
+		name     string
+		backup   string
+		storages func() []storage.Backend
+		expected string
+		err      string
+	}{
+		{
+			"presigned",
+			"backup.tar.gz",
+			func() []storage.Backend {
+				return []storage.Backend{
+					&mockBackend{name: "Local", uploads: map[string]int{"backup.tar.gz": 1}},
+					&presignBackend{&mockBackend{name: "S3", uploads: map[string]int{"backup.tar.gz": 1}}},
+				}
+			},
+			"https://S3.example.com/backup.tar.gz?expires=1h0m0s\n",
+			"",
+		},
+		{
+			"missing backup",
+			"backup.tar.gz",
+			func() []storage.Backend {
+				return []storage.Backend{&presignBackend{&mockBackend{name: "S3", uploads: map[string]int{}}}}
+			},
+			"",
+			"error looking up backup `backup.tar.gz` in backend `S3`",
+		},
+		{
+			"presigning fails",
+			"broken.tar.gz",
+			func() []storage.Backend {
+				return []storage.Backend{&presignBackend{&mockBackend{name: "S3", uploads: map[string]int{"broken.tar.gz": 1}}}}
+			},
+			"",
+			"error sharing backup using backend `S3`",
+		},
+		{
+			"no presigner",
+			"backup.tar.gz",
+			func() []storage.Backend {
+				return []storage.Backend{&mockBackend{name: "Local", uploads: map[string]int{"backup.tar.gz": 1}}}
+			},
+			"",
+			"no storage backend supporting pre-signed URLs is configured",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := newScript(&Config{})
+			s.storages = test.storages()
+
+			output, err := captureStdout(t, func() error {
+				return shareBackup(test.backup, time.Hour)(s)
+			})
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Errorf("Expected error containing %q, got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if output != test.expected {
+				t.Errorf("Expected output %q, got %q", test.expected, output)
+			}
+		})
+	}
+}
+
+// captureStdout returns everything the given function writes to stdout.
+func captureStdout(t *testing.T, fn func() error) (string, error) {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("Unexpected error creating pipe: %v", err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	fnErr := fn()
+	os.Stdout = stdout
+	w.Close()
+	output, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("Unexpected error reading output: %v", err)
+	}
+	return string(output), fnErr
+}
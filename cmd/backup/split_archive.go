@@ -0,0 +1,233 @@
+// Copyright 2024 - offen.software <hioffen@posteo.de>
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/offen/docker-volume-backup/internal/errwrap"
+	"github.com/offen/docker-volume-backup/internal/kms"
+	"github.com/offen/docker-volume-backup/internal/storage"
+)
+
+const (
+	// splitPartFormat is used for deriving the name of a part of a split
+	// archive from the name of the archive and the number of the part.
+	splitPartFormat = "%s.part%03d"
+	// splitManifestSuffix is appended to the name of a split archive to
+	// derive the name of the manifest listing its parts.
+	splitManifestSuffix = ".manifest"
+)
+
+var splitPartSuffix = regexp.MustCompile(`\.part\d{3,}$`)
+
+// splitArchive contains the parts a backup file has been split into. Parts
+// are sections of the backup file and are never written to disk on their own.
+type splitArchive struct {
+	// sizes contains the size of each part.
+	sizes []int64
+	// checksums contains the hex encoded SHA-256 checksum of each part.
+	checksums []string
+}
+
+// sections returns a reader for each part of the given backup file.
+func (a *splitArchive) sections(f io.ReaderAt) []*io.SectionReader {
+	var result []*io.SectionReader
+	var offset int64
+	for _, size := range a.sizes {
+		result = append(result, io.NewSectionReader(f, offset, size))
+		offset += size
+	}
+	return result
+}
+
+// split determines the parts of BACKUP_SPLIT_SIZE the given backup file is
+// split into, computing their checksums. Each file is split once only, so
+// subsequent calls return the existing parts.
+func (s *script) split(file string) (*splitArchive, error) {
+	if existing, ok := s.splits[file]; ok {
+		return existing, nil
+	}
+
+	src, err := os.Open(file)
+	if err != nil {
+		return nil, errwrap.Wrap(err, fmt.Sprintf("error opening backup file `%s`", file))
+	}
+	defer src.Close()
+	stat, err := src.Stat()
+	if err != nil {
+		return nil, errwrap.Wrap(err, fmt.Sprintf("error getting file info for backup file `%s`", file))
+	}
+
+	// An empty part is only used in case the backup file is empty.
+	result := &splitArchive{}
+	size, splitSize := stat.Size(), s.c.BackupSplitSize.Int64()
+	for offset := int64(0); offset < size || offset == 0; offset += splitSize {
+		result.sizes = append(result.sizes, min(splitSize, size-offset))
+	}
+	for i, section := range result.sections(src) {
+		h := sha256.New()
+		if _, err := io.Copy(h, section); err != nil {
+			return nil, errwrap.Wrap(err, fmt.Sprintf("error reading part %d", i+1))
+		}
+		result.checksums = append(result.checksums, hex.EncodeToString(h.Sum(nil)))
+	}
+
+	s.logger.Info(
+		fmt.Sprintf("Split backup file `%s` into %d parts.", filepath.Base(file), len(result.sizes)),
+	)
+	s.splits[file] = result
+	return result, nil
+}
+
+// copySplitArchive uploads the parts of the given backup file to the given
+// backend using the given name, followed by a manifest listing all parts and
+// their checksums. As the manifest is uploaded last, its presence signals
+// the set of parts is complete.
+func (s *script) copySplitArchive(b storage.Backend, file, name string) error {
+	split, err := s.split(file)
+	if err != nil {
+		return errwrap.Wrap(err, "error splitting backup file")
+	}
+	src, err := os.Open(file)
+	if err != nil {
+		return errwrap.Wrap(err, fmt.Sprintf("error opening backup file `%s`", file))
+	}
+	defer src.Close()
+
+	var manifest strings.Builder
+	for i, section := range split.sections(src) {
+		partName := fmt.Sprintf(splitPartFormat, name, i+1)
+		if err := s.copyPart(b, section, partName); err != nil {
+			return errwrap.Wrap(err, fmt.Sprintf("error uploading part %d", i+1))
+		}
+		if s.c.BackupConfirmUpload || s.c.BackupVerifyUpload {
+			if err := s.confirmPart(b, section, partName); err != nil {
+				return err
+			}
+		}
+		// The format is understood by `sha256sum -c`.
+		fmt.Fprintf(&manifest, "%s  %s\n", split.checksums[i], path.Base(partName))
+	}
+
+	dir, err := s.tempDir("manifest-*")
+	if err != nil {
+		return errwrap.Wrap(err, "error creating directory for manifest")
+	}
+	manifestFile := filepath.Join(dir, "manifest")
+	if err := os.WriteFile(manifestFile, []byte(manifest.String()), 0644); err != nil {
+		return errwrap.Wrap(err, "error writing manifest")
+	}
+	if err := s.withTimeout(b.Name(), func(ctx context.Context) error {
+		return b.Copy(ctx, manifestFile, name+splitManifestSuffix)
+	}); err != nil {
+		return errwrap.Wrap(err, "error uploading manifest")
+	}
+	return nil
+}
+
+// copyPart uploads the given part of a backup file using the given name.
+// Backends that can read from a reader are handed the section of the backup
+// file directly. For all others, the part is written to a temporary file,
+// which is removed again after uploading, so at most one part is stored on
+// disk additionally.
+func (s *script) copyPart(b storage.Backend, section *io.SectionReader, name string) error {
+	if streamer, ok := b.(storage.Streamer); ok {
+		attempts, err := s.withRetries(b.Name(), fmt.Sprintf("upload `%s`", name), func(ctx context.Context) error {
+			r := io.NewSectionReader(section, 0, section.Size())
+			return streamer.CopyFrom(storage.NewContextReader(ctx, r), name)
+		})
+		s.recordUploadAttempts(b.Name(), attempts)
+		return err
+	}
+
+	dir, err := os.MkdirTemp("", "part-*")
+	if err != nil {
+		return errwrap.Wrap(err, "error creating directory for part")
+	}
+	defer os.RemoveAll(dir)
+	part := filepath.Join(dir, path.Base(name))
+	f, err := os.Create(part)
+	if err != nil {
+		return errwrap.Wrap(err, "error creating part")
+	}
+	_, err = io.Copy(f, io.NewSectionReader(section, 0, section.Size()))
+	if cErr := f.Close(); err == nil {
+		err = cErr
+	}
+	if err != nil {
+		return errwrap.Wrap(err, "error writing part")
+	}
+	return s.copyWithRetries(b, part, name)
+}
+
+// confirmPart looks up the part with the given name in the given backend
+// and returns an error in case it does not exist or its size does not match
+// the given section of the backup file. In case BACKUP_VERIFY_UPLOAD is set,
+// the checksum of the uploaded part is compared as well.
+func (s *script) confirmPart(b storage.Backend, section *io.SectionReader, name string) error {
+	info, err := b.Stat(name)
+	if err != nil {
+		return errwrap.Wrap(err, fmt.Sprintf("error confirming upload to backend `%s`", b.Name()))
+	}
+	if info.Size != section.Size() {
+		return errwrap.Wrap(
+			nil,
+			fmt.Sprintf(
+				"size of uploaded file in backend `%s` does not match, expected %d bytes, got %d",
+				b.Name(),
+				section.Size(),
+				info.Size,
+			),
+		)
+	}
+	if s.c.BackupVerifyUpload {
+		h := md5.New()
+		if _, err := io.Copy(h, io.NewSectionReader(section, 0, section.Size())); err != nil {
+			return errwrap.Wrap(err, "error computing checksum of part")
+		}
+		if err := s.verifyChecksum(b, h.Sum(nil), name); err != nil {
+			return err
+		}
+	}
+	s.logger.Info(
+		fmt.Sprintf("Confirmed upload of `%s` to backend `%s`.", name, b.Name()),
+	)
+	return nil
+}
+
+// uploadedName returns the name of the file whose presence in a backend
+// signals the backup with the given name has been uploaded completely.
+func (s *script) uploadedName(name string) string {
+	if s.c.BackupSplitSize > 0 {
+		return name + splitManifestSuffix
+	}
+	return name
+}
+
+// backupSetName returns the name of the backup the file with the given name
+// belongs to, i.e. it strips the suffix of parts, manifests, envelopes and
+// checksum files.
+func backupSetName(name string) string {
+	if strings.HasSuffix(name, splitManifestSuffix) {
+		return strings.TrimSuffix(name, splitManifestSuffix)
+	}
+	if strings.HasSuffix(name, kms.EnvelopeSuffix) {
+		return strings.TrimSuffix(name, kms.EnvelopeSuffix)
+	}
+	if isChecksumFile(name) {
+		return strings.TrimSuffix(name, path.Ext(name))
+	}
+	return splitPartSuffix.ReplaceAllString(name, "")
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/offen/docker-volume-backup/internal/storage"
+	"github.com/offen/docker-volume-backup/internal/storage/local"
+)
+
+func TestCopySplitArchive(t *testing.T) {
+	for _, test := range []struct {
+		size          int
+		expectedParts int
+		streaming     bool
+	}{
+		{25, 3, true},
+		{20, 2, true},
+		{0, 1, true},
+		{25, 3, false},
+		{0, 1, false},
+	} {
+		t.Run(fmt.Sprintf("%d bytes, streaming %v", test.size, test.streaming), func(t *testing.T) {
+			content := make([]byte, test.size)
+			for i := range content {
+				content[i] = byte(i)
+			}
+			file := filepath.Join(t.TempDir(), "backup.tar.gz")
+			if err := os.WriteFile(file, content, 0644); err != nil {
+				t.Fatalf("Unexpected error writing file: %v", err)
+			}
+
+			s := newScript(&Config{BackupSplitSize: 10, BackupConfirmUpload: true})
+			archive := t.TempDir()
+			var b storage.Backend = local.NewStorageBackend(local.Config{ArchivePath: archive}, func(storage.LogLevel, string, string, ...any) {})
+			if !test.streaming {
+				// Embedding the backend hides its CopyFrom method.
+				b = struct{ storage.Backend }{b}
+			}
+			if err := s.copySplitArchive(b, file, "backup.tar.gz"); err != nil {
+				t.Fatalf("Unexpected error copying split archive: %v", err)
+			}
+
+			var joined []byte
+			var manifest string
+			for i := 1; i <= test.expectedParts; i++ {
+				name := fmt.Sprintf("backup.tar.gz.part%03d", i)
+				part, err := os.ReadFile(filepath.Join(archive, name))
+				if err != nil {
+					t.Fatalf("Expected part %d to exist, got %v", i, err)
+				}
+				joined = append(joined, part...)
+				sum := sha256.Sum256(part)
+				manifest += fmt.Sprintf("%s  %s\n", hex.EncodeToString(sum[:]), name)
+			}
+			if _, err := os.Stat(filepath.Join(archive, fmt.Sprintf("backup.tar.gz.part%03d", test.expectedParts+1))); err == nil {
+				t.Errorf("Expected %d parts only", test.expectedParts)
+			}
+			if !slices.Equal(joined, content) {
+				t.Error("Expected parts to match the backup file")
+			}
+			result, err := os.ReadFile(filepath.Join(archive, "backup.tar.gz.manifest"))
+			if err != nil {
+				t.Fatalf("Expected manifest to exist, got %v", err)
+			}
+			if string(result) != manifest {
+				t.Errorf("Unexpected manifest %s", result)
+			}
+		})
+	}
+}
+
+func TestPruneSplitArchives(t *testing.T) {
+	archive := t.TempDir()
+	old := time.Now().Add(-72 * time.Hour)
+	files := map[string]time.Time{
+		"backup-1.tar.gz.gpg.part001":  old,
+		"backup-1.tar.gz.gpg.part002":  old,
+		"backup-1.tar.gz.gpg.manifest": old,
+		"backup-1.tar.gz.gpg.key":      old,
+		// the parts of a backup are pruned as a unit, so this one is kept
+		"backup-2.tar.gz.gpg.part001":   old,
+		"backup-2.tar.gz.gpg.part002":   time.Now(),
+		"backup-2.tar.gz.gpg.manifest":  time.Now(),
+		"backup-3.tar.gz.gpg.part001":   old,
+		"backup-3.tar.gz.gpg.manifest":  old,
+		"backup-3.tar.gz.gpg.protected": old,
+	}
+	for name, modTime := range files {
+		location := filepath.Join(archive, name)
+		if err := os.WriteFile(location, nil, 0644); err != nil {
+			t.Fatalf("Unexpected error writing file: %v", err)
+		}
+		if err := os.Chtimes(location, modTime, modTime); err != nil {
+			t.Fatalf("Unexpected error setting modification time: %v", err)
+		}
+	}
+
+	s := newScript(&Config{BackupSplitSize: 10, BackupFilename: "backup.tar.gz"})
+	b := local.NewStorageBackend(local.Config{ArchivePath: archive}, func(storage.LogLevel, string, string, ...any) {})
+	stats, err := s.pruneBackupSets(context.Background(), b, time.Now().Add(-24*time.Hour))
+	if err != nil {
+		t.Fatalf("Unexpected error pruning: %v", err)
+	}
+	if stats.Total != 3 || stats.Pruned != 1 || !slices.Equal(stats.Matches, []string{"backup-1.tar.gz.gpg"}) {
+		t.Errorf("Unexpected stats %v", stats)
+	}
+
+	entries, err := os.ReadDir(archive)
+	if err != nil {
+		t.Fatalf("Unexpected error reading directory: %v", err)
+	}
+	for _, e := range entries {
+		if backupSetName(e.Name()) == "backup-1.tar.gz.gpg" {
+			t.Errorf("Expected %s to be pruned", e.Name())
+		}
+	}
+	if len(entries) != 6 {
+		t.Errorf("Expected 6 remaining files, got %d", len(entries))
+	}
+}
@@ -30,14 +30,49 @@ type ServicesStats struct {
 type BackupFileStats struct {
 	Name     string
 	FullPath string
-	Size     uint64
+	// Pattern is the name of the backup file before interpolating strftime
+	// tokens, i.e. after rendering BACKUP_FILENAME and expanding environment
+	// variables.
+	Pattern string
+	Size    uint64
+	// Files is the number of regular files contained in the backup, and
+	// UncompressedSize their total size.
+	Files            uint
+	UncompressedSize uint64
+	// Checksum is only populated when BACKUP_CHECKSUM_ALGORITHM is set.
+	Checksum string
+	// Incremental is only populated when BACKUP_CHANGED_SINCE_MARKER is set.
+	Incremental *IncrementalManifest
 }
 
 // StorageStats stats about the status of an archival directory
 type StorageStats struct {
-	Total       uint
-	Pruned      uint
-	PruneErrors uint
+	Total        uint
+	Pruned       uint
+	PruneErrors  uint
+	PruneMatches []string
+	// PruneDryRun is true in case backups have not actually been pruned, so
+	// Pruned is the number of backups that would have been pruned.
+	PruneDryRun bool
+	// RetentionDays is the number of days backups are retained in the
+	// storage, or -1 if backups are not pruned by age.
+	RetentionDays int
+	// Uploaded is true in case the backup has been uploaded to the storage
+	// in this run. UploadError holds the reason in case the upload failed.
+	Uploaded    bool
+	UploadError string
+	// UploadAttempts and PruneAttempts are the number of attempts it took
+	// to upload and prune backups, as per BACKUP_UPLOAD_RETRIES.
+	UploadAttempts uint
+	PruneAttempts  uint
+	// UploadDuration is the time it took to upload the backup, including
+	// retries.
+	UploadDuration time.Duration
+	// Upload stats are only populated for backends that report them, which
+	// currently is S3. Throughput is given in bytes per second.
+	UploadedBytes    uint64
+	UploadParts      uint
+	UploadThroughput uint64
 }
 
 // Stats global stats regarding script execution
@@ -52,4 +87,8 @@ type Stats struct {
 	Services   ServicesStats
 	BackupFile BackupFileStats
 	Storages   map[string]StorageStats
+	Backends   map[string]BackendState
+	// PreviousRun is nil unless a state file is configured and a backup
+	// run has completed before.
+	PreviousRun *RunState
 }
@@ -4,11 +4,15 @@
 package main
 
 import (
+	"cmp"
 	"context"
 	"errors"
 	"fmt"
 	"io"
 	"os"
+	"slices"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -21,6 +25,17 @@ import (
 	"github.com/offen/docker-volume-backup/internal/errwrap"
 )
 
+// newDockerClient creates a client for the docker daemon in case its socket
+// is mounted or DOCKER_HOST is set. Otherwise, it returns nil.
+func newDockerClient() (*client.Client, error) {
+	_, err := os.Stat("/var/run/docker.sock")
+	_, dockerHostSet := os.LookupEnv("DOCKER_HOST")
+	if os.IsNotExist(err) && !dockerHostSet {
+		return nil, nil
+	}
+	return client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+}
+
 func scaleService(cli *client.Client, serviceID string, replicas uint64) ([]string, error) {
 	service, _, err := cli.ServiceInspectWithRaw(context.Background(), serviceID, types.ServiceInspectOptions{})
 	if err != nil {
@@ -95,7 +110,7 @@ func isSwarm(c interface {
 // stopped during the backup and returns a function that can be called to
 // restart everything that has been stopped.
 func (s *script) stopContainersAndServices() (func() error, error) {
-	if s.cli == nil {
+	if s.cli == nil || s.c.containersStopped {
 		return noop, nil
 	}
 
@@ -136,6 +151,37 @@ func (s *script) stopContainersAndServices() (func() error, error) {
 	if err != nil {
 		return noop, errwrap.Wrap(err, "error querying for containers to stop")
 	}
+	reason := fmt.Sprintf("labeled %s", filterMatchLabel)
+
+	// The backup container itself might belong to the compose project too.
+	ownID, _ := os.Hostname()
+	var ownServiceID string
+	if s.c.BackupStopComposeProject != "" {
+		reason = fmt.Sprintf("%s or belong to compose project %s", reason, s.c.BackupStopComposeProject)
+		projectContainers, err := s.cli.ContainerList(context.Background(), types.ContainerListOptions{
+			Filters: filters.NewArgs(filters.KeyValuePair{
+				Key:   "label",
+				Value: fmt.Sprintf("com.docker.compose.project=%s", s.c.BackupStopComposeProject),
+			}),
+		})
+		if err != nil {
+			return noop, errwrap.Wrap(err, "error querying for containers of compose project")
+		}
+		for _, container := range projectContainers {
+			if ownID != "" && strings.HasPrefix(container.ID, ownID) {
+				continue
+			}
+			if !slices.ContainsFunc(containersToStop, func(c types.Container) bool { return c.ID == container.ID }) {
+				containersToStop = append(containersToStop, container)
+			}
+		}
+		for _, container := range allContainers {
+			if ownID != "" && strings.HasPrefix(container.ID, ownID) {
+				ownServiceID = container.Labels["com.docker.swarm.service.id"]
+			}
+		}
+	}
+	containersToStop = s.restartOrder(containersToStop)
 
 	var allServices []swarm.Service
 	var servicesToScaleDown []handledSwarmService
@@ -154,6 +200,26 @@ func (s *script) stopContainersAndServices() (func() error, error) {
 		if err != nil {
 			return noop, errwrap.Wrap(err, "error querying for services to scale down")
 		}
+		if s.c.BackupStopComposeProject != "" {
+			// Compose projects deployed to a swarm are stacks, whose services
+			// are scaled down.
+			stackServices, err := s.cli.ServiceList(context.Background(), types.ServiceListOptions{
+				Filters: filters.NewArgs(filters.KeyValuePair{
+					Key:   "label",
+					Value: fmt.Sprintf("com.docker.stack.namespace=%s", s.c.BackupStopComposeProject),
+				}),
+				Status: true,
+			})
+			if err != nil {
+				return noop, errwrap.Wrap(err, "error querying for services of compose project")
+			}
+			for _, svc := range stackServices {
+				if svc.ID == ownServiceID || slices.ContainsFunc(matchingServices, func(m swarm.Service) bool { return m.ID == svc.ID }) {
+					continue
+				}
+				matchingServices = append(matchingServices, svc)
+			}
+		}
 		for _, s := range matchingServices {
 			if s.Spec.Mode.Replicated == nil {
 				return noop, errwrap.Wrap(
@@ -172,6 +238,37 @@ func (s *script) stopContainersAndServices() (func() error, error) {
 		return noop, nil
 	}
 
+	if s.dryRun {
+		s.logger.Info(
+			fmt.Sprintf("Would %s %d out of %d running container(s) as they were %s.", s.c.BackupStopAction, len(containersToStop), len(allContainers), reason),
+		)
+		s.logOrder("Would stop", reversed(containersToStop))
+		if isDockerSwarm {
+			s.logger.Info(
+				fmt.Sprintf("Would scale down %d out of %d active service(s) as they were %s.", len(servicesToScaleDown), len(allServices), reason),
+			)
+		}
+		s.stats.Containers = ContainersStats{
+			All:    uint(len(allContainers)),
+			ToStop: uint(len(containersToStop)),
+		}
+		s.stats.Services = ServicesStats{
+			All:         uint(len(allServices)),
+			ToScaleDown: uint(len(servicesToScaleDown)),
+		}
+		return noop, nil
+	}
+
+	if s.c.BackupStopAction == "pause" {
+		if len(servicesToScaleDown) != 0 || slices.ContainsFunc(containersToStop, func(c types.Container) bool {
+			_, ok := c.Labels["com.docker.swarm.service.id"]
+			return ok
+		}) {
+			return noop, errwrap.Wrap(nil, "BACKUP_STOP_ACTION is set to pause, but swarm services cannot be paused, cannot continue")
+		}
+		return s.pauseContainers(containersToStop, len(allContainers), reason)
+	}
+
 	if isDockerSwarm {
 		for _, container := range containersToStop {
 			if swarmServiceID, ok := container.Labels["com.docker.swarm.service.id"]; ok {
@@ -197,26 +294,29 @@ func (s *script) stopContainersAndServices() (func() error, error) {
 
 	s.logger.Info(
 		fmt.Sprintf(
-			"Stopping %d out of %d running container(s) as they were labeled %s.",
+			"Stopping %d out of %d running container(s) as they were %s.",
 			len(containersToStop),
 			len(allContainers),
-			filterMatchLabel,
+			reason,
 		),
 	)
 	if isDockerSwarm {
 		s.logger.Info(
 			fmt.Sprintf(
-				"Scaling down %d out of %d active service(s) as they were labeled %s.",
+				"Scaling down %d out of %d active service(s) as they were %s.",
 				len(servicesToScaleDown),
 				len(allServices),
-				filterMatchLabel,
+				reason,
 			),
 		)
 	}
 
 	var stoppedContainers []types.Container
 	var stopErrors []error
-	for _, container := range containersToStop {
+	// Containers are stopped in the reverse order of restarting them.
+	s.logOrder("Stopping", reversed(containersToStop))
+	for i := len(containersToStop) - 1; i >= 0; i-- {
+		container := containersToStop[i]
 		if err := s.cli.ContainerStop(context.Background(), container.ID, ctr.StopOptions{}); err != nil {
 			stopErrors = append(stopErrors, err)
 		} else {
@@ -282,7 +382,9 @@ func (s *script) stopContainersAndServices() (func() error, error) {
 	return func() error {
 		var restartErrors []error
 		matchedServices := map[string]bool{}
-		for _, container := range stoppedContainers {
+		restartContainers := s.restartOrder(stoppedContainers)
+		s.logOrder("Restarting", restartContainers)
+		for _, container := range restartContainers {
 			if swarmServiceID, ok := container.Labels["com.docker.swarm.service.id"]; ok && isDockerSwarm {
 				if _, ok := matchedServices[swarmServiceID]; ok {
 					continue
@@ -365,3 +467,174 @@ func (s *script) stopContainersAndServices() (func() error, error) {
 		return nil
 	}, initialErr
 }
+
+// restartOrder returns the given containers in the order they are supposed
+// to be restarted in, which is the ascending order of the numeric value of
+// the label given in BACKUP_STOP_PRIORITY_LABEL. Containers with the same
+// priority are restarted after the compose services they depend on.
+// Containers without a valid label have a priority of 0.
+func (s *script) restartOrder(containers []types.Container) []types.Container {
+	priorities := map[string]int{}
+	for _, container := range containers {
+		value, ok := container.Labels[s.c.BackupStopPriorityLabel]
+		if !ok {
+			continue
+		}
+		priority, err := strconv.Atoi(value)
+		if err != nil {
+			s.logger.Warn(
+				fmt.Sprintf("Ignoring invalid value `%s` for label %s on container %s.", value, s.c.BackupStopPriorityLabel, containerName(container)),
+			)
+			continue
+		}
+		priorities[container.ID] = priority
+	}
+
+	sorted := sortByComposeDependencies(containers)
+	slices.SortStableFunc(sorted, func(a, b types.Container) int {
+		return cmp.Compare(priorities[a.ID], priorities[b.ID])
+	})
+	return sorted
+}
+
+// logOrder logs the order in which the given containers are handled in case
+// there is more than one.
+func (s *script) logOrder(action string, containers []types.Container) {
+	if len(containers) < 2 {
+		return
+	}
+	names := make([]string, len(containers))
+	for i, container := range containers {
+		names[i] = containerName(container)
+	}
+	s.logger.Info(
+		fmt.Sprintf("%s containers in the following order: %s.", action, strings.Join(names, ", ")),
+	)
+}
+
+func containerName(container types.Container) string {
+	if len(container.Names) == 0 {
+		return container.ID
+	}
+	return strings.TrimPrefix(container.Names[0], "/")
+}
+
+func reversed(containers []types.Container) []types.Container {
+	result := slices.Clone(containers)
+	slices.Reverse(result)
+	return result
+}
+
+// sortByComposeDependencies returns the given containers sorted so that each
+// container comes after the containers of the compose services it depends on
+// as given in the com.docker.compose.depends_on label. Otherwise, the order
+// of the containers is retained.
+func sortByComposeDependencies(containers []types.Container) []types.Container {
+	byService := map[string][]types.Container{}
+	for _, container := range containers {
+		service := container.Labels["com.docker.compose.service"]
+		byService[service] = append(byService[service], container)
+	}
+
+	var sorted []types.Container
+	visited := map[string]bool{}
+	var visit func(container types.Container)
+	visit = func(container types.Container) {
+		if visited[container.ID] {
+			return
+		}
+		visited[container.ID] = true
+		for _, dependency := range strings.Split(container.Labels["com.docker.compose.depends_on"], ",") {
+			service, _, _ := strings.Cut(dependency, ":")
+			if service == "" {
+				continue
+			}
+			for _, c := range byService[service] {
+				visit(c)
+			}
+		}
+		sorted = append(sorted, container)
+	}
+	for _, container := range containers {
+		visit(container)
+	}
+	return sorted
+}
+
+// pauseContainers pauses the given containers instead of stopping them and
+// returns a function that can be called to unpause them again. As paused
+// containers would stay frozen in case the returned function is never called,
+// unpausing is also registered as a hook and only ever happens once.
+func (s *script) pauseContainers(containers []types.Container, lenAllContainers int, reason string) (func() error, error) {
+	s.logger.Info(
+		fmt.Sprintf(
+			"Pausing %d out of %d running container(s) as they were %s.",
+			len(containers),
+			lenAllContainers,
+			reason,
+		),
+	)
+
+	var pausedContainers []types.Container
+	var pauseErrors []error
+	s.logOrder("Pausing", reversed(containers))
+	for i := len(containers) - 1; i >= 0; i-- {
+		if err := s.cli.ContainerPause(context.Background(), containers[i].ID); err != nil {
+			pauseErrors = append(pauseErrors, err)
+		} else {
+			pausedContainers = append(pausedContainers, containers[i])
+		}
+	}
+
+	s.stats.Containers = ContainersStats{
+		All:        uint(lenAllContainers),
+		ToStop:     uint(len(containers)),
+		Stopped:    uint(len(pausedContainers)),
+		StopErrors: uint(len(pauseErrors)),
+	}
+
+	doUnpause := func() error {
+		var unpauseErrors []error
+		unpauseContainers := s.restartOrder(pausedContainers)
+		s.logOrder("Unpausing", unpauseContainers)
+		for _, container := range unpauseContainers {
+			if err := s.cli.ContainerUnpause(context.Background(), container.ID); err != nil {
+				unpauseErrors = append(unpauseErrors, err)
+			}
+		}
+		if len(unpauseErrors) != 0 {
+			return errwrap.Wrap(
+				errors.Join(unpauseErrors...),
+				fmt.Sprintf("%d error(s) unpausing containers", len(unpauseErrors)),
+			)
+		}
+		s.logger.Info(
+			fmt.Sprintf("Unpaused %d container(s).", len(pausedContainers)),
+		)
+		return nil
+	}
+
+	var once sync.Once
+	var unpauseErr error
+	s.registerHook(hookLevelPlumbing, func(error) (err error) {
+		once.Do(func() {
+			err = doUnpause()
+		})
+		return
+	})
+	unpause := func() error {
+		once.Do(func() {
+			unpauseErr = doUnpause()
+		})
+		return unpauseErr
+	}
+
+	var initialErr error
+	if len(pauseErrors) != 0 {
+		initialErr = errwrap.Wrap(
+			errors.Join(pauseErrors...),
+			fmt.Sprintf("%d error(s) pausing containers", len(pauseErrors)),
+		)
+	}
+	return unpause, initialErr
+}
@@ -2,11 +2,19 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
 	"testing"
 
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/swarm"
+	"github.com/docker/docker/client"
 )
 
 type mockInfoClient struct {
@@ -83,3 +91,207 @@ func TestIsSwarm(t *testing.T) {
 		})
 	}
 }
+
+func TestSortByComposeDependencies(t *testing.T) {
+	container := func(id, service, dependsOn string) types.Container {
+		return types.Container{ID: id, Labels: map[string]string{
+			"com.docker.compose.service":    service,
+			"com.docker.compose.depends_on": dependsOn,
+		}}
+	}
+	containers := []types.Container{
+		container("app", "app", "db:service_healthy:false,cache:service_started:false"),
+		container("worker", "worker", "app:service_started:false"),
+		container("cache", "cache", ""),
+		container("db", "db", ""),
+		{ID: "unrelated"},
+	}
+
+	var order []string
+	for _, c := range sortByComposeDependencies(containers) {
+		order = append(order, c.ID)
+	}
+	expected := []string{"db", "cache", "app", "worker", "unrelated"}
+	if len(order) != len(expected) {
+		t.Fatalf("Expected %v, got %v", expected, order)
+	}
+	for i := range expected {
+		if order[i] != expected[i] {
+			t.Fatalf("Expected %v, got %v", expected, order)
+		}
+	}
+}
+
+func TestRestartOrder(t *testing.T) {
+	container := func(id string, labels map[string]string) types.Container {
+		return types.Container{ID: id, Names: []string{"/" + id}, Labels: labels}
+	}
+	containers := []types.Container{
+		container("web", map[string]string{"docker-volume-backup.stop-priority": "10"}),
+		container("unlabeled", nil),
+		container("db", map[string]string{"docker-volume-backup.stop-priority": "-5"}),
+		container("invalid", map[string]string{"docker-volume-backup.stop-priority": "high"}),
+	}
+
+	s := newScript(&Config{BackupStopPriorityLabel: "docker-volume-backup.stop-priority"})
+	var order []string
+	for _, c := range s.restartOrder(containers) {
+		order = append(order, c.ID)
+	}
+	expected := []string{"db", "unlabeled", "invalid", "web"}
+	for i := range expected {
+		if i >= len(order) || order[i] != expected[i] {
+			t.Fatalf("Expected %v, got %v", expected, order)
+		}
+	}
+}
+
+// newMockDockerServer returns a Docker client talking to a fake Docker API
+// that lists the given containers as labeled to be stopped and records all
+// pause and unpause requests. Pausing the containers in failPause fails.
+func newMockDockerServer(t *testing.T, swarmState swarm.LocalNodeState, containers []types.Container, failPause ...string) (*client.Client, func() []string) {
+	var mu sync.Mutex
+	var calls []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/info"):
+			json.NewEncoder(w).Encode(types.Info{Swarm: swarm.Info{LocalNodeState: swarmState}})
+		case strings.HasSuffix(r.URL.Path, "/containers/json"):
+			if r.URL.Query().Get("filters") == "" {
+				json.NewEncoder(w).Encode(append([]types.Container{{ID: "unlabeled"}}, containers...))
+				return
+			}
+			json.NewEncoder(w).Encode(containers)
+		case strings.HasSuffix(r.URL.Path, "/services"):
+			json.NewEncoder(w).Encode([]swarm.Service{})
+		case r.Method == http.MethodPost && len(parts) >= 2 && (parts[len(parts)-1] == "pause" || parts[len(parts)-1] == "unpause"):
+			action, id := parts[len(parts)-1], parts[len(parts)-2]
+			if action == "pause" && slices.Contains(failPause, id) {
+				http.Error(w, `{"message":"cannot pause"}`, http.StatusInternalServerError)
+				return
+			}
+			mu.Lock()
+			calls = append(calls, action+" "+id)
+			mu.Unlock()
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	cli, err := client.NewClientWithOpts(client.WithHost("tcp://"+server.Listener.Addr().String()), client.WithVersion("1.43"))
+	if err != nil {
+		t.Fatalf("Unexpected error creating client: %v", err)
+	}
+	return cli, func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		result := slices.Clone(calls)
+		slices.Sort(result)
+		return result
+	}
+}
+
+func TestPauseContainers(t *testing.T) {
+	containers := []types.Container{
+		{ID: "app", Names: []string{"/app"}},
+		{ID: "db", Names: []string{"/db"}},
+	}
+
+	t.Run("unpause", func(t *testing.T) {
+		cli, calls := newMockDockerServer(t, swarm.LocalNodeStateInactive, containers)
+		s := newScript(&Config{BackupStopAction: "pause"})
+		s.cli = cli
+
+		unpause, err := s.stopContainersAndServices()
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if expected := []string{"pause app", "pause db"}; !reflect.DeepEqual(calls(), expected) {
+			t.Fatalf("Expected calls %v, got %v", expected, calls())
+		}
+		if s.stats.Containers.All != 3 || s.stats.Containers.ToStop != 2 || s.stats.Containers.Stopped != 2 {
+			t.Errorf("Unexpected stats %v", s.stats.Containers)
+		}
+
+		if err := unpause(); err != nil {
+			t.Fatalf("Unexpected error unpausing: %v", err)
+		}
+		if err := s.runHooks(nil); err != nil {
+			t.Fatalf("Unexpected error running hooks: %v", err)
+		}
+		expected := []string{"pause app", "pause db", "unpause app", "unpause db"}
+		if !reflect.DeepEqual(calls(), expected) {
+			t.Errorf("Expected calls %v, got %v", expected, calls())
+		}
+	})
+
+	t.Run("restore on failure", func(t *testing.T) {
+		cli, calls := newMockDockerServer(t, swarm.LocalNodeStateInactive, containers)
+		s := newScript(&Config{BackupStopAction: "pause"})
+		s.cli = cli
+
+		if _, err := s.stopContainersAndServices(); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if err := s.runHooks(errors.New("backup failed")); err != nil {
+			t.Fatalf("Unexpected error running hooks: %v", err)
+		}
+		expected := []string{"pause app", "pause db", "unpause app", "unpause db"}
+		if !reflect.DeepEqual(calls(), expected) {
+			t.Errorf("Expected calls %v, got %v", expected, calls())
+		}
+	})
+
+	t.Run("pause error", func(t *testing.T) {
+		cli, calls := newMockDockerServer(t, swarm.LocalNodeStateInactive, containers, "db")
+		s := newScript(&Config{BackupStopAction: "pause"})
+		s.cli = cli
+
+		unpause, err := s.stopContainersAndServices()
+		if err == nil {
+			t.Fatal("Expected an error")
+		}
+		if s.stats.Containers.Stopped != 1 || s.stats.Containers.StopErrors != 1 {
+			t.Errorf("Unexpected stats %v", s.stats.Containers)
+		}
+		if err := unpause(); err != nil {
+			t.Fatalf("Unexpected error unpausing: %v", err)
+		}
+		expected := []string{"pause app", "unpause app"}
+		if !reflect.DeepEqual(calls(), expected) {
+			t.Errorf("Expected calls %v, got %v", expected, calls())
+		}
+	})
+
+	t.Run("swarm", func(t *testing.T) {
+		swarmContainers := []types.Container{
+			{ID: "task", Labels: map[string]string{"com.docker.swarm.service.id": "service"}},
+		}
+		cli, calls := newMockDockerServer(t, swarm.LocalNodeStateActive, swarmContainers)
+		s := newScript(&Config{BackupStopAction: "pause"})
+		s.cli = cli
+
+		if _, err := s.stopContainersAndServices(); err == nil || !strings.Contains(err.Error(), "cannot be paused") {
+			t.Fatalf("Expected swarm error, got %v", err)
+		}
+		if len(calls()) != 0 {
+			t.Errorf("Expected no containers to be paused, got %v", calls())
+		}
+	})
+}
+
+func TestStopActionDecode(t *testing.T) {
+	var action StopAction
+	if err := action.Decode("pause"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if action != "pause" {
+		t.Errorf("Expected pause, got %s", action)
+	}
+	if err := action.Decode("kill"); err == nil {
+		t.Error("Expected an error decoding an unknown action")
+	}
+}
@@ -0,0 +1,184 @@
+// Copyright 2024 - offen.software <hioffen@posteo.de>
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/offen/docker-volume-backup/internal/errwrap"
+	"github.com/offen/docker-volume-backup/internal/storage"
+	"go.opentelemetry.io/otel/attribute"
+	"golang.org/x/sync/errgroup"
+)
+
+// initStream decides whether the archive is streamed to the storage backends
+// when BACKUP_STREAM is set. In case any of the configured backends does not
+// support streaming, the archive is written to disk as usual.
+func (s *script) initStream() error {
+	if !s.c.BackupStream {
+		return nil
+	}
+
+	incompatible := []struct {
+		name string
+		set  bool
+	}{
+		{"BACKUP_SPLIT_SIZE", s.c.BackupSplitSize > 0},
+		{"BACKUP_COMPRESSION_OVERRIDES", len(s.c.BackupCompressionOverrides) > 0},
+		{"BACKUP_AUTO_COMPRESSION", s.c.BackupAutoCompression},
+		{"BACKUP_CHECKSUM_ALGORITHM", s.c.BackupChecksumAlgorithm != ""},
+		{"BACKUP_CONFIRM_UPLOAD", s.c.BackupConfirmUpload},
+		{"BACKUP_VERIFY_UPLOAD", s.c.BackupVerifyUpload},
+		{"BACKUP_CHECKPOINT_DIR", s.c.BackupCheckpointDir != ""},
+		{"BACKUP_CONTINUE_ON_ERROR", s.c.BackupContinueOnError},
+		{"BACKUP_LATEST_COPY_BACKENDS", len(s.c.BackupLatestCopyBackends) > 0},
+		{"GPG_KMS_PROVIDER", s.c.GpgKmsProvider != ""},
+	}
+	for _, option := range incompatible {
+		if option.set {
+			return errwrap.Wrap(nil, fmt.Sprintf("BACKUP_STREAM cannot be used together with %s", option.name))
+		}
+	}
+
+	if len(s.storages) == 0 {
+		return errwrap.Wrap(nil, "BACKUP_STREAM requires at least one storage backend to be configured")
+	}
+
+	var unsupported []string
+	for _, b := range s.storages {
+		if _, ok := b.(storage.Streamer); !ok {
+			unsupported = append(unsupported, b.Name())
+		}
+	}
+	if len(unsupported) != 0 {
+		s.logger.Warn(
+			fmt.Sprintf(
+				"BACKUP_STREAM is set, but storage backend(s) %s do not support streaming. The archive will be written to disk before uploading.",
+				strings.Join(unsupported, ", "),
+			),
+		)
+		return nil
+	}
+
+	s.stream = true
+	return nil
+}
+
+// streamArchive uploads the archive written by the given func to all storage
+// backends while it is being created, encrypting it on the fly if
+// configured, so it is never written to disk. In case creating the archive
+// or any of the uploads fails, all uploads are aborted.
+func (s *script) streamArchive(write func(io.Writer) error) error {
+	_, name := path.Split(s.file)
+	if s.encrypted() {
+		s.file = fmt.Sprintf("%s.gpg", s.file)
+	}
+
+	remoteNames := map[string]string{}
+	latestPointers := map[string]string{}
+	for _, b := range s.storages {
+		remoteName, err := s.remoteName(b.Name())
+		if err != nil {
+			return errwrap.Wrap(err, fmt.Sprintf("error determining name of backup in backend `%s`", b.Name()))
+		}
+		remoteNames[b.Name()] = remoteName
+		if s.c.BackupLatestSymlink != "" && containsBackend(s.c.BackupLatestPointerBackends, b.Name()) {
+			pointer, err := s.prepareLatestPointer(remoteName)
+			if err != nil {
+				return errwrap.Wrap(err, "error preparing latest backup")
+			}
+			latestPointers[b.Name()] = pointer
+		}
+	}
+
+	var pipes []*io.PipeWriter
+	var writers []io.Writer
+	eg := errgroup.Group{}
+	for _, backend := range s.storages {
+		b := backend
+		r, w := io.Pipe()
+		pipes = append(pipes, w)
+		writers = append(writers, w)
+		remoteName := remoteNames[b.Name()]
+		span := s.startSpan("upload", attribute.String("backend", b.Name()))
+		eg.Go(func() (err error) {
+			defer func() {
+				endSpan(span, err)
+			}()
+			start := time.Now()
+			// Streaming uploads are cancelled by failing to read from the
+			// archive once the timeout has passed.
+			err = s.withTimeout(b.Name(), func(ctx context.Context) error {
+				return b.(storage.Streamer).CopyFrom(storage.NewContextReader(ctx, r), remoteName)
+			})
+			// Closing the reader makes writing the archive fail in case the
+			// upload has been aborted before reading all data.
+			r.CloseWithError(err)
+			s.recordUpload(b.Name(), time.Since(start), err)
+			if err != nil {
+				return errwrap.Wrap(err, fmt.Sprintf("error streaming backup to backend `%s`", b.Name()))
+			}
+			if pointer := latestPointers[b.Name()]; pointer != "" && b.Name() != "Local" {
+				return s.withTimeout(b.Name(), func(ctx context.Context) error {
+					return b.Copy(ctx, pointer, s.c.BackupLatestSymlink)
+				})
+			}
+			return nil
+		})
+	}
+
+	counter := &countingWriter{w: io.MultiWriter(writers...)}
+	writeErr := func() error {
+		if !s.encrypted() {
+			return write(counter)
+		}
+		dst, err := s.encryptWriter(counter, name, []byte(s.c.GpgPassphrase))
+		if err != nil {
+			return errwrap.Wrap(err, "error encrypting backup")
+		}
+		if err := write(dst); err != nil {
+			return err
+		}
+		return dst.Close()
+	}()
+	for _, w := range pipes {
+		w.CloseWithError(writeErr)
+	}
+
+	// In case an upload failed, writing the archive failed because of it, so
+	// the upload error is the more relevant one.
+	if err := eg.Wait(); err != nil {
+		return errwrap.Wrap(err, "error streaming archive")
+	}
+	if writeErr != nil {
+		return errwrap.Wrap(writeErr, "error writing archive")
+	}
+
+	s.recordUploadStats()
+	_, uploaded := path.Split(s.file)
+	s.stats.BackupFile.Size = counter.n
+	s.stats.BackupFile.Name = uploaded
+	s.stats.BackupFile.FullPath = s.file
+	s.logger.Info(
+		fmt.Sprintf("Streamed backup `%s` of %s to %d storage backend(s).", uploaded, formatBytes(counter.n, false), len(s.storages)),
+	)
+	return nil
+}
+
+// countingWriter counts the bytes written to the underlying writer.
+type countingWriter struct {
+	w io.Writer
+	n uint64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += uint64(n)
+	return n, err
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/offen/docker-volume-backup/internal/storage"
+	"github.com/offen/docker-volume-backup/internal/storage/local"
+)
+
+func TestInitStream(t *testing.T) {
+	newLocal := func() storage.Backend {
+		return local.NewStorageBackend(local.Config{ArchivePath: t.TempDir()}, func(storage.LogLevel, string, string, ...any) {})
+	}
+
+	s := newScript(&Config{BackupStream: true})
+	s.storages = []storage.Backend{newLocal()}
+	if err := s.initStream(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !s.stream {
+		t.Error("Expected archive to be streamed")
+	}
+
+	s = newScript(&Config{BackupStream: true})
+	s.storages = []storage.Backend{newLocal(), &mockBackend{name: "S3", uploads: map[string]int{}}}
+	if err := s.initStream(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if s.stream {
+		t.Error("Expected archive to be written to disk in case a backend does not support streaming")
+	}
+
+	s = newScript(&Config{BackupStream: true, BackupSplitSize: 1024})
+	s.storages = []storage.Backend{newLocal()}
+	if err := s.initStream(); err == nil {
+		t.Error("Expected error for incompatible configuration")
+	}
+}
+
+func TestStreamArchive(t *testing.T) {
+	archive := t.TempDir()
+	s := newScript(&Config{BackupStream: true, GpgPassphrase: "secret"})
+	s.file = filepath.Join(t.TempDir(), "backup.tar.gz")
+	s.storages = []storage.Backend{
+		local.NewStorageBackend(local.Config{ArchivePath: archive}, func(storage.LogLevel, string, string, ...any) {}),
+	}
+	if err := s.initStream(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if err := s.streamArchive(func(w io.Writer) error {
+		_, err := w.Write([]byte("content"))
+		return err
+	}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if s.stats.BackupFile.Name != "backup.tar.gz.gpg" || s.stats.BackupFile.Size == 0 {
+		t.Errorf("Unexpected stats %#v", s.stats.BackupFile)
+	}
+	if _, err := os.Stat(s.file); !os.IsNotExist(err) {
+		t.Errorf("Expected archive to not be written to disk, got %v", err)
+	}
+
+	f, err := os.Open(filepath.Join(archive, "backup.tar.gz.gpg"))
+	if err != nil {
+		t.Fatalf("Expected streamed backup to be stored: %v", err)
+	}
+	defer f.Close()
+	r, err := decryptMessage(f, []byte("secret"))
+	if err != nil {
+		t.Fatalf("Unexpected error decrypting backup: %v", err)
+	}
+	plaintext, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("Unexpected error reading plaintext: %v", err)
+	}
+	if !bytes.Equal(plaintext, []byte("content")) {
+		t.Errorf("Unexpected plaintext %s", plaintext)
+	}
+
+	s.file = filepath.Join(t.TempDir(), "failed.tar.gz")
+	if err := s.streamArchive(func(w io.Writer) error {
+		if _, err := w.Write([]byte("partial")); err != nil {
+			return err
+		}
+		return errors.New("archive failed")
+	}); err == nil {
+		t.Error("Expected error when writing the archive fails")
+	}
+	entries, err := os.ReadDir(archive)
+	if err != nil {
+		t.Fatalf("Unexpected error reading archive: %v", err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("Expected partial backup to be discarded, found %d file(s)", len(entries))
+	}
+}
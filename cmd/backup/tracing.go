@@ -0,0 +1,80 @@
+// Copyright 2024 - offen.software <hioffen@posteo.de>
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"context"
+
+	"github.com/offen/docker-volume-backup/internal/errwrap"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// initTracing sets up exporting spans to the configured OTLP endpoint. In case
+// no endpoint is configured, spans are not recorded at all.
+func (s *script) initTracing() error {
+	if s.c.OtelExporterOtlpEndpoint == "" || s.validating {
+		return nil
+	}
+
+	exporter, err := otlptracehttp.New(
+		context.Background(),
+		otlptracehttp.WithEndpointURL(s.c.OtelExporterOtlpEndpoint),
+	)
+	if err != nil {
+		return errwrap.Wrap(err, "error creating OTLP exporter")
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewWithAttributes(
+			semconv.SchemaURL,
+			semconv.ServiceName(s.c.OtelServiceName),
+			semconv.ServiceVersion(version),
+		)),
+	)
+	s.tracer = provider.Tracer("github.com/offen/docker-volume-backup")
+	s.registerHook(hookLevelPlumbing, func(error) error {
+		if err := provider.Shutdown(context.Background()); err != nil {
+			return errwrap.Wrap(err, "error flushing spans")
+		}
+		return nil
+	})
+	return nil
+}
+
+// withSpan wraps the given function so it runs in a span with the given name.
+// Spans started while the function is running are children of this span.
+func (s *script) withSpan(name string, cb func() error, attrs ...attribute.KeyValue) func() error {
+	return func() error {
+		parent := s.spanCtx
+		ctx, span := s.tracer.Start(parent, name, trace.WithAttributes(attrs...))
+		s.spanCtx = ctx
+		err := cb()
+		s.spanCtx = parent
+		endSpan(span, err)
+		return err
+	}
+}
+
+// startSpan starts a span with the given name as a child of the current span.
+// Callers are expected to call endSpan when done.
+func (s *script) startSpan(name string, attrs ...attribute.KeyValue) trace.Span {
+	_, span := s.tracer.Start(s.spanCtx, name, trace.WithAttributes(attrs...))
+	return span
+}
+
+// endSpan records the given error, if any, and ends the span.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
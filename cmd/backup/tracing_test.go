@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestWithSpan(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	s := newScript(&Config{})
+	s.tracer = sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)).Tracer("test")
+
+	err := s.withSpan("run", func() error {
+		span := s.startSpan("upload")
+		endSpan(span, nil)
+		return s.withSpan("prune", func() error {
+			return errors.New("prune failed")
+		})()
+	})()
+	if err == nil || err.Error() != "prune failed" {
+		t.Fatalf("Expected error of callback to be returned, got %v", err)
+	}
+
+	spans := map[string]sdktrace.ReadOnlySpan{}
+	for _, span := range recorder.Ended() {
+		spans[span.Name()] = span
+	}
+	if len(spans) != 3 {
+		t.Fatalf("Expected 3 spans, got %d", len(spans))
+	}
+	run := spans["run"]
+	for _, name := range []string{"upload", "prune"} {
+		if parent := spans[name].Parent().SpanID(); parent != run.SpanContext().SpanID() {
+			t.Errorf("Expected %s to be a child of run", name)
+		}
+	}
+	if run.Parent().IsValid() {
+		t.Error("Expected run to be a root span")
+	}
+	for name, expected := range map[string]codes.Code{"run": codes.Error, "prune": codes.Error, "upload": codes.Unset} {
+		if code := spans[name].Status().Code; code != expected {
+			t.Errorf("Expected status %v for %s, got %v", expected, name, code)
+		}
+	}
+	if s.spanCtx != context.Background() {
+		t.Error("Expected span context to be restored")
+	}
+}
+
+func TestInitTracing(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v1/traces" {
+			requests.Add(1)
+		}
+	}))
+	defer server.Close()
+
+	s := newScript(&Config{OtelExporterOtlpEndpoint: server.URL + "/v1/traces", OtelServiceName: "docker-volume-backup"})
+	if err := s.initTracing(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := s.withSpan("run", func() error { return nil })(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := s.runHooks(nil); err != nil {
+		t.Fatalf("Unexpected error running hooks: %v", err)
+	}
+	if requests.Load() == 0 {
+		t.Error("Expected spans to be exported when running hooks")
+	}
+
+	s = newScript(&Config{})
+	if err := s.initTracing(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(s.hooks) != 0 {
+		t.Error("Expected no hooks to be registered without an endpoint")
+	}
+}
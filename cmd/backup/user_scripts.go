@@ -0,0 +1,76 @@
+// Copyright 2024 - offen.software <hioffen@posteo.de>
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/offen/docker-volume-backup/internal/errwrap"
+)
+
+// runPreScript runs the executable configured as BACKUP_PRE_SCRIPT before
+// the archive is created. In case it fails, the run is aborted.
+func (s *script) runPreScript() error {
+	if s.c.BackupPreScript == "" {
+		return nil
+	}
+	if err := s.runUserScript(s.ctx, s.c.BackupPreScript, nil); err != nil {
+		return errwrap.Wrap(err, fmt.Sprintf("error running pre-backup script `%s`", s.c.BackupPreScript))
+	}
+	return nil
+}
+
+// initPostScript registers a hook that runs the executable configured as
+// BACKUP_POST_SCRIPT once the run has finished. The location of the archive
+// and the outcome of the run are passed as environment variables. As the
+// backup has already been taken at this point, failures are logged only.
+func (s *script) initPostScript() {
+	if s.c.BackupPostScript == "" || s.task {
+		return
+	}
+	// The hook is registered while initializing the script, so it runs before
+	// the archive is removed by the hooks registered when creating it.
+	s.registerHook(hookLevelPlumbing, func(err error) error {
+		if s.skipped || s.retryPending(err) {
+			return nil
+		}
+		env := []string{fmt.Sprintf("BACKUP_ARCHIVE=%s", s.file), "BACKUP_STATUS=success"}
+		if err != nil {
+			env[1] = "BACKUP_STATUS=failure"
+			env = append(env, fmt.Sprintf("BACKUP_ERROR=%v", errwrap.Unwrap(err)))
+		}
+		// The run's context might have been cancelled already, which must not
+		// keep the script from running.
+		if err := s.runUserScript(context.Background(), s.c.BackupPostScript, env); err != nil {
+			s.logger.Warn(
+				fmt.Sprintf("Error running post-backup script `%s`: %v", s.c.BackupPostScript, err),
+			)
+		}
+		return nil
+	})
+}
+
+// runUserScript runs the given executable using the given additional
+// environment variables and logs its output.
+func (s *script) runUserScript(ctx context.Context, executable string, env []string) error {
+	cmd := exec.CommandContext(ctx, executable)
+	cmd.Env = append(os.Environ(), env...)
+	output, err := cmd.CombinedOutput()
+	for _, line := range strings.Split(strings.TrimSpace(string(output)), "\n") {
+		if line != "" {
+			s.logger.Info(line)
+		}
+	}
+	if err != nil {
+		return errwrap.Wrap(err, "error running executable")
+	}
+	s.logger.Info(
+		fmt.Sprintf("Successfully ran `%s`.", executable),
+	)
+	return nil
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestUserScripts(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		file := filepath.Join(dir, name)
+		if err := os.WriteFile(file, []byte("#!/bin/sh\n"+content), 0755); err != nil {
+			t.Fatalf("Unexpected error writing script: %v", err)
+		}
+		return file
+	}
+	envFile := filepath.Join(dir, "env")
+
+	t.Run("failing pre script", func(t *testing.T) {
+		s := newScript(&Config{BackupPreScript: write("pre.sh", "echo quiescing\nexit 1\n")})
+		s.ctx = context.Background()
+		if err := s.runPreScript(); err == nil {
+			t.Error("Expected error from failing pre script")
+		}
+		if !strings.Contains(s.stats.LogOutput.String(), "quiescing") {
+			t.Errorf("Expected output of script to be logged, got %s", s.stats.LogOutput.String())
+		}
+	})
+
+	t.Run("post script", func(t *testing.T) {
+		s := newScript(&Config{BackupPostScript: write("post.sh", "echo \"$BACKUP_ARCHIVE $BACKUP_STATUS $BACKUP_ERROR\" > "+envFile+"\n")})
+		s.file = "/tmp/backup.tar.gz"
+		s.initPostScript()
+		if err := s.runHooks(errors.New("upload failed")); err != nil {
+			t.Fatalf("Unexpected error running hooks: %v", err)
+		}
+		env, err := os.ReadFile(envFile)
+		if err != nil {
+			t.Fatalf("Unexpected error reading env: %v", err)
+		}
+		if string(env) != "/tmp/backup.tar.gz failure upload failed\n" {
+			t.Errorf("Unexpected environment %q", env)
+		}
+	})
+
+	t.Run("failing post script", func(t *testing.T) {
+		s := newScript(&Config{BackupPostScript: write("post-fail.sh", "exit 1\n")})
+		s.initPostScript()
+		if err := s.runHooks(nil); err != nil {
+			t.Errorf("Expected failing post script to be ignored, got %v", err)
+		}
+		if !strings.Contains(s.stats.LogOutput.String(), "Error running post-backup script") {
+			t.Errorf("Expected warning to be logged, got %s", s.stats.LogOutput.String())
+		}
+	})
+}
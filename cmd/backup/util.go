@@ -37,6 +37,22 @@ func remove(location string) error {
 	return nil
 }
 
+// touch creates the file at the given location in case it does not exist yet
+// and sets its access and modification times to the given value.
+func touch(location string, t time.Time) error {
+	f, err := os.OpenFile(location, os.O_RDONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return errwrap.Wrap(err, fmt.Sprintf("error opening `%s`", location))
+	}
+	if err := f.Close(); err != nil {
+		return errwrap.Wrap(err, fmt.Sprintf("error closing `%s`", location))
+	}
+	if err := os.Chtimes(location, t, t); err != nil {
+		return errwrap.Wrap(err, fmt.Sprintf("error setting times on `%s`", location))
+	}
+	return nil
+}
+
 // buffer takes an io.Writer and returns a wrapped version of the
 // writer that writes to both the original target as well as the returned buffer
 func buffer(w io.Writer) (io.Writer, *bytes.Buffer) {
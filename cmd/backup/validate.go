@@ -0,0 +1,136 @@
+// Copyright 2024 - offen.software <hioffen@posteo.de>
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/offen/docker-volume-backup/internal/errwrap"
+)
+
+// validate checks the configurations available using any of the
+// configuration strategies without running a backup. All problems that are
+// found are logged, attributed to the configuration they have been found in.
+func (c *command) validate() error {
+	var errs []error
+	seen := map[string]bool{}
+	for _, strategy := range []configStrategy{configStrategyEnv, configStrategyConfd} {
+		configurations, err := sourceConfiguration(strategy, c.configFile)
+		if err != nil {
+			c.logger.Error(
+				fmt.Sprintf("Configuration sourced using strategy %s is invalid: %v", strategy, errwrap.Unwrap(err)),
+			)
+			errs = append(errs, errwrap.Wrap(err, fmt.Sprintf("error sourcing configuration using strategy %s", strategy)))
+			continue
+		}
+		for _, config := range configurations {
+			// The confd strategy falls back to the environment in case no
+			// configuration files exist.
+			if seen[config.source] {
+				continue
+			}
+			seen[config.source] = true
+
+			problems := validateConfig(c.ctx, config)
+			for _, problem := range problems {
+				c.logger.Error(
+					fmt.Sprintf("Configuration %s (%s) is invalid: %v", config.source, strategy, errwrap.Unwrap(problem)),
+				)
+			}
+			if len(problems) != 0 {
+				errs = append(errs, errwrap.Wrap(errors.Join(problems...), fmt.Sprintf("invalid configuration %s", config.source)))
+				continue
+			}
+			c.logger.Info(
+				fmt.Sprintf("Configuration %s (%s) is valid.", config.source, strategy),
+			)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// validateConfig returns all problems found in the given configuration. It
+// parses all cron expressions and filenames, and initializes a script using
+// the configuration, so storage backends and notifications are created.
+// Storage backends are not contacted.
+func validateConfig(ctx context.Context, config *Config) []error {
+	var problems []error
+
+	for _, expression := range []struct {
+		name  string
+		value string
+	}{
+		{"BACKUP_CRON_EXPRESSION", config.BackupCronExpression},
+		{"BACKUP_PRUNE_PREVIEW_CRON_EXPRESSION", config.BackupPrunePreviewCronExpression},
+		{"BACKUP_VERIFY_CRON_EXPRESSION", config.BackupVerifyCronExpression},
+		{"GPG_VERIFY_CRON_EXPRESSION", config.GpgVerifyCronExpression},
+		{"NOTIFICATION_HEARTBEAT_CRON_EXPRESSION", config.NotificationHeartbeatCronExpression},
+	} {
+		if expression.value == "" {
+			continue
+		}
+		if _, err := cronParser.Parse(config.cronSpec(expression.value)); err != nil {
+			problems = append(problems, errwrap.Wrap(err, fmt.Sprintf("invalid %s %s", expression.name, expression.value)))
+		}
+	}
+
+	backends := make([]string, 0, len(config.BackupFilenameOverrides))
+	for backend := range config.BackupFilenameOverrides {
+		backends = append(backends, backend)
+	}
+	slices.Sort(backends)
+	type filename struct {
+		name  string
+		value string
+	}
+	filenames := []filename{{"BACKUP_FILENAME", config.BackupFilename}}
+	for _, backend := range backends {
+		filenames = append(filenames, filename{fmt.Sprintf("filename override for %s", backend), config.BackupFilenameOverrides[backend]})
+	}
+	for _, f := range filenames {
+		if _, err := renderBackupFilename(f.value, config.BackupCompression); err != nil {
+			problems = append(problems, errwrap.Wrap(err, fmt.Sprintf("invalid %s", f.name)))
+			continue
+		}
+		if unknown := unknownDirectives(f.value); len(unknown) != 0 {
+			problems = append(problems, errwrap.Wrap(nil, fmt.Sprintf("%s contains unsupported strftime directive(s) %s", f.name, strings.Join(unknown, ", "))))
+		}
+	}
+
+	if err := initForValidation(ctx, config); err != nil {
+		problems = append(problems, err)
+	}
+	return problems
+}
+
+// initForValidation initializes a script using the given configuration and
+// releases all resources acquired right after. Initializing does not have any
+// side effects, i.e. no notifications are sent and no state is persisted.
+func initForValidation(ctx context.Context, config *Config) (err error) {
+	s := newScript(config)
+	s.ctx = ctx
+	s.task = true
+	s.validating = true
+
+	unset, err := s.c.applyEnv()
+	if err != nil {
+		return errwrap.Wrap(err, "error applying env")
+	}
+	defer func() {
+		if derr := unset(); derr != nil {
+			err = errors.Join(err, errwrap.Wrap(derr, "error unsetting environment variables"))
+		}
+	}()
+
+	initErr := s.init()
+	s.hookLevel = hookLevelPlumbing
+	if hookErr := s.runHooks(initErr); hookErr != nil {
+		return errors.Join(initErr, errwrap.Wrap(hookErr, "error releasing resources"))
+	}
+	return initErr
+}
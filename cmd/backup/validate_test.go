@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestValidateConfig(t *testing.T) {
+	archive := t.TempDir()
+	tests := []struct {
+		name     string
+		config   *Config
+		expected []string
+	}{
+		{
+			"valid",
+			&Config{BackupCronExpression: "@daily", BackupFilename: "backup-%Y-%m-%d.{{ .Extension }}", NotificationLevel: "error", BackupArchive: archive},
+			nil,
+		},
+		{
+			"invalid cron expression",
+			&Config{BackupCronExpression: "0 25 * * *", BackupFilename: "backup.tar.gz", NotificationLevel: "error", BackupArchive: archive},
+			[]string{"invalid BACKUP_CRON_EXPRESSION 0 25 * * *"},
+		},
+		{
+			"invalid filenames",
+			&Config{
+				BackupCronExpression:    "@daily",
+				BackupFilename:          "backup-100%.tar.gz",
+				BackupFilenameOverrides: map[string]string{"S3": "{{ .Unknown"},
+				NotificationLevel:       "error",
+				BackupArchive:           archive,
+			},
+			[]string{
+				"BACKUP_FILENAME contains unsupported strftime directive(s) %.",
+				"invalid filename override for S3",
+			},
+		},
+		{
+			"invalid notification level",
+			&Config{BackupCronExpression: "@daily", BackupFilename: "backup.tar.gz", NotificationLevel: "debug", BackupArchive: archive},
+			[]string{"unknown NOTIFICATION_LEVEL debug"},
+		},
+		{
+			"no storage backend",
+			&Config{BackupCronExpression: "@daily", BackupFilename: "backup.tar.gz", NotificationLevel: "error", BackupArchive: filepath.Join(archive, "missing")},
+			[]string{"no storage backend is configured"},
+		},
+		{
+			"compression level not supported",
+			&Config{BackupCronExpression: "@daily", BackupFilename: "backup.tar.gz", NotificationLevel: "error", BackupArchive: archive, BackupCompression: "gz", BackupCompressionLevel: "19"},
+			[]string{"invalid gzip compression level 19"},
+		},
+		{
+			"compression memory limit too low",
+			&Config{BackupCronExpression: "@daily", BackupFilename: "backup.tar.gz", NotificationLevel: "error", BackupArchive: archive, BackupCompression: "zst", BackupCompressionMemoryLimit: 1 << 20},
+			[]string{"BACKUP_COMPRESSION_MEMORY_LIMIT of 1.0 MiB is too low for zst compression"},
+		},
+		{
+			"unknown external symlinks mode",
+			&Config{BackupCronExpression: "@daily", BackupFilename: "backup.tar.gz", NotificationLevel: "error", BackupArchive: archive, BackupExternalSymlinks: "follow"},
+			[]string{"unknown value for BACKUP_EXTERNAL_SYMLINKS: follow"},
+		},
+		{
+			"unknown consistency check mode",
+			&Config{BackupCronExpression: "@daily", BackupFilename: "backup.tar.gz", NotificationLevel: "error", BackupArchive: archive, BackupConsistencyCheck: "abort"},
+			[]string{"unknown value for BACKUP_CONSISTENCY_CHECK: abort"},
+		},
+		{
+			"auto compression without compression",
+			&Config{BackupCronExpression: "@daily", BackupFilename: "backup.tar", NotificationLevel: "error", BackupArchive: archive, BackupCompression: "none", BackupAutoCompression: true},
+			[]string{"BACKUP_AUTO_COMPRESSION cannot be used when BACKUP_COMPRESSION is set to none"},
+		},
+		{
+			"compression level without compression",
+			&Config{BackupCronExpression: "@daily", BackupFilename: "backup.tar", NotificationLevel: "error", BackupArchive: archive, BackupCompression: "none", BackupCompressionLevel: "best", GpgPassphrase: "secret"},
+			[]string{"BACKUP_COMPRESSION_LEVEL cannot be used when no backup is compressed"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			problems := validateConfig(context.Background(), test.config)
+			if len(problems) != len(test.expected) {
+				t.Fatalf("Expected %d problems, got %v", len(test.expected), problems)
+			}
+			for i, expected := range test.expected {
+				if !strings.Contains(problems[i].Error(), expected) {
+					t.Errorf("Expected %q to contain %q", problems[i].Error(), expected)
+				}
+			}
+		})
+	}
+}
+
+func TestValidateConfigSideEffects(t *testing.T) {
+	var requests int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+	}))
+	defer server.Close()
+
+	archive := t.TempDir()
+	stateFile := filepath.Join(t.TempDir(), "state.json")
+	config := &Config{
+		BackupCronExpression:       "@daily",
+		BackupFilename:             "backup.tar.gz",
+		NotificationLevel:          "info",
+		NotificationURLs:           []string{"generic+" + server.URL},
+		NotificationHealthcheckURL: server.URL,
+		MetricsPushgatewayURL:      server.URL,
+		MetricsPushgatewayJob:      "docker-volume-backup",
+		BackupStateFile:            stateFile,
+		BackupArchive:              archive,
+	}
+	if problems := validateConfig(context.Background(), config); len(problems) != 0 {
+		t.Fatalf("Unexpected problems %v", problems)
+	}
+	if _, err := os.Stat(stateFile); !os.IsNotExist(err) {
+		t.Errorf("Expected state file not to be written, got %v", err)
+	}
+	if requests != 0 {
+		t.Errorf("Expected no requests to be sent, got %d", requests)
+	}
+}
@@ -0,0 +1,127 @@
+// Copyright 2024 - offen.software <hioffen@posteo.de>
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	openpgp "github.com/ProtonMail/go-crypto/openpgp/v2"
+	"github.com/offen/docker-volume-backup/internal/errwrap"
+	"github.com/offen/docker-volume-backup/internal/storage"
+	"golang.org/x/sync/errgroup"
+)
+
+// decryptionCheckLength is the number of bytes downloaded for checking
+// whether a backup can be decrypted. It is expected to contain the packets
+// required for decrypting the session key.
+const decryptionCheckLength = 4096
+
+// verifyDecryption checks whether the most recent encrypted backup in each
+// storage backend can be decrypted using the configured passphrase or key
+// management service. Only the beginning of each backup is downloaded.
+func (s *script) verifyDecryption() error {
+	if !s.encrypted() {
+		return errwrap.Wrap(nil, "GPG_PASSPHRASE or GPG_KMS_PROVIDER is required for verifying decryption")
+	}
+
+	eg := errgroup.Group{}
+	for _, backend := range s.storages {
+		b := backend
+		eg.Go(func() error {
+			return s.verifyBackendDecryption(b)
+		})
+	}
+
+	if err := eg.Wait(); err != nil {
+		return errwrap.Wrap(err, "error verifying decryption")
+	}
+	return nil
+}
+
+func (s *script) verifyBackendDecryption(b storage.Backend) error {
+	candidates, err := b.List(s.pruningPrefix(b.Name()))
+	if err != nil {
+		return errwrap.Wrap(err, fmt.Sprintf("error listing backups in %s", b.Name()))
+	}
+
+	latest := latestBackup(candidates, func(name string) bool {
+		return strings.HasSuffix(name, ".gpg")
+	})
+	if latest == nil {
+		s.logger.Warn(
+			fmt.Sprintf("No encrypted backups found in %s, skipping decryption check.", b.Name()),
+		)
+		return nil
+	}
+
+	passphrase, err := s.decryptionPassphrase(b, latest.Name)
+	if err != nil {
+		return errwrap.Wrap(err, fmt.Sprintf("error retrieving passphrase for %s in %s", latest.Name, b.Name()))
+	}
+
+	r, err := b.Open(latest.Name, decryptionCheckLength)
+	if err != nil {
+		return errwrap.Wrap(err, fmt.Sprintf("error opening %s in %s", latest.Name, b.Name()))
+	}
+	defer r.Close()
+
+	if err := checkDecryption(r, passphrase); err != nil {
+		return errwrap.Wrap(err, fmt.Sprintf("unable to decrypt %s in %s", latest.Name, b.Name()))
+	}
+	s.logger.Info(
+		fmt.Sprintf("Successfully verified backup `%s` in %s can be decrypted.", latest.Name, b.Name()),
+	)
+	return nil
+}
+
+// latestBackup returns the most recently modified of the given backups
+// whose name is accepted by the given filter, or nil if there is none.
+func latestBackup(candidates []storage.ObjectInfo, filter func(name string) bool) *storage.ObjectInfo {
+	var latest *storage.ObjectInfo
+	for i, candidate := range candidates {
+		if storage.IsProtectionMarker(candidate.Name) || !filter(candidate.Name) {
+			continue
+		}
+		if latest == nil || candidate.LastModified.After(latest.LastModified) {
+			latest = &candidates[i]
+		}
+	}
+	return latest
+}
+
+// checkDecryption tries to decrypt the session key of the given PGP message
+// and to read the first bytes of the plaintext. It does not require the entire
+// message to be available.
+func checkDecryption(r io.Reader, passphrase []byte) error {
+	plaintext, err := decryptMessage(r, passphrase)
+	if err != nil {
+		return err
+	}
+	if _, err := plaintext.Read(make([]byte, 1)); err != nil && err != io.EOF {
+		return errwrap.Wrap(err, "error reading plaintext")
+	}
+	return nil
+}
+
+// decryptMessage returns a reader for the plaintext of the given symmetrically
+// encrypted PGP message.
+func decryptMessage(r io.Reader, passphrase []byte) (io.Reader, error) {
+	prompted := false
+	prompt := func(keys []openpgp.Key, symmetric bool) ([]byte, error) {
+		if prompted {
+			return nil, errors.New("passphrase was not accepted")
+		}
+		prompted = true
+		return passphrase, nil
+	}
+
+	md, err := openpgp.ReadMessage(r, nil, prompt, nil)
+	if err != nil {
+		return nil, errwrap.Wrap(err, "error reading message")
+	}
+	return md.UnverifiedBody, nil
+}
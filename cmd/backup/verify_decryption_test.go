@@ -0,0 +1,45 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+
+	openpgp "github.com/ProtonMail/go-crypto/openpgp/v2"
+)
+
+func TestCheckDecryption(t *testing.T) {
+	var ciphertext bytes.Buffer
+	w, err := openpgp.SymmetricallyEncrypt(&ciphertext, []byte("correct"), nil, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error encrypting: %v", err)
+	}
+	plaintext := make([]byte, 1<<20)
+	if _, err := rand.Read(plaintext); err != nil {
+		t.Fatalf("Unexpected error generating plaintext: %v", err)
+	}
+	if _, err := w.Write(plaintext); err != nil {
+		t.Fatalf("Unexpected error writing plaintext: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Unexpected error closing writer: %v", err)
+	}
+	head := ciphertext.Bytes()[:decryptionCheckLength]
+
+	tests := []struct {
+		name        string
+		passphrase  string
+		expectError bool
+	}{
+		{"correct passphrase", "correct", false},
+		{"wrong passphrase", "wrong", true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := checkDecryption(bytes.NewReader(head), []byte(test.passphrase))
+			if (err != nil) != test.expectError {
+				t.Errorf("Unexpected error value %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,256 @@
+// Copyright 2024 - offen.software <hioffen@posteo.de>
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/klauspost/pgzip"
+	"github.com/offen/docker-volume-backup/internal/errwrap"
+	"github.com/offen/docker-volume-backup/internal/storage"
+)
+
+// verifyRestore restores the most recent backup in each storage backend to
+// a temporary directory and runs the configured verification command against
+// it. Backends are processed one after another so that only a single backup
+// needs to be stored on disk at any time.
+func (s *script) verifyRestore() error {
+	if s.c.BackupVerifyCommand == "" {
+		return errwrap.Wrap(nil, "BACKUP_VERIFY_COMMAND is required for verifying restores")
+	}
+
+	for _, b := range s.storages {
+		if err := s.verifyBackendRestore(b); err != nil {
+			return errwrap.Wrap(err, "error verifying restore")
+		}
+	}
+	return nil
+}
+
+func (s *script) verifyBackendRestore(b storage.Backend) error {
+	candidates, err := b.List(s.pruningPrefix(b.Name()))
+	if err != nil {
+		return errwrap.Wrap(err, fmt.Sprintf("error listing backups in %s", b.Name()))
+	}
+
+	latest := latestBackup(candidates, func(name string) bool {
+		return archiveCompression(strings.TrimSuffix(name, ".gpg")) != ""
+	})
+	if latest == nil {
+		s.logger.Warn(
+			fmt.Sprintf("No backups found in %s, skipping restore verification.", b.Name()),
+		)
+		return nil
+	}
+
+	target, err := os.MkdirTemp("", "verify-restore-*")
+	if err != nil {
+		return errwrap.Wrap(err, "error creating temporary directory")
+	}
+	defer func() {
+		if err := remove(target); err != nil {
+			s.logger.Warn(
+				fmt.Sprintf("Failed to remove temporary directory `%s`: %v", target, err),
+			)
+		}
+	}()
+
+	if err := s.restoreBackup(b, latest.Name, target); err != nil {
+		return errwrap.Wrap(err, fmt.Sprintf("error restoring %s from %s", latest.Name, b.Name()))
+	}
+	s.logger.Info(
+		fmt.Sprintf("Restored backup `%s` from %s to `%s`, running verification command.", latest.Name, b.Name(), target),
+	)
+
+	// The restored path is appended to the arguments of the command.
+	cmd := exec.Command("/bin/sh", "-c", fmt.Sprintf(`%s "$@"`, s.c.BackupVerifyCommand), "sh", target)
+	output, err := cmd.CombinedOutput()
+	if len(output) != 0 {
+		s.logger.Info(string(output))
+	}
+	if err != nil {
+		return errwrap.Wrap(err, fmt.Sprintf("backup %s in %s could not be verified", latest.Name, b.Name()))
+	}
+
+	s.logger.Info(
+		fmt.Sprintf("Successfully verified backup `%s` in %s.", latest.Name, b.Name()),
+	)
+	return nil
+}
+
+// restoreBackup downloads the backup with the given name from the given
+// backend and extracts it into target, decrypting it if required.
+func (s *script) restoreBackup(b storage.Backend, name, target string) error {
+	var passphrase []byte
+	if strings.HasSuffix(name, ".gpg") {
+		var err error
+		passphrase, err = s.decryptionPassphrase(b, name)
+		if err != nil {
+			return errwrap.Wrap(err, "error retrieving passphrase")
+		}
+	}
+
+	rc, err := b.Open(name, 0)
+	if err != nil {
+		return errwrap.Wrap(err, "error opening backup")
+	}
+	defer rc.Close()
+
+	var r io.Reader = rc
+	if passphrase != nil {
+		r, err = decryptMessage(rc, passphrase)
+		if err != nil {
+			return errwrap.Wrap(err, "error decrypting backup")
+		}
+		name = strings.TrimSuffix(name, ".gpg")
+	}
+
+	return restoreArchive(r, archiveCompression(name), target)
+}
+
+// archiveCompression returns the compression of the archive with the given
+// name, judging from its extension. In case the name does not look like an
+// archive, an empty string is returned.
+func archiveCompression(name string) string {
+	switch {
+	case strings.HasSuffix(name, ".tar.gz"):
+		return "gz"
+	case strings.HasSuffix(name, ".tar.zst"):
+		return "zst"
+	case strings.HasSuffix(name, ".tar.xz"):
+		return "xz"
+	case strings.HasSuffix(name, ".tar"):
+		return "none"
+	default:
+		return ""
+	}
+}
+
+// restoreArchive extracts the tar archive read from r into target. Entries
+// resolving to a location outside of target or to a location below a symlink
+// cause an error.
+func restoreArchive(r io.Reader, compression string, target string) error {
+	switch compression {
+	case "gz":
+		gz, err := pgzip.NewReader(r)
+		if err != nil {
+			return errwrap.Wrap(err, "error creating gzip reader")
+		}
+		defer gz.Close()
+		r = gz
+	case "zst":
+		zr, err := zstd.NewReader(r)
+		if err != nil {
+			return errwrap.Wrap(err, "error creating zstd reader")
+		}
+		defer zr.Close()
+		r = zr
+	case "xz":
+		xr, err := newXZReader(r)
+		if err != nil {
+			return errwrap.Wrap(err, "error creating xz reader")
+		}
+		defer xr.Close()
+		r = xr
+	}
+
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return errwrap.Wrap(err, "error reading archive")
+		}
+
+		location := filepath.Join(target, header.Name)
+		if !strings.HasPrefix(location, filepath.Clean(target)+string(os.PathSeparator)) {
+			return fmt.Errorf("archive entry %s points outside of the target directory", header.Name)
+		}
+		if err := checkNoSymlinks(target, location); err != nil {
+			return errwrap.Wrap(err, fmt.Sprintf("error restoring archive entry %s", header.Name))
+		}
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(location, header.FileInfo().Mode().Perm()|0700); err != nil {
+				return errwrap.Wrap(err, fmt.Sprintf("error creating directory %s", location))
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(location), 0755); err != nil {
+				return errwrap.Wrap(err, fmt.Sprintf("error creating directory for %s", location))
+			}
+			if err := writeRestoredFile(location, header.FileInfo().Mode().Perm(), tr); err != nil {
+				return errwrap.Wrap(err, fmt.Sprintf("error writing %s", location))
+			}
+		case tar.TypeSymlink:
+			if err := os.MkdirAll(filepath.Dir(location), 0755); err != nil {
+				return errwrap.Wrap(err, fmt.Sprintf("error creating directory for %s", location))
+			}
+			if err := os.Symlink(header.Linkname, location); err != nil {
+				return errwrap.Wrap(err, fmt.Sprintf("error creating symlink %s", location))
+			}
+		case tar.TypeLink:
+			linkTarget := filepath.Join(target, header.Linkname)
+			if !strings.HasPrefix(linkTarget, filepath.Clean(target)+string(os.PathSeparator)) {
+				return fmt.Errorf("hard link %s points outside of the target directory", header.Name)
+			}
+			if err := checkNoSymlinks(target, linkTarget); err != nil {
+				return errwrap.Wrap(err, fmt.Sprintf("error restoring hard link %s", header.Name))
+			}
+			if err := os.MkdirAll(filepath.Dir(location), 0755); err != nil {
+				return errwrap.Wrap(err, fmt.Sprintf("error creating directory for %s", location))
+			}
+			if err := os.Link(linkTarget, location); err != nil {
+				return errwrap.Wrap(err, fmt.Sprintf("error creating hard link %s", location))
+			}
+		}
+	}
+}
+
+// checkNoSymlinks returns an error in case the given location within target
+// or any of its parent directories below target is a symlink. Symlinks are
+// restored as they are, so writing through them could modify files outside
+// of target.
+func checkNoSymlinks(target, location string) error {
+	rel, err := filepath.Rel(target, location)
+	if err != nil {
+		return errwrap.Wrap(err, "error resolving location")
+	}
+	current := target
+	for _, elem := range strings.Split(rel, string(os.PathSeparator)) {
+		current = filepath.Join(current, elem)
+		info, err := os.Lstat(current)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return errwrap.Wrap(err, fmt.Sprintf("error getting file info for %s", current))
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("refusing to write through symlink %s", current)
+		}
+	}
+	return nil
+}
+
+func writeRestoredFile(location string, mode os.FileMode, r io.Reader) error {
+	f, err := os.OpenFile(location, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+func TestRestoreArchive(t *testing.T) {
+	for _, compression := range []string{"gz", "zst", "xz", "none"} {
+		t.Run(compression, func(t *testing.T) {
+			if compression == "xz" {
+				if _, err := exec.LookPath(xzCommand); err != nil {
+					t.Skip("xz is not available")
+				}
+			}
+			root := t.TempDir()
+			source := filepath.Join(root, "backup")
+			if err := os.MkdirAll(filepath.Join(source, "data"), 0755); err != nil {
+				t.Fatalf("Unexpected error creating directory: %v", err)
+			}
+			file := filepath.Join(source, "data", "file.txt")
+			if err := os.WriteFile(file, []byte("content"), 0644); err != nil {
+				t.Fatalf("Unexpected error writing file: %v", err)
+			}
+
+			archive := filepath.Join(root, "backup.tar")
+			files := []string{source, filepath.Join(source, "data"), file}
+			if _, err := createArchive(files, source, archive, compression, 1, "", nil, nil, 1<<16, nil); err != nil {
+				t.Fatalf("Unexpected error creating archive: %v", err)
+			}
+
+			f, err := os.Open(archive)
+			if err != nil {
+				t.Fatalf("Unexpected error opening archive: %v", err)
+			}
+			defer f.Close()
+
+			target := t.TempDir()
+			if err := restoreArchive(f, compression, target); err != nil {
+				t.Fatalf("Unexpected error restoring archive: %v", err)
+			}
+			content, err := os.ReadFile(filepath.Join(target, "backup", "data", "file.txt"))
+			if err != nil {
+				t.Fatalf("Expected file to be restored, got error %v", err)
+			}
+			if string(content) != "content" {
+				t.Errorf("Unexpected file content %s", content)
+			}
+		})
+	}
+}
+
+func TestRestoreArchiveOutsideTarget(t *testing.T) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	if err := tw.WriteHeader(&tar.Header{Name: "../escape.txt", Mode: 0644, Size: 1, Typeflag: tar.TypeReg}); err != nil {
+		t.Fatalf("Unexpected error writing header: %v", err)
+	}
+	if _, err := tw.Write([]byte("x")); err != nil {
+		t.Fatalf("Unexpected error writing content: %v", err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("Unexpected error closing writer: %v", err)
+	}
+
+	if err := restoreArchive(&buf, "none", t.TempDir()); err == nil {
+		t.Error("Expected an error for an entry outside of the target directory")
+	}
+}
+
+func TestArchiveCompression(t *testing.T) {
+	tests := map[string]string{
+		"backup.tar.gz":  "gz",
+		"backup.tar.zst": "zst",
+		"backup.tar.xz":  "xz",
+		"backup.tar":     "none",
+		"latest":         "",
+		"backup.txt":     "",
+	}
+	for name, expected := range tests {
+		if result := archiveCompression(name); result != expected {
+			t.Errorf("Expected %q for %s, got %q", expected, name, result)
+		}
+	}
+}
+
+func TestRestoreArchiveThroughSymlink(t *testing.T) {
+	outside := t.TempDir()
+	for name, headers := range map[string][]*tar.Header{
+		"file below symlink": {
+			{Name: "link", Linkname: outside, Typeflag: tar.TypeSymlink},
+			{Name: "link/escape.txt", Mode: 0644, Size: 1, Typeflag: tar.TypeReg},
+		},
+		"file replacing symlink": {
+			{Name: "link", Linkname: filepath.Join(outside, "escape.txt"), Typeflag: tar.TypeSymlink},
+			{Name: "link", Mode: 0644, Size: 1, Typeflag: tar.TypeReg},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			var buf bytes.Buffer
+			tw := tar.NewWriter(&buf)
+			for _, header := range headers {
+				if err := tw.WriteHeader(header); err != nil {
+					t.Fatalf("Unexpected error writing header: %v", err)
+				}
+				if header.Size > 0 {
+					if _, err := tw.Write([]byte("x")); err != nil {
+						t.Fatalf("Unexpected error writing content: %v", err)
+					}
+				}
+			}
+			if err := tw.Close(); err != nil {
+				t.Fatalf("Unexpected error closing writer: %v", err)
+			}
+
+			if err := restoreArchive(&buf, "none", t.TempDir()); err == nil {
+				t.Error("Expected an error for an entry written through a symlink")
+			}
+			if _, err := os.Stat(filepath.Join(outside, "escape.txt")); err == nil {
+				t.Error("Expected no file to be written outside of the target directory")
+			}
+		})
+	}
+}
@@ -0,0 +1,75 @@
+// Copyright 2024 - offen.software <hioffen@posteo.de>
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/offen/docker-volume-backup/internal/errwrap"
+	"github.com/offen/docker-volume-backup/internal/storage"
+)
+
+// verifyUpload compares the MD5 checksum of the file with the given name in
+// the given backend against the checksum of the given local file. Backends
+// that can report the checksum of a stored file are asked for it, all other
+// files are downloaded again.
+func (s *script) verifyUpload(b storage.Backend, file, name string) error {
+	expected, err := md5File(file)
+	if err != nil {
+		return errwrap.Wrap(err, "error computing checksum of backup file")
+	}
+	return s.verifyChecksum(b, expected, name)
+}
+
+// verifyChecksum compares the MD5 checksum of the file with the given name in
+// the given backend against the expected checksum.
+func (s *script) verifyChecksum(b storage.Backend, expected []byte, name string) error {
+	var actual []byte
+	if reporter, ok := b.(storage.ChecksumReporter); ok {
+		var err error
+		actual, err = reporter.MD5(name)
+		if err != nil && !errors.Is(err, storage.ErrChecksumUnavailable) {
+			return errwrap.Wrap(err, fmt.Sprintf("error looking up checksum of `%s` in backend `%s`", name, b.Name()))
+		}
+	}
+	if actual == nil {
+		rc, err := b.Open(name, 0)
+		if err != nil {
+			return errwrap.Wrap(err, fmt.Sprintf("error downloading `%s` from backend `%s`", name, b.Name()))
+		}
+		defer rc.Close()
+		h := md5.New()
+		if _, err := io.Copy(h, rc); err != nil {
+			return errwrap.Wrap(err, fmt.Sprintf("error downloading `%s` from backend `%s`", name, b.Name()))
+		}
+		actual = h.Sum(nil)
+	}
+
+	if !bytes.Equal(expected, actual) {
+		return errwrap.Wrap(
+			nil,
+			fmt.Sprintf("checksum of uploaded file in backend `%s` does not match, expected %x, got %x", b.Name(), expected, actual),
+		)
+	}
+	return nil
+}
+
+// md5File returns the MD5 checksum of the file at the given location.
+func md5File(file string) ([]byte, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, errwrap.Wrap(err, "error opening file")
+	}
+	defer f.Close()
+	h := md5.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return nil, errwrap.Wrap(err, "error reading file")
+	}
+	return h.Sum(nil), nil
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"crypto/md5"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/offen/docker-volume-backup/internal/storage"
+	"github.com/offen/docker-volume-backup/internal/storage/local"
+)
+
+type checksumBackend struct {
+	storage.Backend
+	sum []byte
+}
+
+func (c *checksumBackend) MD5(string) ([]byte, error) {
+	if c.sum == nil {
+		return nil, storage.ErrChecksumUnavailable
+	}
+	return c.sum, nil
+}
+
+func TestVerifyUpload(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "backup.tar.gz")
+	if err := os.WriteFile(file, []byte("content"), 0644); err != nil {
+		t.Fatalf("Unexpected error writing file: %v", err)
+	}
+	sum := md5.Sum([]byte("content"))
+	otherSum := md5.Sum([]byte("other"))
+
+	tests := []struct {
+		name        string
+		remote      string
+		sum         []byte
+		expectError bool
+	}{
+		{"intact upload", "content", nil, false},
+		{"truncated upload", "cont", nil, true},
+		{"reported checksum", "cont", sum[:], false},
+		{"reported checksum mismatch", "content", otherSum[:], true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			archive := t.TempDir()
+			if err := os.WriteFile(filepath.Join(archive, "backup.tar.gz"), []byte(test.remote), 0644); err != nil {
+				t.Fatalf("Unexpected error writing file: %v", err)
+			}
+			b := &checksumBackend{
+				Backend: local.NewStorageBackend(local.Config{ArchivePath: archive}, func(storage.LogLevel, string, string, ...any) {}),
+				sum:     test.sum,
+			}
+			s := newScript(&Config{BackupVerifyUpload: true})
+			err := s.verifyUpload(b, file, "backup.tar.gz")
+			if (err != nil) != test.expectError {
+				t.Errorf("Unexpected error value %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,104 @@
+// Copyright 2024 - offen.software <hioffen@posteo.de>
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/docker/docker/api/types/mount"
+	"github.com/offen/docker-volume-backup/internal/errwrap"
+)
+
+// volumeMetadataFile is the name of the file containing volume metadata. It
+// is stored at the root of the archive.
+const volumeMetadataFile = "docker-volume-backup.volumes.json"
+
+// VolumeMetadata contains the information required for recreating a volume
+// that has been backed up.
+type VolumeMetadata struct {
+	Name        string
+	Destination string
+	Driver      string
+	Options     map[string]string
+	Labels      map[string]string
+}
+
+// writeVolumeMetadata inspects all volumes that are mounted into the backup
+// container below the given backup path and writes their metadata to a file
+// which is expected to be added to the archive. It returns the location
+// of the file, or an empty string in case no metadata is collected.
+func (s *script) writeVolumeMetadata(backupPath string) (string, error) {
+	if !s.c.BackupVolumeMetadata {
+		return "", nil
+	}
+	if s.cli == nil {
+		s.logger.Warn("BACKUP_VOLUME_METADATA is set, but no Docker client is available. Skipping collection of volume metadata.")
+		return "", nil
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		return "", errwrap.Wrap(err, "error getting hostname")
+	}
+	container, err := s.cli.ContainerInspect(context.Background(), hostname)
+	if err != nil {
+		s.logger.Warn(
+			fmt.Sprintf("Unable to inspect own container using hostname `%s`, skipping collection of volume metadata: %v", hostname, err),
+		)
+		return "", nil
+	}
+
+	metadata := []VolumeMetadata{}
+	for _, m := range container.Mounts {
+		if m.Type != mount.TypeVolume {
+			continue
+		}
+		rel, err := filepath.Rel(backupPath, m.Destination)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+			continue
+		}
+		volume, err := s.cli.VolumeInspect(context.Background(), m.Name)
+		if err != nil {
+			return "", errwrap.Wrap(err, fmt.Sprintf("error inspecting volume %s", m.Name))
+		}
+		metadata = append(metadata, VolumeMetadata{
+			Name:        volume.Name,
+			Destination: m.Destination,
+			Driver:      volume.Driver,
+			Options:     volume.Options,
+			Labels:      volume.Labels,
+		})
+	}
+
+	b, err := json.MarshalIndent(metadata, "", "  ")
+	if err != nil {
+		return "", errwrap.Wrap(err, "error marshaling volume metadata")
+	}
+
+	// Files located next to the archive are stored at the root of the archive.
+	location := path.Join(path.Dir(s.file), volumeMetadataFile)
+	if err := os.MkdirAll(path.Dir(location), 0755); err != nil {
+		return "", errwrap.Wrap(err, "error creating directory for volume metadata")
+	}
+	if err := os.WriteFile(location, b, 0644); err != nil {
+		return "", errwrap.Wrap(err, "error writing volume metadata")
+	}
+	s.registerHook(hookLevelPlumbing, func(error) error {
+		if err := remove(location); err != nil {
+			return errwrap.Wrap(err, "error removing volume metadata")
+		}
+		return nil
+	})
+
+	s.logger.Info(
+		fmt.Sprintf("Collected metadata of %d volume(s).", len(metadata)),
+	)
+	return location, nil
+}
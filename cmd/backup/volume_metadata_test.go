@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/mount"
+	"github.com/docker/docker/api/types/volume"
+	"github.com/docker/docker/client"
+)
+
+func TestWriteVolumeMetadata(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/json") && strings.Contains(r.URL.Path, "/containers/"):
+			json.NewEncoder(w).Encode(types.ContainerJSON{
+				Mounts: []types.MountPoint{
+					{Type: mount.TypeVolume, Name: "data", Destination: "/backup/data"},
+					{Type: mount.TypeVolume, Name: "other", Destination: "/other"},
+					{Type: mount.TypeBind, Source: "/srv", Destination: "/backup/srv"},
+				},
+			})
+		case strings.HasSuffix(r.URL.Path, "/volumes/data"):
+			json.NewEncoder(w).Encode(volume.Volume{
+				Name:    "data",
+				Driver:  "local",
+				Options: map[string]string{"type": "tmpfs"},
+				Labels:  map[string]string{"app": "db"},
+			})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	cli, err := client.NewClientWithOpts(client.WithHost("tcp://"+server.Listener.Addr().String()), client.WithVersion("1.43"))
+	if err != nil {
+		t.Fatalf("Unexpected error creating client: %v", err)
+	}
+
+	s := newScript(&Config{BackupVolumeMetadata: true})
+	s.cli = cli
+	s.file = filepath.Join(t.TempDir(), "backup.tar.gz")
+	location, err := s.writeVolumeMetadata("/backup")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if location != filepath.Join(filepath.Dir(s.file), volumeMetadataFile) {
+		t.Errorf("Unexpected location %s", location)
+	}
+
+	b, err := os.ReadFile(location)
+	if err != nil {
+		t.Fatalf("Unexpected error reading metadata: %v", err)
+	}
+	var metadata []VolumeMetadata
+	if err := json.Unmarshal(b, &metadata); err != nil {
+		t.Fatalf("Unexpected error decoding metadata: %v", err)
+	}
+	expected := []VolumeMetadata{{
+		Name:        "data",
+		Destination: "/backup/data",
+		Driver:      "local",
+		Options:     map[string]string{"type": "tmpfs"},
+		Labels:      map[string]string{"app": "db"},
+	}}
+	if !reflect.DeepEqual(metadata, expected) {
+		t.Errorf("Expected metadata %v, got %v", expected, metadata)
+	}
+
+	if err := s.runHooks(nil); err != nil {
+		t.Fatalf("Unexpected error running hooks: %v", err)
+	}
+	if _, err := os.Stat(location); !os.IsNotExist(err) {
+		t.Errorf("Expected metadata file to be removed, got %v", err)
+	}
+}
+
+func TestWriteVolumeMetadataSkipped(t *testing.T) {
+	tests := []struct {
+		name   string
+		config *Config
+		logged string
+	}{
+		{"disabled", &Config{}, ""},
+		{"no docker client", &Config{BackupVolumeMetadata: true}, "no Docker client is available"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := newScript(test.config)
+			location, err := s.writeVolumeMetadata("/backup")
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if location != "" {
+				t.Errorf("Expected no metadata to be written, got %s", location)
+			}
+			if !strings.Contains(s.stats.LogOutput.String(), test.logged) {
+				t.Errorf("Expected %q to be logged, got %s", test.logged, s.stats.LogOutput.String())
+			}
+		})
+	}
+}
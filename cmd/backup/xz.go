@@ -0,0 +1,126 @@
+// Copyright 2024 - offen.software <hioffen@posteo.de>
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os/exec"
+	"strconv"
+
+	"github.com/offen/docker-volume-backup/internal/errwrap"
+)
+
+// xz compression is performed by piping data through the xz binary, which
+// is installed in the image.
+const xzCommand = "xz"
+
+// xzWriter compresses all data written to it using xz, writing the result
+// to the underlying writer.
+type xzWriter struct {
+	cmd   *exec.Cmd
+	stdin io.WriteCloser
+}
+
+func newXZWriter(w io.Writer, concurrency int, level CompressionLevel) (*xzWriter, error) {
+	preset, err := xzCompressionPreset(level)
+	if err != nil {
+		return nil, err
+	}
+	cmd := exec.Command(xzCommand, "--compress", "--stdout", preset, fmt.Sprintf("--threads=%d", concurrency))
+	cmd.Stdout = w
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, errwrap.Wrap(err, "error creating stdin pipe")
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, errwrap.Wrap(err, "error starting xz")
+	}
+	return &xzWriter{cmd: cmd, stdin: stdin}, nil
+}
+
+func (x *xzWriter) Write(p []byte) (int, error) {
+	return x.stdin.Write(p)
+}
+
+// Close signals the end of the input and waits for xz to write all
+// remaining data.
+func (x *xzWriter) Close() error {
+	if err := x.stdin.Close(); err != nil {
+		return errwrap.Wrap(err, "error closing stdin pipe")
+	}
+	if err := x.cmd.Wait(); err != nil {
+		return errwrap.Wrap(err, "error running xz")
+	}
+	return nil
+}
+
+// xzReader decompresses data read from the underlying reader using xz.
+type xzReader struct {
+	cmd    *exec.Cmd
+	stdout io.ReadCloser
+	cancel context.CancelFunc
+	eof    bool
+}
+
+func newXZReader(r io.Reader) (*xzReader, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cmd := exec.CommandContext(ctx, xzCommand, "--decompress", "--stdout")
+	cmd.Stdin = r
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		cancel()
+		return nil, errwrap.Wrap(err, "error creating stdout pipe")
+	}
+	if err := cmd.Start(); err != nil {
+		cancel()
+		return nil, errwrap.Wrap(err, "error starting xz")
+	}
+	return &xzReader{cmd: cmd, stdout: stdout, cancel: cancel}, nil
+}
+
+func (x *xzReader) Read(p []byte) (int, error) {
+	n, err := x.stdout.Read(p)
+	if err == io.EOF {
+		x.eof = true
+	}
+	return n, err
+}
+
+// Close waits for xz to exit. Readers that are closed before reaching the end
+// of the data cause xz to be killed instead of decompressing the remaining
+// data, which is not considered an error.
+func (x *xzReader) Close() error {
+	defer x.cancel()
+	if !x.eof {
+		x.cancel()
+		x.cmd.Wait()
+		return nil
+	}
+	if err := x.cmd.Wait(); err != nil {
+		return errwrap.Wrap(err, "error running xz")
+	}
+	return nil
+}
+
+// xzCompressionPreset maps the given level to an xz preset flag. Numeric
+// levels need to be between 1 and 9.
+func xzCompressionPreset(level CompressionLevel) (string, error) {
+	switch level {
+	case "", "default":
+		return "-6", nil
+	case "fastest":
+		return "-1", nil
+	case "better":
+		return "-8", nil
+	case "best":
+		return "-9e", nil
+	}
+	l, err := strconv.Atoi(level.String())
+	if err != nil || l < 1 || l > 9 {
+		return "", errwrap.Wrap(nil, fmt.Sprintf("invalid xz compression level %s, expected a number between 1 and 9", level))
+	}
+	return fmt.Sprintf("-%d", l), nil
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os/exec"
+	"testing"
+	"time"
+)
+
+func TestXZReaderClose(t *testing.T) {
+	if _, err := exec.LookPath(xzCommand); err != nil {
+		t.Skip("xz is not available")
+	}
+
+	data := bytes.Repeat([]byte("docker-volume-backup"), 1<<20)
+	compressed := &bytes.Buffer{}
+	w, err := newXZWriter(compressed, 1, "fastest")
+	if err != nil {
+		t.Fatalf("Unexpected error creating writer: %v", err)
+	}
+	if _, err := w.Write(data); err != nil {
+		t.Fatalf("Unexpected error writing data: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Unexpected error closing writer: %v", err)
+	}
+
+	t.Run("read to end", func(t *testing.T) {
+		r, err := newXZReader(bytes.NewReader(compressed.Bytes()))
+		if err != nil {
+			t.Fatalf("Unexpected error creating reader: %v", err)
+		}
+		result, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatalf("Unexpected error reading data: %v", err)
+		}
+		if !bytes.Equal(result, data) {
+			t.Errorf("Expected %d decompressed bytes, got %d", len(data), len(result))
+		}
+		if err := r.Close(); err != nil {
+			t.Errorf("Unexpected error closing reader: %v", err)
+		}
+	})
+
+	t.Run("closed early", func(t *testing.T) {
+		r, err := newXZReader(bytes.NewReader(compressed.Bytes()))
+		if err != nil {
+			t.Fatalf("Unexpected error creating reader: %v", err)
+		}
+		if _, err := io.ReadFull(r, make([]byte, 1024)); err != nil {
+			t.Fatalf("Unexpected error reading data: %v", err)
+		}
+
+		done := make(chan error)
+		go func() { done <- r.Close() }()
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Errorf("Unexpected error closing reader: %v", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Expected closing the reader not to decompress the remaining data")
+		}
+	})
+
+	t.Run("invalid data", func(t *testing.T) {
+		r, err := newXZReader(bytes.NewReader([]byte("not xz")))
+		if err != nil {
+			t.Fatalf("Unexpected error creating reader: %v", err)
+		}
+		io.Copy(io.Discard, r)
+		if err := r.Close(); err == nil {
+			t.Error("Expected an error closing the reader")
+		}
+	})
+}
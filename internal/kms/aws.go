@@ -0,0 +1,205 @@
+// Copyright 2024 - offen.software <hioffen@posteo.de>
+// SPDX-License-Identifier: MPL-2.0
+
+package kms
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/offen/docker-volume-backup/internal/errwrap"
+)
+
+const providerAWS = "aws"
+
+// awsKeyWrapper wraps keys using the Encrypt and Decrypt operations of AWS
+// KMS. Requests are sent to the JSON API directly and signed using
+// Signature Version 4.
+type awsKeyWrapper struct {
+	client   *http.Client
+	creds    *credentials.Credentials
+	endpoint string
+	region   string
+	keyID    string
+}
+
+func newAWSKeyWrapper(opts Config, client *http.Client) (KeyWrapper, error) {
+	if opts.Region == "" {
+		return nil, errwrap.Wrap(nil, "a region is required when using AWS KMS")
+	}
+	var creds *credentials.Credentials
+	if opts.AccessKeyID != "" && opts.SecretAccessKey != "" {
+		creds = credentials.NewStaticV4(opts.AccessKeyID, opts.SecretAccessKey, "")
+	} else {
+		// An empty endpoint makes the provider fall back to the environment
+		// and the default instance metadata endpoints.
+		creds = credentials.NewIAM(opts.IamRoleEndpoint)
+	}
+	endpoint := opts.Endpoint
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://kms.%s.amazonaws.com/", opts.Region)
+	}
+	return &awsKeyWrapper{
+		client:   client,
+		creds:    creds,
+		endpoint: endpoint,
+		region:   opts.Region,
+		keyID:    opts.KeyID,
+	}, nil
+}
+
+// Wrap encrypts the given key using the configured KMS key.
+func (w *awsKeyWrapper) Wrap(ctx context.Context, key []byte) (*Envelope, error) {
+	var result struct {
+		CiphertextBlob []byte
+		KeyId          string
+	}
+	if err := w.do(ctx, "Encrypt", map[string]any{
+		"KeyId":     w.keyID,
+		"Plaintext": key,
+	}, &result); err != nil {
+		return nil, errwrap.Wrap(err, "error wrapping data key")
+	}
+	return &Envelope{
+		Provider:   providerAWS,
+		KeyID:      result.KeyId,
+		WrappedKey: result.CiphertextBlob,
+	}, nil
+}
+
+// Unwrap decrypts the key contained in the given envelope.
+func (w *awsKeyWrapper) Unwrap(ctx context.Context, envelope *Envelope) ([]byte, error) {
+	if envelope.Provider != providerAWS {
+		return nil, errwrap.Wrap(nil, fmt.Sprintf("data key has been wrapped using %s, not %s", envelope.Provider, providerAWS))
+	}
+	var result struct {
+		Plaintext []byte
+	}
+	if err := w.do(ctx, "Decrypt", map[string]any{
+		"KeyId":          envelope.KeyID,
+		"CiphertextBlob": envelope.WrappedKey,
+	}, &result); err != nil {
+		return nil, errwrap.Wrap(err, "error unwrapping data key")
+	}
+	return result.Plaintext, nil
+}
+
+func (w *awsKeyWrapper) do(ctx context.Context, operation string, payload, result any) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return errwrap.Wrap(err, "error marshaling request")
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return errwrap.Wrap(err, "error creating request")
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "TrentService."+operation)
+
+	creds, err := w.creds.Get()
+	if err != nil {
+		return errwrap.Wrap(err, "error retrieving credentials")
+	}
+	signRequest(req, body, creds, w.region, "kms", time.Now().UTC())
+
+	res, err := w.client.Do(req)
+	if err != nil {
+		return errwrap.Wrap(err, fmt.Sprintf("error calling %s", operation))
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		b, _ := io.ReadAll(io.LimitReader(res.Body, 1<<16))
+		var apiErr struct {
+			Type    string `json:"__type"`
+			Message string `json:"message"`
+		}
+		if err := json.Unmarshal(b, &apiErr); err == nil && apiErr.Type != "" {
+			return errwrap.Wrap(nil, fmt.Sprintf("%s failed with %s: %s", operation, apiErr.Type, apiErr.Message))
+		}
+		return errwrap.Wrap(nil, fmt.Sprintf("%s failed with status %d: %s", operation, res.StatusCode, strings.TrimSpace(string(b))))
+	}
+	if err := json.NewDecoder(res.Body).Decode(result); err != nil {
+		return errwrap.Wrap(err, "error decoding response")
+	}
+	return nil
+}
+
+// signRequest adds a Signature Version 4 Authorization header for the given
+// service to the given request.
+func signRequest(req *http.Request, body []byte, creds credentials.Value, region, service string, t time.Time) {
+	amzDate := t.Format("20060102T150405Z")
+	date := t.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+	if creds.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.SessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(req.Header.Get(name))
+	}
+	var names []string
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&canonicalHeaders, "%s:%s\n", name, headers[name])
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		path,
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		hexSHA256(body),
+	}, "\n")
+
+	scope := fmt.Sprintf("%s/%s/%s/aws4_request", date, region, service)
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		hexSHA256([]byte(canonicalRequest)),
+	}, "\n")
+
+	key := []byte("AWS4" + creds.SecretAccessKey)
+	for _, part := range []string{date, region, service, "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		creds.AccessKeyID, scope, signedHeaders, signature,
+	))
+}
+
+func hexSHA256(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
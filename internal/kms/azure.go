@@ -0,0 +1,132 @@
+// Copyright 2024 - offen.software <hioffen@posteo.de>
+// SPDX-License-Identifier: MPL-2.0
+
+package kms
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+	"github.com/offen/docker-volume-backup/internal/errwrap"
+)
+
+const (
+	providerAzure = "azure"
+
+	keyVaultAPIVersion = "7.4"
+	keyVaultScope      = "https://vault.azure.net/.default"
+	keyVaultAlgorithm  = "RSA-OAEP-256"
+)
+
+// azureKeyWrapper wraps keys using the wrapkey and unwrapkey operations of
+// an Azure Key Vault key.
+type azureKeyWrapper struct {
+	client *http.Client
+	cred   azcore.TokenCredential
+	keyURL string
+}
+
+func newAzureKeyWrapper(opts Config, client *http.Client) (KeyWrapper, error) {
+	cred, err := azidentity.NewDefaultAzureCredential(nil)
+	if err != nil {
+		return nil, errwrap.Wrap(err, "error creating azure credential")
+	}
+	return &azureKeyWrapper{
+		client: client,
+		cred:   cred,
+		keyURL: strings.TrimSuffix(opts.KeyID, "/"),
+	}, nil
+}
+
+// Wrap encrypts the given key using the configured key. In case the key
+// URL does not contain a version, the current version of the key is used.
+func (w *azureKeyWrapper) Wrap(ctx context.Context, key []byte) (*Envelope, error) {
+	kid, wrapped, err := w.do(ctx, w.keyURL, "wrapkey", key)
+	if err != nil {
+		return nil, errwrap.Wrap(err, "error wrapping data key")
+	}
+	return &Envelope{
+		Provider:   providerAzure,
+		KeyID:      kid,
+		WrappedKey: wrapped,
+	}, nil
+}
+
+// Unwrap decrypts the key contained in the given envelope using the key
+// version that was used for wrapping it.
+func (w *azureKeyWrapper) Unwrap(ctx context.Context, envelope *Envelope) ([]byte, error) {
+	if envelope.Provider != providerAzure {
+		return nil, errwrap.Wrap(nil, fmt.Sprintf("data key has been wrapped using %s, not %s", envelope.Provider, providerAzure))
+	}
+	_, key, err := w.do(ctx, envelope.KeyID, "unwrapkey", envelope.WrappedKey)
+	if err != nil {
+		return nil, errwrap.Wrap(err, "error unwrapping data key")
+	}
+	return key, nil
+}
+
+func (w *azureKeyWrapper) do(ctx context.Context, keyURL, operation string, value []byte) (string, []byte, error) {
+	body, err := json.Marshal(map[string]string{
+		"alg":   keyVaultAlgorithm,
+		"value": base64.RawURLEncoding.EncodeToString(value),
+	})
+	if err != nil {
+		return "", nil, errwrap.Wrap(err, "error marshaling request")
+	}
+	req, err := http.NewRequestWithContext(
+		ctx,
+		http.MethodPost,
+		fmt.Sprintf("%s/%s?api-version=%s", keyURL, operation, keyVaultAPIVersion),
+		bytes.NewReader(body),
+	)
+	if err != nil {
+		return "", nil, errwrap.Wrap(err, "error creating request")
+	}
+	token, err := w.cred.GetToken(ctx, policy.TokenRequestOptions{Scopes: []string{keyVaultScope}})
+	if err != nil {
+		return "", nil, errwrap.Wrap(err, "error requesting token")
+	}
+	req.Header.Set("Authorization", "Bearer "+token.Token)
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := w.client.Do(req)
+	if err != nil {
+		return "", nil, errwrap.Wrap(err, fmt.Sprintf("error calling %s", operation))
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		b, _ := io.ReadAll(io.LimitReader(res.Body, 1<<16))
+		var apiErr struct {
+			Error struct {
+				Code    string `json:"code"`
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		if err := json.Unmarshal(b, &apiErr); err == nil && apiErr.Error.Code != "" {
+			return "", nil, errwrap.Wrap(nil, fmt.Sprintf("%s failed with %s: %s", operation, apiErr.Error.Code, apiErr.Error.Message))
+		}
+		return "", nil, errwrap.Wrap(nil, fmt.Sprintf("%s failed with status %d: %s", operation, res.StatusCode, strings.TrimSpace(string(b))))
+	}
+
+	var result struct {
+		Kid   string `json:"kid"`
+		Value string `json:"value"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&result); err != nil {
+		return "", nil, errwrap.Wrap(err, "error decoding response")
+	}
+	decoded, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(result.Value, "="))
+	if err != nil {
+		return "", nil, errwrap.Wrap(err, "error decoding key")
+	}
+	return result.Kid, decoded, nil
+}
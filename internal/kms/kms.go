@@ -0,0 +1,83 @@
+// Copyright 2024 - offen.software <hioffen@posteo.de>
+// SPDX-License-Identifier: MPL-2.0
+
+// Package kms implements envelope encryption, wrapping randomly generated
+// data encryption keys using a key held by a key management service.
+package kms
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"net/http"
+
+	"github.com/offen/docker-volume-backup/internal/errwrap"
+	"github.com/offen/docker-volume-backup/internal/storage"
+)
+
+// EnvelopeSuffix is appended to the name of an encrypted backup for storing
+// its envelope next to it.
+const EnvelopeSuffix = ".key"
+
+// dataKeyLength is the length of the generated data encryption keys in bytes.
+const dataKeyLength = 32
+
+// Envelope contains a data encryption key wrapped by a key management
+// service and everything required to unwrap it again.
+type Envelope struct {
+	Provider   string `json:"provider"`
+	KeyID      string `json:"keyId"`
+	WrappedKey []byte `json:"wrappedKey"`
+}
+
+// KeyWrapper wraps and unwraps data encryption keys using a key management
+// service. The plaintext key never leaves the process.
+type KeyWrapper interface {
+	Wrap(ctx context.Context, key []byte) (*Envelope, error)
+	Unwrap(ctx context.Context, envelope *Envelope) ([]byte, error)
+}
+
+// Config contains values that define the key management service used for
+// wrapping data encryption keys.
+type Config struct {
+	// Provider is either "aws" or "azure".
+	Provider string
+	// KeyID is the id, ARN or alias of an AWS KMS key or the URL of an Azure
+	// Key Vault key.
+	KeyID string
+	// Region is the AWS region the key is stored in.
+	Region string
+	// Endpoint overrides the AWS KMS endpoint derived from the region.
+	Endpoint        string
+	AccessKeyID     string
+	SecretAccessKey string
+	IamRoleEndpoint string
+	UserAgent       string
+}
+
+// NewKeyWrapper creates a key wrapper for the configured provider.
+func NewKeyWrapper(opts Config) (KeyWrapper, error) {
+	if opts.KeyID == "" {
+		return nil, errwrap.Wrap(nil, "a key id is required for wrapping data keys")
+	}
+	client := &http.Client{
+		Transport: storage.NewUserAgentTransport(http.DefaultTransport, opts.UserAgent),
+	}
+	switch opts.Provider {
+	case providerAWS:
+		return newAWSKeyWrapper(opts, client)
+	case providerAzure:
+		return newAzureKeyWrapper(opts, client)
+	default:
+		return nil, errwrap.Wrap(nil, fmt.Sprintf("unknown key management service %s", opts.Provider))
+	}
+}
+
+// NewDataKey returns a new random data encryption key.
+func NewDataKey() ([]byte, error) {
+	key := make([]byte, dataKeyLength)
+	if _, err := rand.Read(key); err != nil {
+		return nil, errwrap.Wrap(err, "error generating data key")
+	}
+	return key, nil
+}
@@ -0,0 +1,156 @@
+package kms
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+func TestSignRequest(t *testing.T) {
+	// This is the get-vanilla example of the Signature Version 4 test suite.
+	req := httptest.NewRequest(http.MethodGet, "https://example.amazonaws.com/", nil)
+	signRequest(
+		req,
+		nil,
+		credentials.Value{AccessKeyID: "AKIDEXAMPLE", SecretAccessKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY"},
+		"us-east-1",
+		"service",
+		time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC),
+	)
+	expected := "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, SignedHeaders=host;x-amz-date, Signature=5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31"
+	if auth := req.Header.Get("Authorization"); auth != expected {
+		t.Errorf("Unexpected Authorization header %s", auth)
+	}
+}
+
+// reverse stands in for the encryption performed by the key management
+// service.
+func reverse(b []byte) []byte {
+	r := make([]byte, len(b))
+	for i := range b {
+		r[len(b)-1-i] = b[i]
+	}
+	return r
+}
+
+func TestAWSKeyWrapper(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=key/") {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		var payload struct {
+			KeyId          string
+			Plaintext      []byte
+			CiphertextBlob []byte
+		}
+		json.NewDecoder(r.Body).Decode(&payload)
+		switch r.Header.Get("X-Amz-Target") {
+		case "TrentService.Encrypt":
+			json.NewEncoder(w).Encode(map[string]any{"KeyId": "arn:" + payload.KeyId, "CiphertextBlob": reverse(payload.Plaintext)})
+		case "TrentService.Decrypt":
+			if payload.KeyId != "arn:alias/backup" {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(`{"__type":"NotFoundException","message":"unknown key"}`))
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]any{"KeyId": payload.KeyId, "Plaintext": reverse(payload.CiphertextBlob)})
+		}
+	}))
+	defer server.Close()
+
+	w, err := newAWSKeyWrapper(Config{
+		KeyID:           "alias/backup",
+		Region:          "eu-central-1",
+		Endpoint:        server.URL,
+		AccessKeyID:     "key",
+		SecretAccessKey: "secret",
+	}, server.Client())
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	testRoundTrip(t, w, "arn:alias/backup")
+
+	_, err = w.Unwrap(context.Background(), &Envelope{Provider: providerAWS, KeyID: "other"})
+	if err == nil || !strings.Contains(err.Error(), "NotFoundException") {
+		t.Errorf("Expected error from API, got %v", err)
+	}
+}
+
+type staticToken struct{}
+
+func (staticToken) GetToken(context.Context, policy.TokenRequestOptions) (azcore.AccessToken, error) {
+	return azcore.AccessToken{Token: "token", ExpiresOn: time.Now().Add(time.Hour)}, nil
+}
+
+func TestAzureKeyWrapper(t *testing.T) {
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token" || r.URL.Query().Get("api-version") == "" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		var payload struct {
+			Value string `json:"value"`
+		}
+		json.NewDecoder(r.Body).Decode(&payload)
+		value, _ := base64.RawURLEncoding.DecodeString(payload.Value)
+		switch r.URL.Path {
+		case "/keys/backup/wrapkey":
+			json.NewEncoder(w).Encode(map[string]string{
+				"kid":   server.URL + "/keys/backup/v1",
+				"value": base64.RawURLEncoding.EncodeToString(reverse(value)),
+			})
+		case "/keys/backup/v1/unwrapkey":
+			json.NewEncoder(w).Encode(map[string]string{
+				"kid":   server.URL + "/keys/backup/v1",
+				"value": base64.RawURLEncoding.EncodeToString(reverse(value)),
+			})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	w := &azureKeyWrapper{
+		client: server.Client(),
+		cred:   staticToken{},
+		keyURL: server.URL + "/keys/backup",
+	}
+	testRoundTrip(t, w, server.URL+"/keys/backup/v1")
+}
+
+func testRoundTrip(t *testing.T, w KeyWrapper, expectedKeyID string) {
+	t.Helper()
+	key, err := NewDataKey()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	envelope, err := w.Wrap(context.Background(), key)
+	if err != nil {
+		t.Fatalf("Unexpected error wrapping key: %v", err)
+	}
+	if envelope.KeyID != expectedKeyID {
+		t.Errorf("Expected key id %s, got %s", expectedKeyID, envelope.KeyID)
+	}
+	if bytes.Equal(envelope.WrappedKey, key) {
+		t.Error("Expected wrapped key to differ from plaintext key")
+	}
+	unwrapped, err := w.Unwrap(context.Background(), envelope)
+	if err != nil {
+		t.Fatalf("Unexpected error unwrapping key: %v", err)
+	}
+	if !bytes.Equal(unwrapped, key) {
+		t.Error("Expected unwrapped key to match")
+	}
+}
@@ -8,6 +8,8 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
+	"net/http"
 	"os"
 	"path/filepath"
 	"strings"
@@ -15,9 +17,12 @@ import (
 	"text/template"
 	"time"
 
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
 	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
 	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blob"
 	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/container"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/sas"
 	"github.com/offen/docker-volume-backup/internal/errwrap"
 	"github.com/offen/docker-volume-backup/internal/storage"
 )
@@ -26,6 +31,7 @@ type azureBlobStorage struct {
 	*storage.StorageBackend
 	client        *azblob.Client
 	containerName string
+	immutableFor  time.Duration
 }
 
 // Config contains values that define the configuration of an Azure Blob Storage.
@@ -36,6 +42,8 @@ type Config struct {
 	ConnectionString  string
 	Endpoint          string
 	RemotePath        string
+	UserAgent         string
+	ImmutableFor      time.Duration
 }
 
 // NewStorageBackend creates and initializes a new Azure Blob Storage backend.
@@ -54,6 +62,14 @@ func NewStorageBackend(opts Config, logFunc storage.Log) (storage.Backend, error
 	}
 	normalizedEndpoint := fmt.Sprintf("%s/", strings.TrimSuffix(ep.String(), "/"))
 
+	clientOptions := &azblob.ClientOptions{
+		ClientOptions: azcore.ClientOptions{
+			Transport: &http.Client{
+				Transport: storage.NewUserAgentTransport(http.DefaultTransport, opts.UserAgent),
+			},
+		},
+	}
+
 	var client *azblob.Client
 	if opts.PrimaryAccountKey != "" {
 		cred, err := azblob.NewSharedKeyCredential(opts.AccountName, opts.PrimaryAccountKey)
@@ -61,12 +77,12 @@ func NewStorageBackend(opts Config, logFunc storage.Log) (storage.Backend, error
 			return nil, errwrap.Wrap(err, "error creating shared key Azure credential")
 		}
 
-		client, err = azblob.NewClientWithSharedKeyCredential(normalizedEndpoint, cred, nil)
+		client, err = azblob.NewClientWithSharedKeyCredential(normalizedEndpoint, cred, clientOptions)
 		if err != nil {
 			return nil, errwrap.Wrap(err, "error creating azure client from primary account key")
 		}
 	} else if opts.ConnectionString != "" {
-		client, err = azblob.NewClientFromConnectionString(opts.ConnectionString, nil)
+		client, err = azblob.NewClientFromConnectionString(opts.ConnectionString, clientOptions)
 		if err != nil {
 			return nil, errwrap.Wrap(err, "error creating azure client from connection string")
 		}
@@ -75,7 +91,7 @@ func NewStorageBackend(opts Config, logFunc storage.Log) (storage.Backend, error
 		if err != nil {
 			return nil, errwrap.Wrap(err, "error creating managed identity credential")
 		}
-		client, err = azblob.NewClient(normalizedEndpoint, cred, nil)
+		client, err = azblob.NewClient(normalizedEndpoint, cred, clientOptions)
 		if err != nil {
 			return nil, errwrap.Wrap(err, "error creating azure client from managed identity")
 		}
@@ -84,6 +100,7 @@ func NewStorageBackend(opts Config, logFunc storage.Log) (storage.Backend, error
 	storage := azureBlobStorage{
 		client:        client,
 		containerName: opts.ContainerName,
+		immutableFor:  opts.ImmutableFor,
 		StorageBackend: &storage.StorageBackend{
 			DestinationPath: opts.RemotePath,
 			Log:             logFunc,
@@ -97,53 +114,215 @@ func (b *azureBlobStorage) Name() string {
 	return "Azure"
 }
 
-// Copy copies the given file to the storage backend.
-func (b *azureBlobStorage) Copy(file string) error {
+// Preflight checks the container is writable by uploading and removing a
+// marker file. In case uploaded files are immutable, it only checks the
+// container can be listed.
+func (b *azureBlobStorage) Preflight(ctx context.Context) error {
+	if b.immutableFor > 0 {
+		return storage.CheckReachable(b)
+	}
+	return storage.CheckWritable(ctx, b)
+}
+
+// Copy copies the given file to the storage backend, storing it
+// using the given name.
+func (b *azureBlobStorage) Copy(ctx context.Context, file, name string) error {
 	fileReader, err := os.Open(file)
 	if err != nil {
 		return errwrap.Wrap(err, fmt.Sprintf("error opening file %s", file))
 	}
-	_, err = b.client.UploadStream(
-		context.Background(),
+	defer fileReader.Close()
+	if err := b.upload(ctx, fileReader, name); err != nil {
+		return errwrap.Wrap(err, fmt.Sprintf("error uploading file %s", file))
+	}
+	return nil
+}
+
+// CopyFrom uploads the data read from the given reader to the storage
+// backend using the given name. The blob is only committed once all data
+// has been read.
+func (b *azureBlobStorage) CopyFrom(r io.Reader, name string) error {
+	return b.upload(context.Background(), r, name)
+}
+
+func (b *azureBlobStorage) upload(ctx context.Context, r io.Reader, name string) error {
+	blobName := filepath.Join(b.DestinationPath, name)
+	if _, err := b.client.UploadStream(
+		ctx,
 		b.containerName,
-		filepath.Join(b.DestinationPath, filepath.Base(file)),
-		fileReader,
+		blobName,
+		r,
 		nil,
-	)
+	); err != nil {
+		var respErr *azcore.ResponseError
+		if errors.As(err, &respErr) {
+			err = &storage.StatusError{StatusCode: respErr.StatusCode, Err: err}
+		}
+		return errwrap.Wrap(err, fmt.Sprintf("error uploading blob %s", blobName))
+	}
+	if b.immutableFor > 0 {
+		mode := blob.ImmutabilityPolicySettingLocked
+		_, err := b.client.ServiceClient().
+			NewContainerClient(b.containerName).
+			NewBlobClient(blobName).
+			SetImmutabilityPolicy(ctx, time.Now().Add(b.immutableFor), &blob.SetImmutabilityPolicyOptions{
+				Mode: &mode,
+			})
+		if err != nil {
+			return errwrap.Wrap(err, fmt.Sprintf("error setting immutability policy for %s", blobName))
+		}
+	}
+	return nil
+}
+
+// Stat returns information about the blob with the given name in the storage backend.
+func (b *azureBlobStorage) Stat(name string) (*storage.ObjectInfo, error) {
+	props, err := b.client.ServiceClient().
+		NewContainerClient(b.containerName).
+		NewBlobClient(filepath.Join(b.DestinationPath, name)).
+		GetProperties(context.Background(), nil)
 	if err != nil {
-		return errwrap.Wrap(err, fmt.Sprintf("error uploading file %s", file))
+		return nil, errwrap.Wrap(err, fmt.Sprintf("error getting properties of blob %s", name))
+	}
+	info := &storage.ObjectInfo{Name: name}
+	if props.ContentLength != nil {
+		info.Size = *props.ContentLength
+	}
+	if props.LastModified != nil {
+		info.LastModified = *props.LastModified
+	}
+	return info, nil
+}
+
+// MD5 returns the MD5 checksum of the blob with the given name, which Azure
+// only stores for blobs that have been uploaded in a single request.
+func (b *azureBlobStorage) MD5(name string) ([]byte, error) {
+	props, err := b.client.ServiceClient().
+		NewContainerClient(b.containerName).
+		NewBlobClient(filepath.Join(b.DestinationPath, name)).
+		GetProperties(context.Background(), nil)
+	if err != nil {
+		return nil, errwrap.Wrap(err, fmt.Sprintf("error getting properties of blob %s", name))
+	}
+	if len(props.ContentMD5) == 0 {
+		return nil, storage.ErrChecksumUnavailable
+	}
+	return props.ContentMD5, nil
+}
+
+// PresignedURL returns a URL containing a SAS token that allows reading the
+// blob with the given name until the given expiry has passed. This requires
+// the backend to be authenticated using a shared key.
+func (b *azureBlobStorage) PresignedURL(name string, expiry time.Duration) (string, error) {
+	u, err := b.client.ServiceClient().
+		NewContainerClient(b.containerName).
+		NewBlobClient(filepath.Join(b.DestinationPath, name)).
+		GetSASURL(sas.BlobPermissions{Read: true}, time.Now().Add(expiry), nil)
+	if err != nil {
+		return "", errwrap.Wrap(err, fmt.Sprintf("error generating SAS URL for blob %s", name))
+	}
+	return u, nil
+}
+
+// List returns information about all blobs in the Azure Blob storage backend
+// whose name starts with the given prefix.
+func (b *azureBlobStorage) List(prefix string) ([]storage.ObjectInfo, error) {
+	lookupPrefix := filepath.Join(b.DestinationPath, prefix)
+	pager := b.client.NewListBlobsFlatPager(b.containerName, &container.ListBlobsFlatOptions{
+		Prefix: &lookupPrefix,
+	})
+	var result []storage.ObjectInfo
+	for pager.More() {
+		resp, err := pager.NextPage(context.Background())
+		if err != nil {
+			return nil, errwrap.Wrap(err, "error paging over blobs")
+		}
+		for _, v := range resp.Segment.BlobItems {
+			info := storage.ObjectInfo{
+				Name: strings.TrimPrefix(strings.TrimPrefix(*v.Name, b.DestinationPath), "/"),
+			}
+			if v.Properties.ContentLength != nil {
+				info.Size = *v.Properties.ContentLength
+			}
+			if v.Properties.LastModified != nil {
+				info.LastModified = *v.Properties.LastModified
+			}
+			result = append(result, info)
+		}
+	}
+	return result, nil
+}
+
+// Open returns a reader for the first length bytes of the blob with the given
+// name in the Azure Blob storage backend. If length is not positive, the
+// entire blob is read.
+func (b *azureBlobStorage) Open(name string, length int64) (io.ReadCloser, error) {
+	opts := &azblob.DownloadStreamOptions{}
+	if length > 0 {
+		opts.Range = azblob.HTTPRange{Count: length}
+	}
+	resp, err := b.client.DownloadStream(context.Background(), b.containerName, filepath.Join(b.DestinationPath, name), opts)
+	if err != nil {
+		return nil, errwrap.Wrap(err, fmt.Sprintf("error downloading blob %s", name))
+	}
+	return resp.Body, nil
+}
+
+// Remove deletes the blob with the given name from the Azure Blob storage
+// backend.
+func (b *azureBlobStorage) Remove(name string) error {
+	if _, err := b.client.DeleteBlob(context.Background(), b.containerName, filepath.Join(b.DestinationPath, name), nil); err != nil {
+		return errwrap.Wrap(err, fmt.Sprintf("error removing blob %s", name))
 	}
 	return nil
 }
 
 // Prune rotates away backups according to the configuration and provided
 // deadline for the Azure Blob storage backend.
-func (b *azureBlobStorage) Prune(deadline time.Time, pruningPrefix string) (*storage.PruneStats, error) {
+func (b *azureBlobStorage) Prune(ctx context.Context, deadline time.Time, pruningPrefix string, dryRun bool) (*storage.PruneStats, error) {
 	lookupPrefix := filepath.Join(b.DestinationPath, pruningPrefix)
 	pager := b.client.NewListBlobsFlatPager(b.containerName, &container.ListBlobsFlatOptions{
-		Prefix: &lookupPrefix,
+		Prefix:  &lookupPrefix,
+		Include: container.ListBlobsInclude{ImmutabilityPolicy: true},
 	})
-	var matches []string
-	var totalCount uint
+	var blobs []*container.BlobItem
 	for pager.More() {
-		resp, err := pager.NextPage(context.Background())
+		resp, err := pager.NextPage(ctx)
 		if err != nil {
 			return nil, errwrap.Wrap(err, "error paging over blobs")
 		}
-		for _, v := range resp.Segment.BlobItems {
-			totalCount++
-			if v.Properties.LastModified.Before(deadline) {
-				matches = append(matches, *v.Name)
+		blobs = append(blobs, resp.Segment.BlobItems...)
+	}
+
+	blobs, lenProtected := storage.FilterProtected(blobs, func(v *container.BlobItem) string { return *v.Name }, b.PruneExclusions()...)
+	if lenProtected != 0 {
+		b.Log(storage.LogLevelInfo, b.Name(), "Skipping %d protected backups.", lenProtected)
+	}
+
+	var matches []string
+	totalCount := uint(len(blobs) + lenProtected)
+	var lenLocked int
+	now := time.Now()
+	for _, v := range blobs {
+		if v.Properties.LastModified.Before(deadline) {
+			if expiresOn := v.Properties.ImmutabilityPolicyExpiresOn; expiresOn != nil && expiresOn.After(now) {
+				lenLocked++
+				continue
 			}
+			matches = append(matches, *v.Name)
 		}
 	}
+	if lenLocked != 0 {
+		b.Log(storage.LogLevelInfo, b.Name(), "Skipping %d backups that are older than the given deadline, but still locked.", lenLocked)
+	}
 
 	stats := &storage.PruneStats{
-		Total:  totalCount,
-		Pruned: uint(len(matches)),
+		Total:   totalCount,
+		Pruned:  uint(len(matches)),
+		Matches: matches,
 	}
 
-	pruneErr := b.DoPrune(b.Name(), len(matches), int(totalCount), deadline, func() error {
+	pruneErr := b.DoPrune(b.Name(), len(matches), int(totalCount), deadline, dryRun, func() error {
 		wg := sync.WaitGroup{}
 		wg.Add(len(matches))
 		var errs []error
@@ -151,7 +330,7 @@ func (b *azureBlobStorage) Prune(deadline time.Time, pruningPrefix string) (*sto
 		for _, match := range matches {
 			name := match
 			go func() {
-				_, err := b.client.DeleteBlob(context.Background(), b.containerName, name, nil)
+				_, err := b.client.DeleteBlob(ctx, b.containerName, name, nil)
 				if err != nil {
 					errs = append(errs, err)
 				}
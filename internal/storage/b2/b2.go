@@ -0,0 +1,489 @@
+// Copyright 2024 - offen.software <hioffen@posteo.de>
+// SPDX-License-Identifier: MPL-2.0
+
+package b2
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/offen/docker-volume-backup/internal/errwrap"
+	"github.com/offen/docker-volume-backup/internal/storage"
+)
+
+// uploadAttempts is the number of times uploading a file or a part is
+// attempted. B2 expects clients to request a new upload URL and retry in
+// case an upload fails with a server error.
+const uploadAttempts = 3
+
+type b2Storage struct {
+	*storage.StorageBackend
+	client             *http.Client
+	auth               *authorization
+	bucketID           string
+	bucketName         string
+	largeFileThreshold int64
+	partSize           int64
+}
+
+// Config contains values that define the configuration of a Backblaze B2
+// bucket.
+type Config struct {
+	Endpoint           string
+	ApplicationKeyID   string
+	ApplicationKey     string
+	BucketName         string
+	RemotePath         string
+	LargeFileThreshold int64
+	PartSize           int64
+	UserAgent          string
+}
+
+type authorization struct {
+	AccountID               string `json:"accountId"`
+	AuthorizationToken      string `json:"authorizationToken"`
+	APIURL                  string `json:"apiUrl"`
+	DownloadURL             string `json:"downloadUrl"`
+	AbsoluteMinimumPartSize int64  `json:"absoluteMinimumPartSize"`
+}
+
+// NewStorageBackend creates and initializes a new Backblaze B2 storage backend.
+func NewStorageBackend(opts Config, logFunc storage.Log) (storage.Backend, error) {
+	if opts.ApplicationKeyID == "" || opts.ApplicationKey == "" {
+		return nil, errwrap.Wrap(nil, "B2_BUCKET_NAME is defined, but no application key was provided")
+	}
+	client := &http.Client{
+		Transport: storage.NewUserAgentTransport(http.DefaultTransport, opts.UserAgent),
+	}
+
+	req, err := http.NewRequest(http.MethodGet, strings.TrimSuffix(opts.Endpoint, "/")+"/b2api/v2/b2_authorize_account", nil)
+	if err != nil {
+		return nil, errwrap.Wrap(err, "error creating request")
+	}
+	req.SetBasicAuth(opts.ApplicationKeyID, opts.ApplicationKey)
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, errwrap.Wrap(err, "error authorizing account")
+	}
+	defer res.Body.Close()
+	if err := checkResponse(res); err != nil {
+		return nil, errwrap.Wrap(err, "error authorizing account")
+	}
+	auth := &authorization{}
+	if err := json.NewDecoder(res.Body).Decode(auth); err != nil {
+		return nil, errwrap.Wrap(err, "error decoding authorization")
+	}
+	if opts.PartSize < auth.AbsoluteMinimumPartSize {
+		return nil, errwrap.Wrap(nil, fmt.Sprintf("part size must be at least %d bytes", auth.AbsoluteMinimumPartSize))
+	}
+
+	b := &b2Storage{
+		client:             client,
+		auth:               auth,
+		bucketName:         opts.BucketName,
+		largeFileThreshold: opts.LargeFileThreshold,
+		partSize:           opts.PartSize,
+		StorageBackend: &storage.StorageBackend{
+			DestinationPath: opts.RemotePath,
+			Log:             logFunc,
+		},
+	}
+
+	var buckets struct {
+		Buckets []struct {
+			BucketID string `json:"bucketId"`
+		} `json:"buckets"`
+	}
+	if err := b.call(context.Background(), "b2_list_buckets", map[string]string{
+		"accountId":  auth.AccountID,
+		"bucketName": opts.BucketName,
+	}, &buckets); err != nil {
+		return nil, errwrap.Wrap(err, "error looking up bucket")
+	}
+	if len(buckets.Buckets) == 0 {
+		return nil, errwrap.Wrap(nil, fmt.Sprintf("bucket %s does not exist", opts.BucketName))
+	}
+	b.bucketID = buckets.Buckets[0].BucketID
+	return b, nil
+}
+
+// Name returns the name of the storage backend
+func (b *b2Storage) Name() string {
+	return "B2"
+}
+
+// Preflight checks the storage is writable by uploading and removing a marker
+// file.
+func (b *b2Storage) Preflight(ctx context.Context) error {
+	return storage.CheckWritable(ctx, b)
+}
+
+// file is the subset of the file information returned by the B2 API used
+// by the storage backend.
+type file struct {
+	FileID          string `json:"fileId"`
+	FileName        string `json:"fileName"`
+	ContentLength   int64  `json:"contentLength"`
+	UploadTimestamp int64  `json:"uploadTimestamp"`
+}
+
+func (f *file) info(name string) storage.ObjectInfo {
+	return storage.ObjectInfo{
+		Name:         name,
+		Size:         f.ContentLength,
+		LastModified: time.UnixMilli(f.UploadTimestamp),
+	}
+}
+
+func (b *b2Storage) key(name string) string {
+	return strings.TrimPrefix(path.Join(b.DestinationPath, name), "/")
+}
+
+// Copy copies the given file to the storage backend, storing it using the
+// given name. Files larger than the configured threshold are uploaded in
+// parts.
+func (b *b2Storage) Copy(ctx context.Context, file, name string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return errwrap.Wrap(err, fmt.Sprintf("error opening file %s", file))
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return errwrap.Wrap(err, fmt.Sprintf("error getting file info for %s", file))
+	}
+
+	key := b.key(name)
+	if fi.Size() > b.largeFileThreshold {
+		err = b.uploadLargeFile(ctx, f, fi.Size(), key)
+	} else {
+		err = b.uploadFile(ctx, f, fi.Size(), key)
+	}
+	if err != nil {
+		return errwrap.Wrap(err, fmt.Sprintf("error uploading backup to bucket %s", b.bucketName))
+	}
+
+	b.Log(storage.LogLevelInfo, b.Name(), "Uploaded a copy of backup `%s` to bucket `%s`.", file, b.bucketName)
+	return nil
+}
+
+type uploadURL struct {
+	UploadURL          string `json:"uploadUrl"`
+	AuthorizationToken string `json:"authorizationToken"`
+}
+
+func (b *b2Storage) uploadFile(ctx context.Context, f *os.File, size int64, key string) error {
+	r := io.NewSectionReader(f, 0, size)
+	checksum, err := sha1Sum(r)
+	if err != nil {
+		return err
+	}
+	return b.upload(ctx, "b2_get_upload_url", map[string]string{"bucketId": b.bucketID}, r, checksum, func(h http.Header) {
+		h.Set("X-Bz-File-Name", url.PathEscape(key))
+		h.Set("Content-Type", "b2/x-auto")
+	})
+}
+
+func (b *b2Storage) uploadLargeFile(ctx context.Context, f *os.File, size int64, key string) error {
+	var started struct {
+		FileID string `json:"fileId"`
+	}
+	if err := b.call(ctx, "b2_start_large_file", map[string]string{
+		"bucketId":    b.bucketID,
+		"fileName":    key,
+		"contentType": "b2/x-auto",
+	}, &started); err != nil {
+		return errwrap.Wrap(err, "error starting large file")
+	}
+
+	var checksums []string
+	for offset, part := int64(0), 1; offset < size; offset, part = offset+b.partSize, part+1 {
+		r := io.NewSectionReader(f, offset, min(b.partSize, size-offset))
+		checksum, err := sha1Sum(r)
+		if err != nil {
+			return errors.Join(err, b.cancelLargeFile(context.WithoutCancel(ctx), started.FileID))
+		}
+		if err := b.upload(ctx, "b2_get_upload_part_url", map[string]string{"fileId": started.FileID}, r, checksum, func(h http.Header) {
+			h.Set("X-Bz-Part-Number", strconv.Itoa(part))
+		}); err != nil {
+			return errors.Join(errwrap.Wrap(err, fmt.Sprintf("error uploading part %d", part)), b.cancelLargeFile(context.WithoutCancel(ctx), started.FileID))
+		}
+		checksums = append(checksums, checksum)
+	}
+
+	if err := b.call(ctx, "b2_finish_large_file", map[string]any{
+		"fileId":        started.FileID,
+		"partSha1Array": checksums,
+	}, nil); err != nil {
+		return errors.Join(errwrap.Wrap(err, "error finishing large file"), b.cancelLargeFile(context.WithoutCancel(ctx), started.FileID))
+	}
+	return nil
+}
+
+func (b *b2Storage) cancelLargeFile(ctx context.Context, fileID string) error {
+	if err := b.call(ctx, "b2_cancel_large_file", map[string]string{"fileId": fileID}, nil); err != nil {
+		return errwrap.Wrap(err, "error cancelling large file")
+	}
+	return nil
+}
+
+// upload requests an upload URL using the given operation and uploads the
+// content of r to it, retrying with a new URL in case of failure.
+func (b *b2Storage) upload(ctx context.Context, operation string, payload any, r *io.SectionReader, checksum string, setHeaders func(http.Header)) error {
+	var err error
+	for attempt := 0; attempt < uploadAttempts; attempt++ {
+		if err = b.uploadOnce(ctx, operation, payload, r, checksum, setHeaders); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+func (b *b2Storage) uploadOnce(ctx context.Context, operation string, payload any, r *io.SectionReader, checksum string, setHeaders func(http.Header)) error {
+	var target uploadURL
+	if err := b.call(ctx, operation, payload, &target); err != nil {
+		return errwrap.Wrap(err, "error requesting upload url")
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return errwrap.Wrap(err, "error rewinding file")
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target.UploadURL, r)
+	if err != nil {
+		return errwrap.Wrap(err, "error creating request")
+	}
+	req.ContentLength = r.Size()
+	req.Header.Set("Authorization", target.AuthorizationToken)
+	req.Header.Set("X-Bz-Content-Sha1", checksum)
+	setHeaders(req.Header)
+	res, err := b.client.Do(req)
+	if err != nil {
+		return errwrap.Wrap(err, "error uploading")
+	}
+	defer res.Body.Close()
+	return checkResponse(res)
+}
+
+// Stat returns information about the file with the given name in the
+// Backblaze B2 backend.
+func (b *b2Storage) Stat(name string) (*storage.ObjectInfo, error) {
+	f, err := b.lookup(context.Background(), b.key(name))
+	if err != nil {
+		return nil, err
+	}
+	info := f.info(name)
+	return &info, nil
+}
+
+func (b *b2Storage) lookup(ctx context.Context, key string) (*file, error) {
+	var result struct {
+		Files []file `json:"files"`
+	}
+	if err := b.call(ctx, "b2_list_file_names", map[string]any{
+		"bucketId":      b.bucketID,
+		"startFileName": key,
+		"maxFileCount":  1,
+	}, &result); err != nil {
+		return nil, errwrap.Wrap(err, fmt.Sprintf("error looking up file %s", key))
+	}
+	if len(result.Files) == 0 || result.Files[0].FileName != key {
+		return nil, errwrap.Wrap(nil, fmt.Sprintf("file %s does not exist", key))
+	}
+	return &result.Files[0], nil
+}
+
+// List returns information about all files in the Backblaze B2 backend
+// whose name starts with the given prefix.
+func (b *b2Storage) List(prefix string) ([]storage.ObjectInfo, error) {
+	files, err := b.list(context.Background(), b.key(prefix))
+	if err != nil {
+		return nil, err
+	}
+	var result []storage.ObjectInfo
+	for _, f := range files {
+		name := strings.TrimPrefix(strings.TrimPrefix(f.FileName, b.key("")), "/")
+		result = append(result, f.info(name))
+	}
+	return result, nil
+}
+
+func (b *b2Storage) list(ctx context.Context, prefix string) ([]file, error) {
+	var files []file
+	payload := map[string]any{
+		"bucketId":     b.bucketID,
+		"prefix":       prefix,
+		"maxFileCount": 1000,
+	}
+	for {
+		var page struct {
+			Files        []file  `json:"files"`
+			NextFileName *string `json:"nextFileName"`
+		}
+		if err := b.call(ctx, "b2_list_file_names", payload, &page); err != nil {
+			return nil, errwrap.Wrap(err, "error looking up files from remote storage")
+		}
+		files = append(files, page.Files...)
+		if page.NextFileName == nil {
+			return files, nil
+		}
+		payload["startFileName"] = *page.NextFileName
+	}
+}
+
+// Open returns a reader for the first length bytes of the file with the
+// given name in the Backblaze B2 backend. If length is not positive, the
+// entire file is read.
+func (b *b2Storage) Open(name string, length int64) (io.ReadCloser, error) {
+	key := b.key(name)
+	req, err := http.NewRequest(
+		http.MethodGet,
+		fmt.Sprintf("%s/file/%s/%s", b.auth.DownloadURL, url.PathEscape(b.bucketName), (&url.URL{Path: key}).EscapedPath()),
+		nil,
+	)
+	if err != nil {
+		return nil, errwrap.Wrap(err, "error creating request")
+	}
+	req.Header.Set("Authorization", b.auth.AuthorizationToken)
+	if length > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=0-%d", length-1))
+	}
+	res, err := b.client.Do(req)
+	if err != nil {
+		return nil, errwrap.Wrap(err, fmt.Sprintf("error downloading file %s", name))
+	}
+	if err := checkResponse(res); err != nil {
+		res.Body.Close()
+		return nil, errwrap.Wrap(err, fmt.Sprintf("error downloading file %s", name))
+	}
+	return res.Body, nil
+}
+
+// Remove deletes the file with the given name from the Backblaze B2 backend.
+func (b *b2Storage) Remove(name string) error {
+	f, err := b.lookup(context.Background(), b.key(name))
+	if err != nil {
+		return err
+	}
+	return b.remove(context.Background(), f)
+}
+
+func (b *b2Storage) remove(ctx context.Context, f *file) error {
+	if err := b.call(ctx, "b2_delete_file_version", map[string]string{
+		"fileId":   f.FileID,
+		"fileName": f.FileName,
+	}, nil); err != nil {
+		return errwrap.Wrap(err, fmt.Sprintf("error removing file %s", f.FileName))
+	}
+	return nil
+}
+
+// Prune rotates away backups according to the configuration and provided
+// deadline for the Backblaze B2 backend.
+func (b *b2Storage) Prune(ctx context.Context, deadline time.Time, pruningPrefix string, dryRun bool) (*storage.PruneStats, error) {
+	candidates, err := b.list(ctx, b.key(pruningPrefix))
+	if err != nil {
+		return nil, errwrap.Wrap(err, "error listing candidates for pruning")
+	}
+
+	candidates, lenProtected := storage.FilterProtected(candidates, func(f file) string { return f.FileName }, b.PruneExclusions()...)
+	if lenProtected != 0 {
+		b.Log(storage.LogLevelInfo, b.Name(), "Skipping %d protected backups.", lenProtected)
+	}
+
+	var matches []file
+	var matchNames []string
+	lenCandidates := len(candidates) + lenProtected
+	for _, candidate := range candidates {
+		if time.UnixMilli(candidate.UploadTimestamp).Before(deadline) {
+			matches = append(matches, candidate)
+			matchNames = append(matchNames, candidate.FileName)
+		}
+	}
+
+	stats := &storage.PruneStats{
+		Total:   uint(lenCandidates),
+		Pruned:  uint(len(matches)),
+		Matches: matchNames,
+	}
+
+	pruneErr := b.DoPrune(b.Name(), len(matches), lenCandidates, deadline, dryRun, func() error {
+		var errs []error
+		for i := range matches {
+			if err := b.remove(ctx, &matches[i]); err != nil {
+				errs = append(errs, err)
+			}
+		}
+		return errors.Join(errs...)
+	})
+
+	return stats, pruneErr
+}
+
+// call invokes the given operation of the B2 API, decoding the response
+// into result unless it is nil.
+func (b *b2Storage) call(ctx context.Context, operation string, payload, result any) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return errwrap.Wrap(err, "error marshaling request")
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, fmt.Sprintf("%s/b2api/v2/%s", b.auth.APIURL, operation), bytes.NewReader(body))
+	if err != nil {
+		return errwrap.Wrap(err, "error creating request")
+	}
+	req.Header.Set("Authorization", b.auth.AuthorizationToken)
+	req.Header.Set("Content-Type", "application/json")
+	res, err := b.client.Do(req)
+	if err != nil {
+		return errwrap.Wrap(err, fmt.Sprintf("error calling %s", operation))
+	}
+	defer res.Body.Close()
+	if err := checkResponse(res); err != nil {
+		return errwrap.Wrap(err, fmt.Sprintf("error calling %s", operation))
+	}
+	if result == nil {
+		return nil
+	}
+	if err := json.NewDecoder(res.Body).Decode(result); err != nil {
+		return errwrap.Wrap(err, "error decoding response")
+	}
+	return nil
+}
+
+// checkResponse returns an error containing the message returned by the API
+// in case the given response does not indicate success. The status code is
+// retained as a storage.StatusError, so callers can retry transient errors.
+func checkResponse(res *http.Response) error {
+	if res.StatusCode >= 200 && res.StatusCode < 300 {
+		return nil
+	}
+	body, _ := io.ReadAll(io.LimitReader(res.Body, 1<<16))
+	var payload struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	}
+	message := fmt.Sprintf("unexpected status %d: %s", res.StatusCode, strings.TrimSpace(string(body)))
+	if err := json.Unmarshal(body, &payload); err == nil && payload.Code != "" {
+		message = fmt.Sprintf("unexpected status %d (%s): %s", res.StatusCode, payload.Code, payload.Message)
+	}
+	return &storage.StatusError{StatusCode: res.StatusCode, Err: errwrap.Wrap(nil, message)}
+}
+
+func sha1Sum(r io.Reader) (string, error) {
+	h := sha1.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return "", errwrap.Wrap(err, "error calculating checksum")
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
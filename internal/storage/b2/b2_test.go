@@ -0,0 +1,258 @@
+package b2
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/offen/docker-volume-backup/internal/storage"
+)
+
+type fakeFile struct {
+	id       string
+	content  []byte
+	uploaded time.Time
+}
+
+// fakeServer implements the parts of the B2 API used by the backend.
+type fakeServer struct {
+	mu         sync.Mutex
+	url        string
+	files      map[string]fakeFile
+	largeFiles map[string][][]byte
+	largeNames map[string]string
+	parts      int
+	failNext   bool
+}
+
+func (f *fakeServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if r.URL.Path == "/b2api/v2/b2_authorize_account" {
+		if id, key, _ := r.BasicAuth(); id != "id" || key != "key" {
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprint(w, `{"code":"unauthorized","message":"invalid key"}`)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]any{
+			"accountId":               "account",
+			"authorizationToken":      "token",
+			"apiUrl":                  f.url,
+			"downloadUrl":             f.url,
+			"absoluteMinimumPartSize": 5,
+		})
+		return
+	}
+	if r.Header.Get("Authorization") != "token" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	var payload map[string]any
+	if strings.HasPrefix(r.URL.Path, "/b2api/") {
+		json.NewDecoder(r.Body).Decode(&payload)
+	}
+	switch r.URL.Path {
+	case "/b2api/v2/b2_list_buckets":
+		json.NewEncoder(w).Encode(map[string]any{"buckets": []any{map[string]string{"bucketId": "bucket-id"}}})
+	case "/b2api/v2/b2_get_upload_url":
+		json.NewEncoder(w).Encode(map[string]string{"uploadUrl": f.url + "/upload", "authorizationToken": "token"})
+	case "/b2api/v2/b2_get_upload_part_url":
+		json.NewEncoder(w).Encode(map[string]string{"uploadUrl": f.url + "/upload_part/" + payload["fileId"].(string), "authorizationToken": "token"})
+	case "/b2api/v2/b2_start_large_file":
+		id := fmt.Sprintf("large-%d", len(f.largeNames))
+		f.largeNames[id] = payload["fileName"].(string)
+		json.NewEncoder(w).Encode(map[string]string{"fileId": id})
+	case "/b2api/v2/b2_finish_large_file":
+		id := payload["fileId"].(string)
+		var content []byte
+		for _, part := range f.largeFiles[id] {
+			content = append(content, part...)
+		}
+		f.files[f.largeNames[id]] = fakeFile{id: id, content: content, uploaded: time.Now()}
+		w.Write([]byte("{}"))
+	case "/b2api/v2/b2_list_file_names":
+		var names []string
+		for name := range f.files {
+			start, _ := payload["startFileName"].(string)
+			prefix, _ := payload["prefix"].(string)
+			if name >= start && strings.HasPrefix(name, prefix) {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+		var files []any
+		for _, name := range names {
+			files = append(files, map[string]any{
+				"fileId":          f.files[name].id,
+				"fileName":        name,
+				"contentLength":   len(f.files[name].content),
+				"uploadTimestamp": f.files[name].uploaded.UnixMilli(),
+			})
+		}
+		json.NewEncoder(w).Encode(map[string]any{"files": files, "nextFileName": nil})
+	case "/b2api/v2/b2_delete_file_version":
+		delete(f.files, payload["fileName"].(string))
+		w.Write([]byte("{}"))
+	case "/upload":
+		if f.failNext {
+			f.failNext = false
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		name, _ := url.PathUnescape(r.Header.Get("X-Bz-File-Name"))
+		content, _ := io.ReadAll(r.Body)
+		f.files[name] = fakeFile{id: "id-" + name, content: content, uploaded: time.Now()}
+		w.Write([]byte("{}"))
+	default:
+		if id, ok := strings.CutPrefix(r.URL.Path, "/upload_part/"); ok {
+			content, _ := io.ReadAll(r.Body)
+			f.largeFiles[id] = append(f.largeFiles[id], content)
+			f.parts++
+			w.Write([]byte("{}"))
+			return
+		}
+		if name, ok := strings.CutPrefix(r.URL.Path, "/file/bucket/"); ok {
+			file, exists := f.files[name]
+			if !exists {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.Write(file.content)
+			return
+		}
+		w.WriteHeader(http.StatusBadRequest)
+	}
+}
+
+func newTestBackend(t *testing.T) (storage.Backend, *fakeServer) {
+	t.Helper()
+	f := &fakeServer{
+		files:      map[string]fakeFile{},
+		largeFiles: map[string][][]byte{},
+		largeNames: map[string]string{},
+	}
+	server := httptest.NewServer(f)
+	t.Cleanup(server.Close)
+	f.url = server.URL
+
+	b, err := NewStorageBackend(Config{
+		Endpoint:           server.URL,
+		ApplicationKeyID:   "id",
+		ApplicationKey:     "key",
+		BucketName:         "bucket",
+		RemotePath:         "backups",
+		LargeFileThreshold: 10,
+		PartSize:           5,
+	}, func(storage.LogLevel, string, string, ...any) {})
+	if err != nil {
+		t.Fatalf("Unexpected error creating backend: %v", err)
+	}
+	return b, f
+}
+
+func TestCopy(t *testing.T) {
+	b, f := newTestBackend(t)
+	dir := t.TempDir()
+	small := filepath.Join(dir, "small.tar.gz")
+	large := filepath.Join(dir, "large.tar.gz")
+	if err := os.WriteFile(small, []byte("small"), 0644); err != nil {
+		t.Fatalf("Unexpected error writing file: %v", err)
+	}
+	if err := os.WriteFile(large, []byte("this is a large file"), 0644); err != nil {
+		t.Fatalf("Unexpected error writing file: %v", err)
+	}
+
+	f.failNext = true
+	if err := b.Copy(context.Background(), small, "small.tar.gz"); err != nil {
+		t.Fatalf("Unexpected error copying small file: %v", err)
+	}
+	if err := b.Copy(context.Background(), large, "large.tar.gz"); err != nil {
+		t.Fatalf("Unexpected error copying large file: %v", err)
+	}
+	if f.parts != 4 {
+		t.Errorf("Expected large file to be uploaded in 4 parts, got %d", f.parts)
+	}
+
+	for name, expected := range map[string]string{"small.tar.gz": "small", "large.tar.gz": "this is a large file"} {
+		info, err := b.Stat(name)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if info.Size != int64(len(expected)) {
+			t.Errorf("Unexpected size %d for %s", info.Size, name)
+		}
+		r, err := b.Open(name, 0)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		content, _ := io.ReadAll(r)
+		r.Close()
+		if string(content) != expected {
+			t.Errorf("Unexpected content %s", content)
+		}
+	}
+
+	if _, err := b.Stat("missing.tar.gz"); err == nil {
+		t.Error("Expected error for missing file")
+	}
+}
+
+func TestPrune(t *testing.T) {
+	b, f := newTestBackend(t)
+	old := time.Now().Add(-48 * time.Hour)
+	f.files["backups/backup-1.tar.gz"] = fakeFile{id: "1", uploaded: old}
+	f.files["backups/backup-2.tar.gz"] = fakeFile{id: "2", uploaded: old}
+	f.files["backups/backup-2.tar.gz"+storage.ProtectionMarkerSuffix] = fakeFile{id: "3", uploaded: old}
+	f.files["backups/backup-3.tar.gz"] = fakeFile{id: "4", uploaded: time.Now()}
+	f.files["backups/other.tar.gz"] = fakeFile{id: "5", uploaded: old}
+
+	stats, err := b.Prune(context.Background(), time.Now().Add(-24*time.Hour), "backup-", false)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if stats.Total != 3 || stats.Pruned != 1 {
+		t.Errorf("Unexpected stats %#v", stats)
+	}
+	for name, expected := range map[string]bool{
+		"backups/backup-1.tar.gz": false,
+		"backups/backup-2.tar.gz": true,
+		"backups/backup-3.tar.gz": true,
+		"backups/other.tar.gz":    true,
+	} {
+		if _, ok := f.files[name]; ok != expected {
+			t.Errorf("Expected existence of %s to be %v", name, expected)
+		}
+	}
+}
+
+func TestCheckResponse(t *testing.T) {
+	rec := httptest.NewRecorder()
+	rec.WriteHeader(http.StatusTooManyRequests)
+	rec.WriteString(`{"code":"too_many_requests","message":"slow down"}`)
+
+	err := checkResponse(rec.Result())
+	var statusErr *storage.StatusError
+	if !errors.As(err, &statusErr) {
+		t.Fatalf("Expected a status error, got %v", err)
+	}
+	if statusErr.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("Expected status code 429, got %d", statusErr.StatusCode)
+	}
+	if !strings.Contains(err.Error(), "unexpected status 429 (too_many_requests): slow down") {
+		t.Errorf("Unexpected error message %v", err)
+	}
+}
@@ -0,0 +1,57 @@
+// Copyright 2024 - offen.software <hioffen@posteo.de>
+// SPDX-License-Identifier: MPL-2.0
+
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os/exec"
+	"strings"
+
+	"github.com/offen/docker-volume-backup/internal/errwrap"
+)
+
+// StartCommand starts the given command and returns a reader for its output,
+// which is used by storage backends that download files using a binary.
+// Closing the reader waits for the command to exit. In case the output has
+// been read entirely and the command failed, an error containing the output
+// of the command on stderr is returned.
+func StartCommand(cmd *exec.Cmd) (io.ReadCloser, error) {
+	stderr := &bytes.Buffer{}
+	cmd.Stderr = stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, errwrap.Wrap(err, "error creating pipe")
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, errwrap.Wrap(err, "error starting command")
+	}
+	return &commandReader{ReadCloser: stdout, cmd: cmd, stderr: stderr}, nil
+}
+
+// commandReader reads the output of a command and waits for the command
+// to exit when being closed.
+type commandReader struct {
+	io.ReadCloser
+	cmd    *exec.Cmd
+	stderr *bytes.Buffer
+	eof    bool
+}
+
+func (c *commandReader) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	if errors.Is(err, io.EOF) {
+		c.eof = true
+	}
+	return n, err
+}
+
+func (c *commandReader) Close() error {
+	c.ReadCloser.Close()
+	if err := c.cmd.Wait(); err != nil && c.eof {
+		return errwrap.Wrap(err, strings.TrimSpace(c.stderr.String()))
+	}
+	return nil
+}
@@ -3,16 +3,19 @@ package dropbox
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
+	"io"
+	"net/http"
 	"net/url"
 	"os"
-	"path"
 	"path/filepath"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/dropbox/dropbox-sdk-go-unofficial/v6/dropbox"
+	"github.com/dropbox/dropbox-sdk-go-unofficial/v6/dropbox/auth"
 	"github.com/dropbox/dropbox-sdk-go-unofficial/v6/dropbox/files"
 	"github.com/offen/docker-volume-backup/internal/errwrap"
 	"github.com/offen/docker-volume-backup/internal/storage"
@@ -23,6 +26,7 @@ type dropboxStorage struct {
 	*storage.StorageBackend
 	client           files.Client
 	concurrencyLevel int
+	rateLimitRetries int
 }
 
 // Config allows to configure a Dropbox storage backend.
@@ -34,6 +38,8 @@ type Config struct {
 	AppSecret        string
 	RemotePath       string
 	ConcurrencyLevel int
+	RateLimitRetries int
+	UserAgent        string
 }
 
 // NewStorageBackend creates and initializes a new Dropbox storage backend.
@@ -48,15 +54,20 @@ func NewStorageBackend(opts Config, logFunc storage.Log) (storage.Backend, error
 		},
 	}
 
+	ctx := context.WithValue(context.Background(), oauth2.HTTPClient, &http.Client{
+		Transport: storage.NewUserAgentTransport(http.DefaultTransport, opts.UserAgent),
+	})
+
 	logFunc(storage.LogLevelInfo, "Dropbox", "Fetching fresh access token for Dropbox storage backend.")
-	tkSource := conf.TokenSource(context.Background(), &oauth2.Token{RefreshToken: opts.RefreshToken})
+	tkSource := conf.TokenSource(ctx, &oauth2.Token{RefreshToken: opts.RefreshToken})
 	token, err := tkSource.Token()
 	if err != nil {
 		return nil, errwrap.Wrap(err, "error refreshing token")
 	}
 
 	dbxConfig := dropbox.Config{
-		Token: token.AccessToken,
+		Token:  token.AccessToken,
+		Client: oauth2.NewClient(ctx, oauth2.StaticTokenSource(&oauth2.Token{AccessToken: token.AccessToken})),
 	}
 
 	if opts.Endpoint != "https://api.dropbox.com/" {
@@ -79,6 +90,7 @@ func NewStorageBackend(opts Config, logFunc storage.Log) (storage.Backend, error
 		},
 		client:           client,
 		concurrencyLevel: opts.ConcurrencyLevel,
+		rateLimitRetries: opts.RateLimitRetries,
 	}, nil
 }
 
@@ -87,9 +99,15 @@ func (b *dropboxStorage) Name() string {
 	return "Dropbox"
 }
 
-// Copy copies the given file to the WebDav storage backend.
-func (b *dropboxStorage) Copy(file string) error {
-	_, name := path.Split(file)
+// Preflight checks the storage is writable by uploading and removing a marker
+// file.
+func (b *dropboxStorage) Preflight(ctx context.Context) error {
+	return storage.CheckWritable(ctx, b)
+}
+
+// Copy copies the given file to the Dropbox storage backend, storing it
+// using the given name.
+func (b *dropboxStorage) Copy(ctx context.Context, file, name string) error {
 
 	folderArg := files.NewCreateFolderArg(b.DestinationPath)
 	if _, err := b.client.CreateFolderV2(folderArg); err != nil {
@@ -100,15 +118,18 @@ func (b *dropboxStorage) Copy(file string) error {
 			}
 			b.Log(storage.LogLevelInfo, b.Name(), "Destination path '%s' already exists, no new directory required.", b.DestinationPath)
 		default:
-			return errwrap.Wrap(err, fmt.Sprintf("error creating directory '%s'", b.DestinationPath))
+			return errwrap.Wrap(statusError(err), fmt.Sprintf("error creating directory '%s'", b.DestinationPath))
 		}
 	}
 
-	r, err := os.Open(file)
+	f, err := os.Open(file)
 	if err != nil {
 		return errwrap.Wrap(err, "error opening the file to be uploaded")
 	}
-	defer r.Close()
+	defer f.Close()
+	// The Dropbox SDK does not support cancelling requests, so the upload is
+	// aborted before reading the next chunk instead.
+	r := storage.NewContextReader(ctx, f)
 
 	// Start new upload session and get session id
 	b.Log(storage.LogLevelInfo, b.Name(), "Starting upload session for backup '%s' at path '%s'.", file, b.DestinationPath)
@@ -116,10 +137,14 @@ func (b *dropboxStorage) Copy(file string) error {
 	var sessionId string
 	uploadSessionStartArg := files.NewUploadSessionStartArg()
 	uploadSessionStartArg.SessionType = &files.UploadSessionType{Tagged: dropbox.Tagged{Tag: files.UploadSessionTypeConcurrent}}
-	if res, err := b.client.UploadSessionStart(uploadSessionStartArg, nil); err != nil {
+	if err := b.withRateLimitRetry(func() error {
+		res, err := b.client.UploadSessionStart(uploadSessionStartArg, nil)
+		if err == nil {
+			sessionId = res.SessionId
+		}
+		return err
+	}, nil); err != nil {
 		return errwrap.Wrap(err, "error starting the upload session")
-	} else {
-		sessionId = res.SessionId
 	}
 
 	// Send the file in 148MB chunks (Dropbox API limit is 150MB, concurrent upload requires a multiple of 4MB though)
@@ -127,7 +152,7 @@ func (b *dropboxStorage) Copy(file string) error {
 
 	const chunkSize = 148 * 1024 * 1024 // 148MB
 	var offset uint64 = 0
-	var guard = make(chan struct{}, b.concurrencyLevel)
+	var limiter = newAdaptiveLimiter(b.concurrencyLevel)
 	var errorChn = make(chan error, b.concurrencyLevel)
 	var EOFChn = make(chan bool, b.concurrencyLevel)
 	var mu sync.Mutex
@@ -135,7 +160,7 @@ func (b *dropboxStorage) Copy(file string) error {
 
 loop:
 	for {
-		guard <- struct{}{} // limit concurrency
+		limiter.acquire() // limit concurrency
 		select {
 		case err := <-errorChn: // error from goroutine
 			return err
@@ -145,12 +170,13 @@ loop:
 		default:
 		}
 
+		wg.Add(1)
 		go func() {
+			var success bool
 			defer func() {
 				wg.Done()
-				<-guard
+				limiter.release(success)
 			}()
-			wg.Add(1)
 			chunk := make([]byte, chunkSize)
 
 			mu.Lock() // to preserve offset of chunks
@@ -183,20 +209,26 @@ loop:
 
 			mu.Unlock()
 
-			if err := b.client.UploadSessionAppendV2(uploadSessionAppendArg, bytes.NewReader(chunk)); err != nil {
+			if err := b.withRateLimitRetry(func() error {
+				return b.client.UploadSessionAppendV2(uploadSessionAppendArg, bytes.NewReader(chunk))
+			}, limiter.throttle); err != nil {
 				errorChn <- errwrap.Wrap(err, "error appending the file to the upload session")
 				return
 			}
+			success = true
 		}()
 	}
 
 	// Finish the upload session, commit the file (no new data added)
 
-	_, err = b.client.UploadSessionFinish(
-		files.NewUploadSessionFinishArg(
-			files.NewUploadSessionCursor(sessionId, 0),
-			files.NewCommitInfo(filepath.Join(b.DestinationPath, name)),
-		), nil)
+	err = b.withRateLimitRetry(func() error {
+		_, err := b.client.UploadSessionFinish(
+			files.NewUploadSessionFinishArg(
+				files.NewUploadSessionCursor(sessionId, 0),
+				files.NewCommitInfo(filepath.Join(b.DestinationPath, name)),
+			), nil)
+		return err
+	}, nil)
 	if err != nil {
 		return errwrap.Wrap(err, "error finishing the upload session")
 	}
@@ -206,49 +238,183 @@ loop:
 	return nil
 }
 
+// Stat returns information about the file with the given name in the Dropbox storage backend.
+func (b *dropboxStorage) Stat(name string) (*storage.ObjectInfo, error) {
+	res, err := b.client.GetMetadata(files.NewGetMetadataArg(filepath.Join(b.DestinationPath, name)))
+	if err != nil {
+		return nil, errwrap.Wrap(err, fmt.Sprintf("error looking up metadata for %s", name))
+	}
+	metadata, ok := res.(*files.FileMetadata)
+	if !ok {
+		return nil, errwrap.Wrap(nil, fmt.Sprintf("expected %s to be a file", name))
+	}
+	return &storage.ObjectInfo{
+		Name:         name,
+		Size:         int64(metadata.Size),
+		LastModified: metadata.ServerModified,
+	}, nil
+}
+
+// List returns information about all files in the Dropbox storage backend
+// whose name starts with the given prefix.
+func (b *dropboxStorage) List(prefix string) ([]storage.ObjectInfo, error) {
+	var entries []files.IsMetadata
+	res, err := b.client.ListFolder(files.NewListFolderArg(b.DestinationPath))
+	if err != nil {
+		return nil, errwrap.Wrap(err, "error looking up files from remote storage")
+	}
+	entries = append(entries, res.Entries...)
+
+	for res.HasMore {
+		res, err = b.client.ListFolderContinue(files.NewListFolderContinueArg(res.Cursor))
+		if err != nil {
+			return nil, errwrap.Wrap(err, "error looking up files from remote storage")
+		}
+		entries = append(entries, res.Entries...)
+	}
+
+	var result []storage.ObjectInfo
+	for _, entry := range entries {
+		metadata, ok := entry.(*files.FileMetadata)
+		if !ok || !strings.HasPrefix(metadata.Name, prefix) {
+			continue
+		}
+		result = append(result, storage.ObjectInfo{
+			Name:         metadata.Name,
+			Size:         int64(metadata.Size),
+			LastModified: metadata.ServerModified,
+		})
+	}
+	return result, nil
+}
+
+// Open returns a reader for the first length bytes of the file with the given
+// name in the Dropbox storage backend. If length is not positive, the entire
+// file is read.
+func (b *dropboxStorage) Open(name string, length int64) (io.ReadCloser, error) {
+	arg := files.NewDownloadArg(filepath.Join(b.DestinationPath, name))
+	if length > 0 {
+		arg.ExtraHeaders = map[string]string{
+			"Range": fmt.Sprintf("bytes=0-%d", length-1),
+		}
+	}
+	_, content, err := b.client.Download(arg)
+	if err != nil {
+		return nil, errwrap.Wrap(err, fmt.Sprintf("error downloading file %s", name))
+	}
+	return content, nil
+}
+
+// Remove deletes the file with the given name from the Dropbox storage
+// backend.
+func (b *dropboxStorage) Remove(name string) error {
+	if _, err := b.client.DeleteV2(files.NewDeleteArg(filepath.Join(b.DestinationPath, name))); err != nil {
+		return errwrap.Wrap(err, fmt.Sprintf("error removing file %s", name))
+	}
+	return nil
+}
+
+// withRateLimitRetry calls fn and retries it in case Dropbox responds with
+// a rate limit error, waiting for the duration requested in retry_after
+// or backing off exponentially in case no such value is given. throttle is
+// called before waiting so callers can reduce the number of concurrent requests.
+func (b *dropboxStorage) withRateLimitRetry(fn func() error, throttle func() int) error {
+	for attempt := 0; ; attempt++ {
+		err := fn()
+		var rateLimitErr auth.RateLimitAPIError
+		if !errors.As(err, &rateLimitErr) || attempt >= b.rateLimitRetries {
+			return statusError(err)
+		}
+
+		wait := time.Second << attempt
+		if rateLimitErr.RateLimitError != nil && rateLimitErr.RateLimitError.RetryAfter > 0 {
+			wait = time.Duration(rateLimitErr.RateLimitError.RetryAfter) * time.Second
+		}
+		if throttle != nil {
+			b.Log(storage.LogLevelWarning, b.Name(), "Rate limited by Dropbox, reducing concurrency to %d and retrying in %s (attempt %d of %d).", throttle(), wait, attempt+1, b.rateLimitRetries)
+		} else {
+			b.Log(storage.LogLevelWarning, b.Name(), "Rate limited by Dropbox, retrying in %s (attempt %d of %d).", wait, attempt+1, b.rateLimitRetries)
+		}
+		time.Sleep(wait)
+	}
+}
+
+// statusError retains the status code of errors the Dropbox SDK returns in
+// case of throttling or failures on the server side as a storage.StatusError,
+// so callers can retry such requests. Other errors are returned as is.
+func statusError(err error) error {
+	var rateLimitErr auth.RateLimitAPIError
+	var serverErr auth.ServerError
+	var internalErr dropbox.SDKInternalError
+	switch {
+	case errors.As(err, &rateLimitErr):
+		return &storage.StatusError{StatusCode: http.StatusTooManyRequests, Err: err}
+	case errors.As(err, &serverErr):
+		// The SDK does not populate the status code of server errors.
+		return &storage.StatusError{StatusCode: max(serverErr.StatusCode, http.StatusInternalServerError), Err: err}
+	case errors.As(err, &internalErr):
+		return &storage.StatusError{StatusCode: internalErr.StatusCode, Err: err}
+	}
+	return err
+}
+
 // Prune rotates away backups according to the configuration and provided deadline for the Dropbox storage backend.
-func (b *dropboxStorage) Prune(deadline time.Time, pruningPrefix string) (*storage.PruneStats, error) {
+func (b *dropboxStorage) Prune(ctx context.Context, deadline time.Time, pruningPrefix string, dryRun bool) (*storage.PruneStats, error) {
 	var entries []files.IsMetadata
 	res, err := b.client.ListFolder(files.NewListFolderArg(b.DestinationPath))
 	if err != nil {
-		return nil, errwrap.Wrap(err, "error looking up candidates from remote storage")
+		return nil, errwrap.Wrap(statusError(err), "error looking up candidates from remote storage")
 	}
 	entries = append(entries, res.Entries...)
 
 	for res.HasMore {
 		res, err = b.client.ListFolderContinue(files.NewListFolderContinueArg(res.Cursor))
 		if err != nil {
-			return nil, errwrap.Wrap(err, "error looking up candidates from remote storage")
+			return nil, errwrap.Wrap(statusError(err), "error looking up candidates from remote storage")
 		}
 		entries = append(entries, res.Entries...)
 	}
 
-	var matches []*files.FileMetadata
-	var lenCandidates int
+	var candidates []*files.FileMetadata
 	for _, candidate := range entries {
 		switch candidate := candidate.(type) {
 		case *files.FileMetadata:
-			if !strings.HasPrefix(candidate.Name, pruningPrefix) {
-				continue
-			}
-			lenCandidates++
-			if candidate.ServerModified.Before(deadline) {
-				matches = append(matches, candidate)
+			if strings.HasPrefix(candidate.Name, pruningPrefix) {
+				candidates = append(candidates, candidate)
 			}
 		default:
 			continue
 		}
 	}
 
+	candidates, lenProtected := storage.FilterProtected(candidates, func(c *files.FileMetadata) string { return c.Name }, b.PruneExclusions()...)
+	if lenProtected != 0 {
+		b.Log(storage.LogLevelInfo, b.Name(), "Skipping %d protected backups.", lenProtected)
+	}
+
+	var matches []*files.FileMetadata
+	var matchNames []string
+	lenCandidates := len(candidates) + lenProtected
+	for _, candidate := range candidates {
+		if candidate.ServerModified.Before(deadline) {
+			matches = append(matches, candidate)
+			matchNames = append(matchNames, candidate.Name)
+		}
+	}
+
 	stats := &storage.PruneStats{
-		Total:  uint(lenCandidates),
-		Pruned: uint(len(matches)),
+		Total:   uint(lenCandidates),
+		Pruned:  uint(len(matches)),
+		Matches: matchNames,
 	}
 
-	pruneErr := b.DoPrune(b.Name(), len(matches), lenCandidates, deadline, func() error {
+	pruneErr := b.DoPrune(b.Name(), len(matches), lenCandidates, deadline, dryRun, func() error {
 		for _, match := range matches {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
 			if _, err := b.client.DeleteV2(files.NewDeleteArg(filepath.Join(b.DestinationPath, match.Name))); err != nil {
-				return errwrap.Wrap(err, "error removing file from Dropbox storage")
+				return errwrap.Wrap(statusError(err), "error removing file from Dropbox storage")
 			}
 		}
 		return nil
@@ -0,0 +1,42 @@
+package dropbox
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/dropbox/dropbox-sdk-go-unofficial/v6/dropbox"
+	"github.com/dropbox/dropbox-sdk-go-unofficial/v6/dropbox/auth"
+	"github.com/offen/docker-volume-backup/internal/storage"
+)
+
+func TestStatusError(t *testing.T) {
+	tests := []struct {
+		name       string
+		err        error
+		statusCode int
+	}{
+		{"rate limit", auth.RateLimitAPIError{}, http.StatusTooManyRequests},
+		{"server error", auth.ServerError{}, http.StatusInternalServerError},
+		{"internal error", dropbox.SDKInternalError{StatusCode: http.StatusBadGateway}, http.StatusBadGateway},
+		{"other error", errors.New("other"), 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := statusError(test.err)
+			if !errors.Is(err, test.err) {
+				t.Errorf("Expected %v to wrap %v", err, test.err)
+			}
+			var statusErr *storage.StatusError
+			if !errors.As(err, &statusErr) {
+				if test.statusCode != 0 {
+					t.Errorf("Expected a status error, got %v", err)
+				}
+				return
+			}
+			if statusErr.StatusCode != test.statusCode {
+				t.Errorf("Expected status code %d, got %d", test.statusCode, statusErr.StatusCode)
+			}
+		})
+	}
+}
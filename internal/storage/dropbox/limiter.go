@@ -0,0 +1,62 @@
+// Copyright 2024 - offen.software <hioffen@posteo.de>
+// SPDX-License-Identifier: MPL-2.0
+
+package dropbox
+
+import "sync"
+
+// adaptiveLimiter limits the number of concurrently running operations.
+// The limit is halved each time Dropbox rate limits a request and slowly
+// recovers towards the configured maximum as requests succeed again.
+type adaptiveLimiter struct {
+	mu        sync.Mutex
+	cond      *sync.Cond
+	max       int
+	limit     int
+	active    int
+	successes int
+}
+
+func newAdaptiveLimiter(max int) *adaptiveLimiter {
+	l := &adaptiveLimiter{max: max, limit: max}
+	l.cond = sync.NewCond(&l.mu)
+	return l
+}
+
+// acquire blocks until running another operation does not exceed the
+// current limit.
+func (l *adaptiveLimiter) acquire() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for l.active >= l.limit {
+		l.cond.Wait()
+	}
+	l.active++
+}
+
+// release frees a slot acquired before. Successful operations count towards
+// raising the limit by one again.
+func (l *adaptiveLimiter) release(success bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.active--
+	if success && l.limit < l.max {
+		l.successes++
+		if l.successes >= l.limit {
+			l.limit++
+			l.successes = 0
+		}
+	}
+	l.cond.Broadcast()
+}
+
+// throttle halves the current limit and returns the new value.
+func (l *adaptiveLimiter) throttle() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.limit > 1 {
+		l.limit = l.limit / 2
+	}
+	l.successes = 0
+	return l.limit
+}
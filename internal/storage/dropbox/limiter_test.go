@@ -0,0 +1,31 @@
+package dropbox
+
+import "testing"
+
+func TestAdaptiveLimiter(t *testing.T) {
+	l := newAdaptiveLimiter(4)
+
+	if limit := l.throttle(); limit != 2 {
+		t.Errorf("Expected limit of 2 after throttling, got %d", limit)
+	}
+	if limit := l.throttle(); limit != 1 {
+		t.Errorf("Expected limit of 1 after throttling, got %d", limit)
+	}
+	if limit := l.throttle(); limit != 1 {
+		t.Errorf("Expected limit to not drop below 1, got %d", limit)
+	}
+
+	for i := 0; i < 20; i++ {
+		l.acquire()
+		l.release(true)
+	}
+	if l.limit != 4 {
+		t.Errorf("Expected limit to recover to 4, got %d", l.limit)
+	}
+
+	l.acquire()
+	l.release(false)
+	if l.active != 0 {
+		t.Errorf("Expected no active operations, got %d", l.active)
+	}
+}
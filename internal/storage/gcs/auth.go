@@ -0,0 +1,177 @@
+// Copyright 2024 - offen.software <hioffen@posteo.de>
+// SPDX-License-Identifier: MPL-2.0
+
+package gcs
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/offen/docker-volume-backup/internal/errwrap"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/jwt"
+)
+
+const (
+	scope           = "https://www.googleapis.com/auth/devstorage.read_write"
+	defaultTokenURL = "https://oauth2.googleapis.com/token"
+	metadataURL     = "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token"
+	impersonateURL  = "https://iamcredentials.googleapis.com/v1/projects/-/serviceAccounts/%s:generateAccessToken"
+)
+
+// credentialsFile is the format of service account keys and user credentials
+// as created by `gcloud auth application-default login`.
+type credentialsFile struct {
+	Type         string `json:"type"`
+	ClientEmail  string `json:"client_email"`
+	PrivateKeyID string `json:"private_key_id"`
+	PrivateKey   string `json:"private_key"`
+	TokenURI     string `json:"token_uri"`
+	ClientID     string `json:"client_id"`
+	ClientSecret string `json:"client_secret"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+// newTokenSource creates a token source from the given credentials JSON. In
+// case no credentials are given, tokens are requested from the metadata
+// server, e.g. when using Workload Identity on GKE. In case a service account
+// to impersonate is given, the credentials are used for requesting tokens for
+// this service account.
+func newTokenSource(ctx context.Context, credentials, impersonate string) (oauth2.TokenSource, error) {
+	var ts oauth2.TokenSource
+	if credentials == "" {
+		ts = &metadataTokenSource{ctx: ctx}
+	} else {
+		var f credentialsFile
+		if err := json.Unmarshal([]byte(credentials), &f); err != nil {
+			return nil, errwrap.Wrap(err, "error parsing credentials")
+		}
+		tokenURL := f.TokenURI
+		if tokenURL == "" {
+			tokenURL = defaultTokenURL
+		}
+		switch f.Type {
+		case "service_account":
+			conf := &jwt.Config{
+				Email:        f.ClientEmail,
+				PrivateKey:   []byte(f.PrivateKey),
+				PrivateKeyID: f.PrivateKeyID,
+				Scopes:       []string{scope},
+				TokenURL:     tokenURL,
+			}
+			ts = conf.TokenSource(ctx)
+		case "authorized_user":
+			conf := &oauth2.Config{
+				ClientID:     f.ClientID,
+				ClientSecret: f.ClientSecret,
+				Endpoint:     oauth2.Endpoint{TokenURL: tokenURL},
+				Scopes:       []string{scope},
+			}
+			ts = conf.TokenSource(ctx, &oauth2.Token{RefreshToken: f.RefreshToken})
+		default:
+			return nil, errwrap.Wrap(nil, fmt.Sprintf("unsupported credentials type %s", f.Type))
+		}
+	}
+
+	if impersonate != "" {
+		ts = &impersonatedTokenSource{
+			ctx:    ctx,
+			client: oauth2.NewClient(ctx, ts),
+			target: impersonate,
+		}
+	}
+	return oauth2.ReuseTokenSource(nil, ts), nil
+}
+
+// metadataTokenSource requests tokens for the default service account from
+// the metadata server.
+type metadataTokenSource struct {
+	ctx context.Context
+}
+
+func (m *metadataTokenSource) Token() (*oauth2.Token, error) {
+	req, err := http.NewRequestWithContext(m.ctx, http.MethodGet, metadataURL, nil)
+	if err != nil {
+		return nil, errwrap.Wrap(err, "error creating request")
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	res, err := httpClient(m.ctx).Do(req)
+	if err != nil {
+		return nil, errwrap.Wrap(err, "error requesting token from metadata server")
+	}
+	defer res.Body.Close()
+	if err := checkResponse(res); err != nil {
+		return nil, errwrap.Wrap(err, "error requesting token from metadata server")
+	}
+
+	var payload struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+		TokenType   string `json:"token_type"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&payload); err != nil {
+		return nil, errwrap.Wrap(err, "error decoding token")
+	}
+	return &oauth2.Token{
+		AccessToken: payload.AccessToken,
+		TokenType:   payload.TokenType,
+		Expiry:      time.Now().Add(time.Duration(payload.ExpiresIn) * time.Second),
+	}, nil
+}
+
+// impersonatedTokenSource requests short-lived tokens for the target service
+// account using the IAM Credentials API.
+type impersonatedTokenSource struct {
+	ctx    context.Context
+	client *http.Client
+	target string
+}
+
+func (i *impersonatedTokenSource) Token() (*oauth2.Token, error) {
+	body, err := json.Marshal(map[string]any{
+		"scope":    []string{scope},
+		"lifetime": "3600s",
+	})
+	if err != nil {
+		return nil, errwrap.Wrap(err, "error marshaling request")
+	}
+	req, err := http.NewRequestWithContext(i.ctx, http.MethodPost, fmt.Sprintf(impersonateURL, i.target), bytes.NewReader(body))
+	if err != nil {
+		return nil, errwrap.Wrap(err, "error creating request")
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := i.client.Do(req)
+	if err != nil {
+		return nil, errwrap.Wrap(err, fmt.Sprintf("error impersonating %s", i.target))
+	}
+	defer res.Body.Close()
+	if err := checkResponse(res); err != nil {
+		return nil, errwrap.Wrap(err, fmt.Sprintf("error impersonating %s", i.target))
+	}
+
+	var payload struct {
+		AccessToken string    `json:"accessToken"`
+		ExpireTime  time.Time `json:"expireTime"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&payload); err != nil {
+		return nil, errwrap.Wrap(err, "error decoding token")
+	}
+	return &oauth2.Token{
+		AccessToken: payload.AccessToken,
+		TokenType:   "Bearer",
+		Expiry:      payload.ExpireTime,
+	}, nil
+}
+
+// httpClient returns the client stored in the given context as done by
+// the oauth2 package, falling back to the default client.
+func httpClient(ctx context.Context) *http.Client {
+	if c, ok := ctx.Value(oauth2.HTTPClient).(*http.Client); ok {
+		return c
+	}
+	return http.DefaultClient
+}
@@ -0,0 +1,349 @@
+// Copyright 2024 - offen.software <hioffen@posteo.de>
+// SPDX-License-Identifier: MPL-2.0
+
+package gcs
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/offen/docker-volume-backup/internal/errwrap"
+	"github.com/offen/docker-volume-backup/internal/storage"
+	"golang.org/x/oauth2"
+)
+
+type gcsStorage struct {
+	*storage.StorageBackend
+	client     *http.Client
+	endpoint   string
+	bucket     string
+	kmsKeyName string
+}
+
+// Config contains values that define the configuration of a Google Cloud
+// Storage bucket.
+type Config struct {
+	BucketName                string
+	RemotePath                string
+	Credentials               string
+	ImpersonateServiceAccount string
+	KMSKeyName                string
+	Endpoint                  string
+	UserAgent                 string
+}
+
+// NewStorageBackend creates and initializes a new Google Cloud Storage backend.
+func NewStorageBackend(opts Config, logFunc storage.Log) (storage.Backend, error) {
+	ctx := context.WithValue(context.Background(), oauth2.HTTPClient, &http.Client{
+		Transport: storage.NewUserAgentTransport(http.DefaultTransport, opts.UserAgent),
+	})
+	ts, err := newTokenSource(ctx, opts.Credentials, opts.ImpersonateServiceAccount)
+	if err != nil {
+		return nil, errwrap.Wrap(err, "error creating token source")
+	}
+
+	return &gcsStorage{
+		client:     oauth2.NewClient(ctx, ts),
+		endpoint:   strings.TrimSuffix(opts.Endpoint, "/"),
+		bucket:     opts.BucketName,
+		kmsKeyName: opts.KMSKeyName,
+		StorageBackend: &storage.StorageBackend{
+			DestinationPath: opts.RemotePath,
+			Log:             logFunc,
+		},
+	}, nil
+}
+
+// Name returns the name of the storage backend
+func (b *gcsStorage) Name() string {
+	return "GCS"
+}
+
+// Preflight checks the storage is writable by uploading and removing a marker
+// file.
+func (b *gcsStorage) Preflight(ctx context.Context) error {
+	return storage.CheckWritable(ctx, b)
+}
+
+// object is the subset of the object resource of the JSON API used by the
+// storage backend.
+type object struct {
+	Name    string    `json:"name"`
+	Size    string    `json:"size"`
+	Updated time.Time `json:"updated"`
+}
+
+func (o *object) info(name string) storage.ObjectInfo {
+	size, _ := strconv.ParseInt(o.Size, 10, 64)
+	return storage.ObjectInfo{
+		Name:         name,
+		Size:         size,
+		LastModified: o.Updated,
+	}
+}
+
+func (b *gcsStorage) key(name string) string {
+	return strings.TrimPrefix(path.Join(b.DestinationPath, name), "/")
+}
+
+func (b *gcsStorage) objectURL(key string) string {
+	return fmt.Sprintf("%s/storage/v1/b/%s/o/%s", b.endpoint, url.PathEscape(b.bucket), url.PathEscape(key))
+}
+
+// Copy copies the given file to the storage backend, storing it
+// using the given name. Files are uploaded using a resumable upload
+// session, encrypting them using the configured KMS key if given.
+func (b *gcsStorage) Copy(ctx context.Context, file, name string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return errwrap.Wrap(err, fmt.Sprintf("error opening file %s", file))
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return errwrap.Wrap(err, fmt.Sprintf("error getting file info for %s", file))
+	}
+
+	key := b.key(name)
+	query := url.Values{"uploadType": {"resumable"}, "name": {key}}
+	if b.kmsKeyName != "" {
+		query.Set("kmsKeyName", b.kmsKeyName)
+	}
+	metadata, err := json.Marshal(map[string]string{"name": key})
+	if err != nil {
+		return errwrap.Wrap(err, "error marshaling object metadata")
+	}
+	req, err := http.NewRequestWithContext(
+		ctx,
+		http.MethodPost,
+		fmt.Sprintf("%s/upload/storage/v1/b/%s/o?%s", b.endpoint, url.PathEscape(b.bucket), query.Encode()),
+		bytes.NewReader(metadata),
+	)
+	if err != nil {
+		return errwrap.Wrap(err, "error creating request")
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Upload-Content-Type", "application/octet-stream")
+	req.Header.Set("X-Upload-Content-Length", strconv.FormatInt(fi.Size(), 10))
+	res, err := b.do(req)
+	if err != nil {
+		return errwrap.Wrap(err, "error starting upload session")
+	}
+	res.Body.Close()
+	session := res.Header.Get("Location")
+	if session == "" {
+		return errwrap.Wrap(nil, "upload session did not return a location")
+	}
+
+	req, err = http.NewRequestWithContext(ctx, http.MethodPut, session, f)
+	if err != nil {
+		return errwrap.Wrap(err, "error creating request")
+	}
+	req.ContentLength = fi.Size()
+	res, err = b.do(req)
+	if err != nil {
+		return errwrap.Wrap(err, fmt.Sprintf("error uploading backup to bucket %s", b.bucket))
+	}
+	res.Body.Close()
+
+	b.Log(storage.LogLevelInfo, b.Name(), "Uploaded a copy of backup `%s` to bucket `%s`.", file, b.bucket)
+	return nil
+}
+
+// Stat returns information about the object with the given name in the
+// Google Cloud Storage backend.
+func (b *gcsStorage) Stat(name string) (*storage.ObjectInfo, error) {
+	req, err := http.NewRequest(http.MethodGet, b.objectURL(b.key(name)), nil)
+	if err != nil {
+		return nil, errwrap.Wrap(err, "error creating request")
+	}
+	res, err := b.do(req)
+	if err != nil {
+		return nil, errwrap.Wrap(err, fmt.Sprintf("error looking up object %s", name))
+	}
+	defer res.Body.Close()
+	var o object
+	if err := json.NewDecoder(res.Body).Decode(&o); err != nil {
+		return nil, errwrap.Wrap(err, "error decoding object")
+	}
+	info := o.info(name)
+	return &info, nil
+}
+
+// List returns information about all objects in the Google Cloud Storage
+// backend whose name starts with the given prefix.
+func (b *gcsStorage) List(prefix string) ([]storage.ObjectInfo, error) {
+	objects, err := b.list(context.Background(), b.key(prefix))
+	if err != nil {
+		return nil, err
+	}
+	var result []storage.ObjectInfo
+	for _, o := range objects {
+		name := strings.TrimPrefix(strings.TrimPrefix(o.Name, b.key("")), "/")
+		result = append(result, o.info(name))
+	}
+	return result, nil
+}
+
+func (b *gcsStorage) list(ctx context.Context, prefix string) ([]object, error) {
+	var objects []object
+	var pageToken string
+	for {
+		query := url.Values{"prefix": {prefix}}
+		if pageToken != "" {
+			query.Set("pageToken", pageToken)
+		}
+		req, err := http.NewRequestWithContext(
+			ctx,
+			http.MethodGet,
+			fmt.Sprintf("%s/storage/v1/b/%s/o?%s", b.endpoint, url.PathEscape(b.bucket), query.Encode()),
+			nil,
+		)
+		if err != nil {
+			return nil, errwrap.Wrap(err, "error creating request")
+		}
+		res, err := b.do(req)
+		if err != nil {
+			return nil, errwrap.Wrap(err, "error looking up objects from remote storage")
+		}
+		var page struct {
+			Items         []object `json:"items"`
+			NextPageToken string   `json:"nextPageToken"`
+		}
+		err = json.NewDecoder(res.Body).Decode(&page)
+		res.Body.Close()
+		if err != nil {
+			return nil, errwrap.Wrap(err, "error decoding objects")
+		}
+		objects = append(objects, page.Items...)
+		if page.NextPageToken == "" {
+			return objects, nil
+		}
+		pageToken = page.NextPageToken
+	}
+}
+
+// Open returns a reader for the first length bytes of the object with the
+// given name in the Google Cloud Storage backend. If length is not positive,
+// the entire object is read.
+func (b *gcsStorage) Open(name string, length int64) (io.ReadCloser, error) {
+	req, err := http.NewRequest(http.MethodGet, b.objectURL(b.key(name))+"?alt=media", nil)
+	if err != nil {
+		return nil, errwrap.Wrap(err, "error creating request")
+	}
+	if length > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=0-%d", length-1))
+	}
+	res, err := b.do(req)
+	if err != nil {
+		return nil, errwrap.Wrap(err, fmt.Sprintf("error downloading object %s", name))
+	}
+	return res.Body, nil
+}
+
+// Remove deletes the object with the given name from the Google Cloud
+// Storage backend.
+func (b *gcsStorage) Remove(name string) error {
+	return b.remove(context.Background(), b.key(name))
+}
+
+func (b *gcsStorage) remove(ctx context.Context, key string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, b.objectURL(key), nil)
+	if err != nil {
+		return errwrap.Wrap(err, "error creating request")
+	}
+	res, err := b.do(req)
+	if err != nil {
+		return errwrap.Wrap(err, fmt.Sprintf("error removing object %s", key))
+	}
+	res.Body.Close()
+	return nil
+}
+
+// Prune rotates away backups according to the configuration and provided
+// deadline for the Google Cloud Storage backend.
+func (b *gcsStorage) Prune(ctx context.Context, deadline time.Time, pruningPrefix string, dryRun bool) (*storage.PruneStats, error) {
+	candidates, err := b.list(ctx, b.key(pruningPrefix))
+	if err != nil {
+		return nil, errwrap.Wrap(err, "error listing candidates for pruning")
+	}
+
+	candidates, lenProtected := storage.FilterProtected(candidates, func(o object) string { return o.Name }, b.PruneExclusions()...)
+	if lenProtected != 0 {
+		b.Log(storage.LogLevelInfo, b.Name(), "Skipping %d protected backups.", lenProtected)
+	}
+
+	var matches []string
+	lenCandidates := len(candidates) + lenProtected
+	for _, candidate := range candidates {
+		if candidate.Updated.Before(deadline) {
+			matches = append(matches, candidate.Name)
+		}
+	}
+
+	stats := &storage.PruneStats{
+		Total:   uint(lenCandidates),
+		Pruned:  uint(len(matches)),
+		Matches: matches,
+	}
+
+	pruneErr := b.DoPrune(b.Name(), len(matches), lenCandidates, deadline, dryRun, func() error {
+		var errs []error
+		for _, match := range matches {
+			if err := b.remove(ctx, match); err != nil {
+				errs = append(errs, err)
+			}
+		}
+		return errors.Join(errs...)
+	})
+
+	return stats, pruneErr
+}
+
+// do sends the given request, returning an error in case the response
+// does not indicate success.
+func (b *gcsStorage) do(req *http.Request) (*http.Response, error) {
+	res, err := b.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkResponse(res); err != nil {
+		res.Body.Close()
+		return nil, err
+	}
+	return res, nil
+}
+
+// checkResponse returns an error containing the message returned by the API
+// in case the given response does not indicate success. The status code is
+// retained as a storage.StatusError, so callers can retry transient errors.
+func checkResponse(res *http.Response) error {
+	if res.StatusCode >= 200 && res.StatusCode < 300 {
+		return nil
+	}
+	body, _ := io.ReadAll(io.LimitReader(res.Body, 1<<16))
+	var payload struct {
+		Error struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	message := strings.TrimSpace(string(body))
+	if err := json.Unmarshal(body, &payload); err == nil && payload.Error.Message != "" {
+		message = payload.Error.Message
+	}
+	return &storage.StatusError{
+		StatusCode: res.StatusCode,
+		Err:        errwrap.Wrap(nil, fmt.Sprintf("unexpected status %d: %s", res.StatusCode, message)),
+	}
+}
@@ -0,0 +1,181 @@
+package gcs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/offen/docker-volume-backup/internal/storage"
+)
+
+type fakeObject struct {
+	content []byte
+	updated time.Time
+}
+
+// fakeServer implements the parts of the JSON API used by the backend.
+type fakeServer struct {
+	mu      sync.Mutex
+	objects map[string]fakeObject
+	kmsKey  string
+}
+
+func (f *fakeServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	switch {
+	case r.Method == http.MethodPost && strings.HasPrefix(r.URL.Path, "/upload/storage/v1/b/bucket/o"):
+		f.kmsKey = r.URL.Query().Get("kmsKeyName")
+		w.Header().Set("Location", "http://"+r.Host+"/session/"+r.URL.Query().Get("name"))
+	case r.Method == http.MethodPut && strings.HasPrefix(r.URL.Path, "/session/"):
+		b, _ := io.ReadAll(r.Body)
+		f.objects[strings.TrimPrefix(r.URL.Path, "/session/")] = fakeObject{content: b, updated: time.Now()}
+	case r.Method == http.MethodGet && r.URL.Path == "/storage/v1/b/bucket/o":
+		var items []map[string]any
+		for name, o := range f.objects {
+			if strings.HasPrefix(name, r.URL.Query().Get("prefix")) {
+				items = append(items, f.resource(name, o))
+			}
+		}
+		json.NewEncoder(w).Encode(map[string]any{"items": items})
+	case strings.HasPrefix(r.URL.Path, "/storage/v1/b/bucket/o/"):
+		name := strings.TrimPrefix(r.URL.Path, "/storage/v1/b/bucket/o/")
+		o, ok := f.objects[name]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"error":{"message":"No such object"}}`)
+			return
+		}
+		switch {
+		case r.Method == http.MethodDelete:
+			delete(f.objects, name)
+		case r.URL.Query().Get("alt") == "media":
+			w.Write(o.content)
+		default:
+			json.NewEncoder(w).Encode(f.resource(name, o))
+		}
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+	}
+}
+
+func (f *fakeServer) resource(name string, o fakeObject) map[string]any {
+	return map[string]any{
+		"name":    name,
+		"size":    fmt.Sprintf("%d", len(o.content)),
+		"updated": o.updated.Format(time.RFC3339Nano),
+	}
+}
+
+func newTestBackend(t *testing.T) (*gcsStorage, *fakeServer) {
+	t.Helper()
+	f := &fakeServer{objects: map[string]fakeObject{}}
+	server := httptest.NewServer(f)
+	t.Cleanup(server.Close)
+	return &gcsStorage{
+		client:     server.Client(),
+		endpoint:   server.URL,
+		bucket:     "bucket",
+		kmsKeyName: "my-key",
+		StorageBackend: &storage.StorageBackend{
+			DestinationPath: "backups",
+			Log:             func(storage.LogLevel, string, string, ...any) {},
+		},
+	}, f
+}
+
+func TestCopyStat(t *testing.T) {
+	b, f := newTestBackend(t)
+	file := filepath.Join(t.TempDir(), "backup.tar.gz")
+	if err := os.WriteFile(file, []byte("content"), 0644); err != nil {
+		t.Fatalf("Unexpected error writing file: %v", err)
+	}
+	if err := b.Copy(context.Background(), file, "backup.tar.gz"); err != nil {
+		t.Fatalf("Unexpected error copying file: %v", err)
+	}
+	if f.kmsKey != "my-key" {
+		t.Errorf("Expected KMS key to be passed, got %q", f.kmsKey)
+	}
+
+	info, err := b.Stat("backup.tar.gz")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if info.Size != 7 {
+		t.Errorf("Expected size 7, got %d", info.Size)
+	}
+
+	r, err := b.Open("backup.tar.gz", 0)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer r.Close()
+	content, _ := io.ReadAll(r)
+	if string(content) != "content" {
+		t.Errorf("Unexpected content %s", content)
+	}
+
+	if _, err := b.Stat("missing.tar.gz"); err == nil || !strings.Contains(err.Error(), "No such object") {
+		t.Errorf("Expected error for missing object, got %v", err)
+	}
+}
+
+func TestPrune(t *testing.T) {
+	b, f := newTestBackend(t)
+	old := time.Now().Add(-48 * time.Hour)
+	f.objects["backups/backup-1.tar.gz"] = fakeObject{updated: old}
+	f.objects["backups/backup-2.tar.gz"] = fakeObject{updated: old}
+	f.objects["backups/backup-2.tar.gz"+storage.ProtectionMarkerSuffix] = fakeObject{updated: old}
+	f.objects["backups/backup-3.tar.gz"] = fakeObject{updated: time.Now()}
+
+	objects, err := b.List("backup-")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(objects) != 4 {
+		t.Errorf("Expected 4 objects, got %d", len(objects))
+	}
+
+	stats, err := b.Prune(context.Background(), time.Now().Add(-24*time.Hour), "backup-", false)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if stats.Total != 3 || stats.Pruned != 1 {
+		t.Errorf("Unexpected stats %#v", stats)
+	}
+	if _, ok := f.objects["backups/backup-1.tar.gz"]; ok {
+		t.Error("Expected backup-1 to be pruned")
+	}
+	if _, ok := f.objects["backups/backup-2.tar.gz"]; !ok {
+		t.Error("Expected protected backup-2 to be kept")
+	}
+}
+
+func TestCheckResponse(t *testing.T) {
+	rec := httptest.NewRecorder()
+	rec.WriteHeader(http.StatusTooManyRequests)
+	rec.WriteString(`{"error":{"message":"slow down"}}`)
+
+	err := checkResponse(rec.Result())
+	var statusErr *storage.StatusError
+	if !errors.As(err, &statusErr) {
+		t.Fatalf("Expected a status error, got %v", err)
+	}
+	if statusErr.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("Expected status code 429, got %d", statusErr.StatusCode)
+	}
+	if !strings.Contains(err.Error(), "unexpected status 429: slow down") {
+		t.Errorf("Unexpected error message %v", err)
+	}
+}
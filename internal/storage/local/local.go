@@ -4,12 +4,14 @@
 package local
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
 	"os"
 	"path"
 	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/offen/docker-volume-backup/internal/errwrap"
@@ -43,31 +45,165 @@ func (b *localStorage) Name() string {
 	return "Local"
 }
 
-// Copy copies the given file to the local storage backend.
-func (b *localStorage) Copy(file string) error {
-	_, name := path.Split(file)
+// Preflight checks the archive directory is writable by creating and
+// removing a temporary file. The marker is not copied using Copy, as it
+// must not replace the latest symlink.
+func (b *localStorage) Preflight(ctx context.Context) error {
+	f, err := os.CreateTemp(b.DestinationPath, storage.PreflightMarkerPrefix+"*")
+	if err != nil {
+		return errwrap.Wrap(err, "error creating marker file")
+	}
+	f.Close()
+	if err := os.Remove(f.Name()); err != nil {
+		return errwrap.Wrap(err, "error removing marker file")
+	}
+	return nil
+}
 
-	if err := copyFile(file, path.Join(b.DestinationPath, name)); err != nil {
+// Copy copies the given file to the local storage backend, storing it
+// using the given name.
+func (b *localStorage) Copy(ctx context.Context, file, name string) error {
+	if dir := path.Dir(name); dir != "." {
+		if err := os.MkdirAll(path.Join(b.DestinationPath, dir), 0755); err != nil {
+			return errwrap.Wrap(err, fmt.Sprintf("error creating directory %s", dir))
+		}
+	}
+
+	if err := copyFile(ctx, file, path.Join(b.DestinationPath, name)); err != nil {
 		return errwrap.Wrap(err, "error copying file to archive")
 	}
 	b.Log(storage.LogLevelInfo, b.Name(), "Stored copy of backup `%s` in `%s`.", file, b.DestinationPath)
 
-	if b.latestSymlink != "" {
-		symlink := path.Join(b.DestinationPath, b.latestSymlink)
-		if _, err := os.Lstat(symlink); err == nil {
-			os.Remove(symlink)
+	return b.updateLatestSymlink(name)
+}
+
+// CopyFrom stores the data read from the given reader in the local storage
+// backend using the given name. The data is written to a temporary file
+// first, which is only moved into place once all data has been read.
+func (b *localStorage) CopyFrom(r io.Reader, name string) error {
+	dir := path.Join(b.DestinationPath, path.Dir(name))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return errwrap.Wrap(err, fmt.Sprintf("error creating directory %s", dir))
+	}
+
+	out, err := os.CreateTemp(dir, fmt.Sprintf(".%s-*", path.Base(name)))
+	if err != nil {
+		return errwrap.Wrap(err, "error creating temporary file")
+	}
+	defer os.Remove(out.Name())
+	if _, err := io.Copy(out, r); err != nil {
+		out.Close()
+		return errwrap.Wrap(err, "error writing backup to archive")
+	}
+	if err := out.Close(); err != nil {
+		return errwrap.Wrap(err, "error closing temporary file")
+	}
+	if err := os.Chmod(out.Name(), 0644); err != nil {
+		return errwrap.Wrap(err, "error setting permissions of backup")
+	}
+	if err := os.Rename(out.Name(), path.Join(b.DestinationPath, name)); err != nil {
+		return errwrap.Wrap(err, "error moving backup into place")
+	}
+	b.Log(storage.LogLevelInfo, b.Name(), "Stored streamed backup `%s` in `%s`.", name, b.DestinationPath)
+
+	return b.updateLatestSymlink(name)
+}
+
+// updateLatestSymlink points the latest symlink to the file with the given
+// name, in case a symlink is configured. Files named after the symlink, e.g.
+// the envelope of the latest backup, are stored next to it and do not
+// replace it.
+func (b *localStorage) updateLatestSymlink(name string) error {
+	if b.latestSymlink == "" || strings.HasPrefix(path.Base(name), b.latestSymlink+".") {
+		return nil
+	}
+	symlink := path.Join(b.DestinationPath, b.latestSymlink)
+	if _, err := os.Lstat(symlink); err == nil {
+		os.Remove(symlink)
+	}
+	if err := os.Symlink(name, symlink); err != nil {
+		return errwrap.Wrap(err, "error creating latest symlink")
+	}
+	b.Log(storage.LogLevelInfo, b.Name(), "Created/Updated symlink `%s` for latest backup.", b.latestSymlink)
+	return nil
+}
+
+// Stat returns information about the file with the given name in the local storage backend.
+func (b *localStorage) Stat(name string) (*storage.ObjectInfo, error) {
+	fi, err := os.Stat(path.Join(b.DestinationPath, name))
+	if err != nil {
+		return nil, errwrap.Wrap(err, fmt.Sprintf("error calling stat on file %s", name))
+	}
+	return &storage.ObjectInfo{
+		Name:         name,
+		Size:         fi.Size(),
+		LastModified: fi.ModTime(),
+	}, nil
+}
+
+// List returns information about all files in the local storage backend
+// whose name starts with the given prefix. Symlinks are ignored.
+func (b *localStorage) List(prefix string) ([]storage.ObjectInfo, error) {
+	globPattern := path.Join(
+		b.DestinationPath,
+		fmt.Sprintf("%s*", prefix),
+	)
+	globMatches, err := filepath.Glob(globPattern)
+	if err != nil {
+		return nil, errwrap.Wrap(
+			err,
+			fmt.Sprintf(
+				"error looking up matching files using pattern %s",
+				globPattern,
+			),
+		)
+	}
+
+	var result []storage.ObjectInfo
+	for _, candidate := range globMatches {
+		fi, err := os.Lstat(candidate)
+		if err != nil {
+			return nil, errwrap.Wrap(
+				err,
+				fmt.Sprintf(
+					"error calling Lstat on file %s",
+					candidate,
+				),
+			)
 		}
-		if err := os.Symlink(name, symlink); err != nil {
-			return errwrap.Wrap(err, "error creating latest symlink")
+		if !fi.Mode().IsRegular() {
+			continue
 		}
-		b.Log(storage.LogLevelInfo, b.Name(), "Created/Updated symlink `%s` for latest backup.", b.latestSymlink)
+		result = append(result, storage.ObjectInfo{
+			Name:         fi.Name(),
+			Size:         fi.Size(),
+			LastModified: fi.ModTime(),
+		})
+	}
+	return result, nil
+}
+
+// Open returns a reader for the first length bytes of the file with the given
+// name in the local storage backend. If length is not positive, the entire
+// file is read.
+func (b *localStorage) Open(name string, length int64) (io.ReadCloser, error) {
+	f, err := os.Open(path.Join(b.DestinationPath, name))
+	if err != nil {
+		return nil, errwrap.Wrap(err, fmt.Sprintf("error opening file %s", name))
 	}
+	return storage.LimitReadCloser(f, length), nil
+}
 
+// Remove deletes the file with the given name from the local storage backend.
+func (b *localStorage) Remove(name string) error {
+	if err := os.Remove(path.Join(b.DestinationPath, name)); err != nil {
+		return errwrap.Wrap(err, fmt.Sprintf("error removing file %s", name))
+	}
 	return nil
 }
 
 // Prune rotates away backups according to the configuration and provided deadline for the local storage backend.
-func (b *localStorage) Prune(deadline time.Time, pruningPrefix string) (*storage.PruneStats, error) {
+func (b *localStorage) Prune(ctx context.Context, deadline time.Time, pruningPrefix string, dryRun bool) (*storage.PruneStats, error) {
 	globPattern := path.Join(
 		b.DestinationPath,
 		fmt.Sprintf("%s*", pruningPrefix),
@@ -101,7 +237,14 @@ func (b *localStorage) Prune(deadline time.Time, pruningPrefix string) (*storage
 		}
 	}
 
+	candidates, lenProtected := storage.FilterProtected(candidates, func(c string) string { return c }, b.PruneExclusions()...)
+	if lenProtected != 0 {
+		b.Log(storage.LogLevelInfo, b.Name(), "Skipping %d protected backups.", lenProtected)
+	}
+	lenCandidates := len(candidates) + lenProtected
+
 	var matches []string
+	var matchNames []string
 	for _, candidate := range candidates {
 		fi, err := os.Stat(candidate)
 		if err != nil {
@@ -115,17 +258,23 @@ func (b *localStorage) Prune(deadline time.Time, pruningPrefix string) (*storage
 		}
 		if fi.ModTime().Before(deadline) {
 			matches = append(matches, candidate)
+			matchNames = append(matchNames, filepath.Base(candidate))
 		}
 	}
 
 	stats := &storage.PruneStats{
-		Total:  uint(len(candidates)),
-		Pruned: uint(len(matches)),
+		Total:   uint(lenCandidates),
+		Pruned:  uint(len(matches)),
+		Matches: matchNames,
 	}
 
-	pruneErr := b.DoPrune(b.Name(), len(matches), len(candidates), deadline, func() error {
+	pruneErr := b.DoPrune(b.Name(), len(matches), lenCandidates, deadline, dryRun, func() error {
 		var removeErrors []error
 		for _, match := range matches {
+			if err := ctx.Err(); err != nil {
+				removeErrors = append(removeErrors, err)
+				break
+			}
 			if err := os.Remove(match); err != nil {
 				removeErrors = append(removeErrors, err)
 			}
@@ -146,7 +295,7 @@ func (b *localStorage) Prune(deadline time.Time, pruningPrefix string) (*storage
 }
 
 // copy creates a copy of the file located at `dst` at `src`.
-func copyFile(src, dst string) error {
+func copyFile(ctx context.Context, src, dst string) error {
 	in, err := os.Open(src)
 	if err != nil {
 		return err
@@ -158,7 +307,7 @@ func copyFile(src, dst string) error {
 		return err
 	}
 
-	_, err = io.Copy(out, in)
+	_, err = io.Copy(out, storage.NewContextReader(ctx, in))
 	if err != nil {
 		out.Close()
 		return err
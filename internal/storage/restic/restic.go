@@ -0,0 +1,444 @@
+// Copyright 2024 - offen.software <hioffen@posteo.de>
+// SPDX-License-Identifier: MPL-2.0
+
+package restic
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/offen/docker-volume-backup/internal/errwrap"
+	"github.com/offen/docker-volume-backup/internal/storage"
+)
+
+// snapshotTag is added to all snapshots created by the backend so that other
+// snapshots stored in the same repository are left alone.
+const snapshotTag = "docker-volume-backup"
+
+// exitCodeRepositoryMissing is returned by restic 0.17 and later in case the
+// repository does not exist yet. Earlier versions only print a hint.
+const (
+	exitCodeRepositoryMissing = 10
+	hintRepositoryMissing     = "Is there a repository at the following location?"
+)
+
+// prefixTagPrefix is prepended to the pruning prefix when tagging snapshots,
+// so that the retention policy is applied to the snapshots of a single
+// configuration only.
+const prefixTagPrefix = "prefix="
+
+type resticStorage struct {
+	*storage.StorageBackend
+	env           []string
+	pruningPrefix string
+	retention     retention
+}
+
+// retention is the number of most recent days, weeks, months and years for
+// which the newest snapshot is kept when pruning.
+type retention struct {
+	daily, weekly, monthly, yearly int
+}
+
+// Config allows to configure a restic backend.
+type Config struct {
+	Repository string
+	Password   string
+	// PruningPrefix is the prefix of the names of files that are pruned
+	// together. Snapshots of such files are tagged accordingly.
+	PruningPrefix string
+}
+
+// NewStorageBackend creates and initializes a new restic storage backend,
+// which stores each backup as a snapshot in a restic repository using the
+// restic binary. The repository is initialized in case it does not exist yet.
+func NewStorageBackend(opts Config, logFunc storage.Log) (storage.Backend, error) {
+	if _, err := exec.LookPath("restic"); err != nil {
+		return nil, errwrap.Wrap(err, "error looking up restic binary")
+	}
+	if strings.Contains(opts.PruningPrefix, ",") {
+		return nil, errwrap.Wrap(nil, fmt.Sprintf("pruning prefix %s must not contain a comma", opts.PruningPrefix))
+	}
+
+	b := &resticStorage{
+		StorageBackend: &storage.StorageBackend{
+			DestinationPath: opts.Repository,
+			Log:             logFunc,
+		},
+		env: append(
+			os.Environ(),
+			fmt.Sprintf("RESTIC_REPOSITORY=%s", opts.Repository),
+			fmt.Sprintf("RESTIC_PASSWORD=%s", opts.Password),
+		),
+		pruningPrefix: opts.PruningPrefix,
+	}
+
+	if _, err := b.restic(context.Background(), nil, "cat", "config"); err != nil {
+		var exitErr *exec.ExitError
+		if !errors.As(err, &exitErr) || (exitErr.ExitCode() != exitCodeRepositoryMissing && !strings.Contains(err.Error(), hintRepositoryMissing)) {
+			return nil, errwrap.Wrap(err, "error opening repository")
+		}
+		if _, err := b.restic(context.Background(), nil, "init"); err != nil {
+			return nil, errwrap.Wrap(err, "error initializing repository")
+		}
+		logFunc(storage.LogLevelInfo, b.Name(), "Initialized repository at '%s'.", opts.Repository)
+	}
+	return b, nil
+}
+
+// Name returns the name of the storage backend
+func (b *resticStorage) Name() string {
+	return "Restic"
+}
+
+// SetRetention sets the grandfather-father-son retention policy that is
+// applied using `restic forget` when pruning.
+func (b *resticStorage) SetRetention(daily, weekly, monthly, yearly int) {
+	b.retention = retention{daily, weekly, monthly, yearly}
+}
+
+// Copy stores the given file as a new snapshot in the restic repository,
+// using the given name as the name of the only file in the snapshot.
+// Data that is already contained in the repository is not stored again.
+func (b *resticStorage) Copy(ctx context.Context, file, name string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return errwrap.Wrap(err, fmt.Sprintf("error opening file %s", file))
+	}
+	defer f.Close()
+
+	if _, err := b.restic(ctx, f, "backup", "--quiet", "--tag", b.tags(name), "--stdin", "--stdin-filename", name); err != nil {
+		return errwrap.Wrap(err, "error uploading the file")
+	}
+	b.Log(storage.LogLevelInfo, b.Name(), "Uploaded a copy of backup `%s` to repository '%s'.", file, b.DestinationPath)
+	return nil
+}
+
+// CopyFrom stores the data read from the given reader as a new snapshot in
+// the restic repository. In case reading fails, restic is stopped before it
+// can create a snapshot of the partial data.
+func (b *resticStorage) CopyFrom(r io.Reader, name string) error {
+	cmd := b.command(context.Background(), nil, "backup", "--quiet", "--tag", b.tags(name), "--stdin", "--stdin-filename", name)
+	stderr := &bytes.Buffer{}
+	cmd.Stderr = stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return errwrap.Wrap(err, "error creating pipe")
+	}
+	if err := cmd.Start(); err != nil {
+		return errwrap.Wrap(err, "error starting restic")
+	}
+	if _, err := io.Copy(stdin, r); err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return errwrap.Wrap(err, "error uploading the file")
+	}
+	stdin.Close()
+	if err := cmd.Wait(); err != nil {
+		return errwrap.Wrap(err, strings.TrimSpace(stderr.String()))
+	}
+	b.Log(storage.LogLevelInfo, b.Name(), "Uploaded streamed backup `%s` to repository '%s'.", name, b.DestinationPath)
+	return nil
+}
+
+// Stat returns information about the file with the given name in the restic
+// repository. In case multiple snapshots contain the file, the latest one
+// is used.
+func (b *resticStorage) Stat(name string) (*storage.ObjectInfo, error) {
+	snapshots, err := b.snapshots(context.Background())
+	if err != nil {
+		return nil, errwrap.Wrap(err, fmt.Sprintf("error calling stat on file %s", name))
+	}
+	for _, s := range latestByName(snapshots) {
+		if s.name() == name {
+			return &storage.ObjectInfo{Name: name, Size: s.size(), LastModified: s.Time}, nil
+		}
+	}
+	return nil, errwrap.Wrap(nil, fmt.Sprintf("error calling stat on file %s: no snapshot found", name))
+}
+
+// List returns information about all files in the restic repository whose
+// name starts with the given prefix.
+func (b *resticStorage) List(prefix string) ([]storage.ObjectInfo, error) {
+	snapshots, err := b.snapshots(context.Background())
+	if err != nil {
+		return nil, errwrap.Wrap(err, "error listing snapshots")
+	}
+	var result []storage.ObjectInfo
+	for _, s := range latestByName(snapshots) {
+		if strings.HasPrefix(s.name(), prefix) {
+			result = append(result, storage.ObjectInfo{Name: s.name(), Size: s.size(), LastModified: s.Time})
+		}
+	}
+	return result, nil
+}
+
+// Open returns a reader for the first length bytes of the file with the given
+// name in the restic repository. If length is not positive, the entire
+// file is read.
+func (b *resticStorage) Open(name string, length int64) (io.ReadCloser, error) {
+	snapshots, err := b.snapshots(context.Background())
+	if err != nil {
+		return nil, errwrap.Wrap(err, fmt.Sprintf("error opening file %s", name))
+	}
+	var id string
+	for _, s := range latestByName(snapshots) {
+		if s.name() == name {
+			id = s.ID
+		}
+	}
+	if id == "" {
+		return nil, errwrap.Wrap(nil, fmt.Sprintf("error opening file %s: no snapshot found", name))
+	}
+
+	r, err := storage.StartCommand(b.command(context.Background(), nil, "dump", "--quiet", id, "/"+name))
+	if err != nil {
+		return nil, errwrap.Wrap(err, fmt.Sprintf("error opening file %s", name))
+	}
+	return storage.LimitReadCloser(r, length), nil
+}
+
+// Remove forgets all snapshots containing the file with the given name and
+// removes data that is no longer referenced from the restic repository.
+func (b *resticStorage) Remove(name string) error {
+	snapshots, err := b.snapshots(context.Background())
+	if err != nil {
+		return errwrap.Wrap(err, fmt.Sprintf("error removing file %s", name))
+	}
+	var ids []string
+	for _, s := range snapshots {
+		if s.name() == name {
+			ids = append(ids, s.ID)
+		}
+	}
+	if err := b.forget(context.Background(), ids); err != nil {
+		return errwrap.Wrap(err, fmt.Sprintf("error removing file %s", name))
+	}
+	return nil
+}
+
+// Prune rotates away backups according to the configuration and provided
+// deadline for the restic storage backend. The snapshots to remove are
+// determined by restic itself, mapping the deadline and the retention policy
+// to the `--keep-*` options of `restic forget`. All matching snapshots are
+// forgotten at once, so the repository is only pruned a single time.
+func (b *resticStorage) Prune(ctx context.Context, deadline time.Time, pruningPrefix string, dryRun bool) (*storage.PruneStats, error) {
+	snapshots, err := b.snapshots(ctx)
+	if err != nil {
+		return nil, errwrap.Wrap(err, "error listing snapshots")
+	}
+	removed, err := b.policyMatches(ctx, deadline, pruningPrefix)
+	if err != nil {
+		return nil, errwrap.Wrap(err, "error applying retention policy")
+	}
+
+	candidates, lenProtected := storage.FilterProtected(latestByName(snapshots), snapshot.name, b.PruneExclusions()...)
+	if lenProtected != 0 {
+		b.Log(storage.LogLevelInfo, b.Name(), "Skipping %d protected backups.", lenProtected)
+	}
+
+	var matches []string
+	expired := map[string]bool{}
+	for _, candidate := range candidates {
+		if !strings.HasPrefix(candidate.name(), pruningPrefix) {
+			continue
+		}
+		if removed[candidate.ID] {
+			matches = append(matches, candidate.name())
+			expired[candidate.name()] = true
+		}
+	}
+
+	stats := &storage.PruneStats{
+		Total:   uint(len(candidates) + lenProtected),
+		Pruned:  uint(len(matches)),
+		Matches: matches,
+	}
+
+	pruneErr := b.DoPrune(b.Name(), len(matches), len(candidates)+lenProtected, deadline, dryRun, func() error {
+		var ids []string
+		for _, s := range snapshots {
+			if expired[s.name()] {
+				ids = append(ids, s.ID)
+			}
+		}
+		return b.forget(ctx, ids)
+	})
+
+	return stats, pruneErr
+}
+
+// keepArgs returns the `--keep-*` options of `restic forget` matching the
+// given deadline and the retention policy. As restic keeps snapshots within
+// the given duration of the latest snapshot, the deadline is relative to the
+// latest snapshot instead of the current time.
+func (b *resticStorage) keepArgs(deadline time.Time) []string {
+	var args []string
+	if !deadline.IsZero() {
+		hours := max(int(time.Since(deadline).Round(time.Hour).Hours()), 1)
+		args = append(args, "--keep-within", fmt.Sprintf("%dh", hours))
+	}
+	for _, keep := range []struct {
+		flag  string
+		value int
+	}{
+		{"--keep-daily", b.retention.daily},
+		{"--keep-weekly", b.retention.weekly},
+		{"--keep-monthly", b.retention.monthly},
+		{"--keep-yearly", b.retention.yearly},
+	} {
+		if keep.value > 0 {
+			args = append(args, keep.flag, strconv.Itoa(keep.value))
+		}
+	}
+	return args
+}
+
+// policyMatches returns the ids of the snapshots of files with the given
+// prefix that restic would remove as per the deadline and the retention
+// policy.
+func (b *resticStorage) policyMatches(ctx context.Context, deadline time.Time, pruningPrefix string) (map[string]bool, error) {
+	keep := b.keepArgs(deadline)
+	if len(keep) == 0 {
+		return nil, nil
+	}
+	tags := snapshotTag
+	if pruningPrefix != "" {
+		tags = fmt.Sprintf("%s,%s%s", snapshotTag, prefixTagPrefix, pruningPrefix)
+	}
+	out, err := b.restic(ctx, nil, append([]string{"forget", "--dry-run", "--json", "--group-by", "", "--tag", tags}, keep...)...)
+	if err != nil {
+		return nil, errwrap.Wrap(err, "error running forget")
+	}
+	return parseForget(out)
+}
+
+// tags returns the tags of the snapshot of the file with the given name.
+func (b *resticStorage) tags(name string) string {
+	if b.pruningPrefix != "" && strings.HasPrefix(name, b.pruningPrefix) {
+		return fmt.Sprintf("%s,%s%s", snapshotTag, prefixTagPrefix, b.pruningPrefix)
+	}
+	return snapshotTag
+}
+
+// forget forgets the snapshots with the given ids and prunes the repository.
+func (b *resticStorage) forget(ctx context.Context, ids []string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	if _, err := b.restic(ctx, nil, append([]string{"forget", "--quiet", "--prune"}, ids...)...); err != nil {
+		return errwrap.Wrap(err, "error forgetting snapshots")
+	}
+	return nil
+}
+
+// snapshots returns all snapshots created by the backend.
+func (b *resticStorage) snapshots(ctx context.Context) ([]snapshot, error) {
+	out, err := b.restic(ctx, nil, "snapshots", "--json", "--tag", snapshotTag)
+	if err != nil {
+		return nil, err
+	}
+	return parseSnapshots(out)
+}
+
+// command creates a restic command using the configured repository.
+func (b *resticStorage) command(ctx context.Context, stdin io.Reader, args ...string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, "restic", args...)
+	cmd.Env = b.env
+	cmd.Stdin = stdin
+	return cmd
+}
+
+// restic runs restic using the given arguments and returns its output.
+func (b *resticStorage) restic(ctx context.Context, stdin io.Reader, args ...string) ([]byte, error) {
+	cmd := b.command(ctx, stdin, args...)
+	stderr := &bytes.Buffer{}
+	cmd.Stderr = stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, errwrap.Wrap(err, strings.TrimSpace(stderr.String()))
+	}
+	return out, nil
+}
+
+// snapshot is a single snapshot as printed by `restic snapshots --json`.
+type snapshot struct {
+	ID      string    `json:"id"`
+	Time    time.Time `json:"time"`
+	Paths   []string  `json:"paths"`
+	Summary *struct {
+		TotalBytesProcessed int64 `json:"total_bytes_processed"`
+	} `json:"summary"`
+}
+
+// name returns the name of the file contained in the snapshot.
+func (s snapshot) name() string {
+	if len(s.Paths) == 0 {
+		return ""
+	}
+	return strings.TrimPrefix(s.Paths[0], "/")
+}
+
+// size returns the size of the file contained in the snapshot. It is only
+// known for snapshots created by restic 0.17 or later.
+func (s snapshot) size() int64 {
+	if s.Summary == nil {
+		return 0
+	}
+	return s.Summary.TotalBytesProcessed
+}
+
+func parseSnapshots(out []byte) ([]snapshot, error) {
+	var snapshots []snapshot
+	if err := json.Unmarshal(out, &snapshots); err != nil {
+		return nil, errwrap.Wrap(err, "error parsing snapshots")
+	}
+	return snapshots, nil
+}
+
+// parseForget returns the ids of the snapshots that are removed as per the
+// output of `restic forget --json`.
+func parseForget(out []byte) (map[string]bool, error) {
+	var groups []struct {
+		Remove []snapshot `json:"remove"`
+	}
+	if err := json.Unmarshal(out, &groups); err != nil {
+		return nil, errwrap.Wrap(err, "error parsing forget output")
+	}
+	removed := map[string]bool{}
+	for _, group := range groups {
+		for _, s := range group.Remove {
+			removed[s.ID] = true
+		}
+	}
+	return removed, nil
+}
+
+// latestByName returns the latest snapshot for each file name, sorted by
+// time.
+func latestByName(snapshots []snapshot) []snapshot {
+	latest := map[string]snapshot{}
+	for _, s := range snapshots {
+		if existing, ok := latest[s.name()]; !ok || s.Time.After(existing.Time) {
+			latest[s.name()] = s
+		}
+	}
+	result := make([]snapshot, 0, len(latest))
+	for _, s := range latest {
+		result = append(result, s)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Time.Before(result[j].Time)
+	})
+	return result
+}
@@ -0,0 +1,81 @@
+package restic
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseSnapshots(t *testing.T) {
+	out := []byte(`[
+  {"time":"2024-01-02T03:04:05.123Z","paths":["/backup-2024-01-02.tar.gz"],"id":"a1","summary":{"total_bytes_processed":1234}},
+  {"time":"2024-01-03T03:04:05Z","paths":["/backup-2024-01-03.tar.gz"],"id":"b2"},
+  {"time":"2024-01-04T03:04:05Z","paths":["/backup-2024-01-02.tar.gz"],"id":"c3","summary":{"total_bytes_processed":99}}
+]`)
+	snapshots, err := parseSnapshots(out)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(snapshots) != 3 {
+		t.Fatalf("Expected 3 snapshots, got %d", len(snapshots))
+	}
+	if snapshots[0].name() != "backup-2024-01-02.tar.gz" || snapshots[0].size() != 1234 {
+		t.Errorf("Unexpected snapshot %v", snapshots[0])
+	}
+	if snapshots[1].size() != 0 {
+		t.Errorf("Expected unknown size to be 0, got %d", snapshots[1].size())
+	}
+
+	latest := latestByName(snapshots)
+	if len(latest) != 2 {
+		t.Fatalf("Expected 2 files, got %d", len(latest))
+	}
+	if latest[0].ID != "b2" || latest[1].ID != "c3" {
+		t.Errorf("Expected latest snapshots sorted by time, got %s and %s", latest[0].ID, latest[1].ID)
+	}
+
+	if _, err := parseSnapshots([]byte("not json")); err == nil {
+		t.Error("Expected error parsing invalid output")
+	}
+}
+
+func TestParseForget(t *testing.T) {
+	out := []byte(`[
+  {"tags":null,"host":"","paths":null,"keep":[{"id":"a1"}],"remove":[{"id":"b2"},{"id":"c3"}],"reasons":[]},
+  {"tags":null,"host":"","paths":null,"keep":[{"id":"d4"}],"remove":null,"reasons":[]}
+]`)
+	removed, err := parseForget(out)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(removed, map[string]bool{"b2": true, "c3": true}) {
+		t.Errorf("Unexpected removed snapshots %v", removed)
+	}
+	if _, err := parseForget([]byte("not json")); err == nil {
+		t.Error("Expected error parsing invalid output")
+	}
+}
+
+func TestKeepArgs(t *testing.T) {
+	b := &resticStorage{}
+	if args := b.keepArgs(time.Time{}); len(args) != 0 {
+		t.Errorf("Expected no args without retention, got %v", args)
+	}
+
+	b.SetRetention(7, 4, 0, 1)
+	args := b.keepArgs(time.Now().AddDate(0, 0, -2))
+	expected := []string{"--keep-within", "48h", "--keep-daily", "7", "--keep-weekly", "4", "--keep-yearly", "1"}
+	if !reflect.DeepEqual(args, expected) {
+		t.Errorf("Expected %v, got %v", expected, args)
+	}
+}
+
+func TestTags(t *testing.T) {
+	b := &resticStorage{pruningPrefix: "backup-"}
+	if tags := b.tags("backup-2024-01-02.tar.gz"); tags != "docker-volume-backup,prefix=backup-" {
+		t.Errorf("Unexpected tags %s", tags)
+	}
+	if tags := b.tags("other.tar.gz"); tags != "docker-volume-backup" {
+		t.Errorf("Unexpected tags %s", tags)
+	}
+}
@@ -0,0 +1,283 @@
+// Copyright 2024 - offen.software <hioffen@posteo.de>
+// SPDX-License-Identifier: MPL-2.0
+
+package rsync
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/offen/docker-volume-backup/internal/errwrap"
+	"github.com/offen/docker-volume-backup/internal/storage"
+)
+
+type rsyncStorage struct {
+	*storage.StorageBackend
+	hostName string
+	target   string
+	sshArgs  []string
+}
+
+// Config allows to configure a rsync backend.
+type Config struct {
+	HostName     string
+	Port         string
+	User         string
+	IdentityFile string
+	RemotePath   string
+	// KnownHostsFile is the location of a known_hosts file the host key of
+	// the server is verified against. In case it is empty, the default
+	// known_hosts files of ssh are used.
+	KnownHostsFile string
+	// SkipHostKeyCheck disables verifying the host key of the server.
+	SkipHostKeyCheck bool
+}
+
+// NewStorageBackend creates and initializes a new rsync storage backend,
+// which transfers files using the rsync and ssh binaries.
+func NewStorageBackend(opts Config, logFunc storage.Log) (storage.Backend, error) {
+	for _, command := range []string{"rsync", "ssh"} {
+		if _, err := exec.LookPath(command); err != nil {
+			return nil, errwrap.Wrap(err, fmt.Sprintf("error looking up %s binary", command))
+		}
+	}
+
+	target := opts.HostName
+	if opts.User != "" {
+		target = fmt.Sprintf("%s@%s", opts.User, opts.HostName)
+	}
+
+	return &rsyncStorage{
+		StorageBackend: &storage.StorageBackend{
+			DestinationPath: opts.RemotePath,
+			Log:             logFunc,
+		},
+		hostName: opts.HostName,
+		target:   target,
+		sshArgs:  sshArgs(opts),
+	}, nil
+}
+
+// sshArgs returns the arguments passed to ssh for connecting to the server.
+// Unless disabled, the host key of the server is required to be known.
+func sshArgs(opts Config) []string {
+	args := []string{
+		"-p", opts.Port,
+		"-o", "BatchMode=yes",
+		"-o", "LogLevel=ERROR",
+	}
+	switch {
+	case opts.SkipHostKeyCheck:
+		args = append(args, "-o", "StrictHostKeyChecking=no", "-o", "UserKnownHostsFile=/dev/null")
+	case opts.KnownHostsFile != "":
+		args = append(args, "-o", "StrictHostKeyChecking=yes", "-o", fmt.Sprintf("UserKnownHostsFile=%s", opts.KnownHostsFile))
+	default:
+		args = append(args, "-o", "StrictHostKeyChecking=yes")
+	}
+	if _, err := os.Stat(opts.IdentityFile); err == nil {
+		args = append(args, "-i", opts.IdentityFile)
+	}
+	return args
+}
+
+// Name returns the name of the storage backend
+func (b *rsyncStorage) Name() string {
+	return "Rsync"
+}
+
+// Preflight checks the storage is writable by uploading and removing a marker
+// file.
+func (b *rsyncStorage) Preflight(ctx context.Context) error {
+	return storage.CheckWritable(ctx, b)
+}
+
+// Copy copies the given file to the rsync storage backend, storing it
+// using the given name. Similar files that already exist in the remote
+// directory, e.g. previous backups, are used as a basis for delta transfer.
+func (b *rsyncStorage) Copy(ctx context.Context, file, name string) error {
+	if dir := path.Dir(name); dir != "." {
+		if _, err := b.ssh(ctx, "mkdir", "-p", "--", path.Join(b.DestinationPath, dir)); err != nil {
+			return errwrap.Wrap(err, fmt.Sprintf("error creating directory '%s'", dir))
+		}
+	}
+	if _, err := b.rsync(ctx, "--times", "--fuzzy", file, b.remote(name)); err != nil {
+		return errwrap.Wrap(err, "error uploading the file")
+	}
+	b.Log(storage.LogLevelInfo, b.Name(), "Uploaded a copy of backup `%s` to '%s' at path '%s'.", file, b.hostName, b.DestinationPath)
+	return nil
+}
+
+// Stat returns information about the file with the given name in the rsync storage backend.
+func (b *rsyncStorage) Stat(name string) (*storage.ObjectInfo, error) {
+	out, err := b.rsync(context.Background(), "--list-only", "--no-human-readable", b.remote(name))
+	if err != nil {
+		return nil, errwrap.Wrap(err, fmt.Sprintf("error calling stat on file %s", name))
+	}
+	files := parseListing(out)
+	if len(files) != 1 {
+		return nil, errwrap.Wrap(nil, fmt.Sprintf("error calling stat on file %s: not a regular file", name))
+	}
+	files[0].Name = name
+	return &files[0], nil
+}
+
+// List returns information about all files in the rsync storage backend
+// whose name starts with the given prefix.
+func (b *rsyncStorage) List(prefix string) ([]storage.ObjectInfo, error) {
+	return b.list(context.Background(), prefix)
+}
+
+func (b *rsyncStorage) list(ctx context.Context, prefix string) ([]storage.ObjectInfo, error) {
+	out, err := b.rsync(ctx, "--list-only", "--no-human-readable", b.remote("")+"/")
+	if err != nil {
+		return nil, errwrap.Wrap(err, "error reading directory")
+	}
+	var result []storage.ObjectInfo
+	for _, file := range parseListing(out) {
+		if strings.HasPrefix(file.Name, prefix) {
+			result = append(result, file)
+		}
+	}
+	return result, nil
+}
+
+// Open returns a reader for the first length bytes of the file with the given
+// name in the rsync storage backend. If length is not positive, the entire
+// file is read.
+func (b *rsyncStorage) Open(name string, length int64) (io.ReadCloser, error) {
+	args := []string{"cat", "--", path.Join(b.DestinationPath, name)}
+	if length > 0 {
+		args = []string{"head", "-c", strconv.FormatInt(length, 10), "--", path.Join(b.DestinationPath, name)}
+	}
+	cmd := exec.Command("ssh", append(append(append([]string{}, b.sshArgs...), "--", b.target), quoteAll(args)...)...)
+	r, err := storage.StartCommand(cmd)
+	if err != nil {
+		return nil, errwrap.Wrap(err, fmt.Sprintf("error opening file %s", name))
+	}
+	return r, nil
+}
+
+// Remove deletes the file with the given name from the rsync storage backend.
+func (b *rsyncStorage) Remove(name string) error {
+	return b.remove(context.Background(), name)
+}
+
+func (b *rsyncStorage) remove(ctx context.Context, name string) error {
+	if _, err := b.ssh(ctx, "rm", "--", path.Join(b.DestinationPath, name)); err != nil {
+		return errwrap.Wrap(err, fmt.Sprintf("error removing file %s", name))
+	}
+	return nil
+}
+
+// Prune rotates away backups according to the configuration and provided deadline for the rsync storage backend.
+func (b *rsyncStorage) Prune(ctx context.Context, deadline time.Time, pruningPrefix string, dryRun bool) (*storage.PruneStats, error) {
+	candidates, err := b.list(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+
+	candidates, lenProtected := storage.FilterProtected(candidates, func(c storage.ObjectInfo) string { return c.Name }, b.PruneExclusions()...)
+	if lenProtected != 0 {
+		b.Log(storage.LogLevelInfo, b.Name(), "Skipping %d protected backups.", lenProtected)
+	}
+
+	var matches []string
+	for _, candidate := range candidates {
+		if !strings.HasPrefix(candidate.Name, pruningPrefix) {
+			continue
+		}
+		if candidate.LastModified.Before(deadline) {
+			matches = append(matches, candidate.Name)
+		}
+	}
+
+	stats := &storage.PruneStats{
+		Total:   uint(len(candidates) + lenProtected),
+		Pruned:  uint(len(matches)),
+		Matches: matches,
+	}
+
+	pruneErr := b.DoPrune(b.Name(), len(matches), len(candidates)+lenProtected, deadline, dryRun, func() error {
+		for _, match := range matches {
+			if err := b.remove(ctx, match); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	return stats, pruneErr
+}
+
+// remote returns the rsync location of the file with the given name.
+func (b *rsyncStorage) remote(name string) string {
+	return fmt.Sprintf("%s:%s", b.target, path.Join(b.DestinationPath, name))
+}
+
+// rsync runs rsync using ssh as the remote shell and returns its output.
+func (b *rsyncStorage) rsync(ctx context.Context, args ...string) ([]byte, error) {
+	shell := strings.Join(quoteAll(append([]string{"ssh"}, b.sshArgs...)), " ")
+	return run(exec.CommandContext(ctx, "rsync", append([]string{"--protect-args", "-e", shell}, args...)...))
+}
+
+// ssh runs the given command on the remote host and returns its output.
+func (b *rsyncStorage) ssh(ctx context.Context, args ...string) ([]byte, error) {
+	return run(exec.CommandContext(ctx, "ssh", append(append(append([]string{}, b.sshArgs...), "--", b.target), quoteAll(args)...)...))
+}
+
+func run(cmd *exec.Cmd) ([]byte, error) {
+	stderr := &bytes.Buffer{}
+	cmd.Stderr = stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, errwrap.Wrap(err, strings.TrimSpace(stderr.String()))
+	}
+	return out, nil
+}
+
+// listingLine matches a regular file in the output of `rsync --list-only`.
+var listingLine = regexp.MustCompile(`^-\S*\s+([\d,.]+)\s+(\d{4}/\d{2}/\d{2} \d{2}:\d{2}:\d{2}) (.+)$`)
+
+// parseListing parses the regular files from the output of
+// `rsync --list-only`, which prints modification times in local time.
+func parseListing(out []byte) []storage.ObjectInfo {
+	var result []storage.ObjectInfo
+	for _, line := range strings.Split(string(out), "\n") {
+		submatches := listingLine.FindStringSubmatch(line)
+		if submatches == nil {
+			continue
+		}
+		size, err := strconv.ParseInt(strings.NewReplacer(",", "", ".", "").Replace(submatches[1]), 10, 64)
+		if err != nil {
+			continue
+		}
+		modTime, err := time.ParseInLocation("2006/01/02 15:04:05", submatches[2], time.Local)
+		if err != nil {
+			continue
+		}
+		result = append(result, storage.ObjectInfo{
+			Name:         submatches[3],
+			Size:         size,
+			LastModified: modTime,
+		})
+	}
+	return result
+}
+
+// quoteAll quotes the given arguments for being passed to a remote shell.
+func quoteAll(args []string) []string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		quoted[i] = "'" + strings.ReplaceAll(arg, "'", `'\''`) + "'"
+	}
+	return quoted
+}
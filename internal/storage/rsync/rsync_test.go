@@ -0,0 +1,58 @@
+package rsync
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestParseListing(t *testing.T) {
+	out := []byte(`drwxr-xr-x           4096 2024/01/02 03:04:05 .
+-rw-r--r--        1,234,567 2024/01/02 03:04:05 backup-2024-01-02.tar.gz
+-rw-r--r--              7 2024/01/03 03:04:05 backup with spaces.tar.gz
+lrwxrwxrwx             20 2024/01/03 03:04:05 backup.latest.tar.gz
+`)
+	files := parseListing(out)
+	if len(files) != 2 {
+		t.Fatalf("Expected 2 files, got %d", len(files))
+	}
+	if files[0].Name != "backup-2024-01-02.tar.gz" || files[0].Size != 1234567 {
+		t.Errorf("Unexpected file %v", files[0])
+	}
+	if expected := time.Date(2024, 1, 2, 3, 4, 5, 0, time.Local); !files[0].LastModified.Equal(expected) {
+		t.Errorf("Expected modification time %v, got %v", expected, files[0].LastModified)
+	}
+	if files[1].Name != "backup with spaces.tar.gz" || files[1].Size != 7 {
+		t.Errorf("Unexpected file %v", files[1])
+	}
+}
+
+func TestQuoteAll(t *testing.T) {
+	quoted := quoteAll([]string{"rm", "--", "/backups/it's here"})
+	expected := []string{`'rm'`, `'--'`, `'/backups/it'\''s here'`}
+	for i := range expected {
+		if quoted[i] != expected[i] {
+			t.Errorf("Expected %s, got %s", expected[i], quoted[i])
+		}
+	}
+}
+
+func TestSSHArgs(t *testing.T) {
+	tests := []struct {
+		name     string
+		opts     Config
+		expected []string
+	}{
+		{"default", Config{Port: "22"}, []string{"-o", "StrictHostKeyChecking=yes"}},
+		{"known hosts", Config{Port: "22", KnownHostsFile: "/tmp/known_hosts"}, []string{"-o", "StrictHostKeyChecking=yes", "-o", "UserKnownHostsFile=/tmp/known_hosts"}},
+		{"skip", Config{Port: "22", SkipHostKeyCheck: true}, []string{"-o", "StrictHostKeyChecking=no", "-o", "UserKnownHostsFile=/dev/null"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			args := sshArgs(test.opts)
+			if !slices.Equal(args[len(args)-len(test.expected):], test.expected) {
+				t.Errorf("Expected args to end with %v, got %v", test.expected, args)
+			}
+		})
+	}
+}
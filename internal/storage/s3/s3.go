@@ -5,16 +5,23 @@ package s3
 
 import (
 	"context"
+	"crypto/md5"
 	"crypto/x509"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"io"
 	"os"
-	"path"
 	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/minio/minio-go/v7"
 	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/minio/minio-go/v7/pkg/encrypt"
 	"github.com/offen/docker-volume-backup/internal/errwrap"
 	"github.com/offen/docker-volume-backup/internal/storage"
 )
@@ -25,6 +32,16 @@ type s3Storage struct {
 	bucket       string
 	storageClass string
 	partSize     int64
+	concurrency  int
+	immutableFor time.Duration
+	sse          encrypt.ServerSide
+
+	listRetries    int
+	listRetryDelay time.Duration
+	uploaded       []string
+
+	mu          sync.Mutex
+	uploadStats storage.UploadStats
 }
 
 // Config contains values that define the configuration of a S3 backend.
@@ -39,7 +56,14 @@ type Config struct {
 	BucketName       string
 	StorageClass     string
 	PartSize         int64
+	Concurrency      int
 	CACert           *x509.Certificate
+	UserAgent        string
+	ImmutableFor     time.Duration
+	ListRetries      int
+	ListRetryDelay   time.Duration
+	SSE              string
+	SSEKMSKeyID      string
 }
 
 // NewStorageBackend creates and initializes a new S3/Minio storage backend.
@@ -78,37 +102,78 @@ func NewStorageBackend(opts Config, logFunc storage.Log) (storage.Backend, error
 		}
 		transport.TLSClientConfig.RootCAs.AddCert(opts.CACert)
 	}
-	options.Transport = transport
+	options.Transport = storage.NewUserAgentTransport(transport, opts.UserAgent)
 
 	mc, err := minio.New(opts.Endpoint, &options)
 	if err != nil {
 		return nil, errwrap.Wrap(err, "error setting up minio client")
 	}
 
+	sse, err := serverSideEncryption(opts.SSE, opts.SSEKMSKeyID)
+	if err != nil {
+		return nil, errwrap.Wrap(err, "error configuring server side encryption")
+	}
+
 	return &s3Storage{
 		StorageBackend: &storage.StorageBackend{
 			DestinationPath: opts.RemotePath,
 			Log:             logFunc,
 		},
-		client:       mc,
-		bucket:       opts.BucketName,
-		storageClass: opts.StorageClass,
-		partSize:     opts.PartSize,
+		client:         mc,
+		bucket:         opts.BucketName,
+		storageClass:   opts.StorageClass,
+		partSize:       opts.PartSize,
+		concurrency:    opts.Concurrency,
+		immutableFor:   opts.ImmutableFor,
+		sse:            sse,
+		listRetries:    opts.ListRetries,
+		listRetryDelay: opts.ListRetryDelay,
 	}, nil
 }
 
+// serverSideEncryption returns the server side encryption to be requested
+// when uploading objects. In case no KMS key id is given for aws:kms, the
+// default KMS key of the bucket is used.
+func serverSideEncryption(mode, kmsKeyID string) (encrypt.ServerSide, error) {
+	switch mode {
+	case "":
+		if kmsKeyID != "" {
+			return nil, errwrap.Wrap(nil, "AWS_SSE_KMS_KEY_ID requires AWS_SSE to be set to aws:kms")
+		}
+		return nil, nil
+	case "AES256":
+		if kmsKeyID != "" {
+			return nil, errwrap.Wrap(nil, "AWS_SSE_KMS_KEY_ID requires AWS_SSE to be set to aws:kms")
+		}
+		return encrypt.NewSSE(), nil
+	case "aws:kms":
+		return encrypt.NewSSEKMS(kmsKeyID, nil)
+	default:
+		return nil, errwrap.Wrap(nil, fmt.Sprintf("unknown value %s for AWS_SSE, expected one of AES256 or aws:kms", mode))
+	}
+}
+
 // Name returns the name of the storage backend
 func (v *s3Storage) Name() string {
 	return "S3"
 }
 
-// Copy copies the given file to the S3/Minio storage backend.
-func (b *s3Storage) Copy(file string) error {
-	_, name := path.Split(file)
-	putObjectOptions := minio.PutObjectOptions{
-		ContentType:  "application/tar+gzip",
-		StorageClass: b.storageClass,
+// Preflight checks the bucket is writable by uploading and removing a marker
+// file. In case uploaded files are immutable, it only checks the bucket can
+// be listed.
+func (v *s3Storage) Preflight(ctx context.Context) error {
+	if v.immutableFor > 0 {
+		return storage.CheckReachable(v)
 	}
+	return storage.CheckWritable(ctx, v)
+}
+
+// Copy copies the given file to the S3/Minio storage backend, storing it
+// using the given name. Files larger than the part size are uploaded in
+// multiple parts, of which up to AWS_UPLOAD_CONCURRENCY are uploaded in
+// parallel.
+func (b *s3Storage) Copy(ctx context.Context, file, name string) error {
+	putObjectOptions := b.putObjectOptions()
 
 	if b.partSize > 0 {
 		srcFileInfo, err := os.Stat(file)
@@ -124,54 +189,301 @@ func (b *s3Storage) Copy(file string) error {
 		putObjectOptions.PartSize = uint64(partSize)
 	}
 
-	if _, err := b.client.FPutObject(context.Background(), b.bucket, filepath.Join(b.DestinationPath, name), file, putObjectOptions); err != nil {
-		if errResp := minio.ToErrorResponse(err); errResp.Message != "" {
-			return errwrap.Wrap(
-				nil,
-				fmt.Sprintf(
-					"error uploading backup to remote storage: [Message]: '%s', [Code]: %s, [StatusCode]: %d",
+	key := filepath.Join(b.DestinationPath, name)
+	start := time.Now()
+	info, err := b.client.FPutObject(ctx, b.bucket, key, file, putObjectOptions)
+	if err != nil {
+		return b.uploadError(key, err)
+	}
+	b.recordUpload(info, time.Since(start))
+
+	b.uploaded = append(b.uploaded, key)
+	b.Log(storage.LogLevelInfo, b.Name(), "Uploaded a copy of backup `%s` to bucket `%s`.", file, b.bucket)
+
+	return nil
+}
+
+// CopyFrom uploads the data read from the given reader to the S3/Minio
+// storage backend using the given name. As the size is not known upfront,
+// the data is always uploaded in parts of AWS_PART_SIZE, which are buffered
+// in memory. When uploading parts concurrently, one buffer per part that is
+// being uploaded is allocated.
+func (b *s3Storage) CopyFrom(r io.Reader, name string) error {
+	putObjectOptions := b.putObjectOptions()
+	putObjectOptions.PartSize = uint64(max(b.partSize, 16)) * 1024 * 1024
+	putObjectOptions.ConcurrentStreamParts = putObjectOptions.NumThreads > 1
+
+	key := filepath.Join(b.DestinationPath, name)
+	start := time.Now()
+	info, err := b.client.PutObject(context.Background(), b.bucket, key, r, -1, putObjectOptions)
+	if err != nil {
+		return b.uploadError(key, err)
+	}
+	b.recordUpload(info, time.Since(start))
+
+	b.uploaded = append(b.uploaded, key)
+	b.Log(storage.LogLevelInfo, b.Name(), "Uploaded streamed backup `%s` to bucket `%s`.", name, b.bucket)
+
+	return nil
+}
+
+func (b *s3Storage) putObjectOptions() minio.PutObjectOptions {
+	opts := minio.PutObjectOptions{
+		ContentType:  "application/tar+gzip",
+		StorageClass: b.storageClass,
+	}
+	if b.concurrency > 0 {
+		opts.NumThreads = uint(b.concurrency)
+	}
+	if b.sse != nil {
+		opts.ServerSideEncryption = b.sse
+	}
+	if b.immutableFor > 0 {
+		opts.Mode = minio.Compliance
+		opts.RetainUntilDate = time.Now().Add(b.immutableFor)
+		opts.SendContentMd5 = true
+	}
+	return opts
+}
+
+// recordUpload adds the given upload to the stats of the backend. The
+// number of parts is derived from the ETag, which is suffixed with the
+// number of parts for multipart uploads.
+func (b *s3Storage) recordUpload(info minio.UploadInfo, took time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.uploadStats.Bytes += info.Size
+	b.uploadStats.Parts += partCount(info.ETag)
+	b.uploadStats.Duration += took
+}
+
+// UploadStats returns information about all files uploaded by the backend.
+func (b *s3Storage) UploadStats() storage.UploadStats {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.uploadStats
+}
+
+// partCount returns the number of parts of the object with the given ETag.
+func partCount(etag string) int {
+	_, suffix, ok := strings.Cut(strings.Trim(etag, `"`), "-")
+	if !ok {
+		return 1
+	}
+	n, err := strconv.Atoi(suffix)
+	if err != nil || n < 1 {
+		return 1
+	}
+	return n
+}
+
+// uploadError wraps the given error returned when uploading the object with
+// the given key. Failed parts are retried by the client already, so the
+// upload is aborted, making sure no incomplete upload is left behind.
+func (b *s3Storage) uploadError(key string, err error) error {
+	if rmErr := b.client.RemoveIncompleteUpload(context.Background(), b.bucket, key); rmErr != nil {
+		b.Log(storage.LogLevelWarning, b.Name(), "Error removing incomplete upload of `%s`: %v", key, rmErr)
+	}
+	if errResp := minio.ToErrorResponse(err); errResp.Message != "" {
+		return errwrap.Wrap(
+			&storage.StatusError{
+				StatusCode: errResp.StatusCode,
+				Err: fmt.Errorf(
+					"[Message]: '%s', [Code]: %s, [StatusCode]: %d",
 					errResp.Message,
 					errResp.Code,
 					errResp.StatusCode,
 				),
-			)
-		}
-		return errwrap.Wrap(err, "error uploading backup to remote storage")
+			},
+			"error uploading backup to remote storage",
+		)
 	}
+	return errwrap.Wrap(err, "error uploading backup to remote storage")
+}
 
-	b.Log(storage.LogLevelInfo, b.Name(), "Uploaded a copy of backup `%s` to bucket `%s`.", file, b.bucket)
+// Stat returns information about the object with the given name in the S3/Minio storage backend.
+func (b *s3Storage) Stat(name string) (*storage.ObjectInfo, error) {
+	info, err := b.client.StatObject(context.Background(), b.bucket, filepath.Join(b.DestinationPath, name), minio.StatObjectOptions{})
+	if err != nil {
+		return nil, errwrap.Wrap(err, fmt.Sprintf("error looking up object %s in remote storage", name))
+	}
+	return &storage.ObjectInfo{
+		Name:         name,
+		Size:         info.Size,
+		LastModified: info.LastModified,
+	}, nil
+}
 
-	return nil
+// MD5 returns the MD5 checksum of the object with the given name, which S3
+// reports as its ETag unless the object has been uploaded in multiple parts
+// or is encrypted using KMS.
+func (b *s3Storage) MD5(name string) ([]byte, error) {
+	info, err := b.client.StatObject(context.Background(), b.bucket, filepath.Join(b.DestinationPath, name), minio.StatObjectOptions{})
+	if err != nil {
+		return nil, errwrap.Wrap(err, fmt.Sprintf("error looking up object %s in remote storage", name))
+	}
+	if strings.Contains(info.ETag, "-") || strings.HasPrefix(info.Metadata.Get("X-Amz-Server-Side-Encryption"), "aws:kms") {
+		return nil, storage.ErrChecksumUnavailable
+	}
+	sum, err := hex.DecodeString(strings.Trim(info.ETag, `"`))
+	if err != nil || len(sum) != md5.Size {
+		return nil, storage.ErrChecksumUnavailable
+	}
+	return sum, nil
 }
 
-// Prune rotates away backups according to the configuration and provided deadline for the S3/Minio storage backend.
-func (b *s3Storage) Prune(deadline time.Time, pruningPrefix string) (*storage.PruneStats, error) {
+// PresignedURL returns a URL that allows downloading the object with the
+// given name until the given expiry has passed.
+func (b *s3Storage) PresignedURL(name string, expiry time.Duration) (string, error) {
+	u, err := b.client.PresignedGetObject(context.Background(), b.bucket, filepath.Join(b.DestinationPath, name), expiry, nil)
+	if err != nil {
+		return "", errwrap.Wrap(err, fmt.Sprintf("error presigning object %s", name))
+	}
+	return u.String(), nil
+}
+
+// List returns information about all objects in the S3/Minio storage backend
+// whose name starts with the given prefix.
+func (b *s3Storage) List(prefix string) ([]storage.ObjectInfo, error) {
 	candidates := b.client.ListObjects(context.Background(), b.bucket, minio.ListObjectsOptions{
-		Prefix:    filepath.Join(b.DestinationPath, pruningPrefix),
+		Prefix:    filepath.Join(b.DestinationPath, prefix),
 		Recursive: true,
 	})
 
-	var matches []minio.ObjectInfo
-	var lenCandidates int
+	var result []storage.ObjectInfo
 	for candidate := range candidates {
-		lenCandidates++
 		if candidate.Err != nil {
 			return nil, errwrap.Wrap(
 				candidate.Err,
-				"error looking up candidates from remote storage",
+				"error looking up objects from remote storage",
 			)
 		}
+		result = append(result, storage.ObjectInfo{
+			Name:         strings.TrimPrefix(strings.TrimPrefix(candidate.Key, b.DestinationPath), "/"),
+			Size:         candidate.Size,
+			LastModified: candidate.LastModified,
+		})
+	}
+	return result, nil
+}
+
+// Open returns a reader for the first length bytes of the object with the
+// given name in the S3/Minio storage backend. If length is not positive,
+// the entire object is read.
+func (b *s3Storage) Open(name string, length int64) (io.ReadCloser, error) {
+	opts := minio.GetObjectOptions{}
+	if length > 0 {
+		if err := opts.SetRange(0, length-1); err != nil {
+			return nil, errwrap.Wrap(err, "error setting range")
+		}
+	}
+	object, err := b.client.GetObject(context.Background(), b.bucket, filepath.Join(b.DestinationPath, name), opts)
+	if err != nil {
+		return nil, errwrap.Wrap(err, fmt.Sprintf("error getting object %s from remote storage", name))
+	}
+	return object, nil
+}
+
+// Remove deletes the object with the given name from the S3/Minio storage
+// backend.
+func (b *s3Storage) Remove(name string) error {
+	if err := b.client.RemoveObject(context.Background(), b.bucket, filepath.Join(b.DestinationPath, name), minio.RemoveObjectOptions{}); err != nil {
+		return errwrap.Wrap(err, fmt.Sprintf("error removing object %s from remote storage", name))
+	}
+	return nil
+}
+
+// SetProtected adds or removes the `protected` tag on the object with the
+// given name, so it can be considered in bucket lifecycle rules.
+func (b *s3Storage) SetProtected(name string, protected bool) error {
+	key := filepath.Join(b.DestinationPath, name)
+	t, err := b.client.GetObjectTagging(context.Background(), b.bucket, key, minio.GetObjectTaggingOptions{})
+	if err != nil {
+		return errwrap.Wrap(err, fmt.Sprintf("error getting tags of object %s", name))
+	}
+	if protected {
+		if err := t.Set("protected", "true"); err != nil {
+			return errwrap.Wrap(err, "error setting tag")
+		}
+	} else {
+		t.Remove("protected")
+	}
+	if err := b.client.PutObjectTagging(context.Background(), b.bucket, key, t, minio.PutObjectTaggingOptions{}); err != nil {
+		return errwrap.Wrap(err, fmt.Sprintf("error updating tags of object %s", name))
+	}
+	return nil
+}
+
+// Prune rotates away backups according to the configuration and provided deadline for the S3/Minio storage backend.
+func (b *s3Storage) Prune(ctx context.Context, deadline time.Time, pruningPrefix string, dryRun bool) (*storage.PruneStats, error) {
+	lookupPrefix := filepath.Join(b.DestinationPath, pruningPrefix)
+	// Candidates are selected using object metadata only, so pruning works
+	// for archived storage classes like GLACIER, too.
+	list := func() ([]minio.ObjectInfo, error) {
+		var objects []minio.ObjectInfo
+		for candidate := range b.client.ListObjects(ctx, b.bucket, minio.ListObjectsOptions{
+			Prefix:    lookupPrefix,
+			Recursive: true,
+		}) {
+			if candidate.Err != nil {
+				return nil, errwrap.Wrap(
+					candidate.Err,
+					"error looking up candidates from remote storage",
+				)
+			}
+			objects = append(objects, candidate)
+		}
+		return objects, nil
+	}
+
+	var expected []string
+	for _, key := range b.uploaded {
+		if strings.HasPrefix(key, lookupPrefix) {
+			expected = append(expected, key)
+		}
+	}
+
+	candidates, err := listConsistently(list, expected, b.listRetries, b.listRetryDelay, func(missing string, retry int) {
+		b.Log(storage.LogLevelWarning, b.Name(), "Listing does not contain `%s` yet, retrying in %s (%d of %d).", missing, b.listRetryDelay, retry, b.listRetries)
+	})
+	if err != nil {
+		return nil, errwrap.Wrap(err, "error listing candidates for pruning")
+	}
+
+	candidates, lenProtected := storage.FilterProtected(candidates, func(o minio.ObjectInfo) string { return o.Key }, b.PruneExclusions()...)
+	if lenProtected != 0 {
+		b.Log(storage.LogLevelInfo, b.Name(), "Skipping %d protected backups.", lenProtected)
+	}
+
+	var matches []minio.ObjectInfo
+	var matchNames []string
+	var lenLocked int
+	lenCandidates := len(candidates) + lenProtected
+	for _, candidate := range candidates {
 		if candidate.LastModified.Before(deadline) {
+			locked, err := b.isLocked(ctx, candidate.Key)
+			if err != nil {
+				return nil, errwrap.Wrap(err, fmt.Sprintf("error looking up retention of %s", candidate.Key))
+			}
+			if locked {
+				lenLocked++
+				continue
+			}
 			matches = append(matches, candidate)
+			matchNames = append(matchNames, candidate.Key)
 		}
 	}
+	if lenLocked != 0 {
+		b.Log(storage.LogLevelInfo, b.Name(), "Skipping %d backups that are older than the given deadline, but still locked.", lenLocked)
+	}
 
 	stats := &storage.PruneStats{
-		Total:  uint(lenCandidates),
-		Pruned: uint(len(matches)),
+		Total:   uint(lenCandidates),
+		Pruned:  uint(len(matches)),
+		Matches: matchNames,
 	}
 
-	pruneErr := b.DoPrune(b.Name(), len(matches), lenCandidates, deadline, func() error {
+	pruneErr := b.DoPrune(b.Name(), len(matches), lenCandidates, deadline, dryRun, func() error {
 		objectsCh := make(chan minio.ObjectInfo)
 		go func() {
 			for _, match := range matches {
@@ -179,7 +491,7 @@ func (b *s3Storage) Prune(deadline time.Time, pruningPrefix string) (*storage.Pr
 			}
 			close(objectsCh)
 		}()
-		errChan := b.client.RemoveObjects(context.Background(), b.bucket, objectsCh, minio.RemoveObjectsOptions{})
+		errChan := b.client.RemoveObjects(ctx, b.bucket, objectsCh, minio.RemoveObjectsOptions{})
 		var removeErrors []error
 		for result := range errChan {
 			if result.Err != nil {
@@ -194,3 +506,58 @@ func (b *s3Storage) Prune(deadline time.Time, pruningPrefix string) (*storage.Pr
 
 	return stats, pruneErr
 }
+
+// isLocked returns true if the object with the given key is under a retention
+// lock that has not expired yet. Retention is only looked up in case the
+// backend is configured to lock objects.
+func (b *s3Storage) isLocked(ctx context.Context, key string) (bool, error) {
+	if b.immutableFor <= 0 {
+		return false, nil
+	}
+	_, retainUntil, err := b.client.GetObjectRetention(ctx, b.bucket, key, "")
+	if err != nil {
+		if errResp := minio.ToErrorResponse(err); errResp.Code == "NoSuchObjectLockConfiguration" || errResp.Code == "ObjectLockConfigurationNotFoundError" {
+			return false, nil
+		}
+		return false, err
+	}
+	return retainUntil != nil && retainUntil.After(time.Now()), nil
+}
+
+// listConsistently calls list until the returned objects contain all of the
+// expected keys, waiting for the given delay between retries. This accounts
+// for storages where objects are not listed immediately after being uploaded.
+// In case any key is still missing after all retries, an error is returned.
+func listConsistently(
+	list func() ([]minio.ObjectInfo, error),
+	expected []string,
+	retries int,
+	delay time.Duration,
+	onRetry func(missing string, retry int),
+) ([]minio.ObjectInfo, error) {
+	for retry := 0; ; retry++ {
+		objects, err := list()
+		if err != nil {
+			return nil, err
+		}
+
+		missing := ""
+		for _, key := range expected {
+			if !slices.ContainsFunc(objects, func(o minio.ObjectInfo) bool { return o.Key == key }) {
+				missing = key
+				break
+			}
+		}
+		if missing == "" {
+			return objects, nil
+		}
+		if retry >= retries {
+			return nil, errwrap.Wrap(
+				nil,
+				fmt.Sprintf("listing did not contain uploaded object `%s` after %d retries", missing, retries),
+			)
+		}
+		onRetry(missing, retry+1)
+		time.Sleep(delay)
+	}
+}
@@ -0,0 +1,182 @@
+package s3
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/offen/docker-volume-backup/internal/storage"
+
+	"github.com/minio/minio-go/v7"
+)
+
+func TestListConsistently(t *testing.T) {
+	tests := []struct {
+		name            string
+		visibleAfter    int
+		retries         int
+		expectError     bool
+		expectedRetries int
+	}{
+		{"immediately consistent", 0, 3, false, 0},
+		{"delayed listing", 2, 3, false, 2},
+		{"listing never catches up", 5, 3, true, 3},
+		{"retries disabled", 1, 0, true, 0},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var calls int
+			list := func() ([]minio.ObjectInfo, error) {
+				objects := []minio.ObjectInfo{{Key: "backups/backup-1.tar.gz"}}
+				if calls >= test.visibleAfter {
+					objects = append(objects, minio.ObjectInfo{Key: "backups/backup-2.tar.gz"})
+				}
+				calls++
+				return objects, nil
+			}
+
+			var retries int
+			objects, err := listConsistently(list, []string{"backups/backup-2.tar.gz"}, test.retries, time.Millisecond, func(string, int) {
+				retries++
+			})
+			if (err != nil) != test.expectError {
+				t.Errorf("Unexpected error value %v", err)
+			}
+			if retries != test.expectedRetries {
+				t.Errorf("Expected %d retries, got %d", test.expectedRetries, retries)
+			}
+			if !test.expectError && len(objects) != 2 {
+				t.Errorf("Expected 2 objects, got %d", len(objects))
+			}
+		})
+	}
+}
+
+func TestPartCount(t *testing.T) {
+	tests := []struct {
+		etag     string
+		expected int
+	}{
+		{`"9b2cf535f27731c974343645a3985328"`, 1},
+		{`"d41d8cd98f00b204e9800998ecf8427e-12"`, 12},
+		{"d41d8cd98f00b204e9800998ecf8427e-1", 1},
+		{`"d41d8cd98f00b204e9800998ecf8427e-x"`, 1},
+	}
+	for _, test := range tests {
+		if got := partCount(test.etag); got != test.expected {
+			t.Errorf("partCount(%s): expected %d, got %d", test.etag, test.expected, got)
+		}
+	}
+}
+
+func TestServerSideEncryption(t *testing.T) {
+	tests := []struct {
+		name           string
+		sse            string
+		kmsKeyID       string
+		expectError    bool
+		expectedHeader string
+		expectedKeyID  string
+	}{
+		{"disabled", "", "", false, "", ""},
+		{"aes256", "AES256", "", false, "AES256", ""},
+		{"kms with key", "aws:kms", "my-key", false, "aws:kms", "my-key"},
+		{"kms with bucket key", "aws:kms", "", false, "aws:kms", ""},
+		{"key without kms", "AES256", "my-key", true, "", ""},
+		{"unknown mode", "aws:fancy", "", true, "", ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var header http.Header
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				switch {
+				case r.URL.Query().Has("location"):
+					w.Write([]byte(`<LocationConstraint xmlns="http://s3.amazonaws.com/doc/2006-03-01/">us-east-1</LocationConstraint>`))
+				case r.Method == http.MethodPut:
+					header = r.Header.Clone()
+					w.Header().Set("ETag", `"9b2cf535f27731c974343645a3985328"`)
+				}
+			}))
+			defer server.Close()
+
+			u, _ := url.Parse(server.URL)
+			b, err := NewStorageBackend(Config{
+				Endpoint:        u.Host,
+				EndpointProto:   "http",
+				AccessKeyID:     "access",
+				SecretAccessKey: "secret",
+				BucketName:      "backups",
+				SSE:             test.sse,
+				SSEKMSKeyID:     test.kmsKeyID,
+			}, func(storage.LogLevel, string, string, ...any) {})
+			if (err != nil) != test.expectError {
+				t.Fatalf("unexpected error value %v", err)
+			}
+			if test.expectError {
+				return
+			}
+
+			file := filepath.Join(t.TempDir(), "backup.tar.gz")
+			if err := os.WriteFile(file, []byte("backup"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if err := b.Copy(context.Background(), file, "backup.tar.gz"); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if header == nil {
+				t.Fatal("expected object to be uploaded")
+			}
+			if got := header.Get("X-Amz-Server-Side-Encryption"); got != test.expectedHeader {
+				t.Errorf("expected encryption header %q, got %q", test.expectedHeader, got)
+			}
+			if got := header.Get("X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id"); got != test.expectedKeyID {
+				t.Errorf("expected key id header %q, got %q", test.expectedKeyID, got)
+			}
+		})
+	}
+}
+
+func TestPresignedURL(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Has("location") {
+			w.Write([]byte(`<LocationConstraint xmlns="http://s3.amazonaws.com/doc/2006-03-01/">us-east-1</LocationConstraint>`))
+		}
+	}))
+	defer server.Close()
+
+	u, _ := url.Parse(server.URL)
+	b, err := NewStorageBackend(Config{
+		Endpoint:        u.Host,
+		EndpointProto:   "http",
+		AccessKeyID:     "access",
+		SecretAccessKey: "secret",
+		BucketName:      "backups",
+		RemotePath:      "daily",
+	}, func(storage.LogLevel, string, string, ...any) {})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	presigned, err := b.(storage.Presigner).PresignedURL("backup.tar.gz", time.Hour)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	parsed, err := url.Parse(presigned)
+	if err != nil {
+		t.Fatalf("unexpected error parsing URL: %v", err)
+	}
+	if parsed.Host != u.Host || parsed.Path != "/backups/daily/backup.tar.gz" {
+		t.Errorf("unexpected URL %s", presigned)
+	}
+	query := parsed.Query()
+	if query.Get("X-Amz-Expires") != "3600" || query.Get("X-Amz-Signature") == "" {
+		t.Errorf("expected URL to be signed for an hour, got %s", presigned)
+	}
+}
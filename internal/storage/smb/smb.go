@@ -0,0 +1,278 @@
+// Copyright 2024 - offen.software <hioffen@posteo.de>
+// SPDX-License-Identifier: MPL-2.0
+
+package smb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/hirochachacha/go-smb2"
+	"github.com/offen/docker-volume-backup/internal/errwrap"
+	"github.com/offen/docker-volume-backup/internal/storage"
+)
+
+type smbStorage struct {
+	*storage.StorageBackend
+	conn     net.Conn
+	session  *smb2.Session
+	share    share
+	hostName string
+}
+
+// share is the subset of the operations on a mounted share that is used by
+// the backend.
+type share interface {
+	MkdirAll(path string, perm os.FileMode) error
+	Create(name string) (io.WriteCloser, error)
+	Open(name string) (io.ReadCloser, error)
+	Stat(name string) (os.FileInfo, error)
+	ReadDir(dirname string) ([]os.FileInfo, error)
+	Remove(name string) error
+	Umount() error
+}
+
+// smbShare adapts a share mounted using go-smb2 to the share interface.
+type smbShare struct {
+	*smb2.Share
+}
+
+func (s smbShare) Create(name string) (io.WriteCloser, error) {
+	f, err := s.Share.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (s smbShare) Open(name string) (io.ReadCloser, error) {
+	f, err := s.Share.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Config allows to configure a SMB backend.
+type Config struct {
+	HostName   string
+	Port       string
+	Share      string
+	Username   string
+	Password   string
+	Domain     string
+	RemotePath string
+}
+
+// NewStorageBackend creates and initializes a new SMB storage backend,
+// mounting the configured share.
+func NewStorageBackend(opts Config, logFunc storage.Log) (storage.Backend, error) {
+	if opts.Share == "" {
+		return nil, errwrap.Wrap(nil, "no share name given")
+	}
+
+	conn, err := net.Dial("tcp", net.JoinHostPort(opts.HostName, opts.Port))
+	if err != nil {
+		return nil, errwrap.Wrap(err, "error connecting to smb server")
+	}
+
+	dialer := &smb2.Dialer{
+		Initiator: &smb2.NTLMInitiator{
+			User:     opts.Username,
+			Password: opts.Password,
+			Domain:   opts.Domain,
+		},
+	}
+	session, err := dialer.Dial(conn)
+	if err != nil {
+		conn.Close()
+		return nil, errwrap.Wrap(err, "error creating smb session")
+	}
+
+	mounted, err := session.Mount(opts.Share)
+	if err != nil {
+		session.Logoff()
+		conn.Close()
+		return nil, errwrap.Wrap(err, fmt.Sprintf("error mounting share %s", opts.Share))
+	}
+
+	return &smbStorage{
+		StorageBackend: &storage.StorageBackend{
+			DestinationPath: remotePath(opts.RemotePath),
+			Log:             logFunc,
+		},
+		conn:     conn,
+		session:  session,
+		share:    smbShare{mounted},
+		hostName: opts.HostName,
+	}, nil
+}
+
+// remotePath returns the given path relative to the root of the share, which
+// is the form paths are expected in by the SMB client.
+func remotePath(p string) string {
+	p = path.Clean("/" + strings.ReplaceAll(p, `\`, "/"))
+	if p == "/" {
+		return "."
+	}
+	return strings.TrimPrefix(p, "/")
+}
+
+// Name returns the name of the storage backend
+func (b *smbStorage) Name() string {
+	return "SMB"
+}
+
+// Close unmounts the share and closes the connection to the SMB server.
+func (b *smbStorage) Close() error {
+	return errors.Join(b.share.Umount(), b.session.Logoff(), b.conn.Close())
+}
+
+// Preflight checks the storage is writable by uploading and removing a marker
+// file.
+func (b *smbStorage) Preflight(ctx context.Context) error {
+	return storage.CheckWritable(ctx, b)
+}
+
+// Copy copies the given file to the SMB storage backend, storing it using the
+// given name. In case the given context is done before the upload has
+// finished, the partially written file is removed.
+func (b *smbStorage) Copy(ctx context.Context, file, name string) error {
+	source, err := os.Open(file)
+	if err != nil {
+		return errwrap.Wrap(err, "error reading the file to be uploaded")
+	}
+	defer source.Close()
+
+	if dir := path.Dir(name); dir != "." {
+		if err := b.share.MkdirAll(path.Join(b.DestinationPath, dir), 0755); err != nil {
+			return errwrap.Wrap(err, fmt.Sprintf("error creating directory '%s'", dir))
+		}
+	}
+
+	location := path.Join(b.DestinationPath, name)
+	destination, err := b.share.Create(location)
+	if err != nil {
+		return errwrap.Wrap(err, "error creating file")
+	}
+	if _, err := io.Copy(destination, storage.NewContextReader(ctx, source)); err != nil {
+		destination.Close()
+		if rmErr := b.share.Remove(location); rmErr != nil {
+			return errors.Join(
+				errwrap.Wrap(err, "error uploading the file"),
+				errwrap.Wrap(rmErr, "error removing partially uploaded file"),
+			)
+		}
+		return errwrap.Wrap(err, "error uploading the file")
+	}
+	if err := destination.Close(); err != nil {
+		return errwrap.Wrap(err, "error closing file")
+	}
+
+	b.Log(storage.LogLevelInfo, b.Name(), "Uploaded a copy of backup `%s` to '%s' at path '%s'.", file, b.hostName, b.DestinationPath)
+	return nil
+}
+
+// Stat returns information about the file with the given name in the SMB storage backend.
+func (b *smbStorage) Stat(name string) (*storage.ObjectInfo, error) {
+	fi, err := b.share.Stat(path.Join(b.DestinationPath, name))
+	if err != nil {
+		return nil, errwrap.Wrap(err, fmt.Sprintf("error calling stat on file %s", name))
+	}
+	return &storage.ObjectInfo{
+		Name:         name,
+		Size:         fi.Size(),
+		LastModified: fi.ModTime(),
+	}, nil
+}
+
+// List returns information about all files in the SMB storage backend
+// whose name starts with the given prefix.
+func (b *smbStorage) List(prefix string) ([]storage.ObjectInfo, error) {
+	candidates, err := b.share.ReadDir(b.DestinationPath)
+	if err != nil {
+		return nil, errwrap.Wrap(err, "error reading directory")
+	}
+
+	var result []storage.ObjectInfo
+	for _, candidate := range candidates {
+		if !candidate.Mode().IsRegular() || !strings.HasPrefix(candidate.Name(), prefix) {
+			continue
+		}
+		result = append(result, storage.ObjectInfo{
+			Name:         candidate.Name(),
+			Size:         candidate.Size(),
+			LastModified: candidate.ModTime(),
+		})
+	}
+	return result, nil
+}
+
+// Open returns a reader for the first length bytes of the file with the given
+// name in the SMB storage backend. If length is not positive, the entire file
+// is read.
+func (b *smbStorage) Open(name string, length int64) (io.ReadCloser, error) {
+	f, err := b.share.Open(path.Join(b.DestinationPath, name))
+	if err != nil {
+		return nil, errwrap.Wrap(err, fmt.Sprintf("error opening file %s", name))
+	}
+	return storage.LimitReadCloser(f, length), nil
+}
+
+// Remove deletes the file with the given name from the SMB storage backend.
+func (b *smbStorage) Remove(name string) error {
+	if err := b.share.Remove(path.Join(b.DestinationPath, name)); err != nil {
+		return errwrap.Wrap(err, fmt.Sprintf("error removing file %s", name))
+	}
+	return nil
+}
+
+// Prune rotates away backups according to the configuration and provided deadline for the SMB storage backend.
+func (b *smbStorage) Prune(ctx context.Context, deadline time.Time, pruningPrefix string, dryRun bool) (*storage.PruneStats, error) {
+	candidates, err := b.share.ReadDir(b.DestinationPath)
+	if err != nil {
+		return nil, errwrap.Wrap(err, "error reading directory")
+	}
+
+	candidates, lenProtected := storage.FilterProtected(candidates, func(c os.FileInfo) string { return c.Name() }, b.PruneExclusions()...)
+	if lenProtected != 0 {
+		b.Log(storage.LogLevelInfo, b.Name(), "Skipping %d protected backups.", lenProtected)
+	}
+
+	var matches []string
+	for _, candidate := range candidates {
+		if !strings.HasPrefix(candidate.Name(), pruningPrefix) {
+			continue
+		}
+		if candidate.ModTime().Before(deadline) {
+			matches = append(matches, candidate.Name())
+		}
+	}
+
+	stats := &storage.PruneStats{
+		Total:   uint(len(candidates) + lenProtected),
+		Pruned:  uint(len(matches)),
+		Matches: matches,
+	}
+
+	pruneErr := b.DoPrune(b.Name(), len(matches), len(candidates)+lenProtected, deadline, dryRun, func() error {
+		for _, match := range matches {
+			if err := ctx.Err(); err != nil {
+				return errwrap.Wrap(err, "pruning was cancelled")
+			}
+			if err := b.share.Remove(path.Join(b.DestinationPath, match)); err != nil {
+				return errwrap.Wrap(err, "error removing file")
+			}
+		}
+		return nil
+	})
+
+	return stats, pruneErr
+}
@@ -0,0 +1,207 @@
+package smb
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/offen/docker-volume-backup/internal/storage"
+)
+
+func TestRemotePath(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"", "."},
+		{"/", "."},
+		{"backups", "backups"},
+		{"/backups/db/", "backups/db"},
+		{`\backups\db`, "backups/db"},
+		{"../backups", "backups"},
+	}
+	for _, test := range tests {
+		t.Run(test.input, func(t *testing.T) {
+			if result := remotePath(test.input); result != test.expected {
+				t.Errorf("Expected %s, got %s", test.expected, result)
+			}
+		})
+	}
+}
+
+// dirShare is a share backed by a local directory.
+type dirShare struct {
+	root string
+}
+
+func (d *dirShare) path(name string) string {
+	return filepath.Join(d.root, filepath.FromSlash(name))
+}
+
+func (d *dirShare) MkdirAll(name string, perm os.FileMode) error {
+	return os.MkdirAll(d.path(name), perm)
+}
+
+func (d *dirShare) Create(name string) (io.WriteCloser, error) {
+	return os.Create(d.path(name))
+}
+
+func (d *dirShare) Open(name string) (io.ReadCloser, error) {
+	return os.Open(d.path(name))
+}
+
+func (d *dirShare) Stat(name string) (os.FileInfo, error) {
+	return os.Stat(d.path(name))
+}
+
+func (d *dirShare) ReadDir(name string) ([]os.FileInfo, error) {
+	entries, err := os.ReadDir(d.path(name))
+	if err != nil {
+		return nil, err
+	}
+	var result []os.FileInfo
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, info)
+	}
+	return result, nil
+}
+
+func (d *dirShare) Remove(name string) error {
+	return os.Remove(d.path(name))
+}
+
+func (d *dirShare) Umount() error {
+	return nil
+}
+
+func newTestBackend(t *testing.T) (*smbStorage, string) {
+	root := t.TempDir()
+	if err := os.Mkdir(filepath.Join(root, "backups"), 0755); err != nil {
+		t.Fatalf("Unexpected error creating directory: %v", err)
+	}
+	return &smbStorage{
+		StorageBackend: &storage.StorageBackend{
+			DestinationPath: "backups",
+			Log:             func(storage.LogLevel, string, string, ...any) {},
+		},
+		share: &dirShare{root: root},
+	}, filepath.Join(root, "backups")
+}
+
+func TestCopy(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "backup.tar.gz")
+	if err := os.WriteFile(file, []byte("backup"), 0644); err != nil {
+		t.Fatalf("Unexpected error writing file: %v", err)
+	}
+
+	t.Run("upload", func(t *testing.T) {
+		b, dir := newTestBackend(t)
+		if err := b.Copy(context.Background(), file, "db/backup.tar.gz"); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		content, err := os.ReadFile(filepath.Join(dir, "db", "backup.tar.gz"))
+		if err != nil {
+			t.Fatalf("Unexpected error reading upload: %v", err)
+		}
+		if string(content) != "backup" {
+			t.Errorf("Unexpected content %q", content)
+		}
+	})
+
+	t.Run("cancelled", func(t *testing.T) {
+		b, dir := newTestBackend(t)
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		if err := b.Copy(ctx, file, "backup.tar.gz"); !errors.Is(err, context.Canceled) {
+			t.Fatalf("Expected context.Canceled, got %v", err)
+		}
+		if _, err := os.Stat(filepath.Join(dir, "backup.tar.gz")); !os.IsNotExist(err) {
+			t.Errorf("Expected partial upload to be removed, got %v", err)
+		}
+	})
+}
+
+func TestPrune(t *testing.T) {
+	tests := []struct {
+		name      string
+		dryRun    bool
+		remaining []string
+	}{
+		{
+			"prune",
+			false,
+			[]string{"backup-3", "backup-4", "backup-4" + storage.ProtectionMarkerSuffix, "other"},
+		},
+		{
+			"dry run",
+			true,
+			[]string{"backup-1", "backup-2", "backup-3", "backup-4", "backup-4" + storage.ProtectionMarkerSuffix, "other"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			b, dir := newTestBackend(t)
+			old := time.Now().Add(-48 * time.Hour)
+			for _, name := range []string{"backup-1", "backup-2", "backup-3", "backup-4", "backup-4" + storage.ProtectionMarkerSuffix, "other"} {
+				p := filepath.Join(dir, name)
+				if err := os.WriteFile(p, nil, 0644); err != nil {
+					t.Fatalf("Unexpected error writing file: %v", err)
+				}
+				if name == "backup-3" {
+					continue
+				}
+				if err := os.Chtimes(p, old, old); err != nil {
+					t.Fatalf("Unexpected error setting times: %v", err)
+				}
+			}
+
+			stats, err := b.Prune(context.Background(), time.Now().Add(-24*time.Hour), "backup-", test.dryRun)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if stats.Total != 5 || stats.Pruned != 2 {
+				t.Errorf("Unexpected stats %v", stats)
+			}
+			if expected := []string{"backup-1", "backup-2"}; !slices.Equal(stats.Matches, expected) {
+				t.Errorf("Expected matches %v, got %v", expected, stats.Matches)
+			}
+
+			entries, err := os.ReadDir(dir)
+			if err != nil {
+				t.Fatalf("Unexpected error reading directory: %v", err)
+			}
+			var remaining []string
+			for _, entry := range entries {
+				remaining = append(remaining, entry.Name())
+			}
+			if !slices.Equal(remaining, test.remaining) {
+				t.Errorf("Expected %v to remain, got %v", test.remaining, remaining)
+			}
+		})
+	}
+}
+
+func TestRemove(t *testing.T) {
+	b, dir := newTestBackend(t)
+	if err := os.WriteFile(filepath.Join(dir, "backup.tar.gz"), nil, 0644); err != nil {
+		t.Fatalf("Unexpected error writing file: %v", err)
+	}
+	if err := b.Remove("backup.tar.gz"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "backup.tar.gz")); !os.IsNotExist(err) {
+		t.Errorf("Expected file to be removed, got %v", err)
+	}
+	if err := b.Remove("backup.tar.gz"); err == nil {
+		t.Error("Expected an error removing a missing file")
+	}
+}
@@ -4,8 +4,11 @@
 package ssh
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
+	"net"
 	"os"
 	"path"
 	"path/filepath"
@@ -16,6 +19,8 @@ import (
 	"github.com/offen/docker-volume-backup/internal/storage"
 	"github.com/pkg/sftp"
 	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
 )
 
 type sshStorage struct {
@@ -33,6 +38,8 @@ type Config struct {
 	Password           string
 	IdentityFile       string
 	IdentityPassphrase string
+	AgentSocket        string
+	KnownHosts         string
 	RemotePath         string
 }
 
@@ -47,29 +54,44 @@ func NewStorageBackend(opts Config, logFunc storage.Log) (storage.Backend, error
 	if _, err := os.Stat(opts.IdentityFile); err == nil {
 		key, err := os.ReadFile(opts.IdentityFile)
 		if err != nil {
-			return nil, errwrap.Wrap(nil, "error reading the private key")
+			return nil, errwrap.Wrap(err, "error reading the private key")
 		}
 
+		// RSA, ECDSA and Ed25519 keys are supported.
 		var signer ssh.Signer
 		if opts.IdentityPassphrase != "" {
 			signer, err = ssh.ParsePrivateKeyWithPassphrase(key, []byte(opts.IdentityPassphrase))
 			if err != nil {
-				return nil, errwrap.Wrap(nil, "error parsing the encrypted private key")
+				return nil, errwrap.Wrap(err, "error parsing the encrypted private key")
 			}
-			authMethods = append(authMethods, ssh.PublicKeys(signer))
 		} else {
 			signer, err = ssh.ParsePrivateKey(key)
 			if err != nil {
-				return nil, errwrap.Wrap(nil, "error parsing the private key")
+				return nil, errwrap.Wrap(err, "error parsing the private key")
 			}
-			authMethods = append(authMethods, ssh.PublicKeys(signer))
+		}
+		authMethods = append(authMethods, ssh.PublicKeys(signer))
+	} else if opts.AgentSocket != "" {
+		conn, err := net.Dial("unix", opts.AgentSocket)
+		if err != nil {
+			return nil, errwrap.Wrap(err, "error connecting to ssh agent")
+		}
+		authMethods = append(authMethods, ssh.PublicKeysCallback(agent.NewClient(conn).Signers))
+	}
+
+	hostKeyCallback := ssh.InsecureIgnoreHostKey()
+	if opts.KnownHosts != "" {
+		var err error
+		hostKeyCallback, err = knownHostsCallback(opts.KnownHosts)
+		if err != nil {
+			return nil, errwrap.Wrap(err, "error parsing known hosts")
 		}
 	}
 
 	sshClientConfig := &ssh.ClientConfig{
 		User:            opts.User,
 		Auth:            authMethods,
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		HostKeyCallback: hostKeyCallback,
 	}
 	sshClient, err := ssh.Dial("tcp", fmt.Sprintf("%s:%s", opts.HostName, opts.Port), sshClientConfig)
 
@@ -101,29 +123,84 @@ func NewStorageBackend(opts Config, logFunc storage.Log) (storage.Backend, error
 	}, nil
 }
 
+// knownHostsCallback returns a callback that verifies host keys against the
+// given content of a known_hosts file and returns a descriptive error in case
+// the host is unknown or its key does not match.
+func knownHostsCallback(content string) (ssh.HostKeyCallback, error) {
+	f, err := os.CreateTemp("", "known_hosts-*")
+	if err != nil {
+		return nil, errwrap.Wrap(err, "error creating temporary file")
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.WriteString(content); err != nil {
+		f.Close()
+		return nil, errwrap.Wrap(err, "error writing temporary file")
+	}
+	if err := f.Close(); err != nil {
+		return nil, errwrap.Wrap(err, "error closing temporary file")
+	}
+
+	callback, err := knownhosts.New(f.Name())
+	if err != nil {
+		return nil, errwrap.Wrap(err, "error reading known hosts")
+	}
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		err := callback(hostname, remote, key)
+		var keyErr *knownhosts.KeyError
+		if errors.As(err, &keyErr) {
+			if len(keyErr.Want) == 0 {
+				return errwrap.Wrap(nil, fmt.Sprintf("host key verification failed: %s is not a known host", hostname))
+			}
+			return errwrap.Wrap(
+				nil,
+				fmt.Sprintf("host key verification failed: the %s key of %s does not match the known hosts, got fingerprint %s", key.Type(), hostname, ssh.FingerprintSHA256(key)),
+			)
+		}
+		return err
+	}, nil
+}
+
 // Name returns the name of the storage backend
 func (b *sshStorage) Name() string {
 	return "SSH"
 }
 
-// Copy copies the given file to the SSH storage backend.
-func (b *sshStorage) Copy(file string) error {
+// Preflight checks the storage is writable by uploading and removing a marker
+// file.
+func (b *sshStorage) Preflight(ctx context.Context) error {
+	return storage.CheckWritable(ctx, b)
+}
+
+// Copy copies the given file to the SSH storage backend, storing it
+// using the given name. In case the given context is done before the upload
+// has finished, the remote file is closed, aborting any pending write.
+func (b *sshStorage) Copy(ctx context.Context, file, name string) error {
 	source, err := os.Open(file)
-	_, name := path.Split(file)
 	if err != nil {
 		return errwrap.Wrap(err, " error reading the file to be uploaded")
 	}
 	defer source.Close()
 
+	if dir := path.Dir(name); dir != "." {
+		if err := b.sftpClient.MkdirAll(filepath.Join(b.DestinationPath, dir)); err != nil {
+			return errwrap.Wrap(err, fmt.Sprintf("error creating directory '%s'", dir))
+		}
+	}
+
 	destination, err := b.sftpClient.Create(filepath.Join(b.DestinationPath, name))
 	if err != nil {
 		return errwrap.Wrap(err, "error creating file")
 	}
 	defer destination.Close()
+	stop := context.AfterFunc(ctx, func() {
+		destination.Close()
+	})
+	defer stop()
 
+	reader := storage.NewContextReader(ctx, source)
 	chunk := make([]byte, 1e9)
 	for {
-		num, err := source.Read(chunk)
+		num, err := reader.Read(chunk)
 		if err == io.EOF {
 			tot, err := destination.Write(chunk[:num])
 			if err != nil {
@@ -156,13 +233,105 @@ func (b *sshStorage) Copy(file string) error {
 	return nil
 }
 
+// CopyFrom stores the data read from the given reader in the SSH storage
+// backend using the given name. In case reading fails, the partially
+// written file is removed.
+func (b *sshStorage) CopyFrom(r io.Reader, name string) error {
+	if dir := path.Dir(name); dir != "." {
+		if err := b.sftpClient.MkdirAll(filepath.Join(b.DestinationPath, dir)); err != nil {
+			return errwrap.Wrap(err, fmt.Sprintf("error creating directory '%s'", dir))
+		}
+	}
+
+	location := filepath.Join(b.DestinationPath, name)
+	destination, err := b.sftpClient.Create(location)
+	if err != nil {
+		return errwrap.Wrap(err, "error creating file")
+	}
+	if _, err := io.Copy(destination, r); err != nil {
+		destination.Close()
+		if rmErr := b.sftpClient.Remove(location); rmErr != nil {
+			return errors.Join(
+				errwrap.Wrap(err, "error uploading the file"),
+				errwrap.Wrap(rmErr, "error removing partially uploaded file"),
+			)
+		}
+		return errwrap.Wrap(err, "error uploading the file")
+	}
+	if err := destination.Close(); err != nil {
+		return errwrap.Wrap(err, "error closing file")
+	}
+
+	b.Log(storage.LogLevelInfo, b.Name(), "Uploaded streamed backup `%s` to '%s' at path '%s'.", name, b.hostName, b.DestinationPath)
+	return nil
+}
+
+// Stat returns information about the file with the given name in the SSH storage backend.
+func (b *sshStorage) Stat(name string) (*storage.ObjectInfo, error) {
+	fi, err := b.sftpClient.Stat(filepath.Join(b.DestinationPath, name))
+	if err != nil {
+		return nil, errwrap.Wrap(err, fmt.Sprintf("error calling stat on file %s", name))
+	}
+	return &storage.ObjectInfo{
+		Name:         name,
+		Size:         fi.Size(),
+		LastModified: fi.ModTime(),
+	}, nil
+}
+
+// List returns information about all files in the SSH storage backend
+// whose name starts with the given prefix.
+func (b *sshStorage) List(prefix string) ([]storage.ObjectInfo, error) {
+	candidates, err := b.sftpClient.ReadDir(b.DestinationPath)
+	if err != nil {
+		return nil, errwrap.Wrap(err, "error reading directory")
+	}
+
+	var result []storage.ObjectInfo
+	for _, candidate := range candidates {
+		if !candidate.Mode().IsRegular() || !strings.HasPrefix(candidate.Name(), prefix) {
+			continue
+		}
+		result = append(result, storage.ObjectInfo{
+			Name:         candidate.Name(),
+			Size:         candidate.Size(),
+			LastModified: candidate.ModTime(),
+		})
+	}
+	return result, nil
+}
+
+// Open returns a reader for the first length bytes of the file with the given
+// name in the SSH storage backend. If length is not positive, the entire file
+// is read.
+func (b *sshStorage) Open(name string, length int64) (io.ReadCloser, error) {
+	f, err := b.sftpClient.Open(filepath.Join(b.DestinationPath, name))
+	if err != nil {
+		return nil, errwrap.Wrap(err, fmt.Sprintf("error opening file %s", name))
+	}
+	return storage.LimitReadCloser(f, length), nil
+}
+
+// Remove deletes the file with the given name from the SSH storage backend.
+func (b *sshStorage) Remove(name string) error {
+	if err := b.sftpClient.Remove(filepath.Join(b.DestinationPath, name)); err != nil {
+		return errwrap.Wrap(err, fmt.Sprintf("error removing file %s", name))
+	}
+	return nil
+}
+
 // Prune rotates away backups according to the configuration and provided deadline for the SSH storage backend.
-func (b *sshStorage) Prune(deadline time.Time, pruningPrefix string) (*storage.PruneStats, error) {
+func (b *sshStorage) Prune(ctx context.Context, deadline time.Time, pruningPrefix string, dryRun bool) (*storage.PruneStats, error) {
 	candidates, err := b.sftpClient.ReadDir(b.DestinationPath)
 	if err != nil {
 		return nil, errwrap.Wrap(err, "error reading directory")
 	}
 
+	candidates, lenProtected := storage.FilterProtected(candidates, func(c os.FileInfo) string { return c.Name() }, b.PruneExclusions()...)
+	if lenProtected != 0 {
+		b.Log(storage.LogLevelInfo, b.Name(), "Skipping %d protected backups.", lenProtected)
+	}
+
 	var matches []string
 	for _, candidate := range candidates {
 		if !strings.HasPrefix(candidate.Name(), pruningPrefix) {
@@ -174,12 +343,16 @@ func (b *sshStorage) Prune(deadline time.Time, pruningPrefix string) (*storage.P
 	}
 
 	stats := &storage.PruneStats{
-		Total:  uint(len(candidates)),
-		Pruned: uint(len(matches)),
+		Total:   uint(len(candidates) + lenProtected),
+		Pruned:  uint(len(matches)),
+		Matches: matches,
 	}
 
-	pruneErr := b.DoPrune(b.Name(), len(matches), len(candidates), deadline, func() error {
+	pruneErr := b.DoPrune(b.Name(), len(matches), len(candidates)+lenProtected, deadline, dryRun, func() error {
 		for _, match := range matches {
+			if err := ctx.Err(); err != nil {
+				return errwrap.Wrap(err, "pruning was cancelled")
+			}
 			if err := b.sftpClient.Remove(filepath.Join(b.DestinationPath, match)); err != nil {
 				return errwrap.Wrap(err, "error removing file")
 			}
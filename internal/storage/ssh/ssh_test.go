@@ -0,0 +1,59 @@
+package ssh
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"net"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+func TestKnownHostsCallback(t *testing.T) {
+	newKey := func() ssh.PublicKey {
+		pub, _, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatalf("Unexpected error generating key: %v", err)
+		}
+		key, err := ssh.NewPublicKey(pub)
+		if err != nil {
+			t.Fatalf("Unexpected error creating public key: %v", err)
+		}
+		return key
+	}
+	known := newKey()
+	other := newKey()
+
+	callback, err := knownHostsCallback(knownhosts.Line([]string{"server.local"}, known))
+	if err != nil {
+		t.Fatalf("Unexpected error creating callback: %v", err)
+	}
+	addr := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 22}
+
+	tests := []struct {
+		name          string
+		hostname      string
+		key           ssh.PublicKey
+		expectedError string
+	}{
+		{"known host", "server.local:22", known, ""},
+		{"mismatched key", "server.local:22", other, "does not match the known hosts"},
+		{"unknown host", "other.local:22", known, "is not a known host"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := callback(test.hostname, addr, test.key)
+			if test.expectedError == "" {
+				if err != nil {
+					t.Errorf("Unexpected error %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), test.expectedError) {
+				t.Errorf("Expected error containing %q, got %v", test.expectedError, err)
+			}
+		})
+	}
+}
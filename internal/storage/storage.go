@@ -4,6 +4,14 @@
 package storage
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"slices"
+	"strings"
 	"time"
 
 	"github.com/offen/docker-volume-backup/internal/errwrap"
@@ -11,15 +19,257 @@ import (
 
 // Backend is an interface for defining functions which all storage providers support.
 type Backend interface {
-	Copy(file string) error
-	Prune(deadline time.Time, pruningPrefix string) (*PruneStats, error)
+	Copy(ctx context.Context, file, name string) error
+	Prune(ctx context.Context, deadline time.Time, pruningPrefix string, dryRun bool) (*PruneStats, error)
+	Stat(name string) (*ObjectInfo, error)
+	List(prefix string) ([]ObjectInfo, error)
+	Open(name string, length int64) (io.ReadCloser, error)
+	Remove(name string) error
 	Name() string
+	// Preflight checks the backend is reachable and writable before a
+	// backup is created.
+	Preflight(ctx context.Context) error
+}
+
+// Presigner is implemented by storage backends that support generating
+// time-limited download URLs for a single file.
+type Presigner interface {
+	PresignedURL(name string, expiry time.Duration) (string, error)
+}
+
+// Protector is implemented by storage backends that can additionally flag
+// protected backups natively, e.g. using object tags.
+type Protector interface {
+	SetProtected(name string, protected bool) error
+}
+
+// ChecksumReporter is implemented by storage backends that can report the
+// MD5 checksum of a stored file without downloading it.
+type ChecksumReporter interface {
+	MD5(name string) ([]byte, error)
+}
+
+// Streamer is implemented by storage backends that can store data of unknown
+// length read from a reader, so the backup does not need to be written to
+// disk first. In case reading fails, the data read so far must not be stored.
+type Streamer interface {
+	CopyFrom(r io.Reader, name string) error
+}
+
+// PruneLimiter is implemented by storage backends that refuse pruning in
+// case more than the given percentage of backups would be deleted.
+type PruneLimiter interface {
+	SetPruneMaxPercent(percent int)
+}
+
+// PruneExcluder is implemented by storage backends that never prune files of
+// the given names, e.g. a copy of the latest backup.
+type PruneExcluder interface {
+	SetPruneExclusions(names ...string)
+}
+
+// RetentionPolicy is implemented by storage backends that apply a
+// grandfather-father-son retention policy themselves when pruning, given the
+// number of most recent days, weeks, months and years to keep a backup for.
+type RetentionPolicy interface {
+	SetRetention(daily, weekly, monthly, yearly int)
+}
+
+// UploadReporter is implemented by storage backends that keep track of the
+// data they have uploaded during a run.
+type UploadReporter interface {
+	UploadStats() UploadStats
+}
+
+// UploadStats contains information about all files uploaded to a backend.
+type UploadStats struct {
+	Bytes    int64
+	Parts    int
+	Duration time.Duration
+}
+
+// ErrChecksumUnavailable is returned by a ChecksumReporter in case the
+// backend does not know the MD5 checksum of the given file, e.g. because it
+// has been uploaded in multiple parts.
+var ErrChecksumUnavailable = errors.New("checksum unavailable")
+
+// StatusError is returned by storage backends in case a request has been
+// answered using an HTTP status code signaling failure, so callers can tell
+// transient failures from permanent ones.
+type StatusError struct {
+	StatusCode int
+	Err        error
+}
+
+func (e *StatusError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *StatusError) Unwrap() error {
+	return e.Err
+}
+
+// ProtectionMarkerSuffix is appended to the name of a backup to derive the
+// name of the marker file that protects the backup from being pruned.
+const ProtectionMarkerSuffix = ".protected"
+
+// IsProtectionMarker returns whether the file with the given name is a
+// marker protecting a backup from being pruned.
+func IsProtectionMarker(name string) bool {
+	return strings.HasSuffix(name, ProtectionMarkerSuffix)
+}
+
+// FilterProtected removes protection markers and all backups protected by
+// one of these markers from the given candidates, which are identified by
+// the given name func. Candidates whose base name is one of the given
+// exclusions are removed as well, without being counted. It returns the
+// remaining candidates and the number of protected backups.
+func FilterProtected[T any](candidates []T, name func(T) string, exclusions ...string) ([]T, int) {
+	protected := map[string]bool{}
+	for _, candidate := range candidates {
+		if n := name(candidate); IsProtectionMarker(n) {
+			protected[strings.TrimSuffix(n, ProtectionMarkerSuffix)] = true
+		}
+	}
+
+	var result []T
+	var lenProtected int
+	for _, candidate := range candidates {
+		n := name(candidate)
+		if IsProtectionMarker(n) || slices.Contains(exclusions, path.Base(n)) {
+			continue
+		}
+		if protected[n] {
+			lenProtected++
+			continue
+		}
+		result = append(result, candidate)
+	}
+	return result, lenProtected
+}
+
+// ObjectInfo contains information about a single file stored in a backend.
+type ObjectInfo struct {
+	Name         string
+	Size         int64
+	LastModified time.Time
+}
+
+// LimitReadCloser returns a ReadCloser that reads at most n bytes from rc
+// and closes rc when closed. If n is not positive, rc is returned as is.
+func LimitReadCloser(rc io.ReadCloser, n int64) io.ReadCloser {
+	if n <= 0 {
+		return rc
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.LimitReader(rc, n), rc}
+}
+
+// NewContextReader returns a reader that fails with the error of the given
+// context once it is done, which aborts uploads reading from it for backends
+// that do not support cancellation otherwise.
+func NewContextReader(ctx context.Context, r io.Reader) io.Reader {
+	return &contextReader{ctx: ctx, r: r}
+}
+
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c *contextReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
 }
 
 // StorageBackend is a generic type of storage. Everything here are common properties of all storage types.
 type StorageBackend struct {
 	DestinationPath string
 	Log             Log
+	pruneMaxPercent int
+	pruneExclusions []string
+}
+
+// SetPruneMaxPercent sets the maximum percentage of backups that can be
+// deleted when pruning. A value of zero means there is no limit.
+func (b *StorageBackend) SetPruneMaxPercent(percent int) {
+	b.pruneMaxPercent = percent
+}
+
+// SetPruneExclusions sets the names of files that are never pruned.
+func (b *StorageBackend) SetPruneExclusions(names ...string) {
+	b.pruneExclusions = names
+}
+
+// PruneExclusions returns the names of files that are never pruned.
+func (b *StorageBackend) PruneExclusions() []string {
+	return b.pruneExclusions
+}
+
+// CheckPruneLimit returns an error in case pruning the given number of
+// matches out of the given number of candidates would delete more than the
+// given percentage of backups. A value of zero or 100 disables the check.
+func CheckPruneLimit(lenMatches, lenCandidates, maxPercent int) error {
+	if maxPercent <= 0 || maxPercent >= 100 || lenMatches*100 <= maxPercent*lenCandidates {
+		return nil
+	}
+	return errwrap.Wrap(
+		nil,
+		fmt.Sprintf(
+			"refusing to prune %d out of %d backups as it exceeds the limit of %d%%, please check your configuration",
+			lenMatches, lenCandidates, maxPercent,
+		),
+	)
+}
+
+// Preflight is used by backends that cannot cheaply check whether they are
+// reachable and writable, so the check always succeeds.
+func (b *StorageBackend) Preflight(ctx context.Context) error {
+	return nil
+}
+
+// PreflightMarkerPrefix is the prefix of the name of the marker file written
+// when checking a backend is writable.
+const PreflightMarkerPrefix = ".docker-volume-backup-preflight-"
+
+// CheckWritable copies a small marker file to the given backend and removes
+// it right after, checking the backend is reachable and writable.
+func CheckWritable(ctx context.Context, b Backend) error {
+	f, err := os.CreateTemp("", "preflight-*")
+	if err != nil {
+		return errwrap.Wrap(err, "error creating marker file")
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.WriteString("docker-volume-backup preflight check\n"); err != nil {
+		f.Close()
+		return errwrap.Wrap(err, "error writing marker file")
+	}
+	if err := f.Close(); err != nil {
+		return errwrap.Wrap(err, "error closing marker file")
+	}
+
+	name := fmt.Sprintf("%s%d", PreflightMarkerPrefix, time.Now().UnixNano())
+	if err := b.Copy(ctx, f.Name(), name); err != nil {
+		return errwrap.Wrap(err, "error copying marker file")
+	}
+	if err := b.Remove(name); err != nil {
+		return errwrap.Wrap(err, "error removing marker file")
+	}
+	return nil
+}
+
+// CheckReachable lists files in the given backend, checking it is reachable
+// and the credentials are valid. It is used by backends that cannot remove
+// files right after writing them, e.g. because they are immutable.
+func CheckReachable(b Backend) error {
+	if _, err := b.List(PreflightMarkerPrefix); err != nil {
+		return errwrap.Wrap(err, "error listing files")
+	}
+	return nil
 }
 
 type LogLevel int
@@ -31,24 +281,46 @@ const (
 
 type Log func(logType LogLevel, context string, msg string, params ...any)
 
-// PruneStats is a wrapper struct for returning stats after pruning
+// PruneStats is a wrapper struct for returning stats after pruning.
+// Matches contains the names of all backups that are older than the
+// given deadline.
 type PruneStats struct {
-	Total  uint
-	Pruned uint
+	Total   uint
+	Pruned  uint
+	Matches []string
 }
 
 // DoPrune holds general control flow that applies to any kind of storage.
 // Callers can pass in a thunk that performs the actual deletion of files.
-func (b *StorageBackend) DoPrune(context string, lenMatches, lenCandidates int, deadline time.Time, doRemoveFiles func() error) error {
+// In a dry run, the thunk is never called.
+func (b *StorageBackend) DoPrune(context string, lenMatches, lenCandidates int, deadline time.Time, dryRun bool, doRemoveFiles func() error) error {
 	if lenMatches != 0 && lenMatches != lenCandidates {
-		if err := doRemoveFiles(); err != nil {
-			return err
-		}
-
 		formattedDeadline, err := deadline.Local().MarshalText()
 		if err != nil {
 			return errwrap.Wrap(err, "error marshaling deadline")
 		}
+
+		limitErr := CheckPruneLimit(lenMatches, lenCandidates, b.pruneMaxPercent)
+		if dryRun {
+			b.Log(LogLevelInfo, context,
+				"Would prune %d out of %d backups as they are older than the given deadline of %s.",
+				lenMatches,
+				lenCandidates,
+				string(formattedDeadline),
+			)
+			if limitErr != nil {
+				b.Log(LogLevelWarning, context, "Pruning would fail: %v", errwrap.Unwrap(limitErr))
+			}
+			return nil
+		}
+		if limitErr != nil {
+			return limitErr
+		}
+
+		if err := doRemoveFiles(); err != nil {
+			return err
+		}
+
 		b.Log(LogLevelInfo, context,
 			"Pruned %d out of %d backups as they were older than the given deadline of %s.",
 			lenMatches,
@@ -0,0 +1,120 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFilterProtected(t *testing.T) {
+	candidates := []string{
+		"backup-1.tar.gz",
+		"backup-1.tar.gz.protected",
+		"backup-2.tar.gz",
+		"backup-3.tar.gz",
+		"backup-4.tar.gz.protected",
+	}
+	result, lenProtected := FilterProtected(candidates, func(c string) string { return c })
+	if lenProtected != 1 {
+		t.Errorf("Expected 1 protected backup, got %d", lenProtected)
+	}
+	expected := []string{"backup-2.tar.gz", "backup-3.tar.gz"}
+	if !reflect.DeepEqual(result, expected) {
+		t.Errorf("Expected %v, got %v", expected, result)
+	}
+
+	result, lenProtected = FilterProtected(append(candidates, "dir/backup-latest.tar.gz"), func(c string) string { return c }, "backup-latest.tar.gz")
+	if lenProtected != 1 {
+		t.Errorf("Expected 1 protected backup, got %d", lenProtected)
+	}
+	if !reflect.DeepEqual(result, expected) {
+		t.Errorf("Expected excluded backup to be removed, got %v", result)
+	}
+}
+
+// markerBackend records the files copied to and removed from it. Methods
+// that are not overridden panic when called.
+type markerBackend struct {
+	Backend
+	copied    map[string]string
+	removed   []string
+	removeErr error
+}
+
+func (m *markerBackend) Copy(ctx context.Context, file, name string) error {
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	m.copied[name] = string(content)
+	return nil
+}
+
+func (m *markerBackend) Remove(name string) error {
+	m.removed = append(m.removed, name)
+	return m.removeErr
+}
+
+func TestCheckWritable(t *testing.T) {
+	b := &markerBackend{copied: map[string]string{}}
+	if err := CheckWritable(context.Background(), b); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(b.copied) != 1 || len(b.removed) != 1 {
+		t.Fatalf("Expected a single marker to be copied and removed, got %v and %v", b.copied, b.removed)
+	}
+	if _, ok := b.copied[b.removed[0]]; !ok || !strings.HasPrefix(b.removed[0], PreflightMarkerPrefix) {
+		t.Errorf("Expected copied marker to be removed, got %s", b.removed[0])
+	}
+
+	b = &markerBackend{copied: map[string]string{}, removeErr: errors.New("permission denied")}
+	if err := CheckWritable(context.Background(), b); err == nil {
+		t.Error("Expected error when marker cannot be removed")
+	}
+}
+
+func TestCheckPruneLimit(t *testing.T) {
+	tests := []struct {
+		matches, candidates, maxPercent int
+		expectError                     bool
+	}{
+		{3, 10, 50, false},
+		{5, 10, 50, false},
+		{6, 10, 50, true},
+		{9, 10, 100, false},
+		{9, 10, 0, false},
+	}
+	for _, test := range tests {
+		err := CheckPruneLimit(test.matches, test.candidates, test.maxPercent)
+		if (err != nil) != test.expectError {
+			t.Errorf("CheckPruneLimit(%d, %d, %d): unexpected error value %v", test.matches, test.candidates, test.maxPercent, err)
+		}
+	}
+}
+
+func TestDoPruneLimit(t *testing.T) {
+	b := &StorageBackend{Log: func(LogLevel, string, string, ...any) {}}
+	b.SetPruneMaxPercent(50)
+
+	removed := false
+	remove := func() error {
+		removed = true
+		return nil
+	}
+	if err := b.DoPrune("test", 6, 10, time.Now(), true, remove); err != nil {
+		t.Errorf("Expected dry run to succeed, got %v", err)
+	}
+	if err := b.DoPrune("test", 6, 10, time.Now(), false, remove); err == nil {
+		t.Error("Expected error when exceeding the limit")
+	}
+	if removed {
+		t.Error("Expected no files to be removed")
+	}
+	if err := b.DoPrune("test", 5, 10, time.Now(), false, remove); err != nil || !removed {
+		t.Errorf("Expected files to be removed within the limit, got %v", err)
+	}
+}
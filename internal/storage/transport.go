@@ -0,0 +1,30 @@
+// Copyright 2024 - offen.software <hioffen@posteo.de>
+// SPDX-License-Identifier: MPL-2.0
+
+package storage
+
+import "net/http"
+
+// NewUserAgentTransport wraps the given RoundTripper so that all requests are
+// sent using the given User-Agent header. In case no User-Agent is given, the
+// RoundTripper is returned as is.
+func NewUserAgentTransport(rt http.RoundTripper, userAgent string) http.RoundTripper {
+	if userAgent == "" {
+		return rt
+	}
+	if rt == nil {
+		rt = http.DefaultTransport
+	}
+	return &userAgentTransport{rt: rt, userAgent: userAgent}
+}
+
+type userAgentTransport struct {
+	rt        http.RoundTripper
+	userAgent string
+}
+
+func (t *userAgentTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.Header.Set("User-Agent", t.userAgent)
+	return t.rt.RoundTrip(req)
+}
@@ -0,0 +1,181 @@
+// Copyright 2024 - offen.software <hioffen@posteo.de>
+// SPDX-License-Identifier: MPL-2.0
+
+package webdav
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/offen/docker-volume-backup/internal/errwrap"
+	"github.com/offen/docker-volume-backup/internal/storage"
+)
+
+// errChunkingUnsupported is returned in case the server does not support
+// Nextcloud's chunked upload protocol.
+var errChunkingUnsupported = errors.New("chunked uploads are not supported")
+
+// copyChunked uploads the given file using Nextcloud's chunked upload
+// protocol. Chunks are uploaded to a temporary directory in the uploads
+// endpoint of the user, and assembled at the destination by the server
+// afterwards. In case the upload fails, the uploaded chunks are removed.
+func (b *webDavStorage) copyChunked(ctx context.Context, file, name string) error {
+	uploads, ok := uploadsURL(b.url, b.username)
+	if !ok {
+		return errChunkingUnsupported
+	}
+	destination := joinURL(b.url, path.Join(b.DestinationPath, name))
+	transfer := joinURL(uploads, fmt.Sprintf("docker-volume-backup-%d", time.Now().UnixNano()))
+
+	res, err := b.do(ctx, "MKCOL", transfer, nil, -1, destination)
+	if err != nil {
+		return errwrap.Wrap(err, "error creating upload directory")
+	}
+	switch res.StatusCode {
+	case http.StatusCreated:
+	case http.StatusNotFound, http.StatusMethodNotAllowed, http.StatusNotImplemented:
+		return errChunkingUnsupported
+	default:
+		return errwrap.Wrap(statusError(res), "error creating upload directory")
+	}
+
+	if err := b.uploadChunks(ctx, file, transfer, destination); err != nil {
+		// Chunks are removed even if the upload has been cancelled.
+		res, rmErr := b.do(context.WithoutCancel(ctx), http.MethodDelete, transfer, nil, -1, "")
+		if rmErr == nil && res.StatusCode >= 300 {
+			rmErr = statusError(res)
+		}
+		if rmErr != nil {
+			err = errors.Join(err, errwrap.Wrap(rmErr, "error removing uploaded chunks"))
+		}
+		return err
+	}
+	return nil
+}
+
+func (b *webDavStorage) uploadChunks(ctx context.Context, file, transfer, destination string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return errwrap.Wrap(err, "error opening the file to be uploaded")
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		return errwrap.Wrap(err, "error reading the file to be uploaded")
+	}
+
+	for i, offset := 1, int64(0); offset < stat.Size() || i == 1; i, offset = i+1, offset+b.chunkSize {
+		size := min(b.chunkSize, stat.Size()-offset)
+		res, err := b.do(
+			ctx,
+			http.MethodPut,
+			joinURL(transfer, fmt.Sprintf("%05d", i)),
+			io.NewSectionReader(f, offset, size),
+			size,
+			destination,
+		)
+		if err != nil {
+			return errwrap.Wrap(err, fmt.Sprintf("error uploading chunk %d", i))
+		}
+		if res.StatusCode >= 300 {
+			return errwrap.Wrap(statusError(res), fmt.Sprintf("error uploading chunk %d", i))
+		}
+	}
+
+	req, err := b.request(ctx, "MOVE", joinURL(transfer, ".file"), nil, -1, destination)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("OC-Total-Length", strconv.FormatInt(stat.Size(), 10))
+	req.Header.Set("Overwrite", "T")
+	res, err := b.send(req)
+	if err != nil {
+		return errwrap.Wrap(err, "error assembling chunks")
+	}
+	if res.StatusCode >= 300 {
+		return errwrap.Wrap(statusError(res), "error assembling chunks")
+	}
+	return nil
+}
+
+func (b *webDavStorage) request(ctx context.Context, method, location string, body io.Reader, length int64, destination string) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, location, body)
+	if err != nil {
+		return nil, errwrap.Wrap(err, "error creating request")
+	}
+	if length >= 0 {
+		req.ContentLength = length
+	}
+	req.SetBasicAuth(b.username, b.password)
+	if destination != "" {
+		req.Header.Set("Destination", destination)
+	}
+	return req, nil
+}
+
+func (b *webDavStorage) send(req *http.Request) (*http.Response, error) {
+	res, err := b.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	io.Copy(io.Discard, res.Body)
+	res.Body.Close()
+	return res, nil
+}
+
+func (b *webDavStorage) do(ctx context.Context, method, location string, body io.Reader, length int64, destination string) (*http.Response, error) {
+	req, err := b.request(ctx, method, location, body, length, destination)
+	if err != nil {
+		return nil, err
+	}
+	return b.send(req)
+}
+
+func statusError(res *http.Response) error {
+	return &storage.StatusError{
+		StatusCode: res.StatusCode,
+		Err:        fmt.Errorf("server responded with %s", res.Status),
+	}
+}
+
+// uploadsURL derives the location of the uploads endpoint of the given user
+// from the given WebDAV URL of a Nextcloud server. It returns false in case
+// the URL does not look like a Nextcloud WebDAV URL.
+func uploadsURL(webdavURL, username string) (string, bool) {
+	u, err := url.Parse(webdavURL)
+	if err != nil {
+		return "", false
+	}
+	prefix, rest, ok := strings.Cut(u.Path, "/remote.php/")
+	if !ok {
+		return "", false
+	}
+	switch {
+	case strings.HasPrefix(rest, "dav/files/"):
+		user, _, _ := strings.Cut(strings.TrimPrefix(rest, "dav/files/"), "/")
+		if user == "" {
+			return "", false
+		}
+		username = user
+	case rest == "webdav" || strings.HasPrefix(rest, "webdav/"):
+	default:
+		return "", false
+	}
+	u.Path = path.Join(prefix, "/remote.php/dav/uploads", username)
+	u.RawPath = ""
+	return u.String(), true
+}
+
+// joinURL appends the given path to the given URL, escaping it as needed.
+func joinURL(base, p string) string {
+	return strings.TrimSuffix(base, "/") + "/" + strings.TrimPrefix((&url.URL{Path: p}).EscapedPath(), "/")
+}
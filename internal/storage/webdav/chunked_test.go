@@ -0,0 +1,143 @@
+package webdav
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/offen/docker-volume-backup/internal/storage"
+)
+
+func TestUploadsURL(t *testing.T) {
+	tests := []struct {
+		url      string
+		expected string
+		ok       bool
+	}{
+		{"https://cloud.example.com/remote.php/dav/files/alice/", "https://cloud.example.com/remote.php/dav/uploads/alice", true},
+		{"https://example.com/nextcloud/remote.php/dav/files/bob/backups", "https://example.com/nextcloud/remote.php/dav/uploads/bob", true},
+		{"https://cloud.example.com/remote.php/webdav/", "https://cloud.example.com/remote.php/dav/uploads/user", true},
+		{"https://webdav.example.com/backups", "", false},
+	}
+	for _, test := range tests {
+		got, ok := uploadsURL(test.url, "user")
+		if ok != test.ok || got != test.expected {
+			t.Errorf("uploadsURL(%s): expected %s, %v, got %s, %v", test.url, test.expected, test.ok, got, ok)
+		}
+	}
+}
+
+// nextcloud is a minimal server implementing Nextcloud's chunked upload
+// protocol, storing assembled files in memory.
+type nextcloud struct {
+	sync.Mutex
+	chunking bool
+	chunks   map[string][]byte
+	files    map[string][]byte
+	requests []string
+}
+
+func (n *nextcloud) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	n.Lock()
+	defer n.Unlock()
+	n.requests = append(n.requests, r.Method)
+	uploads := strings.HasPrefix(r.URL.Path, "/remote.php/dav/uploads/")
+	switch {
+	case uploads && !n.chunking:
+		w.WriteHeader(http.StatusNotFound)
+	case uploads && r.Method == "MKCOL":
+		w.WriteHeader(http.StatusCreated)
+	case uploads && r.Method == http.MethodPut:
+		n.chunks[r.URL.Path], _ = io.ReadAll(r.Body)
+		w.WriteHeader(http.StatusCreated)
+	case uploads && r.Method == "MOVE":
+		dir := strings.TrimSuffix(r.URL.Path, "/.file")
+		var names []string
+		for name := range n.chunks {
+			if strings.HasPrefix(name, dir+"/") {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+		var assembled []byte
+		for _, name := range names {
+			assembled = append(assembled, n.chunks[name]...)
+		}
+		destination := strings.TrimPrefix(r.Header.Get("Destination"), "http://"+r.Host)
+		n.files[destination] = assembled
+		w.WriteHeader(http.StatusCreated)
+	case r.Method == "MKCOL":
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	case r.Method == http.MethodPut:
+		n.files[r.URL.Path], _ = io.ReadAll(r.Body)
+		w.WriteHeader(http.StatusCreated)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func TestCopyChunked(t *testing.T) {
+	content := bytes.Repeat([]byte("backup"), 2*1024*1024)
+	file := filepath.Join(t.TempDir(), "backup.tar.gz")
+	if err := os.WriteFile(file, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name           string
+		chunking       bool
+		expectedChunks int
+	}{
+		{"chunking supported", true, 3},
+		{"chunking unsupported", false, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			n := &nextcloud{chunking: test.chunking, chunks: map[string][]byte{}, files: map[string][]byte{}}
+			server := httptest.NewServer(n)
+			defer server.Close()
+
+			b, err := NewStorageBackend(Config{
+				URL:        server.URL + "/remote.php/dav/files/alice/",
+				RemotePath: "/backups",
+				Username:   "alice",
+				Password:   "secret",
+				Chunked:    true,
+				ChunkSize:  minChunkSize,
+			}, func(storage.LogLevel, string, string, ...any) {})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if err := b.Copy(context.Background(), file, "backup.tar.gz"); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if len(n.chunks) != test.expectedChunks {
+				t.Errorf("expected %d chunks, got %d", test.expectedChunks, len(n.chunks))
+			}
+			if !bytes.Equal(n.files["/remote.php/dav/files/alice/backups/backup.tar.gz"], content) {
+				t.Errorf("expected file to be uploaded, got requests %v", n.requests)
+			}
+		})
+	}
+}
+
+func TestChunkSize(t *testing.T) {
+	if _, err := NewStorageBackend(Config{
+		URL:       "https://cloud.example.com/remote.php/dav/files/alice/",
+		Username:  "alice",
+		Password:  "secret",
+		Chunked:   true,
+		ChunkSize: 1024,
+	}, func(storage.LogLevel, string, string, ...any) {}); err == nil {
+		t.Error("expected error for chunk size below minimum")
+	}
+}
@@ -4,12 +4,16 @@
 package webdav
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"io/fs"
 	"net/http"
 	"os"
 	"path"
 	"path/filepath"
+	"slices"
 	"strings"
 	"time"
 
@@ -20,8 +24,14 @@ import (
 
 type webDavStorage struct {
 	*storage.StorageBackend
-	client *gowebdav.Client
-	url    string
+	client     *gowebdav.Client
+	url        string
+	username   string
+	password   string
+	transport  http.RoundTripper
+	httpClient *http.Client
+	chunked    bool
+	chunkSize  int64
 }
 
 // Config allows to configure a WebDAV storage backend.
@@ -31,8 +41,15 @@ type Config struct {
 	Username    string
 	Password    string
 	URLInsecure bool
+	UserAgent   string
+	Chunked     bool
+	ChunkSize   int64
 }
 
+// minChunkSize is the smallest size of a chunk accepted by Nextcloud, except
+// for the last one.
+const minChunkSize = 5 * 1024 * 1024
+
 // NewStorageBackend creates and initializes a new WebDav storage backend.
 func NewStorageBackend(opts Config, logFunc storage.Log) (storage.Backend, error) {
 	if opts.Username == "" || opts.Password == "" {
@@ -40,14 +57,21 @@ func NewStorageBackend(opts Config, logFunc storage.Log) (storage.Backend, error
 	} else {
 		webdavClient := gowebdav.NewClient(opts.URL, opts.Username, opts.Password)
 
+		var webdavTransport http.RoundTripper = http.DefaultTransport
 		if opts.URLInsecure {
 			defaultTransport, ok := http.DefaultTransport.(*http.Transport)
 			if !ok {
 				return nil, errwrap.Wrap(nil, "unexpected error when asserting type for http.DefaultTransport")
 			}
-			webdavTransport := defaultTransport.Clone()
-			webdavTransport.TLSClientConfig.InsecureSkipVerify = opts.URLInsecure
-			webdavClient.SetTransport(webdavTransport)
+			insecureTransport := defaultTransport.Clone()
+			insecureTransport.TLSClientConfig.InsecureSkipVerify = opts.URLInsecure
+			webdavTransport = insecureTransport
+		}
+		transport := storage.NewUserAgentTransport(webdavTransport, opts.UserAgent)
+		webdavClient.SetTransport(transport)
+
+		if opts.Chunked && opts.ChunkSize < minChunkSize {
+			return nil, errwrap.Wrap(nil, "WEBDAV_CHUNK_SIZE must be at least 5MB")
 		}
 
 		return &webDavStorage{
@@ -55,7 +79,14 @@ func NewStorageBackend(opts Config, logFunc storage.Log) (storage.Backend, error
 				DestinationPath: opts.RemotePath,
 				Log:             logFunc,
 			},
-			client: webdavClient,
+			client:     webdavClient,
+			url:        opts.URL,
+			username:   opts.Username,
+			password:   opts.Password,
+			transport:  transport,
+			httpClient: &http.Client{Transport: transport},
+			chunked:    opts.Chunked,
+			chunkSize:  opts.ChunkSize,
 		}, nil
 	}
 }
@@ -65,19 +96,63 @@ func (b *webDavStorage) Name() string {
 	return "WebDAV"
 }
 
-// Copy copies the given file to the WebDav storage backend.
-func (b *webDavStorage) Copy(file string) error {
-	_, name := path.Split(file)
-	if err := b.client.MkdirAll(b.DestinationPath, 0644); err != nil {
-		return errwrap.Wrap(err, fmt.Sprintf("error creating directory '%s' on server", b.DestinationPath))
+// Preflight checks the storage is writable by uploading and removing a marker
+// file.
+func (b *webDavStorage) Preflight(ctx context.Context) error {
+	return storage.CheckWritable(ctx, b)
+}
+
+// clientFor returns a client whose requests are cancelled once the given
+// context is done.
+func (b *webDavStorage) clientFor(ctx context.Context) *gowebdav.Client {
+	client := gowebdav.NewClient(b.url, b.username, b.password)
+	client.SetTransport(&contextTransport{ctx: ctx, transport: b.transport})
+	return client
+}
+
+// contextTransport sends all requests using the given context, as the
+// WebDAV client does not support passing a context.
+type contextTransport struct {
+	ctx       context.Context
+	transport http.RoundTripper
+}
+
+func (c *contextTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return c.transport.RoundTrip(req.WithContext(c.ctx))
+}
+
+// Copy copies the given file to the WebDav storage backend, storing it
+// using the given name.
+func (b *webDavStorage) Copy(ctx context.Context, file, name string) error {
+	client := b.clientFor(ctx)
+	dir := filepath.Join(b.DestinationPath, path.Dir(name))
+	if err := client.MkdirAll(dir, 0644); err != nil {
+		return errwrap.Wrap(err, fmt.Sprintf("error creating directory '%s' on server", dir))
+	}
+
+	if b.chunked {
+		err := b.copyChunked(ctx, file, name)
+		if err == nil {
+			b.Log(storage.LogLevelInfo, b.Name(), "Uploaded a copy of backup '%s' to '%s' at path '%s' in chunks.", file, b.url, b.DestinationPath)
+			return nil
+		}
+		if !errors.Is(err, errChunkingUnsupported) {
+			return errwrap.Wrap(err, "error uploading the file in chunks")
+		}
+		b.Log(storage.LogLevelWarning, b.Name(), "The server does not support chunked uploads, uploading '%s' in a single request instead.", file)
 	}
 
 	r, err := os.Open(file)
 	if err != nil {
 		return errwrap.Wrap(err, "error opening the file to be uploaded")
 	}
+	defer r.Close()
 
-	if err := b.client.WriteStream(filepath.Join(b.DestinationPath, name), r, 0644); err != nil {
+	if err := client.WriteStream(filepath.Join(b.DestinationPath, name), r, 0644); err != nil {
+		var statusErr gowebdav.StatusError
+		if errors.As(err, &statusErr) {
+			err = &storage.StatusError{StatusCode: statusErr.Status, Err: err}
+		}
 		return errwrap.Wrap(err, "error uploading the file")
 	}
 	b.Log(storage.LogLevelInfo, b.Name(), "Uploaded a copy of backup '%s' to '%s' at path '%s'.", file, b.url, b.DestinationPath)
@@ -85,32 +160,103 @@ func (b *webDavStorage) Copy(file string) error {
 	return nil
 }
 
-// Prune rotates away backups according to the configuration and provided deadline for the WebDav storage backend.
-func (b *webDavStorage) Prune(deadline time.Time, pruningPrefix string) (*storage.PruneStats, error) {
+// Stat returns information about the file with the given name in the WebDav storage backend.
+func (b *webDavStorage) Stat(name string) (*storage.ObjectInfo, error) {
+	fi, err := b.client.Stat(filepath.Join(b.DestinationPath, name))
+	if err != nil {
+		return nil, errwrap.Wrap(err, fmt.Sprintf("error looking up file %s on server", name))
+	}
+	return &storage.ObjectInfo{
+		Name:         name,
+		Size:         fi.Size(),
+		LastModified: fi.ModTime(),
+	}, nil
+}
+
+// List returns information about all files in the WebDav storage backend
+// whose name starts with the given prefix.
+func (b *webDavStorage) List(prefix string) ([]storage.ObjectInfo, error) {
 	candidates, err := b.client.ReadDir(b.DestinationPath)
 	if err != nil {
-		return nil, errwrap.Wrap(err, "error looking up candidates from remote storage")
+		return nil, errwrap.Wrap(err, "error looking up files from remote storage")
 	}
-	var matches []fs.FileInfo
-	var lenCandidates int
+
+	var result []storage.ObjectInfo
 	for _, candidate := range candidates {
-		if !strings.HasPrefix(candidate.Name(), pruningPrefix) {
+		if candidate.IsDir() || !strings.HasPrefix(candidate.Name(), prefix) {
 			continue
 		}
-		lenCandidates++
+		result = append(result, storage.ObjectInfo{
+			Name:         candidate.Name(),
+			Size:         candidate.Size(),
+			LastModified: candidate.ModTime(),
+		})
+	}
+	return result, nil
+}
+
+// Open returns a reader for the first length bytes of the file with the given
+// name in the WebDav storage backend. If length is not positive, the entire
+// file is read.
+func (b *webDavStorage) Open(name string, length int64) (io.ReadCloser, error) {
+	location := filepath.Join(b.DestinationPath, name)
+	var (
+		r   io.ReadCloser
+		err error
+	)
+	if length > 0 {
+		r, err = b.client.ReadStreamRange(location, 0, length)
+	} else {
+		r, err = b.client.ReadStream(location)
+	}
+	if err != nil {
+		return nil, errwrap.Wrap(err, fmt.Sprintf("error reading file %s from server", name))
+	}
+	return r, nil
+}
+
+// Remove deletes the file with the given name from the WebDav storage backend.
+func (b *webDavStorage) Remove(name string) error {
+	if err := b.client.Remove(filepath.Join(b.DestinationPath, name)); err != nil {
+		return errwrap.Wrap(err, fmt.Sprintf("error removing file %s", name))
+	}
+	return nil
+}
+
+// Prune rotates away backups according to the configuration and provided deadline for the WebDav storage backend.
+func (b *webDavStorage) Prune(ctx context.Context, deadline time.Time, pruningPrefix string, dryRun bool) (*storage.PruneStats, error) {
+	client := b.clientFor(ctx)
+	candidates, err := client.ReadDir(b.DestinationPath)
+	if err != nil {
+		return nil, errwrap.Wrap(err, "error looking up candidates from remote storage")
+	}
+	candidates = slices.DeleteFunc(candidates, func(c fs.FileInfo) bool {
+		return !strings.HasPrefix(c.Name(), pruningPrefix)
+	})
+	candidates, lenProtected := storage.FilterProtected(candidates, func(c fs.FileInfo) string { return c.Name() }, b.PruneExclusions()...)
+	if lenProtected != 0 {
+		b.Log(storage.LogLevelInfo, b.Name(), "Skipping %d protected backups.", lenProtected)
+	}
+
+	var matches []fs.FileInfo
+	var matchNames []string
+	lenCandidates := len(candidates) + lenProtected
+	for _, candidate := range candidates {
 		if candidate.ModTime().Before(deadline) {
 			matches = append(matches, candidate)
+			matchNames = append(matchNames, candidate.Name())
 		}
 	}
 
 	stats := &storage.PruneStats{
-		Total:  uint(lenCandidates),
-		Pruned: uint(len(matches)),
+		Total:   uint(lenCandidates),
+		Pruned:  uint(len(matches)),
+		Matches: matchNames,
 	}
 
-	pruneErr := b.DoPrune(b.Name(), len(matches), lenCandidates, deadline, func() error {
+	pruneErr := b.DoPrune(b.Name(), len(matches), lenCandidates, deadline, dryRun, func() error {
 		for _, match := range matches {
-			if err := b.client.Remove(filepath.Join(b.DestinationPath, match.Name())); err != nil {
+			if err := client.Remove(filepath.Join(b.DestinationPath, match.Name())); err != nil {
 				return errwrap.Wrap(err, "error removing file")
 			}
 		}
@@ -0,0 +1,59 @@
+package webdav
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/offen/docker-volume-backup/internal/storage"
+)
+
+func TestCopyCancelled(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "backup.tar.gz")
+	if err := os.WriteFile(file, []byte("backup"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// The server does not respond to uploads until the test is done, so they
+	// only return once the request is cancelled.
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPut {
+			<-release
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+	defer close(release)
+
+	for _, chunked := range []bool{false, true} {
+		b, err := NewStorageBackend(Config{
+			URL:        server.URL + "/remote.php/dav/files/alice/",
+			RemotePath: "/backups",
+			Username:   "alice",
+			Password:   "secret",
+			Chunked:    chunked,
+			ChunkSize:  minChunkSize,
+		}, func(storage.LogLevel, string, string, ...any) {})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		start := time.Now()
+		err = b.Copy(ctx, file, "backup.tar.gz")
+		cancel()
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("chunked %v: expected upload to be cancelled, got %v", chunked, err)
+		}
+		if took := time.Since(start); took > 5*time.Second {
+			t.Errorf("chunked %v: expected upload to be cancelled promptly, took %s", chunked, took)
+		}
+	}
+}
@@ -0,0 +1,33 @@
+#!/bin/sh
+
+set -e
+
+cd "$(dirname "$0")"
+. ../util.sh
+current_test=$(basename $(pwd))
+
+export LOCAL_DIR=$(mktemp -d)
+
+docker compose up -d --quiet-pull
+sleep 5
+
+logs=$(docker compose exec backup backup)
+
+if ! echo "$logs" | grep -q "Pausing 1 out of 2 running container(s)"; then
+  fail "Expected container to be paused during backup, got $logs"
+fi
+pass "Container was paused during backup."
+
+if [ "$(docker inspect -f '{{ .State.Status }}' $(docker compose ps -q offen))" != "running" ]; then
+  fail "Expected container to be unpaused after backup."
+fi
+pass "Container was unpaused after backup."
+
+expect_running_containers "2"
+
+tmp_dir=$(mktemp -d)
+tar -xvf "$LOCAL_DIR/test.tar.gz" -C $tmp_dir
+if [ ! -f "$tmp_dir/backup/app_data/offen.db" ]; then
+  fail "Could not find expected file in untared archive."
+fi
+pass "Found relevant files in untared local backup."